@@ -0,0 +1,160 @@
+// Package awssession creates the AWS session (and credentials) from the cloudwatch section
+// of the config.  It's shared by the cloudwatch and s3 sinks, so they use the same profile,
+// region, credential source and role
+package awssession
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Credential sources for cloudwatch.credentials
+const (
+	// CredentialsDefault uses the SDK default chain: environment, shared config
+	// (cloudwatch.profile), web identity, container and instance metadata
+	CredentialsDefault = "default"
+
+	// CredentialsStatic uses cloudwatch.access_key_id, cloudwatch.secret_access_key
+	// and cloudwatch.session_token
+	CredentialsStatic = "static"
+
+	// CredentialsEnv uses AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+	CredentialsEnv = "env"
+
+	// CredentialsInstance uses the EC2 instance metadata service
+	CredentialsInstance = "instance"
+
+	// CredentialsWebIdentity exchanges the token in cloudwatch.web_identity_token_file
+	// for cloudwatch.web_identity_role_arn (or AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN)
+	CredentialsWebIdentity = "webidentity"
+)
+
+// DefaultRoleSessionName is the session name used when assuming roles, if cloudwatch.session_name isn't set
+const DefaultRoleSessionName = "cloudjournal"
+
+// New creates an AWS session from cloudwatch.profile and cloudwatch.region, using the
+// credentials from cloudwatch.credentials (and assuming cloudwatch.role_arn with them, if it's set)
+func New() (*session.Session, error) {
+	//	Get the configuration information for the AWS profile and region
+	awsProfileName := viper.GetString("cloudwatch.profile")
+	cloudwatchRegion := viper.GetString("cloudwatch.region")
+
+	// Define the session - using SharedConfigState which forces file or env creds
+	// See https://docs.aws.amazon.com/sdk-for-go/v1/developer-guide/configuring-sdk.html for more information
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+		Config:            aws.Config{Region: aws.String(cloudwatchRegion)},
+		Profile:           awsProfileName, /* Specify the profile to use in the credentials file */
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cloudwatch.profile": awsProfileName,
+			"cloudwatch.region":  cloudwatchRegion,
+		}).WithError(err).Error("unable to create AWS session")
+		return nil, err
+	}
+
+	//	Use the configured credentials (and assume a role with them, if we need to)
+	creds, err := newCredentials(sess)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cloudwatch.credentials": viper.GetString("cloudwatch.credentials"),
+			"cloudwatch.role_arn":    viper.GetString("cloudwatch.role_arn"),
+		}).WithError(err).Error("unable to get AWS credentials")
+		return nil, err
+	}
+	if creds != nil {
+		sess = sess.Copy(aws.NewConfig().WithCredentials(creds))
+	}
+
+	return sess, nil
+}
+
+// STSConfig is the client config for STS, which is used to check credentials and assume roles
+func STSConfig() *aws.Config {
+	config := aws.NewConfig()
+	if endpoint := viper.GetString("cloudwatch.sts_endpoint"); endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	return config
+}
+
+// roleSessionName gets the session name to use when assuming roles
+func roleSessionName() string {
+	if name := viper.GetString("cloudwatch.session_name"); name != "" {
+		return name
+	}
+	return DefaultRoleSessionName
+}
+
+// newCredentials gets the credentials to use from cloudwatch.credentials, and then assumes
+// cloudwatch.role_arn with them if it's set.  It returns nil to use the session's own credentials
+func newCredentials(sess *session.Session) (*credentials.Credentials, error) {
+	var creds *credentials.Credentials
+
+	switch source := viper.GetString("cloudwatch.credentials"); source {
+	case "", CredentialsDefault:
+		//	Use the session's credentials
+
+	case CredentialsStatic:
+		accessKeyID := viper.GetString("cloudwatch.access_key_id")
+		secretAccessKey := viper.GetString("cloudwatch.secret_access_key")
+		if accessKeyID == "" || secretAccessKey == "" {
+			return nil, fmt.Errorf("cloudwatch.credentials is %s, but cloudwatch.access_key_id or cloudwatch.secret_access_key isn't set", source)
+		}
+		creds = credentials.NewStaticCredentials(accessKeyID, secretAccessKey, viper.GetString("cloudwatch.session_token"))
+
+	case CredentialsEnv:
+		creds = credentials.NewEnvCredentials()
+
+	case CredentialsInstance:
+		creds = ec2rolecreds.NewCredentials(sess)
+
+	case CredentialsWebIdentity:
+		tokenFile := viper.GetString("cloudwatch.web_identity_token_file")
+		if tokenFile == "" {
+			tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		}
+		roleARN := viper.GetString("cloudwatch.web_identity_role_arn")
+		if roleARN == "" {
+			roleARN = os.Getenv("AWS_ROLE_ARN")
+		}
+		if tokenFile == "" || roleARN == "" {
+			return nil, fmt.Errorf("cloudwatch.credentials is %s, but the web identity token file or role arn isn't set", source)
+		}
+		provider := stscreds.NewWebIdentityRoleProvider(sts.New(sess, STSConfig()), roleARN, roleSessionName(), tokenFile)
+		creds = credentials.NewCredentials(provider)
+
+	default:
+		return nil, fmt.Errorf("unknown cloudwatch.credentials %q.  Use %s, %s, %s, %s or %s", source,
+			CredentialsDefault, CredentialsStatic, CredentialsEnv, CredentialsInstance, CredentialsWebIdentity)
+	}
+
+	//	If we need to assume a role (like one in a central logging account), use the
+	//	credentials we have to get credentials for it.  They're refreshed before they expire
+	roleARN := viper.GetString("cloudwatch.role_arn")
+	if roleARN == "" {
+		return creds, nil
+	}
+
+	stsSession := sess
+	if creds != nil {
+		stsSession = sess.Copy(aws.NewConfig().WithCredentials(creds))
+	}
+
+	return stscreds.NewCredentialsWithClient(sts.New(stsSession, STSConfig()), roleARN, func(provider *stscreds.AssumeRoleProvider) {
+		provider.RoleSessionName = roleSessionName()
+		if externalID := viper.GetString("cloudwatch.external_id"); externalID != "" {
+			provider.ExternalID = aws.String(externalID)
+		}
+	}), nil
+}
@@ -0,0 +1,64 @@
+package cloudwatch
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// PutLogEvents limits.  See
+// https://docs.aws.amazon.com/AmazonCloudWatchLogs/latest/APIReference/API_PutLogEvents.html
+const (
+	// MaxBatchEvents is the most events in a single PutLogEvents call
+	MaxBatchEvents = 10000
+
+	// MaxBatchBytes is the largest PutLogEvents batch, counting each message plus EventOverheadBytes
+	MaxBatchBytes = 1048576
+
+	// EventOverheadBytes is added to the size of each message when sizing a batch
+	EventOverheadBytes = 26
+
+	// MaxBatchSpan is the longest time span the events in a single batch can cover
+	MaxBatchSpan = 24 * time.Hour
+)
+
+// SplitBatches sorts the events chronologically and splits them into
+// batches that are each within the PutLogEvents limits
+func SplitBatches(events []*cloudwatchlogs.InputLogEvent) [][]*cloudwatchlogs.InputLogEvent {
+	retval := [][]*cloudwatchlogs.InputLogEvent{}
+
+	if len(events) == 0 {
+		return retval
+	}
+
+	//	Sort a copy, so we don't change the caller's slice
+	sorted := make([]*cloudwatchlogs.InputLogEvent, len(events))
+	copy(sorted, events)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return *sorted[i].Timestamp < *sorted[j].Timestamp
+	})
+
+	maxSpan := MaxBatchSpan.Milliseconds()
+	current := []*cloudwatchlogs.InputLogEvent{}
+	currentBytes := 0
+
+	for _, event := range sorted {
+		eventBytes := len(*event.Message) + EventOverheadBytes
+
+		//	Start a new batch if this event would break any of the limits
+		if len(current) > 0 &&
+			(len(current) >= MaxBatchEvents ||
+				currentBytes+eventBytes > MaxBatchBytes ||
+				*event.Timestamp-*current[0].Timestamp >= maxSpan) {
+			retval = append(retval, current)
+			current = []*cloudwatchlogs.InputLogEvent{}
+			currentBytes = 0
+		}
+
+		current = append(current, event)
+		currentBytes += eventBytes
+	}
+
+	return append(retval, current)
+}
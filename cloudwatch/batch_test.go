@@ -0,0 +1,90 @@
+package cloudwatch_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/danesparza/cloudjournal/cloudwatch"
+)
+
+func testEvent(timestamp int64, message string) *cloudwatchlogs.InputLogEvent {
+	return &cloudwatchlogs.InputLogEvent{
+		Message:   aws.String(message),
+		Timestamp: aws.Int64(timestamp),
+	}
+}
+
+func TestBatch_SplitBatches_SortsChronologically(t *testing.T) {
+	//	Arrange
+	events := []*cloudwatchlogs.InputLogEvent{
+		testEvent(3000, "third"),
+		testEvent(1000, "first"),
+		testEvent(2000, "second"),
+	}
+
+	//	Act
+	batches := cloudwatch.SplitBatches(events)
+
+	//	Assert
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("SplitBatches - Expected a single batch of 3 events but got %v batches", len(batches))
+	}
+
+	if *batches[0][0].Message != "first" || *batches[0][2].Message != "third" {
+		t.Errorf("SplitBatches - Expected events in chronological order")
+	}
+}
+
+func TestBatch_SplitBatches_RespectsEventCountLimit(t *testing.T) {
+	//	Arrange
+	events := []*cloudwatchlogs.InputLogEvent{}
+	for i := 0; i < cloudwatch.MaxBatchEvents+1; i++ {
+		events = append(events, testEvent(int64(i), "x"))
+	}
+
+	//	Act
+	batches := cloudwatch.SplitBatches(events)
+
+	//	Assert
+	if len(batches) != 2 || len(batches[0]) != cloudwatch.MaxBatchEvents || len(batches[1]) != 1 {
+		t.Errorf("SplitBatches - Expected batches of %v and 1 events", cloudwatch.MaxBatchEvents)
+	}
+}
+
+func TestBatch_SplitBatches_RespectsByteLimit(t *testing.T) {
+	//	Arrange - each event is 200KB plus overhead, so only 5 fit in a batch
+	message := strings.Repeat("a", 200*1024)
+	events := []*cloudwatchlogs.InputLogEvent{}
+	for i := 0; i < 6; i++ {
+		events = append(events, testEvent(int64(i), message))
+	}
+
+	//	Act
+	batches := cloudwatch.SplitBatches(events)
+
+	//	Assert
+	if len(batches) != 2 || len(batches[0]) != 5 || len(batches[1]) != 1 {
+		t.Errorf("SplitBatches - Expected batches of 5 and 1 events but got %v batches", len(batches))
+	}
+}
+
+func TestBatch_SplitBatches_RespectsTimeSpanLimit(t *testing.T) {
+	//	Arrange
+	start := time.Date(2021, 11, 4, 0, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+	events := []*cloudwatchlogs.InputLogEvent{
+		testEvent(start, "day one"),
+		testEvent(start+int64(23*time.Hour/time.Millisecond), "still day one"),
+		testEvent(start+int64(25*time.Hour/time.Millisecond), "day two"),
+	}
+
+	//	Act
+	batches := cloudwatch.SplitBatches(events)
+
+	//	Assert
+	if len(batches) != 2 || len(batches[0]) != 2 || *batches[1][0].Message != "day two" {
+		t.Errorf("SplitBatches - Expected events more than 24 hours apart to be in separate batches")
+	}
+}
@@ -0,0 +1,589 @@
+// Package cloudwatchtest provides an in-memory fake of cloudwatch logs (and the
+// STS call used to check credentials) so code that ships logs can be tested offline
+package cloudwatchtest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// PutLogEvents limits enforced by the fake, matching the real service
+const (
+	maxBatchEvents     = 10000
+	maxBatchBytes      = 1048576
+	maxEventBytes      = 262144
+	eventOverheadBytes = 26
+	maxBatchSpan       = 24 * time.Hour
+	describePageSize   = 50
+)
+
+// Operation names used with FailNext and Calls
+const (
+	OpCreateLogGroup            = "CreateLogGroup"
+	OpCreateLogStream           = "CreateLogStream"
+	OpDescribeLogStreams        = "DescribeLogStreams"
+	OpPutLogEvents              = "PutLogEvents"
+	OpPutRetentionPolicy        = "PutRetentionPolicy"
+	OpTagLogGroup               = "TagLogGroup"
+	OpAssociateKmsKey           = "AssociateKmsKey"
+	OpGetCallerIdentity         = "GetCallerIdentity"
+	OpAssumeRole                = "AssumeRole"
+	OpAssumeRoleWithWebIdentity = "AssumeRoleWithWebIdentity"
+)
+
+// Logs is an in-memory fake of cloudwatch logs.  It keeps log groups, log streams and
+// their events, checks sequence tokens and PutLogEvents limits, and returns the same
+// error codes as the real service.  The zero value isn't usable.  Use NewLogs
+type Logs struct {
+	mu       sync.Mutex
+	groups   map[string]*logGroup
+	failures map[string][]error
+	calls    map[string]int
+	tokens   int
+	roles    []sts.AssumeRoleInput
+}
+
+type logGroup struct {
+	streams map[string]*logStream
+	details LogGroupDetails
+}
+
+// LogGroupDetails are the settings of a log group
+type LogGroupDetails struct {
+	RetentionDays int64
+	Tags          map[string]string
+	KMSKeyID      string
+}
+
+// validRetentionDays are the retention periods cloudwatch accepts
+var validRetentionDays = map[int64]bool{
+	1: true, 3: true, 5: true, 7: true, 14: true, 30: true, 60: true, 90: true, 120: true, 150: true,
+	180: true, 365: true, 400: true, 545: true, 731: true, 1096: true, 1827: true, 2192: true,
+	2557: true, 2922: true, 3288: true, 3653: true,
+}
+
+type logStream struct {
+	events        []*cloudwatchlogs.InputLogEvent
+	sequenceToken string
+	previousToken string
+	lastBatch     []string
+}
+
+// NewLogs creates an empty fake with no log groups
+func NewLogs() *Logs {
+	return &Logs{
+		groups:   make(map[string]*logGroup),
+		failures: make(map[string][]error),
+		calls:    make(map[string]int),
+	}
+}
+
+// FailNext makes the next calls to the operation return the given errors, one per call,
+// before the operation behaves normally again.  A nil error lets that call through.
+// Use awserr.New to create service errors, like awserr.New("ThrottlingException", "Rate exceeded", nil)
+func (fake *Logs) FailNext(operation string, errs ...error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.failures[operation] = append(fake.failures[operation], errs...)
+}
+
+// Calls returns how many times the operation has been called
+func (fake *Logs) Calls(operation string) int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return fake.calls[operation]
+}
+
+// AddLogGroup creates a log group, if it doesn't already exist
+func (fake *Logs) AddLogGroup(groupName string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if _, ok := fake.groups[groupName]; !ok {
+		fake.groups[groupName] = newLogGroup()
+	}
+}
+
+// LogGroup returns the settings of a log group, and false if it doesn't exist
+func (fake *Logs) LogGroup(groupName string) (LogGroupDetails, bool) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	group, ok := fake.groups[groupName]
+	if !ok {
+		return LogGroupDetails{}, false
+	}
+
+	details := group.details
+	details.Tags = make(map[string]string)
+	for key, value := range group.details.Tags {
+		details.Tags[key] = value
+	}
+	return details, true
+}
+
+// AddLogStream creates a log stream (and its log group), if it doesn't already exist
+func (fake *Logs) AddLogStream(groupName, streamName string) {
+	fake.AddLogGroup(groupName)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	group := fake.groups[groupName]
+	if _, ok := group.streams[streamName]; !ok {
+		group.streams[streamName] = &logStream{}
+	}
+}
+
+// HasLogStream returns true if the log stream exists
+func (fake *Logs) HasLogStream(groupName, streamName string) bool {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return fake.stream(groupName, streamName) != nil
+}
+
+// DeleteLogStream deletes a log stream, as if someone removed it outside of the shipper
+func (fake *Logs) DeleteLogStream(groupName, streamName string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if group, ok := fake.groups[groupName]; ok {
+		delete(group.streams, streamName)
+	}
+}
+
+// Messages returns the messages written to a log stream, in the order they were accepted
+func (fake *Logs) Messages(groupName, streamName string) []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	retval := []string{}
+	if stream := fake.stream(groupName, streamName); stream != nil {
+		for _, event := range stream.events {
+			retval = append(retval, aws.StringValue(event.Message))
+		}
+	}
+
+	return retval
+}
+
+// AdvanceSequenceToken changes the sequence token of a log stream, as if another writer
+// had written to it.  It returns the new token
+func (fake *Logs) AdvanceSequenceToken(groupName, streamName string) string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	stream := fake.stream(groupName, streamName)
+	if stream == nil {
+		return ""
+	}
+
+	stream.previousToken = stream.sequenceToken
+	stream.sequenceToken = fake.nextToken()
+	stream.lastBatch = nil
+	return stream.sequenceToken
+}
+
+// CreateLogGroup creates a log group
+func (fake *Logs) CreateLogGroup(input *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := fake.call(OpCreateLogGroup); err != nil {
+		return nil, err
+	}
+
+	groupName := aws.StringValue(input.LogGroupName)
+	if groupName == "" {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeInvalidParameterException, "1 validation error detected: Value at 'logGroupName' failed to satisfy constraint: Member must have length greater than or equal to 1", nil)
+	}
+
+	if _, ok := fake.groups[groupName]; ok {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceAlreadyExistsException, "The specified log group already exists", nil)
+	}
+
+	group := newLogGroup()
+	group.details.KMSKeyID = aws.StringValue(input.KmsKeyId)
+	for key, value := range input.Tags {
+		group.details.Tags[key] = aws.StringValue(value)
+	}
+
+	fake.groups[groupName] = group
+	return &cloudwatchlogs.CreateLogGroupOutput{}, nil
+}
+
+// PutRetentionPolicy sets how long a log group keeps events
+func (fake *Logs) PutRetentionPolicy(input *cloudwatchlogs.PutRetentionPolicyInput) (*cloudwatchlogs.PutRetentionPolicyOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := fake.call(OpPutRetentionPolicy); err != nil {
+		return nil, err
+	}
+
+	group, ok := fake.groups[aws.StringValue(input.LogGroupName)]
+	if !ok {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log group does not exist.", nil)
+	}
+
+	if !validRetentionDays[aws.Int64Value(input.RetentionInDays)] {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeInvalidParameterException, "1 validation error detected: Value at 'retentionInDays' failed to satisfy constraint: Member must satisfy enum value set", nil)
+	}
+
+	group.details.RetentionDays = aws.Int64Value(input.RetentionInDays)
+	return &cloudwatchlogs.PutRetentionPolicyOutput{}, nil
+}
+
+// TagLogGroup adds (or updates) tags on a log group
+func (fake *Logs) TagLogGroup(input *cloudwatchlogs.TagLogGroupInput) (*cloudwatchlogs.TagLogGroupOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := fake.call(OpTagLogGroup); err != nil {
+		return nil, err
+	}
+
+	group, ok := fake.groups[aws.StringValue(input.LogGroupName)]
+	if !ok {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log group does not exist.", nil)
+	}
+
+	for key, value := range input.Tags {
+		group.details.Tags[key] = aws.StringValue(value)
+	}
+	return &cloudwatchlogs.TagLogGroupOutput{}, nil
+}
+
+// AssociateKmsKey sets the KMS key used to encrypt a log group
+func (fake *Logs) AssociateKmsKey(input *cloudwatchlogs.AssociateKmsKeyInput) (*cloudwatchlogs.AssociateKmsKeyOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := fake.call(OpAssociateKmsKey); err != nil {
+		return nil, err
+	}
+
+	group, ok := fake.groups[aws.StringValue(input.LogGroupName)]
+	if !ok {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log group does not exist.", nil)
+	}
+
+	group.details.KMSKeyID = aws.StringValue(input.KmsKeyId)
+	return &cloudwatchlogs.AssociateKmsKeyOutput{}, nil
+}
+
+// CreateLogStream creates a log stream in an existing log group
+func (fake *Logs) CreateLogStream(input *cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := fake.call(OpCreateLogStream); err != nil {
+		return nil, err
+	}
+
+	group, ok := fake.groups[aws.StringValue(input.LogGroupName)]
+	if !ok {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log group does not exist.", nil)
+	}
+
+	streamName := aws.StringValue(input.LogStreamName)
+	if streamName == "" || strings.ContainsAny(streamName, ":*") {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeInvalidParameterException, "1 validation error detected: Value at 'logStreamName' failed to satisfy constraint", nil)
+	}
+
+	if _, ok := group.streams[streamName]; ok {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceAlreadyExistsException, "The specified log stream already exists", nil)
+	}
+
+	group.streams[streamName] = &logStream{}
+	return &cloudwatchlogs.CreateLogStreamOutput{}, nil
+}
+
+// DescribeLogStreams lists the log streams in a log group that start with the prefix,
+// ordered by name, a page at a time
+func (fake *Logs) DescribeLogStreams(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := fake.call(OpDescribeLogStreams); err != nil {
+		return nil, err
+	}
+
+	groupName := aws.StringValue(input.LogGroupName)
+	group, ok := fake.groups[groupName]
+	if !ok {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log group does not exist.", nil)
+	}
+
+	names := []string{}
+	for name := range group.streams {
+		if strings.HasPrefix(name, aws.StringValue(input.LogStreamNamePrefix)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	//	The next token is just the name to start from
+	start := sort.SearchStrings(names, aws.StringValue(input.NextToken))
+	limit := describePageSize
+	if input.Limit != nil && *input.Limit > 0 && *input.Limit < describePageSize {
+		limit = int(*input.Limit)
+	}
+
+	retval := &cloudwatchlogs.DescribeLogStreamsOutput{LogStreams: []*cloudwatchlogs.LogStream{}}
+	for i := start; i < len(names); i++ {
+		if len(retval.LogStreams) == limit {
+			retval.NextToken = aws.String(names[i])
+			break
+		}
+
+		logStream := &cloudwatchlogs.LogStream{
+			LogStreamName: aws.String(names[i]),
+			Arn:           aws.String(fmt.Sprintf("arn:aws:logs:us-east-1:123456789012:log-group:%s:log-stream:%s", groupName, names[i])),
+		}
+		if token := group.streams[names[i]].sequenceToken; token != "" {
+			logStream.UploadSequenceToken = aws.String(token)
+		}
+		retval.LogStreams = append(retval.LogStreams, logStream)
+	}
+
+	return retval, nil
+}
+
+// DescribeLogStreamsPages calls fn with each page of DescribeLogStreams, until fn returns false
+func (fake *Logs) DescribeLogStreamsPages(input *cloudwatchlogs.DescribeLogStreamsInput, fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool) error {
+	pageInput := *input
+	for {
+		page, err := fake.DescribeLogStreams(&pageInput)
+		if err != nil {
+			return err
+		}
+
+		lastPage := page.NextToken == nil
+		if !fn(page, lastPage) || lastPage {
+			return nil
+		}
+
+		pageInput.NextToken = page.NextToken
+	}
+}
+
+// PutLogEvents writes a batch of events to a log stream
+func (fake *Logs) PutLogEvents(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := fake.call(OpPutLogEvents); err != nil {
+		return nil, err
+	}
+
+	stream := fake.stream(aws.StringValue(input.LogGroupName), aws.StringValue(input.LogStreamName))
+	if stream == nil {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log stream does not exist.", nil)
+	}
+
+	if err := checkBatch(input.LogEvents); err != nil {
+		return nil, err
+	}
+
+	//	Check the sequence token.  Sending the last batch again is reported as already accepted
+	token := aws.StringValue(input.SequenceToken)
+	if token != stream.sequenceToken {
+		if token == stream.previousToken && sameMessages(stream.lastBatch, input.LogEvents) {
+			return nil, &cloudwatchlogs.DataAlreadyAcceptedException{
+				ExpectedSequenceToken: aws.String(stream.sequenceToken),
+				Message_:              aws.String(fmt.Sprintf("The given batch of log events has already been accepted. The next batch can be sent with sequenceToken: %s", stream.sequenceToken)),
+			}
+		}
+
+		//	A new stream doesn't expect a token at all
+		invalidToken := &cloudwatchlogs.InvalidSequenceTokenException{
+			Message_: aws.String("The given sequenceToken is invalid. The next expected sequenceToken is: null"),
+		}
+		if stream.sequenceToken != "" {
+			invalidToken.ExpectedSequenceToken = aws.String(stream.sequenceToken)
+			invalidToken.Message_ = aws.String(fmt.Sprintf("The given sequenceToken is invalid. The next expected sequenceToken is: %s", stream.sequenceToken))
+		}
+		return nil, invalidToken
+	}
+
+	stream.lastBatch = []string{}
+	for _, event := range input.LogEvents {
+		stream.events = append(stream.events, event)
+		stream.lastBatch = append(stream.lastBatch, aws.StringValue(event.Message))
+	}
+	stream.previousToken = stream.sequenceToken
+	stream.sequenceToken = fake.nextToken()
+
+	return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String(stream.sequenceToken)}, nil
+}
+
+// GetCallerIdentity always succeeds, unless told to fail with FailNext
+func (fake *Logs) GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := fake.call(OpGetCallerIdentity); err != nil {
+		return nil, err
+	}
+
+	return &sts.GetCallerIdentityOutput{
+		Account: aws.String("123456789012"),
+		Arn:     aws.String("arn:aws:iam::123456789012:user/cloudjournal"),
+		UserId:  aws.String("AIDACLOUDJOURNALTEST"),
+	}, nil
+}
+
+// AssumeRole returns temporary credentials for the role, unless told to fail with FailNext
+func (fake *Logs) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := fake.call(OpAssumeRole); err != nil {
+		return nil, err
+	}
+
+	fake.roles = append(fake.roles, *input)
+	creds, user := fake.assume(input.RoleArn, input.RoleSessionName)
+	return &sts.AssumeRoleOutput{Credentials: creds, AssumedRoleUser: user}, nil
+}
+
+// AssumeRoleWithWebIdentity returns temporary credentials for the role, unless told to fail with FailNext
+func (fake *Logs) AssumeRoleWithWebIdentity(input *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if err := fake.call(OpAssumeRoleWithWebIdentity); err != nil {
+		return nil, err
+	}
+
+	if aws.StringValue(input.WebIdentityToken) == "" {
+		return nil, awserr.New(sts.ErrCodeInvalidIdentityTokenException, "The web identity token is empty", nil)
+	}
+
+	fake.roles = append(fake.roles, sts.AssumeRoleInput{RoleArn: input.RoleArn, RoleSessionName: input.RoleSessionName})
+	creds, user := fake.assume(input.RoleArn, input.RoleSessionName)
+	return &sts.AssumeRoleWithWebIdentityOutput{Credentials: creds, AssumedRoleUser: user}, nil
+}
+
+// AssumedRoles returns the requests for the roles that have been assumed, in order
+func (fake *Logs) AssumedRoles() []sts.AssumeRoleInput {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return append([]sts.AssumeRoleInput{}, fake.roles...)
+}
+
+// assume creates credentials for an assumed role.  The caller must hold the lock
+func (fake *Logs) assume(roleARN, sessionName *string) (*sts.Credentials, *sts.AssumedRoleUser) {
+	creds := &sts.Credentials{
+		AccessKeyId:     aws.String(fmt.Sprintf("ASIAROLE%012d", len(fake.roles))),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("session"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour).UTC()),
+	}
+	user := &sts.AssumedRoleUser{
+		Arn:           roleARN,
+		AssumedRoleId: aws.String("AROACLOUDJOURNALTEST:" + aws.StringValue(sessionName)),
+	}
+
+	return creds, user
+}
+
+// call counts a call to the operation and returns the next injected failure, if there is one.
+// The caller must hold the lock
+func (fake *Logs) call(operation string) error {
+	fake.calls[operation]++
+
+	if errs := fake.failures[operation]; len(errs) > 0 {
+		fake.failures[operation] = errs[1:]
+		return errs[0]
+	}
+
+	return nil
+}
+
+// newLogGroup creates an empty log group
+func newLogGroup() *logGroup {
+	return &logGroup{
+		streams: make(map[string]*logStream),
+		details: LogGroupDetails{Tags: make(map[string]string)},
+	}
+}
+
+// stream finds a log stream.  The caller must hold the lock
+func (fake *Logs) stream(groupName, streamName string) *logStream {
+	group, ok := fake.groups[groupName]
+	if !ok {
+		return nil
+	}
+
+	return group.streams[streamName]
+}
+
+// nextToken creates a new sequence token.  The caller must hold the lock
+func (fake *Logs) nextToken() string {
+	fake.tokens++
+	return fmt.Sprintf("4962%052d", fake.tokens)
+}
+
+// checkBatch checks a batch against the PutLogEvents limits
+func checkBatch(events []*cloudwatchlogs.InputLogEvent) error {
+	if len(events) == 0 {
+		return awserr.New(cloudwatchlogs.ErrCodeInvalidParameterException, "1 validation error detected: Value at 'logEvents' failed to satisfy constraint: Member must have length greater than or equal to 1", nil)
+	}
+
+	if len(events) > maxBatchEvents {
+		return awserr.New(cloudwatchlogs.ErrCodeInvalidParameterException, fmt.Sprintf("1 validation error detected: Value at 'logEvents' failed to satisfy constraint: Member must have length less than or equal to %d", maxBatchEvents), nil)
+	}
+
+	batchBytes := 0
+	for i, event := range events {
+		eventBytes := len(aws.StringValue(event.Message)) + eventOverheadBytes
+		if eventBytes > maxEventBytes {
+			return awserr.New(cloudwatchlogs.ErrCodeInvalidParameterException, fmt.Sprintf("Log event too large: %d bytes exceeds limit of %d", eventBytes, maxEventBytes), nil)
+		}
+		batchBytes += eventBytes
+
+		if i > 0 && aws.Int64Value(event.Timestamp) < aws.Int64Value(events[i-1].Timestamp) {
+			return awserr.New(cloudwatchlogs.ErrCodeInvalidParameterException, "Log events in a single PutLogEvents request must be in chronological order.", nil)
+		}
+	}
+
+	if batchBytes > maxBatchBytes {
+		return awserr.New(cloudwatchlogs.ErrCodeInvalidParameterException, fmt.Sprintf("Upload too large: %d bytes exceeds limit of %d", batchBytes, maxBatchBytes), nil)
+	}
+
+	span := time.Duration(aws.Int64Value(events[len(events)-1].Timestamp)-aws.Int64Value(events[0].Timestamp)) * time.Millisecond
+	if span > maxBatchSpan {
+		return awserr.New(cloudwatchlogs.ErrCodeInvalidParameterException, "The batch of log events in a single PutLogEvents request cannot span more than 24 hours.", nil)
+	}
+
+	return nil
+}
+
+// sameMessages returns true if the events have the same messages as the batch
+func sameMessages(batch []string, events []*cloudwatchlogs.InputLogEvent) bool {
+	if batch == nil || len(batch) != len(events) {
+		return false
+	}
+
+	for i, event := range events {
+		if batch[i] != aws.StringValue(event.Message) {
+			return false
+		}
+	}
+
+	return true
+}
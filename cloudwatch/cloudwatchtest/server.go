@@ -0,0 +1,326 @@
+package cloudwatchtest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// logsTargetPrefix is the X-Amz-Target prefix for cloudwatch logs JSON 1.1 requests
+const logsTargetPrefix = "Logs_20140328."
+
+// Server is a local HTTP stand-in for cloudwatch logs (JSON 1.1 protocol) and STS
+// (query protocol), backed by a Logs fake.  Point cloudwatch.endpoint at Server.URL to
+// use it.  Use Logs.FailNext to make the server return errors
+type Server struct {
+	*httptest.Server
+
+	Logs *Logs
+
+	mu          sync.Mutex
+	accessKeyID string
+}
+
+// LastAccessKeyID returns the access key id that signed the last cloudwatch logs request
+func (server *Server) LastAccessKeyID() string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.accessKeyID
+}
+
+// NewServer starts a server backed by the fake.  Close it when you're done
+func NewServer(fake *Logs) *Server {
+	server := &Server{Logs: fake}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serveHTTP))
+	return server
+}
+
+// serveHTTP routes cloudwatch logs requests by their X-Amz-Target header, and
+// everything else as an STS query request
+func (server *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		server.serveLogs(w, r, strings.TrimPrefix(target, logsTargetPrefix))
+		return
+	}
+
+	server.serveSTS(w, r)
+}
+
+// serveLogs handles a cloudwatch logs JSON 1.1 request
+func (server *Server) serveLogs(w http.ResponseWriter, r *http.Request, operation string) {
+	server.mu.Lock()
+	server.accessKeyID = accessKeyID(r)
+	server.mu.Unlock()
+
+	var output interface{}
+	var err error
+
+	switch operation {
+	case OpCreateLogGroup:
+		input := &cloudwatchlogs.CreateLogGroupInput{}
+		if err = jsonutil.UnmarshalJSON(input, r.Body); err == nil {
+			output, err = server.Logs.CreateLogGroup(input)
+		}
+
+	case OpCreateLogStream:
+		input := &cloudwatchlogs.CreateLogStreamInput{}
+		if err = jsonutil.UnmarshalJSON(input, r.Body); err == nil {
+			output, err = server.Logs.CreateLogStream(input)
+		}
+
+	case OpDescribeLogStreams:
+		input := &cloudwatchlogs.DescribeLogStreamsInput{}
+		if err = jsonutil.UnmarshalJSON(input, r.Body); err == nil {
+			output, err = server.Logs.DescribeLogStreams(input)
+		}
+
+	case OpPutLogEvents:
+		input := &cloudwatchlogs.PutLogEventsInput{}
+		if err = jsonutil.UnmarshalJSON(input, r.Body); err == nil {
+			output, err = server.Logs.PutLogEvents(input)
+		}
+
+	case OpPutRetentionPolicy:
+		input := &cloudwatchlogs.PutRetentionPolicyInput{}
+		if err = jsonutil.UnmarshalJSON(input, r.Body); err == nil {
+			output, err = server.Logs.PutRetentionPolicy(input)
+		}
+
+	case OpTagLogGroup:
+		input := &cloudwatchlogs.TagLogGroupInput{}
+		if err = jsonutil.UnmarshalJSON(input, r.Body); err == nil {
+			output, err = server.Logs.TagLogGroup(input)
+		}
+
+	case OpAssociateKmsKey:
+		input := &cloudwatchlogs.AssociateKmsKeyInput{}
+		if err = jsonutil.UnmarshalJSON(input, r.Body); err == nil {
+			output, err = server.Logs.AssociateKmsKey(input)
+		}
+
+	default:
+		err = awserr.New("UnknownOperationException", fmt.Sprintf("operation %q isn't supported by the test server", operation), nil)
+	}
+
+	if err != nil {
+		writeLogsError(w, err)
+		return
+	}
+
+	body, err := jsonutil.BuildJSON(output)
+	if err != nil {
+		writeLogsError(w, awserr.New("InternalFailure", err.Error(), err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.Write(body)
+}
+
+// writeLogsError writes an error the way cloudwatch logs does
+func writeLogsError(w http.ResponseWriter, err error) {
+	code, message := errorCode(err)
+
+	body := map[string]string{
+		"__type":  code,
+		"message": message,
+	}
+
+	//	Sequence token errors tell the client what token to use next
+	if invalidToken, ok := err.(*cloudwatchlogs.InvalidSequenceTokenException); ok && invalidToken.ExpectedSequenceToken != nil {
+		body["expectedSequenceToken"] = *invalidToken.ExpectedSequenceToken
+	}
+	if alreadyAccepted, ok := err.(*cloudwatchlogs.DataAlreadyAcceptedException); ok && alreadyAccepted.ExpectedSequenceToken != nil {
+		body["expectedSequenceToken"] = *alreadyAccepted.ExpectedSequenceToken
+	}
+
+	encoded, _ := jsonutil.BuildJSON(body)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(errorStatus(code))
+	w.Write(encoded)
+}
+
+// serveSTS handles an STS query request
+func (server *Server) serveSTS(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeSTSError(w, awserr.New("MalformedQueryString", err.Error(), err))
+		return
+	}
+
+	switch action := r.Form.Get("Action"); action {
+	case OpGetCallerIdentity:
+		server.serveGetCallerIdentity(w)
+
+	case OpAssumeRole:
+		output, err := server.Logs.AssumeRole(&sts.AssumeRoleInput{
+			RoleArn:         aws.String(r.Form.Get("RoleArn")),
+			RoleSessionName: aws.String(r.Form.Get("RoleSessionName")),
+			ExternalId:      aws.String(r.Form.Get("ExternalId")),
+		})
+		if err != nil {
+			writeSTSError(w, err)
+			return
+		}
+		writeXML(w, http.StatusOK, newAssumeRoleResponse(action, output.Credentials, output.AssumedRoleUser))
+
+	case OpAssumeRoleWithWebIdentity:
+		output, err := server.Logs.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+			RoleArn:          aws.String(r.Form.Get("RoleArn")),
+			RoleSessionName:  aws.String(r.Form.Get("RoleSessionName")),
+			WebIdentityToken: aws.String(r.Form.Get("WebIdentityToken")),
+		})
+		if err != nil {
+			writeSTSError(w, err)
+			return
+		}
+		writeXML(w, http.StatusOK, newAssumeRoleResponse(action, output.Credentials, output.AssumedRoleUser))
+
+	default:
+		writeSTSError(w, awserr.New("InvalidAction", fmt.Sprintf("action %q isn't supported by the test server", action), nil))
+	}
+}
+
+// serveGetCallerIdentity handles an STS GetCallerIdentity request
+func (server *Server) serveGetCallerIdentity(w http.ResponseWriter) {
+	output, err := server.Logs.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		writeSTSError(w, err)
+		return
+	}
+
+	response := struct {
+		XMLName xml.Name `xml:"GetCallerIdentityResponse"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Arn     string   `xml:"GetCallerIdentityResult>Arn"`
+		UserID  string   `xml:"GetCallerIdentityResult>UserId"`
+		Account string   `xml:"GetCallerIdentityResult>Account"`
+		ID      string   `xml:"ResponseMetadata>RequestId"`
+	}{
+		Xmlns:   "https://sts.amazonaws.com/doc/2011-06-15/",
+		Arn:     *output.Arn,
+		UserID:  *output.UserId,
+		Account: *output.Account,
+		ID:      "cloudjournal-test",
+	}
+
+	writeXML(w, http.StatusOK, response)
+}
+
+// assumeRoleResponse is the response to AssumeRole and AssumeRoleWithWebIdentity
+type assumeRoleResponse struct {
+	XMLName xml.Name
+	Xmlns   string `xml:"xmlns,attr"`
+	Result  assumeRoleResult
+	ID      string `xml:"ResponseMetadata>RequestId"`
+}
+
+// assumeRoleResult is named for the action, like AssumeRoleResult
+type assumeRoleResult struct {
+	XMLName         xml.Name
+	AccessKeyID     string    `xml:"Credentials>AccessKeyId"`
+	SecretAccessKey string    `xml:"Credentials>SecretAccessKey"`
+	SessionToken    string    `xml:"Credentials>SessionToken"`
+	Expiration      time.Time `xml:"Credentials>Expiration"`
+	Arn             string    `xml:"AssumedRoleUser>Arn"`
+	AssumedRoleID   string    `xml:"AssumedRoleUser>AssumedRoleId"`
+}
+
+// newAssumeRoleResponse creates the response for an assume role action
+func newAssumeRoleResponse(action string, creds *sts.Credentials, user *sts.AssumedRoleUser) interface{} {
+	return assumeRoleResponse{
+		XMLName: xml.Name{Local: action + "Response"},
+		Xmlns:   "https://sts.amazonaws.com/doc/2011-06-15/",
+		Result: assumeRoleResult{
+			XMLName:         xml.Name{Local: action + "Result"},
+			AccessKeyID:     *creds.AccessKeyId,
+			SecretAccessKey: *creds.SecretAccessKey,
+			SessionToken:    *creds.SessionToken,
+			Expiration:      *creds.Expiration,
+			Arn:             *user.Arn,
+			AssumedRoleID:   *user.AssumedRoleId,
+		},
+		ID: "cloudjournal-test",
+	}
+}
+
+// writeSTSError writes an error the way STS does
+func writeSTSError(w http.ResponseWriter, err error) {
+	code, message := errorCode(err)
+
+	response := struct {
+		XMLName xml.Name `xml:"ErrorResponse"`
+		Type    string   `xml:"Error>Type"`
+		Code    string   `xml:"Error>Code"`
+		Message string   `xml:"Error>Message"`
+		ID      string   `xml:"RequestId"`
+	}{
+		Type:    "Sender",
+		Code:    code,
+		Message: message,
+		ID:      "cloudjournal-test",
+	}
+
+	writeXML(w, errorStatus(code), response)
+}
+
+// writeXML writes an XML response
+func writeXML(w http.ResponseWriter, status int, response interface{}) {
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	xml.NewEncoder(&body).Encode(response)
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// accessKeyID gets the access key id from a signed request's Authorization header,
+// like AWS4-HMAC-SHA256 Credential=AKID/20211104/us-east-1/logs/aws4_request, ...
+func accessKeyID(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	start := strings.Index(authorization, "Credential=")
+	if start < 0 {
+		return ""
+	}
+
+	credential := authorization[start+len("Credential="):]
+	if end := strings.Index(credential, "/"); end >= 0 {
+		return credential[:end]
+	}
+	return credential
+}
+
+// errorCode gets the error code and message to send for an error
+func errorCode(err error) (string, string) {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code(), aerr.Message()
+	}
+
+	return "InternalFailure", err.Error()
+}
+
+// errorStatus gets the HTTP status code the service uses for an error code
+func errorStatus(code string) int {
+	switch code {
+	case cloudwatchlogs.ErrCodeServiceUnavailableException, "ServiceUnavailable":
+		return http.StatusServiceUnavailable
+	case "InternalFailure":
+		return http.StatusInternalServerError
+	case "ExpiredToken", "InvalidClientTokenId", "AccessDeniedException", "AccessDenied":
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -0,0 +1,101 @@
+package cloudwatch_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/danesparza/cloudjournal/awssession"
+	"github.com/danesparza/cloudjournal/cloudwatch"
+	"github.com/spf13/viper"
+)
+
+func TestCredentials_RoleARN_AssumesRoleWithStaticCredentials(t *testing.T) {
+	//	Arrange
+	fake, server := useTestServer(t)
+	viper.Set("cloudwatch.credentials", awssession.CredentialsStatic)
+	viper.Set("cloudwatch.access_key_id", "AKIDSTATIC")
+	viper.Set("cloudwatch.secret_access_key", "secret")
+	viper.Set("cloudwatch.role_arn", "arn:aws:iam::210987654321:role/central-logging")
+	viper.Set("cloudwatch.external_id", "fleet-1234")
+	viper.Set("cloudwatch.session_name", "raspberrypi")
+	service := cloudwatch.NewService(nil)
+
+	//	Act
+	err := service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("one"))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("WriteToLog - Should execute without error, but got: %s", err)
+	}
+
+	roles := fake.AssumedRoles()
+	if len(roles) != 1 || aws.StringValue(roles[0].RoleArn) != "arn:aws:iam::210987654321:role/central-logging" ||
+		aws.StringValue(roles[0].ExternalId) != "fleet-1234" || aws.StringValue(roles[0].RoleSessionName) != "raspberrypi" {
+		t.Errorf("WriteToLog - Expected the role to be assumed once with the external id and session name, but got %v", roles)
+	}
+
+	if key := server.LastAccessKeyID(); !strings.HasPrefix(key, "ASIAROLE") {
+		t.Errorf("WriteToLog - Expected logs to be written with the assumed role's credentials, but got %q", key)
+	}
+}
+
+func TestCredentials_WebIdentity_UsesRoleCredentials(t *testing.T) {
+	//	Arrange
+	fake, server := useTestServer(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("eyJhbGciOiJSUzI1NiJ9.test.token"), 0600)
+	viper.Set("cloudwatch.credentials", awssession.CredentialsWebIdentity)
+	viper.Set("cloudwatch.web_identity_token_file", tokenFile)
+	viper.Set("cloudwatch.web_identity_role_arn", "arn:aws:iam::123456789012:role/cloudjournal")
+	service := cloudwatch.NewService(nil)
+
+	//	Act
+	err := service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("one"))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("WriteToLog - Should execute without error, but got: %s", err)
+	}
+
+	roles := fake.AssumedRoles()
+	if len(roles) != 1 || aws.StringValue(roles[0].RoleSessionName) != awssession.DefaultRoleSessionName {
+		t.Errorf("WriteToLog - Expected the web identity role to be assumed with the default session name, but got %v", roles)
+	}
+
+	if key := server.LastAccessKeyID(); !strings.HasPrefix(key, "ASIAROLE") {
+		t.Errorf("WriteToLog - Expected logs to be written with the role's credentials, but got %q", key)
+	}
+}
+
+func TestCredentials_StaticWithoutKeys_ReturnsError(t *testing.T) {
+	//	Arrange
+	useTestServer(t)
+	viper.Set("cloudwatch.credentials", awssession.CredentialsStatic)
+	service := cloudwatch.NewService(nil)
+
+	//	Act
+	_, err := service.GetAWSSession()
+
+	//	Assert
+	if err == nil {
+		t.Errorf("GetAWSSession - Expected an error without static keys")
+	}
+}
+
+func TestCredentials_UnknownSource_ReturnsError(t *testing.T) {
+	//	Arrange
+	useTestServer(t)
+	viper.Set("cloudwatch.credentials", "carrier-pigeon")
+	service := cloudwatch.NewService(nil)
+
+	//	Act
+	_, err := service.GetAWSSession()
+
+	//	Assert
+	if err == nil {
+		t.Errorf("GetAWSSession - Expected an error for an unknown credential source")
+	}
+}
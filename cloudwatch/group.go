@@ -0,0 +1,120 @@
+package cloudwatch
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/danesparza/cloudjournal/format"
+	"github.com/danesparza/cloudjournal/metrics"
+	"github.com/danesparza/cloudjournal/token"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// LogGroupOptions are the settings for log groups we create.  The zero value
+// creates log groups with no retention (logs are kept forever), tags or KMS key
+type LogGroupOptions struct {
+	// RetentionDays is how long log events are kept.  0 keeps them forever
+	RetentionDays int64
+
+	// Tags are added to the log group
+	Tags map[string]string
+
+	// KMSKeyID is the ARN of the KMS key used to encrypt the log group
+	KMSKeyID string
+
+	// Reconcile applies the settings to log groups that already exist too
+	Reconcile bool
+}
+
+// NewLogGroupOptionsFromConfig gets the log group options from cloudwatch.retention_days,
+// cloudwatch.tags, cloudwatch.kms_key_id and cloudwatch.reconcile.  Tokens in tag values are replaced
+func NewLogGroupOptionsFromConfig(tokens map[string]string) LogGroupOptions {
+	retval := LogGroupOptions{
+		RetentionDays: viper.GetInt64("cloudwatch.retention_days"),
+		Tags:          format.ParseTags(viper.GetString("cloudwatch.tags")),
+		KMSKeyID:      viper.GetString("cloudwatch.kms_key_id"),
+		Reconcile:     viper.GetBool("cloudwatch.reconcile"),
+	}
+
+	for key, value := range retval.Tags {
+		retval.Tags[key] = token.Replace(value, tokens)
+	}
+
+	return retval
+}
+
+// applyLogGroupOptions sets the retention policy for a log group we just created.  Tags and
+// the KMS key are set when the group is created.  If reconciling, tags and the KMS key are set too
+func (service *Service) applyLogGroupOptions(svc LogsAPI, groupName string, options LogGroupOptions, reconciling bool) {
+	fields := log.Fields{
+		"groupName":     groupName,
+		"retentionDays": options.RetentionDays,
+		"kmsKeyID":      options.KMSKeyID,
+		"tags":          options.Tags,
+	}
+
+	if options.RetentionDays > 0 {
+		_, err := svc.PutRetentionPolicy(&cloudwatchlogs.PutRetentionPolicyInput{
+			LogGroupName:    aws.String(groupName),
+			RetentionInDays: aws.Int64(options.RetentionDays),
+		})
+		if err != nil {
+			metrics.Add("cloudwatch.group_settings_failed", 1)
+			log.WithFields(fields).WithError(err).Error("problem setting the log group retention policy")
+		}
+	}
+
+	if !reconciling {
+		return
+	}
+
+	if len(options.Tags) > 0 {
+		_, err := svc.TagLogGroup(&cloudwatchlogs.TagLogGroupInput{
+			LogGroupName: aws.String(groupName),
+			Tags:         aws.StringMap(options.Tags),
+		})
+		if err != nil {
+			metrics.Add("cloudwatch.group_settings_failed", 1)
+			log.WithFields(fields).WithError(err).Error("problem tagging the log group")
+		}
+	}
+
+	if options.KMSKeyID != "" {
+		_, err := svc.AssociateKmsKey(&cloudwatchlogs.AssociateKmsKeyInput{
+			LogGroupName: aws.String(groupName),
+			KmsKeyId:     aws.String(options.KMSKeyID),
+		})
+		if err != nil {
+			metrics.Add("cloudwatch.group_settings_failed", 1)
+			log.WithFields(fields).WithError(err).Error("problem associating the KMS key with the log group")
+		}
+	}
+
+	log.WithFields(fields).Debug("reconciled log group settings")
+}
+
+// reconcileLogGroup applies the log group options to an existing log group, once per run.
+// Groups created by this run are skipped
+func (service *Service) reconcileLogGroup(svc LogsAPI, groupName string, options LogGroupOptions) {
+	if !options.Reconcile {
+		return
+	}
+
+	if done := service.markReconciled(groupName); !done {
+		service.applyLogGroupOptions(svc, groupName, options, true)
+	}
+}
+
+// markReconciled records that a log group has its settings, and returns true if it already did
+func (service *Service) markReconciled(groupName string) bool {
+	service.streamsMu.Lock()
+	defer service.streamsMu.Unlock()
+
+	if service.reconciled == nil {
+		service.reconciled = make(map[string]bool)
+	}
+
+	done := service.reconciled[groupName]
+	service.reconciled[groupName] = true
+	return done
+}
@@ -0,0 +1,103 @@
+package cloudwatch_test
+
+import (
+	"testing"
+
+	"github.com/danesparza/cloudjournal/cloudwatch"
+	"github.com/danesparza/cloudjournal/cloudwatch/cloudwatchtest"
+	"github.com/spf13/viper"
+)
+
+func TestGroup_NewLogGroupOptionsFromConfig_ReplacesTokensInTags(t *testing.T) {
+	//	Arrange
+	viper.Set("cloudwatch.retention_days", 30)
+	viper.Set("cloudwatch.tags", "Team=platform, Host={hostname}, Unit={unit},,")
+	t.Cleanup(viper.Reset)
+	tokens := map[string]string{"{hostname}": "raspberrypi", "{unit}": "cron"}
+
+	//	Act
+	options := cloudwatch.NewLogGroupOptionsFromConfig(tokens)
+
+	//	Assert
+	if options.RetentionDays != 30 {
+		t.Errorf("NewLogGroupOptionsFromConfig - Expected 30 retention days, but got %v", options.RetentionDays)
+	}
+
+	if len(options.Tags) != 3 || options.Tags["Team"] != "platform" || options.Tags["Host"] != "raspberrypi" || options.Tags["Unit"] != "cron" {
+		t.Errorf("NewLogGroupOptionsFromConfig - Expected tags with tokens replaced, but got %v", options.Tags)
+	}
+}
+
+func TestGroup_WriteToLog_NewGroup_AppliesOptions(t *testing.T) {
+	//	Arrange
+	fake := cloudwatchtest.NewLogs()
+	service := cloudwatch.NewServiceWithClients(nil, fake, fake)
+	options := cloudwatch.LogGroupOptions{
+		RetentionDays: 30,
+		Tags:          map[string]string{"Team": "platform"},
+		KMSKeyID:      "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab",
+	}
+
+	//	Act
+	err := service.WriteToLog("/app/cloudjournal/cron", "host", options, testEntries("one"))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("WriteToLog - Should execute without error, but got: %s", err)
+	}
+
+	group, _ := fake.LogGroup("/app/cloudjournal/cron")
+	if group.RetentionDays != 30 || group.Tags["Team"] != "platform" || group.KMSKeyID != options.KMSKeyID {
+		t.Errorf("WriteToLog - Expected the new log group to have the options, but got %+v", group)
+	}
+}
+
+func TestGroup_WriteToLog_ExistingGroup_ReconcilesOnce(t *testing.T) {
+	//	Arrange
+	fake := cloudwatchtest.NewLogs()
+	fake.AddLogStream("/app/cloudjournal/cron", "host")
+	service := cloudwatch.NewServiceWithClients(nil, fake, fake)
+	options := cloudwatch.LogGroupOptions{
+		RetentionDays: 14,
+		Tags:          map[string]string{"Team": "platform"},
+		Reconcile:     true,
+	}
+
+	//	Act
+	service.WriteToLog("/app/cloudjournal/cron", "host", options, testEntries("one"))
+	err := service.WriteToLog("/app/cloudjournal/cron", "host", options, testEntries("two"))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("WriteToLog - Should execute without error, but got: %s", err)
+	}
+
+	group, _ := fake.LogGroup("/app/cloudjournal/cron")
+	if group.RetentionDays != 14 || group.Tags["Team"] != "platform" {
+		t.Errorf("WriteToLog - Expected the existing log group to be reconciled, but got %+v", group)
+	}
+
+	if calls := fake.Calls(cloudwatchtest.OpTagLogGroup); calls != 1 {
+		t.Errorf("WriteToLog - Expected the log group to be tagged once, but it was tagged %v times", calls)
+	}
+}
+
+func TestGroup_WriteToLog_ExistingGroupWithoutReconcile_IsUnchanged(t *testing.T) {
+	//	Arrange
+	fake := cloudwatchtest.NewLogs()
+	fake.AddLogStream("/app/cloudjournal/cron", "host")
+	service := cloudwatch.NewServiceWithClients(nil, fake, fake)
+	options := cloudwatch.LogGroupOptions{RetentionDays: 14}
+
+	//	Act
+	err := service.WriteToLog("/app/cloudjournal/cron", "host", options, testEntries("one"))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("WriteToLog - Should execute without error, but got: %s", err)
+	}
+
+	if group, _ := fake.LogGroup("/app/cloudjournal/cron"); group.RetentionDays != 0 {
+		t.Errorf("WriteToLog - Expected the existing log group to be unchanged, but got %+v", group)
+	}
+}
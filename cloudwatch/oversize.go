@@ -0,0 +1,79 @@
+package cloudwatch
+
+import (
+	"fmt"
+
+	"github.com/danesparza/cloudjournal/format"
+)
+
+// Oversize policies for events larger than the maximum event size
+const (
+	// OversizeTruncate cuts the message short and adds TruncatedMarker
+	OversizeTruncate = "truncate"
+
+	// OversizeSplit splits the message into numbered continuation events like [1/3] ...
+	OversizeSplit = "split"
+
+	// OversizeDrop drops the event
+	OversizeDrop = "drop"
+)
+
+const (
+	// DefaultMaxEventSize is the largest event CloudWatch accepts (256 KB), including EventOverheadBytes
+	DefaultMaxEventSize = 262144
+
+	// MinMaxEventSize is the smallest max event size we use.  It leaves room for
+	// EventOverheadBytes, the part numbers of split events and TruncatedMarker
+	MinMaxEventSize = 1024
+
+	// TruncatedMarker is added to the end of truncated messages
+	TruncatedMarker = "...[truncated]"
+)
+
+// ClampMaxEventSize returns the max event size within the sizes CloudWatch accepts (and
+// no smaller than MinMaxEventSize).  0 or less is DefaultMaxEventSize
+func ClampMaxEventSize(maxEventSize int) int {
+	switch {
+	case maxEventSize <= 0 || maxEventSize > DefaultMaxEventSize:
+		return DefaultMaxEventSize
+	case maxEventSize < MinMaxEventSize:
+		return MinMaxEventSize
+	}
+	return maxEventSize
+}
+
+// LimitEventSize applies the oversize policy to a message that is larger than maxEventSize
+// (which includes EventOverheadBytes, and is clamped with ClampMaxEventSize), and returns
+// the messages to send in its place.  Messages that fit are returned unchanged.  A dropped
+// message returns no messages
+func LimitEventSize(message string, maxEventSize int, policy string) []string {
+	maxEventSize = ClampMaxEventSize(maxEventSize)
+
+	limit := maxEventSize - EventOverheadBytes
+	if len(message) <= limit {
+		return []string{message}
+	}
+
+	switch policy {
+	case OversizeDrop:
+		return []string{}
+
+	case OversizeSplit:
+		//	Leave room for the part numbers.  There can't be more parts than bytes
+		prefixSize := len(fmt.Sprintf("[%d/%d] ", len(message), len(message)))
+		parts := []string{}
+		for remaining := message; len(remaining) > 0; {
+			part := format.TruncateUTF8(remaining, limit-prefixSize)
+			parts = append(parts, part)
+			remaining = remaining[len(part):]
+		}
+
+		for i := range parts {
+			parts[i] = fmt.Sprintf("[%d/%d] %s", i+1, len(parts), parts[i])
+		}
+		return parts
+
+	default:
+		return []string{format.TruncateUTF8(message, limit-len(TruncatedMarker)) + TruncatedMarker}
+	}
+}
@@ -0,0 +1,91 @@
+package cloudwatch_test
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/danesparza/cloudjournal/cloudwatch"
+)
+
+func TestOversize_LimitEventSize_SmallMessage_Unchanged(t *testing.T) {
+	//	Act
+	messages := cloudwatch.LimitEventSize("hello", cloudwatch.DefaultMaxEventSize, cloudwatch.OversizeDrop)
+
+	//	Assert
+	if len(messages) != 1 || messages[0] != "hello" {
+		t.Errorf("LimitEventSize - Expected the message unchanged but got %v", messages)
+	}
+}
+
+func TestOversize_LimitEventSize_Truncate(t *testing.T) {
+	//	Arrange - 26 bytes of overhead leaves room for 998 bytes of message
+	message := strings.Repeat("é", 600)
+
+	//	Act
+	messages := cloudwatch.LimitEventSize(message, 1024, cloudwatch.OversizeTruncate)
+
+	//	Assert
+	if len(messages) != 1 || len(messages[0]) > 998 || !strings.HasSuffix(messages[0], cloudwatch.TruncatedMarker) {
+		t.Fatalf("LimitEventSize - Expected a single truncated message but got %q", messages)
+	}
+
+	if !utf8.ValidString(messages[0]) {
+		t.Errorf("LimitEventSize - Truncation split a character: %q", messages[0])
+	}
+}
+
+func TestOversize_LimitEventSize_Split(t *testing.T) {
+	//	Arrange
+	message := strings.Repeat("abcdefghij", 300)
+
+	//	Act
+	messages := cloudwatch.LimitEventSize(message, 1024, cloudwatch.OversizeSplit)
+
+	//	Assert
+	joined := ""
+	for i, part := range messages {
+		if len(part) > 1024-cloudwatch.EventOverheadBytes {
+			t.Errorf("LimitEventSize - Part %v is too big: %v bytes", i+1, len(part))
+		}
+		if !strings.HasPrefix(part, "[") {
+			t.Errorf("LimitEventSize - Part %v isn't numbered: %s", i+1, part)
+		}
+		joined += part[strings.Index(part, "] ")+2:]
+	}
+
+	if !strings.HasPrefix(messages[0], "[1/") || joined != message {
+		t.Errorf("LimitEventSize - Expected numbered parts that add up to the message but got %q", messages)
+	}
+}
+
+func TestOversize_LimitEventSize_Drop(t *testing.T) {
+	//	Act
+	messages := cloudwatch.LimitEventSize(strings.Repeat("a", 2000), 1024, cloudwatch.OversizeDrop)
+
+	//	Assert
+	if len(messages) != 0 {
+		t.Errorf("LimitEventSize - Expected the message to be dropped but got %v", messages)
+	}
+}
+
+func TestOversize_LimitEventSize_TooSmall_UsesMinimum(t *testing.T) {
+	//	Arrange - a max event size smaller than the overhead
+	message := strings.Repeat("a", 5000)
+	limit := cloudwatch.MinMaxEventSize - cloudwatch.EventOverheadBytes
+
+	//	Act
+	truncated := cloudwatch.LimitEventSize(message, 20, cloudwatch.OversizeTruncate)
+	parts := cloudwatch.LimitEventSize(message, 20, cloudwatch.OversizeSplit)
+
+	//	Assert
+	if len(truncated) != 1 || len(truncated[0]) != limit || !strings.HasSuffix(truncated[0], cloudwatch.TruncatedMarker) {
+		t.Errorf("LimitEventSize - Expected the message truncated to %v bytes but got %v", limit, len(truncated[0]))
+	}
+
+	for i, part := range parts {
+		if len(part) > limit {
+			t.Errorf("LimitEventSize - Part %v is too big: %v bytes", i+1, len(part))
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package cloudwatch
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/danesparza/cloudjournal/metrics"
+	"github.com/danesparza/cloudjournal/retry"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// RetryAction is what to do about a failed PutLogEvents call
+type RetryAction int
+
+const (
+	// GiveUp means the call can't succeed by trying again
+	GiveUp RetryAction = iota
+
+	// RetryWithBackoff means the call should be tried again after a delay
+	RetryWithBackoff
+
+	// RefreshToken means the call should be tried again right away with the expected sequence token
+	RefreshToken
+
+	// TreatAsSuccess means the batch was already accepted
+	TreatAsSuccess
+)
+
+// String returns the name of the action, for logs
+func (action RetryAction) String() string {
+	switch action {
+	case RetryWithBackoff:
+		return "retry"
+	case RefreshToken:
+		return "refresh_token"
+	case TreatAsSuccess:
+		return "already_accepted"
+	default:
+		return "give_up"
+	}
+}
+
+// maxTokenRefreshes is how many times a batch is retried with a refreshed sequence token
+const maxTokenRefreshes = 3
+
+// expectedTokenPattern finds the expected sequence token in an error message like
+// "The given sequenceToken is invalid. The next expected sequenceToken is: 4963..."
+var expectedTokenPattern = regexp.MustCompile(`sequenceToken(?: is)?: (\S+)`)
+
+// ClassifyError decides what to do about a PutLogEvents error.  For sequence token
+// errors it also returns the sequence token CloudWatch expects next
+func ClassifyError(err error) (RetryAction, string) {
+	var invalidToken *cloudwatchlogs.InvalidSequenceTokenException
+	if errors.As(err, &invalidToken) && invalidToken.ExpectedSequenceToken != nil {
+		return RefreshToken, *invalidToken.ExpectedSequenceToken
+	}
+
+	var alreadyAccepted *cloudwatchlogs.DataAlreadyAcceptedException
+	if errors.As(err, &alreadyAccepted) && alreadyAccepted.ExpectedSequenceToken != nil {
+		return TreatAsSuccess, *alreadyAccepted.ExpectedSequenceToken
+	}
+
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case cloudwatchlogs.ErrCodeInvalidSequenceTokenException:
+			return RefreshToken, expectedToken(aerr.Message())
+
+		case cloudwatchlogs.ErrCodeDataAlreadyAcceptedException:
+			return TreatAsSuccess, expectedToken(aerr.Message())
+
+		case "ThrottlingException", cloudwatchlogs.ErrCodeServiceUnavailableException,
+			"ServiceUnavailable", "InternalFailure", request.ErrCodeRequestError,
+			request.ErrCodeResponseTimeout:
+			return RetryWithBackoff, ""
+		}
+
+		//	Network errors are usually wrapped by the SDK
+		var netErr net.Error
+		if errors.As(aerr.OrigErr(), &netErr) {
+			return RetryWithBackoff, ""
+		}
+
+		return GiveUp, ""
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return RetryWithBackoff, ""
+	}
+
+	return GiveUp, ""
+}
+
+// expectedToken gets the expected sequence token from an error message
+func expectedToken(message string) string {
+	if match := expectedTokenPattern.FindStringSubmatch(message); match != nil && match[1] != "null" {
+		return match[1]
+	}
+	return ""
+}
+
+// putLogEventsWithRetry sends a single batch, retrying according to ClassifyError.
+// It returns the sequence token to use for the next batch
+func (service *Service) putLogEventsWithRetry(svc LogsAPI, params *cloudwatchlogs.PutLogEventsInput) (string, error) {
+
+	maxRetries := viper.GetInt("cloudwatch.retries")
+	baseDelay, err := time.ParseDuration(viper.GetString("cloudwatch.retrydelay"))
+	if err != nil {
+		baseDelay = 500 * time.Millisecond
+	}
+	maxDelay, err := time.ParseDuration(viper.GetString("cloudwatch.maxretrydelay"))
+	if err != nil {
+		maxDelay = 30 * time.Second
+	}
+
+	retries := 0
+	refreshes := 0
+	for attempt := 0; ; attempt++ {
+		resp, err := svc.PutLogEvents(params)
+		if err == nil {
+			metrics.Add("cloudwatch.batches_sent", 1)
+			metrics.Add("cloudwatch.events_sent", int64(len(params.LogEvents)))
+			if resp.NextSequenceToken != nil {
+				return *resp.NextSequenceToken, nil
+			}
+			return "", nil
+		}
+
+		action, token := ClassifyError(err)
+		fields := log.Fields{
+			"groupName":  *params.LogGroupName,
+			"streamName": *params.LogStreamName,
+			"attempt":    attempt + 1,
+			"maxRetries": maxRetries,
+			"action":     action.String(),
+		}
+		metrics.Add("cloudwatch.errors."+action.String(), 1)
+
+		switch {
+		case action == TreatAsSuccess:
+			log.WithFields(fields).WithError(err).Info("cloudwatch says the batch was already accepted")
+			metrics.Add("cloudwatch.batches_sent", 1)
+			return token, nil
+
+		//	Token refreshes don't use up retries, but there is a limit in case
+		//	another writer keeps changing the token
+		case action == RefreshToken && refreshes < maxTokenRefreshes:
+			refreshes++
+			log.WithFields(fields).WithError(err).Warn("sequence token was out of date.  Retrying with the expected token")
+
+			//	If the error didn't tell us the expected token, look it up
+			if token == "" {
+				if logStream, err := service.describeStream(svc, *params.LogGroupName, *params.LogStreamName); err == nil && logStream != nil {
+					token = aws.StringValue(logStream.UploadSequenceToken)
+				}
+			}
+
+			if token != "" {
+				params.SequenceToken = &token
+			} else {
+				params.SequenceToken = nil
+			}
+
+		case action == RetryWithBackoff && retries < maxRetries:
+			delay := retry.Backoff(retries, baseDelay, maxDelay)
+			retries++
+			fields["delay"] = delay.String()
+			log.WithFields(fields).WithError(err).Warn("problem writing to cloudwatch logs.  Retrying")
+			time.Sleep(delay)
+
+		default:
+			log.WithFields(fields).WithError(err).Error("giving up writing to cloudwatch logs")
+			metrics.Add("cloudwatch.batches_failed", 1)
+			return "", err
+		}
+
+		metrics.Add("cloudwatch.retries", 1)
+	}
+}
@@ -0,0 +1,37 @@
+package cloudwatch_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/danesparza/cloudjournal/cloudwatch"
+)
+
+func TestRetry_ClassifyError_ReturnsExpectedActions(t *testing.T) {
+	//	Arrange
+	tests := []struct {
+		err           error
+		action        cloudwatch.RetryAction
+		expectedToken string
+	}{
+		{awserr.New("ThrottlingException", "Rate exceeded", nil), cloudwatch.RetryWithBackoff, ""},
+		{awserr.New("ServiceUnavailableException", "The service is unavailable", nil), cloudwatch.RetryWithBackoff, ""},
+		{awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection reset")), cloudwatch.RetryWithBackoff, ""},
+		{awserr.New("InvalidSequenceTokenException", "The given sequenceToken is invalid. The next expected sequenceToken is: 49612345", nil), cloudwatch.RefreshToken, "49612345"},
+		{awserr.New("DataAlreadyAcceptedException", "The given batch of log events has already been accepted. The next batch can be sent with sequenceToken: 49654321", nil), cloudwatch.TreatAsSuccess, "49654321"},
+		{awserr.New("InvalidParameterException", "Log events in a single PutLogEvents request must be in chronological order", nil), cloudwatch.GiveUp, ""},
+		{errors.New("something else"), cloudwatch.GiveUp, ""},
+	}
+
+	for _, test := range tests {
+		//	Act
+		action, token := cloudwatch.ClassifyError(test.err)
+
+		//	Assert
+		if action != test.action || token != test.expectedToken {
+			t.Errorf("ClassifyError(%v) - Expected %v/%q but got %v/%q", test.err, test.action, test.expectedToken, action, token)
+		}
+	}
+}
@@ -2,65 +2,187 @@ package cloudwatch
 
 import (
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/danesparza/cloudjournal/awssession"
 	"github.com/danesparza/cloudjournal/data"
+	"github.com/danesparza/cloudjournal/format"
+	"github.com/danesparza/cloudjournal/metrics"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
 	"github.com/danesparza/cloudjournal/journal"
 )
 
-// Service encapsulates cloudwatch session and operations
+// Service encapsulates cloudwatch session and operations.  The AWS session and
+// cloudwatch logs client are created the first time they're needed and reused after
+// that.  Credentials are cached by the session and refreshed by the SDK when they expire.
+// Log streams that are known to exist (and their sequence tokens) are cached too
 type Service struct {
 	DB *data.Manager
+
+	// MaxEventSize is the largest event shipped (see LimitEventSize).  It's
+	// cloudwatch.maxeventsize, clamped to the sizes CloudWatch accepts
+	MaxEventSize int
+
+	mu       sync.Mutex
+	client   LogsAPI
+	identity IdentityAPI
+	sess     *session.Session
+
+	streamsMu  sync.Mutex
+	streams    map[streamKey]streamState
+	reconciled map[string]bool
 }
 
-// GetAWSSession gets an AWS session to use with an operation
-func (service Service) GetAWSSession() (*session.Session, error) {
+// LogsAPI is the part of the cloudwatch logs API the Service uses.  It's
+// satisfied by *cloudwatchlogs.CloudWatchLogs and by cloudwatchtest.Logs
+type LogsAPI interface {
+	CreateLogGroup(input *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error)
+	CreateLogStream(input *cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error)
+	DescribeLogStreamsPages(input *cloudwatchlogs.DescribeLogStreamsInput, fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool) error
+	PutLogEvents(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error)
+	PutRetentionPolicy(input *cloudwatchlogs.PutRetentionPolicyInput) (*cloudwatchlogs.PutRetentionPolicyOutput, error)
+	TagLogGroup(input *cloudwatchlogs.TagLogGroupInput) (*cloudwatchlogs.TagLogGroupOutput, error)
+	AssociateKmsKey(input *cloudwatchlogs.AssociateKmsKeyInput) (*cloudwatchlogs.AssociateKmsKeyOutput, error)
+}
 
-	//	Get the configuration information for the AWS profile and region
-	awsProfileName := viper.GetString("cloudwatch.profile")
-	cloudwatchRegion := viper.GetString("cloudwatch.region")
+// IdentityAPI is the part of the STS API the Service uses to check credentials.  It's
+// satisfied by *sts.STS and by cloudwatchtest.Logs
+type IdentityAPI interface {
+	GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error)
+}
 
-	// Define the session - using SharedConfigState which forces file or env creds
-	// See https://docs.aws.amazon.com/sdk-for-go/v1/developer-guide/configuring-sdk.html for more information
-	sess, err := session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-		Config:            aws.Config{Region: aws.String(cloudwatchRegion)},
-		Profile:           awsProfileName, /* Specify the profile to use in the credentials file */
-	})
-	if err != nil {
+// NewService creates a new cloudwatch Service
+func NewService(db *data.Manager) *Service {
+	return &Service{DB: db, MaxEventSize: maxEventSizeFromConfig()}
+}
+
+// NewServiceWithClients creates a new cloudwatch Service that uses the given
+// clients instead of creating them from an AWS session.  This is mostly useful for tests
+func NewServiceWithClients(db *data.Manager, logs LogsAPI, identity IdentityAPI) *Service {
+	return &Service{DB: db, MaxEventSize: maxEventSizeFromConfig(), client: logs, identity: identity}
+}
+
+// maxEventSizeFromConfig gets cloudwatch.maxeventsize, clamped to the sizes CloudWatch accepts
+func maxEventSizeFromConfig() int {
+	maxEventSize := viper.GetInt("cloudwatch.maxeventsize")
+	retval := ClampMaxEventSize(maxEventSize)
+	if maxEventSize != 0 && retval != maxEventSize {
 		log.WithFields(log.Fields{
-			"cloudwatch.profile": awsProfileName,
-			"cloudwatch.region":  cloudwatchRegion,
-		}).WithError(err).Error("unable to create AWS session for cloudwatch logs")
-		return nil, err
+			"cloudwatch.maxeventsize": viper.GetString("cloudwatch.maxeventsize"),
+		}).Warnf("cloudwatch.maxeventsize must be from %v to %v.  Using %v", MinMaxEventSize, DefaultMaxEventSize, retval)
 	}
+	return retval
+}
+
+// GetAWSSession gets the AWS session to use with an operation.  It's created (by
+// awssession) the first time it's needed
+func (service *Service) GetAWSSession() (*session.Session, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
 
-	// Determine if we are authorized to access AWS with the credentials provided. This does not mean you have access to the
-	// services required however.
-	_, err = sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if service.sess != nil {
+		return service.sess, nil
+	}
+
+	sess, err := awssession.New()
 	if err != nil {
-		log.WithFields(log.Fields{
-			"cloudwatch.profile": awsProfileName,
-			"cloudwatch.region":  cloudwatchRegion,
-		}).WithError(err).Error("cannot validate aws credentials")
 		return nil, err
 	}
 
+	service.sess = sess
 	return sess, nil
 }
 
-// CreateLogGroup creates a cloudwatch log group
-func (service Service) CreateLogGroup(groupName string) error {
-	//	Get an AWS session
+// logsConfig is the client config for cloudwatch logs
+func logsConfig() *aws.Config {
+	config := aws.NewConfig()
+	if endpoint := viper.GetString("cloudwatch.endpoint"); endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	return config
+}
+
+// getClient gets the cloudwatch logs client, creating it the first time
+func (service *Service) getClient() (LogsAPI, error) {
+	service.mu.Lock()
+	client := service.client
+	service.mu.Unlock()
+
+	if client != nil {
+		return client, nil
+	}
+
+	sess, err := service.GetAWSSession()
+	if err != nil {
+		return nil, err
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if service.client == nil {
+		service.client = cloudwatchlogs.New(sess, logsConfig())
+	}
+
+	return service.client, nil
+}
+
+// getIdentityClient gets the STS client, creating it the first time
+func (service *Service) getIdentityClient() (IdentityAPI, error) {
+	service.mu.Lock()
+	identity := service.identity
+	service.mu.Unlock()
+
+	if identity != nil {
+		return identity, nil
+	}
+
 	sess, err := service.GetAWSSession()
+	if err != nil {
+		return nil, err
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if service.identity == nil {
+		service.identity = sts.New(sess, awssession.STSConfig())
+	}
+
+	return service.identity, nil
+}
+
+// HealthCheck determines if we are authorized to access AWS with the credentials provided.
+// This does not mean you have access to the services required however.
+func (service *Service) HealthCheck() error {
+	identity, err := service.getIdentityClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = identity.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cloudwatch.profile": viper.GetString("cloudwatch.profile"),
+			"cloudwatch.region":  viper.GetString("cloudwatch.region"),
+		}).WithError(err).Error("cannot validate aws credentials")
+		return err
+	}
+
+	return nil
+}
+
+// CreateLogGroup creates a cloudwatch log group with the tags, KMS key and retention in the options
+func (service *Service) CreateLogGroup(groupName string, options LogGroupOptions) error {
+	//	Get the cloudwatch logs client
+	svc, err := service.getClient()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"cloudwatch.group": groupName,
@@ -68,13 +190,18 @@ func (service Service) CreateLogGroup(groupName string) error {
 		return err
 	}
 
-	//	Create the cloudwatch logs service from the AWS session
-	svc := cloudwatchlogs.New(sess)
-
-	//	.... Create the stream
-	_, err = svc.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{
+	//	.... Create the group
+	input := &cloudwatchlogs.CreateLogGroupInput{
 		LogGroupName: aws.String(groupName),
-	})
+	}
+	if len(options.Tags) > 0 {
+		input.Tags = aws.StringMap(options.Tags)
+	}
+	if options.KMSKeyID != "" {
+		input.KmsKeyId = aws.String(options.KMSKeyID)
+	}
+
+	_, err = svc.CreateLogGroup(input)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"cloudwatch.group": groupName,
@@ -82,14 +209,18 @@ func (service Service) CreateLogGroup(groupName string) error {
 		return err
 	}
 
+	//	New groups don't have a retention policy.  There's nothing else to reconcile
+	service.applyLogGroupOptions(svc, groupName, options, false)
+	service.markReconciled(groupName)
+
 	return nil
 }
 
 // CreateLogStream creates a cloudwatch log stream
-func (service Service) CreateLogStream(groupName, streamName string) error {
+func (service *Service) CreateLogStream(groupName, streamName string) error {
 
-	//	Get an AWS session
-	sess, err := service.GetAWSSession()
+	//	Get the cloudwatch logs client
+	svc, err := service.getClient()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"streamName": streamName,
@@ -97,9 +228,6 @@ func (service Service) CreateLogStream(groupName, streamName string) error {
 		return err
 	}
 
-	//	Create the cloudwatch logs service from the AWS session
-	svc := cloudwatchlogs.New(sess)
-
 	//	.... Create the stream
 	_, err = svc.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
 		LogGroupName:  aws.String(groupName),
@@ -116,10 +244,11 @@ func (service Service) CreateLogStream(groupName, streamName string) error {
 	return nil
 }
 
-// WriteToLog writes the journal entries to the cloudwatch log stream for the tokens
+// WriteToLog writes the journal entries to the cloudwatch log stream.  If the log group
+// doesn't exist, it's created with the options
 // Might want to handle errors similarly to
 // https://github.com/devops-genuine/opentelemetry-collector-contrib/blob/e38594a148080bd0b102281b830505c4acb1b736/exporter/awsemfexporter/cwlog_client.go#L84-L118
-func (service Service) WriteToLog(groupName, streamName string, entries []journal.Entry) error {
+func (service *Service) WriteToLog(groupName, streamName string, options LogGroupOptions, entries []journal.Entry) error {
 
 	log.WithFields(log.Fields{
 		"groupName":  groupName,
@@ -127,8 +256,8 @@ func (service Service) WriteToLog(groupName, streamName string, entries []journa
 		"founditems": len(entries),
 	}).Debug("requested write of items to cloudwatch logs")
 
-	//	Get an AWS session
-	sess, err := service.GetAWSSession()
+	//	Get the cloudwatch logs client
+	svc, err := service.getClient()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"groupName":  groupName,
@@ -137,80 +266,18 @@ func (service Service) WriteToLog(groupName, streamName string, entries []journa
 		return err
 	}
 
-	//	Create the cloudwatch logs service from the AWS session
-	svc := cloudwatchlogs.New(sess)
-
-	//	See if the log stream exists already
-	resp, err := svc.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
-		LogGroupName:        aws.String(groupName),
-		LogStreamNamePrefix: aws.String(streamName),
-	})
-
-	//	If we got an error (or if we appear to have no log streams)...
+	//	Make sure the log group and stream exist, and get the sequence token to use
+	nextSequenceToken, err := service.ensureStream(svc, groupName, streamName, options)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			//	If it's because the log information doesn't exist ...
-			case cloudwatchlogs.ErrCodeResourceNotFoundException:
-				log.WithFields(log.Fields{
-					"aerr.code":    aerr.Code(),
-					"aerr.message": aerr.Message(),
-				}).WithError(err).Info("describe log streams says the resource doesn't exist.  Creating the log group and log stream")
-
-				//	Create the log group
-				err = service.CreateLogGroup(groupName)
-				if err != nil {
-					log.WithError(err).Error("problem creating log group")
-				}
-
-				//	Create the log stream
-				err = service.CreateLogStream(groupName, streamName)
-				if err != nil {
-					log.WithError(err).Error("problem creating log stream")
-				}
-
-			default:
-				log.WithFields(log.Fields{
-					"aerr.code":    aerr.Code(),
-					"aerr.message": aerr.Message(),
-				}).WithError(err).Error("some other aws error is happening")
-			}
-		}
+		return err
 	}
 
-	//	If we don't have log streams...
-	if len(resp.LogStreams) < 1 {
-		log.WithFields(log.Fields{
-			"streamName": streamName,
-			"groupName":  groupName,
-		}).Debug("we appear to have no log stream.  Attempting to create")
-
-		//	Create the log stream
-		err = service.CreateLogStream(groupName, streamName)
-		if err != nil {
-			log.WithError(err).Error("problem creating log stream")
-		}
-	}
-
-	//	Get the next sequence token if it's available
-	nextSequenceToken := ""
-	if len(resp.LogStreams) > 0 {
-		if resp.LogStreams[0].UploadSequenceToken != nil {
-			nextSequenceToken = *resp.LogStreams[0].UploadSequenceToken
-			log.WithFields(log.Fields{
-				"streamName":        streamName,
-				"groupName":         groupName,
-				"nextSequenceToken": nextSequenceToken,
-				"logStreamName":     *resp.LogStreams[0].LogStreamName,
-			}).Debug("found next sequence token for logstream")
-		} else {
-			log.WithFields(log.Fields{
-				"streamName":    streamName,
-				"groupName":     groupName,
-				"logStreamName": *resp.LogStreams[0].LogStreamName,
-			}).Debug("we found a logstream, but don't have a sequence token")
-		}
-	}
+	//	Get how messages should be formatted, and what to do with messages that are too big
+	formatter := format.NewFormatterFromConfig()
+	maxEventSize := service.MaxEventSize
+	oversizePolicy := viper.GetString("cloudwatch.oversize")
+	oversizeCount := 0
+	droppedCount := 0
 
 	// Create cloudwatch log events from our entries
 	events := []*cloudwatchlogs.InputLogEvent{}
@@ -230,50 +297,94 @@ func (service Service) WriteToLog(groupName, streamName string, entries []journa
 		//	Format the timestamp
 		formattedTimestamp := int64(time.Microsecond) * timestamp / int64(time.Millisecond)
 
+		//	Format the message
+		message := formatter.Format(entry)
+
 		log.WithFields(log.Fields{
 			"streamName": streamName,
 			"tstamp":     formattedTimestamp,
-			"message":    entry.Message,
+			"message":    message,
 			"groupName":  groupName,
 		}).Debug("adding log event")
 
-		//	Add the event
-		event := &cloudwatchlogs.InputLogEvent{
-			Message:   aws.String(entry.Message),
-			Timestamp: aws.Int64(formattedTimestamp),
+		//	Make sure the message isn't too big
+		messages := LimitEventSize(message, maxEventSize, oversizePolicy)
+		if len(messages) != 1 || messages[0] != message {
+			oversizeCount++
+		}
+		if len(messages) == 0 {
+			droppedCount++
 		}
 
-		events = append(events, event)
-	}
+		//	Add the event (or events)
+		for _, eventMessage := range messages {
+			event := &cloudwatchlogs.InputLogEvent{
+				Message:   aws.String(eventMessage),
+				Timestamp: aws.Int64(formattedTimestamp),
+			}
 
-	//	Format our log request
-	params := &cloudwatchlogs.PutLogEventsInput{
-		LogEvents:     events,
-		LogGroupName:  aws.String(groupName),
-		LogStreamName: aws.String(streamName),
+			events = append(events, event)
+		}
 	}
 
-	//	If we have a sequence token, use it:
-	if len(nextSequenceToken) > 0 {
-		params.SequenceToken = &nextSequenceToken
+	if oversizeCount > 0 {
+		metrics.Add("cloudwatch.events_oversize", int64(oversizeCount))
+		metrics.Add("cloudwatch.events_dropped", int64(droppedCount))
+		log.WithFields(log.Fields{
+			"streamName":              streamName,
+			"groupName":               groupName,
+			"oversizeCount":           oversizeCount,
+			"droppedCount":            droppedCount,
+			"cloudwatch.oversize":     oversizePolicy,
+			"cloudwatch.maxeventsize": maxEventSize,
+		}).Warn("found log events that were too big")
 	}
 
-	//	Log our events
-	log.WithFields(log.Fields{
-		"streamName":        streamName,
-		"nextSequenceToken": nextSequenceToken,
-		"groupName":         groupName,
-		"eventCount":        len(params.LogEvents),
-	}).Debug("writing to cloudwatch logs...")
+	//	Split the events into batches within the PutLogEvents limits, and send them in order.
+	//	We only report success once every batch has been accepted
+	batches := SplitBatches(events)
+	for batchNumber, batch := range batches {
 
-	_, err = svc.PutLogEvents(params)
-	if err != nil {
+		//	Format our log request
+		params := &cloudwatchlogs.PutLogEventsInput{
+			LogEvents:     batch,
+			LogGroupName:  aws.String(groupName),
+			LogStreamName: aws.String(streamName),
+		}
+
+		//	If we have a sequence token, use it:
+		if len(nextSequenceToken) > 0 {
+			params.SequenceToken = aws.String(nextSequenceToken)
+		}
+
+		//	Log our events
 		log.WithFields(log.Fields{
 			"streamName":        streamName,
 			"nextSequenceToken": nextSequenceToken,
 			"groupName":         groupName,
-		}).WithError(err).Error("problem writing to cloudwatch logs")
-		return err
+			"eventCount":        len(params.LogEvents),
+			"batch":             batchNumber + 1,
+			"batchCount":        len(batches),
+		}).Debug("writing to cloudwatch logs...")
+
+		token, err := service.putLogEventsWithRetry(svc, params)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"streamName":        streamName,
+				"nextSequenceToken": nextSequenceToken,
+				"groupName":         groupName,
+				"batch":             batchNumber + 1,
+				"batchCount":        len(batches),
+			}).WithError(err).Error("problem writing to cloudwatch logs")
+
+			//	We don't know the state of the stream anymore.  Look it up again next time
+			service.forgetStream(groupName, streamName)
+			return err
+		}
+
+		//	The next batch (and the next write) needs the sequence token from this one
+		nextSequenceToken = token
+		service.rememberStream(groupName, streamName, nextSequenceToken)
 	}
 
 	return nil
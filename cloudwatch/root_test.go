@@ -0,0 +1,219 @@
+package cloudwatch_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/danesparza/cloudjournal/awssession"
+	"github.com/danesparza/cloudjournal/cloudwatch"
+	"github.com/danesparza/cloudjournal/cloudwatch/cloudwatchtest"
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/spf13/viper"
+)
+
+func testEntries(messages ...string) []journal.Entry {
+	entries := []journal.Entry{}
+	for i, message := range messages {
+		entries = append(entries, journal.Entry{
+			RealtimeTimestamp: fmt.Sprintf("%d", 1636000000000000+int64(i)*1000),
+			Message:           journal.NewField(message),
+		})
+	}
+	return entries
+}
+
+// useTestServer points the cloudwatch config at a local test server, with test credentials
+// in the environment.  Env credentials have to be asked for, because a profile is set.  The server and config are cleaned up when the test ends
+func useTestServer(t *testing.T) (*cloudwatchtest.Logs, *cloudwatchtest.Server) {
+	fake := cloudwatchtest.NewLogs()
+	server := cloudwatchtest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDCLOUDJOURNALTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	viper.Set("cloudwatch.endpoint", server.URL)
+	viper.Set("cloudwatch.sts_endpoint", server.URL)
+	viper.Set("cloudwatch.region", "us-east-1")
+	viper.Set("cloudwatch.profile", "cloudjournal")
+	viper.Set("cloudwatch.credentials", awssession.CredentialsEnv)
+	t.Cleanup(viper.Reset)
+
+	return fake, server
+}
+
+func TestRoot_WriteToLog_NoGroup_CreatesGroupAndStream(t *testing.T) {
+	//	Arrange
+	fake := cloudwatchtest.NewLogs()
+	service := cloudwatch.NewServiceWithClients(nil, fake, fake)
+
+	//	Act
+	err := service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("one", "two"))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("WriteToLog - Should execute without error, but got: %s", err)
+	}
+
+	if messages := fake.Messages("/app/cloudjournal/cron", "host"); len(messages) != 2 || messages[0] != "one" {
+		t.Errorf("WriteToLog - Expected both messages in the new stream, but got %v", messages)
+	}
+}
+
+func TestRoot_WriteToLog_SecondWrite_UsesCachedStream(t *testing.T) {
+	//	Arrange
+	fake := cloudwatchtest.NewLogs()
+	service := cloudwatch.NewServiceWithClients(nil, fake, fake)
+	service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("one"))
+
+	//	Act
+	err := service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("two"))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("WriteToLog - Should execute without error, but got: %s", err)
+	}
+
+	if calls := fake.Calls(cloudwatchtest.OpDescribeLogStreams); calls != 1 {
+		t.Errorf("WriteToLog - Expected the stream to be described once, but it was described %v times", calls)
+	}
+
+	if messages := fake.Messages("/app/cloudjournal/cron", "host"); len(messages) != 2 {
+		t.Errorf("WriteToLog - Expected 2 messages, but got %v", messages)
+	}
+}
+
+func TestRoot_WriteToLog_PrefixMatch_UsesExactStream(t *testing.T) {
+	//	Arrange - a stream that starts with the same name shouldn't be used
+	fake := cloudwatchtest.NewLogs()
+	fake.AddLogStream("/app/cloudjournal/cron", "host-2")
+	fake.AdvanceSequenceToken("/app/cloudjournal/cron", "host-2")
+	service := cloudwatch.NewServiceWithClients(nil, fake, fake)
+
+	//	Act
+	err := service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("one"))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("WriteToLog - Should execute without error, but got: %s", err)
+	}
+
+	if !fake.HasLogStream("/app/cloudjournal/cron", "host") {
+		t.Errorf("WriteToLog - Expected the stream to be created")
+	}
+
+	if messages := fake.Messages("/app/cloudjournal/cron", "host-2"); len(messages) != 0 {
+		t.Errorf("WriteToLog - Expected nothing written to the other stream, but got %v", messages)
+	}
+}
+
+func TestRoot_WriteToLog_StaleToken_RefreshesToken(t *testing.T) {
+	//	Arrange - another writer changes the token after our first write
+	fake := cloudwatchtest.NewLogs()
+	service := cloudwatch.NewServiceWithClients(nil, fake, fake)
+	service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("one"))
+	fake.AdvanceSequenceToken("/app/cloudjournal/cron", "host")
+
+	//	Act
+	err := service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("two"))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("WriteToLog - Should execute without error, but got: %s", err)
+	}
+
+	if messages := fake.Messages("/app/cloudjournal/cron", "host"); len(messages) != 2 || messages[1] != "two" {
+		t.Errorf("WriteToLog - Expected the second message after refreshing the token, but got %v", messages)
+	}
+}
+
+func TestRoot_WriteToLog_Throttled_Retries(t *testing.T) {
+	//	Arrange
+	viper.Set("cloudwatch.retries", 2)
+	viper.Set("cloudwatch.retrydelay", "1ms")
+	t.Cleanup(viper.Reset)
+
+	fake := cloudwatchtest.NewLogs()
+	fake.FailNext(cloudwatchtest.OpPutLogEvents, awserr.New("ThrottlingException", "Rate exceeded", nil))
+	service := cloudwatch.NewServiceWithClients(nil, fake, fake)
+
+	//	Act
+	err := service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("one"))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("WriteToLog - Should execute without error, but got: %s", err)
+	}
+
+	if calls := fake.Calls(cloudwatchtest.OpPutLogEvents); calls != 2 {
+		t.Errorf("WriteToLog - Expected 2 calls to PutLogEvents, but got %v", calls)
+	}
+}
+
+func TestRoot_WriteToLog_StreamDeleted_RecreatesOnNextWrite(t *testing.T) {
+	//	Arrange
+	fake := cloudwatchtest.NewLogs()
+	service := cloudwatch.NewServiceWithClients(nil, fake, fake)
+	service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("one"))
+	fake.DeleteLogStream("/app/cloudjournal/cron", "host")
+
+	//	Act
+	failedErr := service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("two"))
+	err := service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("two"))
+
+	//	Assert
+	if failedErr == nil {
+		t.Errorf("WriteToLog - Expected an error writing to the deleted stream")
+	}
+
+	if err != nil {
+		t.Fatalf("WriteToLog - Should execute without error after the failure, but got: %s", err)
+	}
+
+	if messages := fake.Messages("/app/cloudjournal/cron", "host"); len(messages) != 1 || messages[0] != "two" {
+		t.Errorf("WriteToLog - Expected the message in the recreated stream, but got %v", messages)
+	}
+}
+
+func TestRoot_HealthCheck_IdentityFails_ReturnsError(t *testing.T) {
+	//	Arrange
+	fake := cloudwatchtest.NewLogs()
+	fake.FailNext(cloudwatchtest.OpGetCallerIdentity, awserr.New("ExpiredToken", "The security token included in the request is expired", nil))
+	service := cloudwatch.NewServiceWithClients(nil, fake, fake)
+
+	//	Act
+	err := service.HealthCheck()
+
+	//	Assert
+	if err == nil {
+		t.Errorf("HealthCheck - Expected an error")
+	}
+
+	if err := service.HealthCheck(); err != nil {
+		t.Errorf("HealthCheck - Expected the next check to succeed, but got: %s", err)
+	}
+}
+
+func TestRoot_WriteToLog_ThroughEndpoint_RefreshesStaleToken(t *testing.T) {
+	//	Arrange - talk to a local server instead of AWS
+	fake, _ := useTestServer(t)
+
+	service := cloudwatch.NewService(nil)
+	service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("one"))
+	fake.AdvanceSequenceToken("/app/cloudjournal/cron", "host")
+
+	//	Act
+	err := service.WriteToLog("/app/cloudjournal/cron", "host", cloudwatch.LogGroupOptions{}, testEntries("two"))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("WriteToLog - Should execute without error, but got: %s", err)
+	}
+
+	if messages := fake.Messages("/app/cloudjournal/cron", "host"); len(messages) != 2 || messages[1] != "two" {
+		t.Errorf("WriteToLog - Expected both messages through the server, but got %v", messages)
+	}
+}
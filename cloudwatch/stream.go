@@ -0,0 +1,188 @@
+package cloudwatch
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/danesparza/cloudjournal/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// streamKey is the cache key for a log stream in a log group
+type streamKey struct {
+	group  string
+	stream string
+}
+
+// streamState is what we know about a log stream that we know exists
+type streamState struct {
+	sequenceToken string
+}
+
+// cachedStream gets what we know about a log stream, from memory first and then
+// (if cloudwatch.persisttokens is set) from the system database
+func (service *Service) cachedStream(groupName, streamName string) (streamState, bool) {
+	service.streamsMu.Lock()
+	state, ok := service.streams[streamKey{groupName, streamName}]
+	service.streamsMu.Unlock()
+
+	if ok {
+		metrics.Add("cloudwatch.stream_cache_hits", 1)
+		return state, true
+	}
+
+	if service.DB != nil && viper.GetBool("cloudwatch.persisttokens") {
+		saved, err := service.DB.GetStreamState(groupName, streamName)
+		if err == nil {
+			metrics.Add("cloudwatch.stream_cache_hits", 1)
+			state = streamState{sequenceToken: saved.SequenceToken}
+			service.setStream(groupName, streamName, state)
+			return state, true
+		}
+
+		if err != buntdb.ErrNotFound {
+			log.WithFields(log.Fields{
+				"groupName":  groupName,
+				"streamName": streamName,
+			}).WithError(err).Error("problem trying to get saved state for log stream")
+		}
+	}
+
+	metrics.Add("cloudwatch.stream_cache_misses", 1)
+	return streamState{}, false
+}
+
+// rememberStream records that a log stream exists and the sequence token to use next
+func (service *Service) rememberStream(groupName, streamName, sequenceToken string) {
+	service.setStream(groupName, streamName, streamState{sequenceToken: sequenceToken})
+
+	if service.DB != nil && viper.GetBool("cloudwatch.persisttokens") {
+		if _, err := service.DB.UpdateStreamState(groupName, streamName, sequenceToken); err != nil {
+			log.WithFields(log.Fields{
+				"groupName":  groupName,
+				"streamName": streamName,
+			}).WithError(err).Error("problem trying to save state for log stream")
+		}
+	}
+}
+
+// forgetStream removes a log stream from the cache, so the next write looks it up again
+func (service *Service) forgetStream(groupName, streamName string) {
+	service.streamsMu.Lock()
+	delete(service.streams, streamKey{groupName, streamName})
+	service.streamsMu.Unlock()
+
+	if service.DB != nil && viper.GetBool("cloudwatch.persisttokens") {
+		if err := service.DB.DeleteStreamState(groupName, streamName); err != nil {
+			log.WithFields(log.Fields{
+				"groupName":  groupName,
+				"streamName": streamName,
+			}).WithError(err).Error("problem trying to remove saved state for log stream")
+		}
+	}
+}
+
+// setStream sets the in-memory state for a log stream
+func (service *Service) setStream(groupName, streamName string, state streamState) {
+	service.streamsMu.Lock()
+	defer service.streamsMu.Unlock()
+
+	if service.streams == nil {
+		service.streams = make(map[streamKey]streamState)
+	}
+	service.streams[streamKey{groupName, streamName}] = state
+}
+
+// describeStream finds the log stream with exactly the given name.  DescribeLogStreams only
+// matches on a prefix, so other streams (like 'unit-old' for 'unit') are skipped.
+// It returns nil if the group exists but the stream doesn't
+func (service *Service) describeStream(svc LogsAPI, groupName, streamName string) (*cloudwatchlogs.LogStream, error) {
+	metrics.Add("cloudwatch.describe_calls", 1)
+
+	var found *cloudwatchlogs.LogStream
+	err := svc.DescribeLogStreamsPages(&cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(groupName),
+		LogStreamNamePrefix: aws.String(streamName),
+	}, func(page *cloudwatchlogs.DescribeLogStreamsOutput, lastPage bool) bool {
+		for _, logStream := range page.LogStreams {
+			if aws.StringValue(logStream.LogStreamName) == streamName {
+				found = logStream
+				return false
+			}
+		}
+		return true
+	})
+
+	return found, err
+}
+
+// ensureStream makes sure the log group and log stream exist, and returns the sequence
+// token to use for the next write.  Cloudwatch is only asked when the stream isn't cached
+func (service *Service) ensureStream(svc LogsAPI, groupName, streamName string, options LogGroupOptions) (string, error) {
+	if state, ok := service.cachedStream(groupName, streamName); ok {
+		service.reconcileLogGroup(svc, groupName, options)
+		return state.sequenceToken, nil
+	}
+
+	logStream, err := service.describeStream(svc, groupName, streamName)
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != cloudwatchlogs.ErrCodeResourceNotFoundException {
+			log.WithFields(log.Fields{
+				"groupName":  groupName,
+				"streamName": streamName,
+			}).WithError(err).Error("problem describing log streams")
+			return "", err
+		}
+
+		//	The log group doesn't exist
+		log.WithFields(log.Fields{
+			"groupName":  groupName,
+			"streamName": streamName,
+		}).Info("describe log streams says the log group doesn't exist.  Creating the log group and log stream")
+
+		if err := service.CreateLogGroup(groupName, options); err != nil && !isAlreadyExists(err) {
+			return "", err
+		}
+	}
+
+	//	The log group exists now.  New groups already have their settings
+	service.reconcileLogGroup(svc, groupName, options)
+
+	//	If we found the stream, use its sequence token.  Otherwise create it
+	sequenceToken := ""
+	if logStream != nil {
+		sequenceToken = aws.StringValue(logStream.UploadSequenceToken)
+		log.WithFields(log.Fields{
+			"streamName":        streamName,
+			"groupName":         groupName,
+			"nextSequenceToken": sequenceToken,
+		}).Debug("found log stream")
+	} else {
+		log.WithFields(log.Fields{
+			"streamName": streamName,
+			"groupName":  groupName,
+		}).Debug("we appear to have no log stream.  Attempting to create")
+
+		if err := service.CreateLogStream(groupName, streamName); err != nil && !isAlreadyExists(err) {
+			return "", err
+		}
+	}
+
+	service.rememberStream(groupName, streamName, sequenceToken)
+	return sequenceToken, nil
+}
+
+// isAlreadyExists returns true if the error says the resource already exists
+func isAlreadyExists(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == cloudwatchlogs.ErrCodeResourceAlreadyExistsException
+}
+
+// isNotFound returns true if the error says the log group or log stream doesn't exist
+func isNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException
+}
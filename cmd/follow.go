@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danesparza/cloudjournal/data"
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/sink"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// followRestartDelay is how long to wait before restarting a follower that stopped
+const followRestartDelay = 10 * time.Second
+
+// followUnits starts a follower for each unit and blocks until the context is cancelled
+func followUnits(ctx context.Context, units []string, out sink.Sink, db *data.Manager, tokens map[string]string) {
+
+	batchSize := viper.GetInt("monitor.batchsize")
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	linger, err := time.ParseDuration(viper.GetString("monitor.linger"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"monitor.linger": viper.GetString("monitor.linger"),
+		}).WithError(err).Error("problem converting linger to a duration.  Using 5s")
+		linger = 5 * time.Second
+	}
+
+	var wg sync.WaitGroup
+	for _, unit := range units {
+		unit = strings.TrimSpace(unit)
+
+		//	Each follower gets its own copy of the tokens
+		unitTokens := make(map[string]string)
+		for key, value := range tokens {
+			unitTokens[key] = value
+		}
+		unitTokens["{unit}"] = unit
+
+		wg.Add(1)
+		go func(unit string, unitTokens map[string]string) {
+			defer wg.Done()
+			followUnit(ctx, unit, out, db, unitTokens, batchSize, linger)
+		}(unit, unitTokens)
+	}
+
+	wg.Wait()
+}
+
+// followUnit follows the journal for a single unit, restarting from the last saved
+// cursor (or after the buffered entries) whenever the follower stops or a batch can't
+// be written
+func followUnit(ctx context.Context, unit string, out sink.Sink, db *data.Manager, tokens map[string]string, batchSize int, linger time.Duration) {
+
+	//	Where we've read the journal up to, when it's past the saved cursor because a sink
+	//	has buffered the entries.  A restart carries on from here, so the buffered entries
+	//	aren't written again
+	buffered := ""
+
+	for {
+		//	Get the state for the unit
+		unitState, err := db.GetLogStateForUnit(unit)
+		if err != nil && err != buntdb.ErrNotFound {
+			log.WithFields(log.Fields{
+				"unit": unit,
+			}).WithError(err).Error("problem trying to get state for unit")
+		}
+
+		cursor := unitState.LastCursor
+		if buffered != "" {
+			cursor = buffered
+		}
+
+		followCtx, stop := context.WithCancel(ctx)
+		entries := make(chan journal.Entry, batchSize)
+		followErr := make(chan error, 1)
+		go func() {
+			followErr <- journal.Follow(followCtx, unit, cursor, entries)
+		}()
+
+		//	Write a batch to the log and checkpoint the cursor.  If a sink buffered the
+		//	entries, the cursor is saved once they're shipped
+		flush := func(batch []journal.Entry) error {
+			isBuffered, err := shipBatch(out, db, unit, tokens, batch)
+			if err != nil {
+				return err
+			}
+
+			buffered = ""
+			if isBuffered {
+				buffered = batch[len(batch)-1].Cursor
+			}
+			return nil
+		}
+
+		//	Ship the buffered entries once they're due
+		idle := func() {
+			if buffered != "" && flushBuffered(out, db, unit, buffered, false) {
+				buffered = ""
+			}
+		}
+
+		err = shipBatches(followCtx, entries, flush, idle, batchSize, linger)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"unit": unit,
+				"sink": out.Name(),
+			}).WithError(err).Error("problem writing to log.  Restarting from the last saved cursor")
+		}
+
+		//	Stop the follower and wait for it to finish
+		stop()
+		for range entries {
+		}
+		if ferr := <-followErr; ferr != nil && ctx.Err() == nil {
+			log.WithFields(log.Fields{
+				"unit": unit,
+			}).WithError(ferr).Error("journal follower stopped.  Restarting from the last saved cursor")
+		}
+
+		select {
+		case <-ctx.Done():
+			//	Ship anything that's buffered before we go
+			if buffered != "" {
+				flushBuffered(out, db, unit, buffered, true)
+			}
+			return
+		case <-time.After(followRestartDelay):
+		}
+	}
+}
+
+// shipBatch writes a batch to the log and saves the unit's cursor.  If a sink buffered the
+// entries it returns true, and the cursor isn't saved until they're shipped
+func shipBatch(out sink.Sink, db *data.Manager, unit string, tokens map[string]string, batch []journal.Entry) (bool, error) {
+	err := out.Write(sink.Batch{Unit: unit, Tokens: tokens, Entries: batch})
+	if errors.Is(err, sink.ErrBuffered) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	saveLogState(db, unit, batch[len(batch)-1].Cursor)
+	return false, nil
+}
+
+// shipBatches collects entries into batches and flushes a batch when it reaches
+// batchSize or when linger has passed since its first entry arrived.  idle is called
+// every linger while there's no batch, so sinks can ship entries they buffered.  It
+// returns when the entries channel is closed or a flush fails
+func shipBatches(ctx context.Context, entries <-chan journal.Entry, flush func([]journal.Entry) error, idle func(), batchSize int, linger time.Duration) error {
+
+	batch := []journal.Entry{}
+	timer := time.NewTimer(linger)
+
+	//	Stop the timer, and drain it if it already fired, so a stale tick can't
+	//	flush the next batch early
+	stopTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+	stopTimer()
+
+	//	A linger of 0 ships every entry right away, but buffered entries are still only
+	//	checked every second
+	idleInterval := linger
+	if idleInterval <= 0 {
+		idleInterval = time.Second
+	}
+	ticker := time.NewTicker(idleInterval)
+	defer ticker.Stop()
+
+	//	Flush whatever we have and start a new batch
+	flushBatch := func() error {
+		stopTimer()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := flush(batch); err != nil {
+			return err
+		}
+		batch = []journal.Entry{}
+		return nil
+	}
+
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				return flushBatch()
+			}
+
+			batch = append(batch, entry)
+			if len(batch) == 1 {
+				timer.Reset(linger)
+			}
+
+			if len(batch) >= batchSize {
+				if err := flushBatch(); err != nil {
+					return err
+				}
+			}
+
+		case <-timer.C:
+			if err := flushBatch(); err != nil {
+				return err
+			}
+
+		case <-ticker.C:
+			if len(batch) == 0 {
+				idle()
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/danesparza/cloudjournal/cloudwatch/cloudwatchtest"
+	"github.com/danesparza/cloudjournal/journal"
+)
+
+// sendEntries sends entries c<first> to c<last>
+func sendEntries(entries chan<- journal.Entry, first, last int) {
+	for i := first; i <= last; i++ {
+		entries <- journal.Entry{
+			Cursor:            fmt.Sprintf("c%d", i),
+			RealtimeTimestamp: fmt.Sprintf("%d", 1636000000000000+int64(i)*1000),
+			Message:           journal.NewField(fmt.Sprintf("message %d", i)),
+		}
+	}
+}
+
+// recordBatches returns a flush that records the size of each batch on a channel
+func recordBatches() (func([]journal.Entry) error, chan int) {
+	sizes := make(chan int, 100)
+	return func(batch []journal.Entry) error {
+		sizes <- len(batch)
+		return nil
+	}, sizes
+}
+
+func TestFollow_ShipBatches_FlushesOnBatchSize(t *testing.T) {
+	//	Arrange
+	entries := make(chan journal.Entry, 10)
+	flush, sizes := recordBatches()
+	sendEntries(entries, 1, 7)
+	close(entries)
+
+	//	Act
+	err := shipBatches(context.Background(), entries, flush, func() {}, 3, time.Hour)
+
+	//	Assert
+	close(sizes)
+	got := []int{}
+	for size := range sizes {
+		got = append(got, size)
+	}
+	if err != nil || fmt.Sprint(got) != "[3 3 1]" {
+		t.Errorf("shipBatches - Expected batches of 3, 3 and 1, but got %v (%v)", got, err)
+	}
+}
+
+func TestFollow_ShipBatches_FlushesOnLinger(t *testing.T) {
+	//	Arrange
+	entries := make(chan journal.Entry, 10)
+	flush, sizes := recordBatches()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go shipBatches(ctx, entries, flush, func() {}, 100, 20*time.Millisecond)
+
+	//	Act
+	sendEntries(entries, 1, 2)
+
+	//	Assert
+	select {
+	case size := <-sizes:
+		if size != 2 {
+			t.Errorf("shipBatches - Expected a batch of 2 after linger, but got %d", size)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("shipBatches - Expected a batch to be flushed after linger")
+	}
+}
+
+func TestFollow_ShipBatches_AfterFullBatch_NextBatchLingers(t *testing.T) {
+	//	Arrange
+	entries := make(chan journal.Entry, 10)
+	flush, sizes := recordBatches()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go shipBatches(ctx, entries, flush, func() {}, 2, 30*time.Millisecond)
+
+	//	Act
+	sendEntries(entries, 1, 2)
+	<-sizes
+	sendEntries(entries, 3, 3)
+	sent := time.Now()
+	size := <-sizes
+
+	//	Assert
+	if waited := time.Since(sent); size != 1 || waited < 25*time.Millisecond {
+		t.Errorf("shipBatches - Expected the next batch to linger, but it was flushed after %v", waited)
+	}
+}
+
+func TestFollow_ShipBatches_FlushFails_ReturnsError(t *testing.T) {
+	//	Arrange
+	entries := make(chan journal.Entry, 10)
+	flushes := 0
+	flush := func(batch []journal.Entry) error {
+		flushes++
+		return errors.New("sink is down")
+	}
+	sendEntries(entries, 1, 4)
+	close(entries)
+
+	//	Act
+	err := shipBatches(context.Background(), entries, flush, func() {}, 2, time.Hour)
+
+	//	Assert
+	if err == nil || flushes != 1 {
+		t.Errorf("shipBatches - Expected to stop at the first failed flush, but got %d flushes (%v)", flushes, err)
+	}
+}
+
+func TestFollow_ShipBatches_Cancelled_Returns(t *testing.T) {
+	//	Arrange
+	entries := make(chan journal.Entry, 10)
+	flush, sizes := recordBatches()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- shipBatches(ctx, entries, flush, func() {}, 100, time.Hour) }()
+	sendEntries(entries, 1, 2)
+
+	//	Act
+	cancel()
+
+	//	Assert
+	select {
+	case err := <-done:
+		if err != nil || len(sizes) != 0 {
+			t.Errorf("shipBatches - Expected to stop without flushing, but got %d flushes (%v)", len(sizes), err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("shipBatches - Expected to return when the context is cancelled")
+	}
+}
+
+func TestFollow_ShipBatch_WriteFails_KeepsCursor(t *testing.T) {
+	//	Arrange
+	out, db, fake := testSink(t)
+	fake.FailNext(cloudwatchtest.OpPutLogEvents, nil)
+	fake.FailNext(cloudwatchtest.OpPutLogEvents, awserr.New("AccessDeniedException", "not authorized", nil))
+	entries := make(chan journal.Entry, 10)
+	sendEntries(entries, 1, 4)
+	close(entries)
+	batch := []journal.Entry{}
+	for entry := range entries {
+		batch = append(batch, entry)
+	}
+
+	//	Act
+	_, first := shipBatch(out, db, "cron", testTokens, batch[:2])
+	_, second := shipBatch(out, db, "cron", testTokens, batch[2:])
+
+	//	Assert
+	state, err := db.GetLogStateForUnit("cron")
+	if first != nil || second == nil || err != nil || state.LastCursor != "c2" {
+		t.Errorf("shipBatch - Expected the cursor from the first batch to be saved, but got %q (%v, %v, %v)", state.LastCursor, first, second, err)
+	}
+}
@@ -58,12 +58,142 @@ func initConfig() {
 	viper.SetDefault("server.port", "2005")
 	viper.SetDefault("server.allowed-origins", "*")
 	viper.SetDefault("log.level", "info")
-	viper.SetDefault("monitor.units", "")     // (Comma seperated) Default to no units monitored
-	viper.SetDefault("monitor.interval", "1") // Default to send data every 1 minute
+	viper.SetDefault("monitor.units", "")           // (Comma seperated) Default to no units monitored
+	viper.SetDefault("monitor.interval", "1")       // Default to send data every 1 minute
+	viper.SetDefault("monitor.mode", "poll")        // poll or follow
+	viper.SetDefault("monitor.batchsize", "500")    // Follow mode: ship when a batch has this many entries ...
+	viper.SetDefault("monitor.linger", "5s")        // ... or when the first entry in the batch is this old
+	viper.SetDefault("monitor.sinks", "cloudwatch") // (Comma seperated) Where entries are shipped
+	viper.SetDefault("journal.reader", "journalctl")
+	viper.SetDefault("journal.pagesize", "1000")                          // Read at most this many entries at a time
+	viper.SetDefault("journal.maxpages", "10")                            // Poll mode: ship at most this many pages for each unit every interval
+	viper.SetDefault("journal.binaryencoding", "utf8")                    // How binary field values are shipped: utf8, base64 or hex
+	viper.SetDefault("journal.fields", "")                                // (Comma seperated) Extra journal fields to ship with each message
+	viper.SetDefault("journal.path", "/var/log/journal,/run/log/journal") // (Comma seperated) Only used by the native reader
 	viper.SetDefault("cloudwatch.region", "us-east-1")
 	viper.SetDefault("cloudwatch.profile", "cloudjournal")
 	viper.SetDefault("cloudwatch.group", "/app/cloudjournal/{unit}")
 	viper.SetDefault("cloudwatch.stream", "{hostname}")
+	viper.SetDefault("cloudwatch.endpoint", "")           // Send cloudwatch logs calls to this URL instead (like a VPC endpoint)
+	viper.SetDefault("cloudwatch.sts_endpoint", "")       // Send STS calls to this URL instead
+	viper.SetDefault("cloudwatch.credentials", "default") // default, static, env, instance or webidentity
+	viper.SetDefault("cloudwatch.role_arn", "")           // A role to assume with those credentials
+	viper.SetDefault("cloudwatch.external_id", "")
+	viper.SetDefault("cloudwatch.session_name", "cloudjournal")
+	viper.SetDefault("cloudwatch.retention_days", 0)      // How long new log groups keep events.  0 keeps them forever
+	viper.SetDefault("cloudwatch.tags", "")               // (Comma seperated) key=value tags for new log groups
+	viper.SetDefault("cloudwatch.kms_key_id", "")         // KMS key ARN to encrypt new log groups with
+	viper.SetDefault("cloudwatch.reconcile", false)       // Apply the settings above to existing log groups too
+	viper.SetDefault("cloudwatch.format", "raw")          // raw or json
+	viper.SetDefault("cloudwatch.maxeventsize", "262144") // The largest event CloudWatch accepts (256 KB)
+	viper.SetDefault("cloudwatch.oversize", "truncate")   // What to do with bigger events: truncate, split or drop
+	viper.SetDefault("cloudwatch.retries", "5")           // How many times to retry a batch that can be retried
+	viper.SetDefault("cloudwatch.retrydelay", "500ms")    // The first retry delay.  It doubles with each retry ...
+	viper.SetDefault("cloudwatch.maxretrydelay", "30s")   // ... up to this
+	viper.SetDefault("cloudwatch.persisttokens", false)   // Save sequence tokens in the system database between restarts
+	viper.SetDefault("loki.url", "")
+	viper.SetDefault("loki.encoding", "protobuf")                   // protobuf or json
+	viper.SetDefault("loki.labels", "unit={unit}, host={hostname}") // (Comma seperated) name=value labels.  Values can use tokens
+	viper.SetDefault("loki.fieldlabels", "")                        // (Comma seperated) Journal fields to add as labels
+	viper.SetDefault("loki.tenant", "")                             // Sent as X-Scope-OrgID
+	viper.SetDefault("loki.username", "")
+	viper.SetDefault("loki.password", "")
+	viper.SetDefault("loki.format", "raw")        // raw or json
+	viper.SetDefault("loki.timeout", "10s")       // How long to wait for each push
+	viper.SetDefault("loki.retries", "5")         // How many times to retry a push when Loki is rate limiting or unavailable
+	viper.SetDefault("loki.retrydelay", "500ms")  // The first retry delay.  It doubles with each retry ...
+	viper.SetDefault("loki.maxretrydelay", "30s") // ... up to this
+	viper.SetDefault("elasticsearch.url", "")
+	viper.SetDefault("elasticsearch.index", "journal-{unit}-{date}") // Can use tokens, and the date tokens from each entry
+	viper.SetDefault("elasticsearch.pipeline", "")                   // An ingest pipeline to run documents through
+	viper.SetDefault("elasticsearch.deadletterindex", "")
+	viper.SetDefault("elasticsearch.username", "")
+	viper.SetDefault("elasticsearch.password", "")
+	viper.SetDefault("elasticsearch.apikey", "")
+	viper.SetDefault("elasticsearch.timeout", "30s")       // How long to wait for each _bulk request
+	viper.SetDefault("elasticsearch.retries", "5")         // How many times to retry entries when the cluster is busy or unavailable
+	viper.SetDefault("elasticsearch.retrydelay", "500ms")  // The first retry delay.  It doubles with each retry ...
+	viper.SetDefault("elasticsearch.maxretrydelay", "30s") // ... up to this
+	viper.SetDefault("syslog.address", "")
+	viper.SetDefault("syslog.network", "udp")         // udp, tcp or tls
+	viper.SetDefault("syslog.hostname", "{hostname}") // For entries without a _HOSTNAME
+	viper.SetDefault("syslog.facility", "user")       // For entries without a SYSLOG_FACILITY
+	viper.SetDefault("syslog.sdid", "")               // The structured data id for journal fields, like name@<your enterprise number>
+	viper.SetDefault("syslog.fields", "")             // (Comma seperated) Journal fields to send as structured data.  Needs syslog.sdid
+	viper.SetDefault("syslog.format", "raw")          // raw or json
+	viper.SetDefault("syslog.maxsize", "8192")        // Longer messages are truncated
+	viper.SetDefault("syslog.timeout", "10s")         // How long to wait to connect and for each write
+	viper.SetDefault("syslog.ca", "")                 // TLS only: the CA that signed the server's certificate ...
+	viper.SetDefault("syslog.cert", "")               // ... and a client certificate and key, if the server wants one
+	viper.SetDefault("syslog.key", "")
+	viper.SetDefault("syslog.servername", "")
+	viper.SetDefault("webhook.url", "")              // Can use tokens
+	viper.SetDefault("webhook.format", "ndjson")     // ndjson or array
+	viper.SetDefault("webhook.body", "")             // Array only: a body template with an {entries} token
+	viper.SetDefault("webhook.headers", "")          // (Comma seperated) Name=value headers.  Values can use tokens
+	viper.SetDefault("webhook.gzip", false)          // Compress the body
+	viper.SetDefault("webhook.batchsize", "500")     // The most entries in one request
+	viper.SetDefault("webhook.timeout", "30s")       // How long to wait for each request
+	viper.SetDefault("webhook.retries", "5")         // How many times to retry server errors, rate limiting and network errors
+	viper.SetDefault("webhook.retrydelay", "500ms")  // The first retry delay.  It doubles with each retry ...
+	viper.SetDefault("webhook.maxretrydelay", "30s") // ... up to this
+	viper.SetDefault("webhook.username", "")
+	viper.SetDefault("webhook.password", "")
+	viper.SetDefault("webhook.bearertoken", "")
+	viper.SetDefault("webhook.ca", "")
+	viper.SetDefault("webhook.cert", "")
+	viper.SetDefault("webhook.key", "")
+	viper.SetDefault("webhook.servername", "")
+	viper.SetDefault("file.directory", path.Join(home, "cloudjournal", "logs"))
+	viper.SetDefault("file.path", "{unit}.ndjson") // The file for each unit, under the directory.  Can use tokens
+	viper.SetDefault("file.maxsize", "100MB")      // Rotate files at this size ...
+	viper.SetDefault("file.maxage", "24h")         // ... or this age
+	viper.SetDefault("file.compress", true)        // gzip rotated files
+	viper.SetDefault("file.maxtotalsize", "1GB")   // Remove the oldest rotated files to stay under this
+	viper.SetDefault("s3.bucket", "")
+	viper.SetDefault("s3.key", "{hostname}/{unit}/{yyyy}/{mm}/{dd}/{cursor-hash}.ndjson.gz") // Can use tokens
+	viper.SetDefault("s3.region", "")                                                        // Defaults to cloudwatch.region
+	viper.SetDefault("s3.endpoint", "")                                                      // For S3-compatible stores, like MinIO ...
+	viper.SetDefault("s3.pathstyle", false)                                                  // ... which usually need path-style URLs
+	viper.SetDefault("s3.access_key_id", "")                                                 // If empty, the cloudwatch credentials are used
+	viper.SetDefault("s3.secret_access_key", "")
+	viper.SetDefault("s3.storageclass", "") // Like STANDARD_IA or GLACIER_IR
+	viper.SetDefault("s3.sse", "")          // AES256 or aws:kms
+	viper.SetDefault("s3.kms_key_id", "")
+	viper.SetDefault("s3.retries", "5")   // How many times the AWS SDK retries an upload
+	viper.SetDefault("s3.maxsize", "8MB") // Upload a unit's buffered entries once they're this big ...
+	viper.SetDefault("s3.maxage", "5m")   // ... or this old
+	viper.SetDefault("kafka.brokers", "")
+	viper.SetDefault("kafka.topic", "journal")         // Can use tokens
+	viper.SetDefault("kafka.keyfield", "unit")         // The journal field (like _BOOT_ID) to key messages by, or unit
+	viper.SetDefault("kafka.version", "2.1.0")         // The oldest broker version in the cluster
+	viper.SetDefault("kafka.compression", "snappy")    // none, gzip, snappy, lz4 or zstd
+	viper.SetDefault("kafka.clientid", "cloudjournal") // Sent to the brokers with each request
+	viper.SetDefault("kafka.timeout", "30s")           // How long to wait to connect and for each request
+	viper.SetDefault("kafka.retries", "5")             // How many times the producer retries a message ...
+	viper.SetDefault("kafka.retrydelay", "500ms")      // ... waiting this long between tries
+	viper.SetDefault("kafka.sasl", "")                 // plain, scram-sha-256 or scram-sha-512
+	viper.SetDefault("kafka.username", "")
+	viper.SetDefault("kafka.password", "")
+	viper.SetDefault("kafka.tls", false) // Connect with TLS
+	viper.SetDefault("kafka.ca", "")     // The CA that signed the brokers' certificates ...
+	viper.SetDefault("kafka.cert", "")   // ... and a client certificate and key, if the brokers want one
+	viper.SetDefault("kafka.key", "")
+	viper.SetDefault("kafka.servername", "")
+	viper.SetDefault("otlp.endpoint", "")
+	viper.SetDefault("otlp.protocol", "http/protobuf")         // http/protobuf, http/json or grpc
+	viper.SetDefault("otlp.headers", "")                       // (Comma seperated) Name=value headers.  Values can use tokens
+	viper.SetDefault("otlp.resource", "")                      // (Comma seperated) name=value extra resource attributes.  Values can use tokens
+	viper.SetDefault("otlp.fields", "SYSLOG_IDENTIFIER, _PID") // (Comma seperated) Journal fields to add as log record attributes
+	viper.SetDefault("otlp.gzip", false)                       // Compress each request
+	viper.SetDefault("otlp.timeout", "10s")                    // How long to wait for each export
+	viper.SetDefault("otlp.retries", "5")                      // How many times to retry an export when the collector is busy or unavailable
+	viper.SetDefault("otlp.retrydelay", "500ms")               // The first retry delay.  It doubles with each retry ...
+	viper.SetDefault("otlp.maxretrydelay", "30s")              // ... up to this
+	viper.SetDefault("otlp.ca", "")                            // The CA that signed the collector's certificate ...
+	viper.SetDefault("otlp.cert", "")                          // ... and a client certificate and key, if the collector wants one
+	viper.SetDefault("otlp.key", "")
+	viper.SetDefault("otlp.servername", "")
 
 	// If a config file is found, read it in
 	viper.ReadInConfig()
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
@@ -9,11 +10,11 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/danesparza/cloudjournal/cloudwatch"
 	"github.com/danesparza/cloudjournal/data"
 	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/metrics"
+	"github.com/danesparza/cloudjournal/sink"
 	"github.com/danesparza/cloudjournal/system"
-	"github.com/danesparza/cloudjournal/token"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -47,16 +48,22 @@ func start(cmd *cobra.Command, args []string) {
 
 	//	Emit what we know:
 	log.WithFields(log.Fields{
-		"systemdb":           systemdb,
-		"loglevel":           loglevel,
-		"machineid":          tokens["{machineid}"],
-		"hostname":           tokens["{hostname}"],
-		"cloudwatch.group":   viper.GetString("cloudwatch.group"),
-		"cloudwatch.stream":  viper.GetString("cloudwatch.stream"),
-		"cloudwatch.profile": viper.GetString("cloudwatch.profile"),
-		"cloudwatch.region":  viper.GetString("cloudwatch.region"),
-		"monitor.units":      viper.GetString("monitor.units"),
-		"monitor.interval":   viper.GetString("monitor.interval"),
+		"systemdb":               systemdb,
+		"loglevel":               loglevel,
+		"machineid":              tokens["{machineid}"],
+		"hostname":               tokens["{hostname}"],
+		"cloudwatch.group":       viper.GetString("cloudwatch.group"),
+		"cloudwatch.stream":      viper.GetString("cloudwatch.stream"),
+		"cloudwatch.profile":     viper.GetString("cloudwatch.profile"),
+		"cloudwatch.region":      viper.GetString("cloudwatch.region"),
+		"cloudwatch.credentials": viper.GetString("cloudwatch.credentials"),
+		"cloudwatch.role_arn":    viper.GetString("cloudwatch.role_arn"),
+		"cloudwatch.format":      viper.GetString("cloudwatch.format"),
+		"monitor.units":          viper.GetString("monitor.units"),
+		"monitor.interval":       viper.GetString("monitor.interval"),
+		"monitor.mode":           viper.GetString("monitor.mode"),
+		"monitor.sinks":          viper.GetString("monitor.sinks"),
+		"journal.reader":         viper.GetString("journal.reader"),
 	}).Info("Starting up")
 
 	//	Create a DBManager object
@@ -67,9 +74,19 @@ func start(cmd *cobra.Command, args []string) {
 	}
 	defer db.Close()
 
-	//	Associate the dbmanager object with the cloudwatch svc
-	cloudService := cloudwatch.Service{
-		DB: db,
+	//	Create the sinks to ship entries to
+	sinks, err := sink.NewFromConfig(viper.GetString("monitor.sinks"), db)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"monitor.sinks": viper.GetString("monitor.sinks"),
+		}).WithError(err).Fatal("problem creating sinks")
+	}
+	out := sink.NewFanout(sinks...)
+	defer out.Close()
+
+	//	Check our sinks (like the AWS credentials) once at startup
+	if err := out.HealthCheck(); err != nil {
+		log.WithError(err).Error("problem checking sinks.  Log shipping will fail until this is fixed")
 	}
 
 	//	Convert interval to a duration
@@ -86,6 +103,11 @@ func start(cmd *cobra.Command, args []string) {
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 	go handleSignals(ctx, sigs, cancel)
 
+	//	Get the most entries to read from the journal at a time, and the most pages to
+	//	ship for each unit every interval
+	pageSize := viper.GetInt("journal.pagesize")
+	maxPages := viper.GetInt("journal.maxpages")
+
 	//	Get the comma-seperated list of units to check from configuration
 	monitoredUnits := strings.Split(viper.GetString("monitor.units"), ",")
 
@@ -99,6 +121,16 @@ func start(cmd *cobra.Command, args []string) {
 	//	Log that the system has started:
 	log.Info("System started")
 
+	//	In follow mode, entries are shipped as they arrive instead of on an interval
+	if viper.GetString("monitor.mode") == "follow" {
+		followUnits(ctx, monitoredUnits, out, db, tokens)
+		return
+	}
+
+	//	Where we've read each unit's journal up to, when it's past the saved cursor
+	//	because a sink has buffered the entries
+	positions := make(map[string]string)
+
 	t := time.Tick(monitorInterval)
 	for {
 		select {
@@ -107,56 +139,143 @@ func start(cmd *cobra.Command, args []string) {
 			for _, unit := range monitoredUnits {
 				unit = strings.TrimSpace(unit)
 
-				//	Format our group and stream names
+				//	Set the unit token
 				tokens["{unit}"] = unit
-				cloudwatchGroupname := token.Replace(viper.GetString("cloudwatch.group"), tokens)
-				cloudwatchStreamname := token.Replace(viper.GetString("cloudwatch.stream"), tokens)
 
 				//	Get the state for the unit
-				unitState, err := cloudService.DB.GetLogStateForUnit(unit)
+				unitState, err := db.GetLogStateForUnit(unit)
 				if err != nil && err != buntdb.ErrNotFound {
 					log.WithFields(log.Fields{
 						"unit": unit,
 					}).WithError(err).Error("problem trying to get state for unit")
 				}
 
-				//	Get the entries from the last cursor
-				entries := journal.GetJournalEntriesForUnitFromCursor(unit, unitState.LastCursor)
-
-				//	If we have entries ...
-				if len(entries) > 0 {
-
-					//	Log the entries:
-					err = cloudService.WriteToLog(cloudwatchGroupname, cloudwatchStreamname, entries)
-					if err != nil {
-						//	If we have an error, don't save state.  Just continue
-						log.WithFields(log.Fields{
-							"unit":       unit,
-							"groupName":  cloudwatchGroupname,
-							"streamName": cloudwatchStreamname,
-						}).WithError(err).Error("problem writing to log.  Retrying with next batch")
-						continue
-					}
-
-					//	Get the last cursor:
-					lastCursor := entries[len(entries)-1].Cursor
-
-					//	Save the state for the unit
-					_, err = cloudService.DB.UpdateLogState(unit, lastCursor)
-					if err != nil {
-						log.WithFields(log.Fields{
-							"unit": unit,
-						}).WithError(err).Error("problem trying to save state for unit")
-					}
+				//	Ship the entries after the last cursor (or after the buffered ones), a page at a time
+				if position := shipUnitPages(out, db, unit, unitState.LastCursor, positions[unit], tokens, pageSize, maxPages); position != "" {
+					positions[unit] = position
+				} else {
+					delete(positions, unit)
 				}
 			}
 
 		case <-ctx.Done():
+			//	Ship anything that's buffered before we go
+			for unit, position := range positions {
+				flushBuffered(out, db, unit, position, true)
+			}
 			return
 		}
 	}
 }
 
+// readJournalPage reads a page of journal entries.  Tests can replace it with a fake journal
+var readJournalPage = journal.GetJournalPageForUnitFromCursor
+
+// shipUnitPages reads the journal for a unit one page at a time starting after the cursor,
+// writes each page to the log and saves the cursor after each page that was written.
+// It stops when the backlog is drained, a page can't be written or it has shipped
+// maxPages pages (so one busy unit can't hold up the others), and the next call carries
+// on from there.  If a sink buffered the entries, the cursor isn't saved until they're
+// shipped.  It returns the cursor it read up to while entries are still buffered, which
+// should be passed back in as buffered (instead of empty) so reading carries on after them
+func shipUnitPages(out sink.Sink, db *data.Manager, unit, cursor, buffered string, tokens map[string]string, pageSize, maxPages int) string {
+	if buffered != "" {
+		cursor = buffered
+	}
+
+	for pages := 1; ; pages++ {
+		//	Get the next page of entries from the last cursor
+		page := readJournalPage(unit, cursor, pageSize)
+
+		//	If we didn't read anything, we're caught up
+		if page.Records == 0 {
+			break
+		}
+
+		if page.Skipped > 0 {
+			metrics.Add("journal.skipped", int64(page.Skipped))
+			log.WithFields(log.Fields{
+				"unit":    unit,
+				"skipped": page.Skipped,
+			}).Warn("skipped journal entries that couldn't be decoded")
+		}
+
+		//	Log the entries:
+		pending := buffered != ""
+		if len(page.Entries) > 0 {
+			err := out.Write(sink.Batch{Unit: unit, Tokens: tokens, Entries: page.Entries})
+			if err != nil && !errors.Is(err, sink.ErrBuffered) {
+				//	If we have an error, don't save state.  Just try again next time
+				log.WithFields(log.Fields{
+					"unit": unit,
+					"sink": out.Name(),
+				}).WithError(err).Error("problem writing to log.  Retrying with next batch")
+				break
+			}
+			pending = err != nil
+		}
+
+		//	Get the last cursor (including any skipped entries, so we never get stuck on them):
+		cursor = page.LastCursor
+
+		//	Save the state for the unit, unless its entries are still buffered
+		if pending {
+			buffered = cursor
+		} else {
+			buffered = ""
+			saveLogState(db, unit, cursor)
+		}
+
+		//	A partial page means there is nothing left to read.  Otherwise the rest
+		//	waits for the next tick once we've shipped enough pages
+		if pageSize < 1 || page.Records < pageSize || (maxPages > 0 && pages >= maxPages) {
+			break
+		}
+	}
+
+	//	Ship the buffered entries if they're due.  That's checked on every tick, even
+	//	when there's nothing new to read
+	if buffered != "" && flushBuffered(out, db, unit, buffered, false) {
+		return ""
+	}
+
+	return buffered
+}
+
+// flushBuffered ships the entries the sinks have buffered for the unit (if they're due, or
+// all of them if force is true), and saves the cursor once they're shipped.  It returns
+// true if nothing is buffered any more
+func flushBuffered(out sink.Sink, db *data.Manager, unit, cursor string, force bool) bool {
+	flusher, ok := out.(sink.Flusher)
+	if !ok {
+		return false
+	}
+
+	err := flusher.Flush(unit, force)
+	if err != nil {
+		if !errors.Is(err, sink.ErrBuffered) {
+			log.WithFields(log.Fields{
+				"unit": unit,
+				"sink": out.Name(),
+			}).WithError(err).Error("problem shipping buffered entries.  Retrying later")
+		}
+		return false
+	}
+
+	saveLogState(db, unit, cursor)
+	return true
+}
+
+// saveLogState saves the cursor for the unit
+func saveLogState(db *data.Manager, unit, cursor string) {
+	_, err := db.UpdateLogState(unit, cursor)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"unit": unit,
+		}).WithError(err).Error("problem trying to save state for unit")
+	}
+}
+
 func handleSignals(ctx context.Context, sigs <-chan os.Signal, cancel context.CancelFunc) {
 	select {
 	case <-ctx.Done():
@@ -172,8 +291,8 @@ func handleSignals(ctx context.Context, sigs <-chan os.Signal, cancel context.Ca
 			}).Info("Shutting down")
 		}
 
+		//	The main loop ships anything buffered, and the sinks are closed on the way out
 		cancel()
-		os.Exit(0)
 	}
 }
 
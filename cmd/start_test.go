@@ -0,0 +1,325 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/danesparza/cloudjournal/awssession"
+	"github.com/danesparza/cloudjournal/cloudwatch"
+	"github.com/danesparza/cloudjournal/cloudwatch/cloudwatchtest"
+	"github.com/danesparza/cloudjournal/data"
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/sink"
+	"github.com/spf13/viper"
+)
+
+// fakeJournal returns a page reader for a journal with the given number of entries.
+// Each entry's cursor is c<n>
+func fakeJournal(count int) func(unit, cursor string, limit int) journal.Page {
+	return func(unit, cursor string, limit int) journal.Page {
+		start := 0
+		if cursor != "" {
+			fmt.Sscanf(strings.TrimPrefix(cursor, "c"), "%d", &start)
+		}
+
+		page := journal.Page{Entries: []journal.Entry{}}
+		for i := start + 1; i <= count && page.Records < limit; i++ {
+			page.Entries = append(page.Entries, journal.Entry{
+				Cursor:            fmt.Sprintf("c%d", i),
+				RealtimeTimestamp: fmt.Sprintf("%d", 1636000000000000+int64(i)*1000),
+				Message:           journal.NewField(fmt.Sprintf("message %d", i)),
+			})
+			page.LastCursor = fmt.Sprintf("c%d", i)
+			page.Records++
+		}
+
+		return page
+	}
+}
+
+// recordedJournal returns a page reader for journal entries recorded with journalctl -o json
+func recordedJournal(t *testing.T, path string) func(unit, cursor string, limit int) journal.Page {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("can't open recorded journal: %s", err)
+	}
+	defer file.Close()
+
+	entries := []journal.Entry{}
+	decoder := journal.NewDecoder(file)
+	for {
+		entry := journal.Entry{}
+		if err := decoder.Decode(&entry); err != nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+
+	return func(unit, cursor string, limit int) journal.Page {
+		start := 0
+		for i, entry := range entries {
+			if entry.Cursor == cursor {
+				start = i + 1
+			}
+		}
+
+		page := journal.Page{Entries: []journal.Entry{}}
+		for i := start; i < len(entries) && page.Records < limit; i++ {
+			page.Entries = append(page.Entries, entries[i])
+			page.LastCursor = entries[i].Cursor
+			page.Records++
+		}
+
+		return page
+	}
+}
+
+// testTokens are the tokens for the cron unit on a test host
+var testTokens = map[string]string{"{unit}": "cron", "{hostname}": "host"}
+
+// testSink creates a cloudwatch sink backed by a fake, and a system database
+func testSink(t *testing.T) (*sink.CloudWatch, *data.Manager, *cloudwatchtest.Logs) {
+	db, err := data.NewManager(filepath.Join(t.TempDir(), "system.db"))
+	if err != nil {
+		t.Fatalf("NewManager failed: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	viper.Set("cloudwatch.group", "/app/cloudjournal/{unit}")
+	viper.Set("cloudwatch.stream", "{hostname}")
+	t.Cleanup(viper.Reset)
+
+	fake := cloudwatchtest.NewLogs()
+	return sink.NewCloudWatch(cloudwatch.NewServiceWithClients(db, fake, fake)), db, fake
+}
+
+// bufferingSink keeps the entries it's sent until it's flushed with force, or once due
+// is set
+type bufferingSink struct {
+	entries []journal.Entry
+	shipped int
+	due     bool
+}
+
+func (s *bufferingSink) Name() string { return "buffering" }
+
+func (s *bufferingSink) Write(batch sink.Batch) error {
+	s.entries = append(s.entries, batch.Entries...)
+	return sink.ErrBuffered
+}
+
+func (s *bufferingSink) Flush(unit string, force bool) error {
+	if !force && !s.due {
+		return sink.ErrBuffered
+	}
+	s.shipped = len(s.entries)
+	return nil
+}
+
+func (s *bufferingSink) Close() error { return nil }
+
+func TestStart_ShipUnitPages_ShipsBacklogAndSavesCursor(t *testing.T) {
+	//	Arrange
+	readJournalPage = fakeJournal(25)
+	t.Cleanup(func() { readJournalPage = journal.GetJournalPageForUnitFromCursor })
+	out, db, fake := testSink(t)
+
+	//	Act
+	shipUnitPages(out, db, "cron", "", "", testTokens, 10, 0)
+
+	//	Assert
+	if messages := fake.Messages("/app/cloudjournal/cron", "host"); len(messages) != 25 {
+		t.Errorf("shipUnitPages - Expected 25 messages shipped, but got %v", len(messages))
+	}
+
+	state, err := db.GetLogStateForUnit("cron")
+	if err != nil || state.LastCursor != "c25" {
+		t.Errorf("shipUnitPages - Expected the last cursor to be saved, but got %q (%v)", state.LastCursor, err)
+	}
+}
+
+func TestStart_ShipUnitPages_MaxPages_ShipsTheRestNextTime(t *testing.T) {
+	//	Arrange
+	readJournalPage = fakeJournal(25)
+	t.Cleanup(func() { readJournalPage = journal.GetJournalPageForUnitFromCursor })
+	out, db, fake := testSink(t)
+
+	//	Act
+	shipUnitPages(out, db, "cron", "", "", testTokens, 10, 2)
+	first := len(fake.Messages("/app/cloudjournal/cron", "host"))
+	state, _ := db.GetLogStateForUnit("cron")
+	shipUnitPages(out, db, "cron", state.LastCursor, "", testTokens, 10, 2)
+
+	//	Assert
+	if first != 20 || state.LastCursor != "c20" {
+		t.Errorf("shipUnitPages - Expected 2 pages shipped, but got %v messages and cursor %q", first, state.LastCursor)
+	}
+
+	if messages := fake.Messages("/app/cloudjournal/cron", "host"); len(messages) != 25 {
+		t.Errorf("shipUnitPages - Expected the rest shipped next time, but got %v messages", len(messages))
+	}
+}
+
+func TestStart_ShipUnitPages_WriteFails_KeepsCursor(t *testing.T) {
+	//	Arrange - the second page can't be written
+	readJournalPage = fakeJournal(25)
+	t.Cleanup(func() { readJournalPage = journal.GetJournalPageForUnitFromCursor })
+	out, db, fake := testSink(t)
+	fake.FailNext(cloudwatchtest.OpPutLogEvents, nil)
+	fake.FailNext(cloudwatchtest.OpPutLogEvents, awserr.New("AccessDeniedException", "not authorized", nil))
+
+	//	Act
+	shipUnitPages(out, db, "cron", "", "", testTokens, 10, 0)
+
+	//	Assert
+	state, err := db.GetLogStateForUnit("cron")
+	if err != nil || state.LastCursor != "c10" {
+		t.Errorf("shipUnitPages - Expected the cursor from the first page to be saved, but got %q (%v)", state.LastCursor, err)
+	}
+}
+
+func TestStart_ShipUnitPages_Buffered_SavesCursorOnceShipped(t *testing.T) {
+	//	Arrange
+	readJournalPage = fakeJournal(25)
+	t.Cleanup(func() { readJournalPage = journal.GetJournalPageForUnitFromCursor })
+	cw, db, fake := testSink(t)
+	buffering := &bufferingSink{}
+	out := sink.NewFanout(cw, buffering)
+
+	//	Act
+	position := shipUnitPages(out, db, "cron", "", "", testTokens, 10, 0)
+	readJournalPage = fakeJournal(30)
+	position = shipUnitPages(out, db, "cron", "", position, testTokens, 10, 0)
+	unsaved, _ := db.GetLogStateForUnit("cron")
+	shipped := flushBuffered(out, db, "cron", position, true)
+
+	//	Assert
+	if position != "c30" || unsaved.LastCursor != "" {
+		t.Errorf("shipUnitPages - Expected to read up to c30 without saving the cursor, but got %q and saved %q", position, unsaved.LastCursor)
+	}
+
+	if messages := fake.Messages("/app/cloudjournal/cron", "host"); len(messages) != 30 || len(buffering.entries) != 30 {
+		t.Errorf("shipUnitPages - Expected 30 entries in each sink, but got %v and %v", len(messages), len(buffering.entries))
+	}
+
+	state, err := db.GetLogStateForUnit("cron")
+	if !shipped || buffering.shipped != 30 || err != nil || state.LastCursor != "c30" {
+		t.Errorf("flushBuffered - Expected the cursor to be saved once the entries are shipped, but got %q (%v)", state.LastCursor, err)
+	}
+}
+
+func TestStart_ShipUnitPages_Buffered_IdleTickKeepsPositionAndFlushes(t *testing.T) {
+	//	Arrange
+	readJournalPage = fakeJournal(25)
+	t.Cleanup(func() { readJournalPage = journal.GetJournalPageForUnitFromCursor })
+	cw, db, fake := testSink(t)
+	buffering := &bufferingSink{}
+	out := sink.NewFanout(cw, buffering)
+
+	//	Act - nothing new is logged for two ticks, and the buffer is due on the second
+	position := shipUnitPages(out, db, "cron", "", "", testTokens, 10, 0)
+	idle := shipUnitPages(out, db, "cron", "", position, testTokens, 10, 0)
+	buffering.due = true
+	flushed := shipUnitPages(out, db, "cron", "", idle, testTokens, 10, 0)
+
+	//	Assert
+	if position != "c25" || idle != "c25" || flushed != "" {
+		t.Errorf("shipUnitPages - Expected to keep the position until the buffer is shipped, but got %q, %q and %q", position, idle, flushed)
+	}
+
+	if messages := fake.Messages("/app/cloudjournal/cron", "host"); len(messages) != 25 || len(buffering.entries) != 25 {
+		t.Errorf("shipUnitPages - Expected 25 entries in each sink, but got %v and %v", len(messages), len(buffering.entries))
+	}
+
+	state, err := db.GetLogStateForUnit("cron")
+	if buffering.shipped != 25 || err != nil || state.LastCursor != "c25" {
+		t.Errorf("shipUnitPages - Expected the cursor to be saved once the buffer is due, but got %q (%v)", state.LastCursor, err)
+	}
+}
+
+func TestStart_ShipUnitPages_Buffered_WriteFails_KeepsPosition(t *testing.T) {
+	//	Arrange - the second page can't be written to cloudwatch
+	readJournalPage = fakeJournal(25)
+	t.Cleanup(func() { readJournalPage = journal.GetJournalPageForUnitFromCursor })
+	cw, db, fake := testSink(t)
+	fake.FailNext(cloudwatchtest.OpPutLogEvents, nil)
+	fake.FailNext(cloudwatchtest.OpPutLogEvents, awserr.New("AccessDeniedException", "not authorized", nil))
+	buffering := &bufferingSink{}
+	out := sink.NewFanout(cw, buffering)
+
+	//	Act
+	failed := shipUnitPages(out, db, "cron", "", "", testTokens, 10, 0)
+	position := shipUnitPages(out, db, "cron", "", failed, testTokens, 10, 0)
+
+	//	Assert
+	if failed != "c10" || position != "c25" {
+		t.Errorf("shipUnitPages - Expected to carry on after the first page, but got %q and then %q", failed, position)
+	}
+
+	if messages := fake.Messages("/app/cloudjournal/cron", "host"); len(messages) != 25 || len(buffering.entries) != 25 {
+		t.Errorf("shipUnitPages - Expected 25 entries in each sink, but got %v and %v", len(messages), len(buffering.entries))
+	}
+
+	if state, _ := db.GetLogStateForUnit("cron"); state.LastCursor != "" {
+		t.Errorf("shipUnitPages - Expected the cursor not to be saved while entries are buffered, but got %q", state.LastCursor)
+	}
+}
+
+func TestStart_ShipUnitPages_ThroughEndpoint_ShipsRecordedJournal(t *testing.T) {
+	//	Arrange - talk to a local server instead of AWS, which throttles the first write
+	fake := cloudwatchtest.NewLogs()
+	fake.FailNext(cloudwatchtest.OpPutLogEvents, awserr.New("ThrottlingException", "Rate exceeded", nil))
+	server := cloudwatchtest.NewServer(fake)
+	defer server.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDCLOUDJOURNALTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	viper.Set("cloudwatch.endpoint", server.URL)
+	viper.Set("cloudwatch.sts_endpoint", server.URL)
+	viper.Set("cloudwatch.region", "us-east-1")
+	viper.Set("cloudwatch.credentials", awssession.CredentialsEnv)
+	viper.Set("cloudwatch.group", "/app/cloudjournal/{unit}")
+	viper.Set("cloudwatch.stream", "{hostname}")
+	viper.Set("cloudwatch.retries", 2)
+	viper.Set("cloudwatch.retrydelay", "1ms")
+	t.Cleanup(viper.Reset)
+
+	readJournalPage = recordedJournal(t, filepath.Join("testdata", "cron.json"))
+	t.Cleanup(func() { readJournalPage = journal.GetJournalPageForUnitFromCursor })
+
+	db, err := data.NewManager(filepath.Join(t.TempDir(), "system.db"))
+	if err != nil {
+		t.Fatalf("NewManager failed: %s", err)
+	}
+	defer db.Close()
+	out, err := sink.New(sink.CloudWatchName, db)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	tokens := map[string]string{"{unit}": "cron", "{hostname}": "raspberrypi"}
+
+	//	Act
+	healthErr := out.(sink.HealthChecker).HealthCheck()
+	shipUnitPages(out, db, "cron", "", "", tokens, 5, 0)
+
+	//	Assert
+	if healthErr != nil {
+		t.Errorf("HealthCheck - Should execute without error, but got: %s", healthErr)
+	}
+
+	messages := fake.Messages("/app/cloudjournal/cron", "raspberrypi")
+	if len(messages) != 12 || messages[0] != "(root) CMD (   cd / && run-parts --report /etc/cron.hourly)" {
+		t.Errorf("shipUnitPages - Expected all 12 recorded messages, but got %v", messages)
+	}
+
+	state, err := db.GetLogStateForUnit("cron")
+	if err != nil || !strings.Contains(state.LastCursor, ";i=1a4b;") {
+		t.Errorf("shipUnitPages - Expected the last recorded cursor to be saved, but got %q (%v)", state.LastCursor, err)
+	}
+}
@@ -31,6 +31,7 @@ func NewManager(systemdbpath string) (*Manager, error) {
 
 	//	Create our indexes
 	sysdb.CreateIndex("State", "State:*", buntdb.IndexString)
+	sysdb.CreateIndex("Stream", "Stream:*", buntdb.IndexString)
 
 	//	Return our Manager reference
 	return retval, nil
@@ -0,0 +1,91 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/buntdb"
+)
+
+// StreamState is what we know about a cloudwatch log stream
+type StreamState struct {
+	Group         string    `json:"group"`
+	Stream        string    `json:"stream"`
+	SequenceToken string    `json:"sequence_token"`
+	Updated       time.Time `json:"updated"`
+}
+
+// UpdateStreamState updates the state (the last sequence token) for a log stream
+func (store Manager) UpdateStreamState(group, stream, sequenceToken string) (StreamState, error) {
+
+	log.WithFields(log.Fields{
+		"group":         group,
+		"stream":        stream,
+		"sequenceToken": sequenceToken,
+	}).Debug("updating state for log stream")
+
+	//	Our return item
+	retval := StreamState{
+		Group:         group,
+		Stream:        stream,
+		SequenceToken: sequenceToken,
+		Updated:       time.Now(),
+	}
+
+	//	Serialize to JSON format
+	encoded, err := json.Marshal(retval)
+	if err != nil {
+		return retval, fmt.Errorf("problem serializing the data: %s", err)
+	}
+
+	//	Save it to the database:
+	err = store.systemdb.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(GetKey("Stream", group, stream), string(encoded), nil)
+		return err
+	})
+
+	//	Return our data:
+	return retval, err
+}
+
+// GetStreamState gets the state for a log stream
+func (store Manager) GetStreamState(group, stream string) (StreamState, error) {
+
+	//	Our return item
+	retval := StreamState{}
+
+	err := store.systemdb.View(func(tx *buntdb.Tx) error {
+		item, err := tx.Get(GetKey("Stream", group, stream))
+		if err != nil {
+			return err
+		}
+
+		if len(item) > 0 {
+			//	Unmarshal data into our item
+			if err := json.Unmarshal([]byte(item), &retval); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	//	Return our data:
+	return retval, err
+}
+
+// DeleteStreamState removes the state for a log stream
+func (store Manager) DeleteStreamState(group, stream string) error {
+	err := store.systemdb.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(GetKey("Stream", group, stream))
+		return err
+	})
+
+	if err == buntdb.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
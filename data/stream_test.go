@@ -0,0 +1,78 @@
+package data_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/danesparza/cloudjournal/data"
+	"github.com/tidwall/buntdb"
+)
+
+func TestStream_UpdateStreamState_ValidState_Successful(t *testing.T) {
+
+	//	Arrange
+	systemdb := getTestFiles()
+
+	db, err := data.NewManager(systemdb)
+	if err != nil {
+		t.Errorf("NewManager failed: %s", err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(systemdb)
+	}()
+
+	testGroup := "/app/cloudjournal/unittest"
+	testStream := "unittest"
+	testToken := "49612345678901234567890123456789012345678901234567890"
+
+	//	Act
+	_, err = db.UpdateStreamState(testGroup, testStream, testToken)
+	if err != nil {
+		t.Errorf("UpdateStreamState - Should execute without error, but got: %s", err)
+	}
+	retval, err := db.GetStreamState(testGroup, testStream)
+
+	//	Assert
+	if err != nil {
+		t.Errorf("GetStreamState - Should execute without error, but got: %s", err)
+	}
+
+	if retval.SequenceToken != testToken {
+		t.Errorf("GetStreamState - Response should match set token, but got: %v", retval.SequenceToken)
+	}
+
+	if retval.Updated.IsZero() {
+		t.Errorf("GetStreamState failed: Should have set an item with the correct datetime: %+v", retval)
+	}
+}
+
+func TestStream_DeleteStreamState_RemovesState(t *testing.T) {
+
+	//	Arrange
+	systemdb := getTestFiles()
+
+	db, err := data.NewManager(systemdb)
+	if err != nil {
+		t.Errorf("NewManager failed: %s", err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(systemdb)
+	}()
+
+	db.UpdateStreamState("/app/cloudjournal/unittest", "unittest", "token")
+
+	//	Act
+	err = db.DeleteStreamState("/app/cloudjournal/unittest", "unittest")
+	_, getErr := db.GetStreamState("/app/cloudjournal/unittest", "unittest")
+
+	//	Assert
+	if err != nil {
+		t.Errorf("DeleteStreamState - Should execute without error, but got: %s", err)
+	}
+
+	if getErr != buntdb.ErrNotFound {
+		t.Errorf("GetStreamState - Expected not found after delete, but got: %v", getErr)
+	}
+}
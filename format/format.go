@@ -0,0 +1,220 @@
+// Package format turns journal entries into log messages, for cloudwatch and the other sinks
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/danesparza/cloudjournal/journal"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// FormatRaw ships just the MESSAGE field (plus any extra fields as NAME=value pairs)
+	FormatRaw = "raw"
+
+	// FormatJSON ships a JSON envelope with the message and journal metadata
+	FormatJSON = "json"
+)
+
+// Formatter turns journal entries into log event messages
+type Formatter struct {
+	// Mode is the output format: raw or json
+	Mode string
+
+	// Fields are the extra journal fields to ship with each message
+	Fields []string
+
+	// BinaryEncoding is how values that aren't valid UTF-8 are rendered
+	BinaryEncoding journal.BinaryEncoding
+}
+
+// NewFormatterFromConfig creates a Formatter from cloudwatch.format,
+// journal.fields and journal.binaryencoding
+func NewFormatterFromConfig() Formatter {
+	retval := Formatter{
+		Mode:           viper.GetString("cloudwatch.format"),
+		Fields:         []string{},
+		BinaryEncoding: journal.BinaryEncoding(viper.GetString("journal.binaryencoding")),
+	}
+
+	for _, name := range strings.Split(viper.GetString("journal.fields"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			retval.Fields = append(retval.Fields, name)
+		}
+	}
+
+	return retval
+}
+
+// Format formats the entry as a log event message
+func (f Formatter) Format(entry journal.Entry) string {
+	if f.Mode == FormatJSON {
+		message, err := f.formatJSON(entry)
+		if err == nil {
+			return message
+		}
+
+		log.WithFields(log.Fields{
+			"cursor": entry.Cursor,
+		}).WithError(err).Warn("problem formatting the entry as JSON.  Shipping it raw")
+	}
+
+	return f.formatRaw(entry)
+}
+
+// formatRaw renders the entry's message, followed by any of the extra fields the
+// entry has as NAME=value pairs (sorted by name).  Values with spaces or quotes are quoted
+func (f Formatter) formatRaw(entry journal.Entry) string {
+	retval := entry.Message.Render(f.BinaryEncoding)
+
+	selected := entry.SelectFields(f.Fields)
+	delete(selected, "MESSAGE")
+
+	names := make([]string, 0, len(selected))
+	for name := range selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := selected[name].Render(f.BinaryEncoding)
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		retval += " " + name + "=" + value
+	}
+
+	return retval
+}
+
+/*
+	JSON envelope example:
+
+	{
+		"level": "info",
+		"msg": "System started",
+		"time": "2021-11-04T05:00:09-04:00",
+		"journal": {
+			"unit": "daydash.service",
+			"hostname": "dashboard",
+			"machine_id": "b8043161058e4f26a87fb9d0978451b6",
+			"boot_id": "6b9d0f62f43c4b0bb0f61848b4da3b15",
+			"pid": "282",
+			"priority": 6,
+			"syslog_identifier": "daydash",
+			"source_timestamp": "2021-11-04T09:00:09.883533Z"
+		}
+	}
+
+	If MESSAGE is a JSON object, its keys are merged into the envelope (like above).
+	Otherwise it is shipped as "message".  Extra journal fields are added to "journal"
+	using their journal field names.
+*/
+
+// formatJSON wraps the entry in a JSON envelope
+func (f Formatter) formatJSON(entry journal.Entry) (string, error) {
+	envelope := make(map[string]interface{})
+
+	//	Merge the message in if it's a JSON object (and doesn't collide with our metadata)
+	message := entry.Message.Render(f.BinaryEncoding)
+	merged := false
+	if trimmed := strings.TrimSpace(message); strings.HasPrefix(trimmed, "{") {
+		dec := json.NewDecoder(bytes.NewReader([]byte(trimmed)))
+		dec.UseNumber()
+		if err := dec.Decode(&envelope); err == nil && !dec.More() {
+			if _, collides := envelope["journal"]; !collides {
+				merged = true
+			}
+		}
+	}
+	if !merged {
+		envelope = map[string]interface{}{"message": message}
+	}
+
+	//	Add the journal metadata
+	metadata := make(map[string]interface{})
+	addField := func(name string, field journal.Field) {
+		if !field.IsEmpty() {
+			metadata[name] = field.Render(f.BinaryEncoding)
+		}
+	}
+
+	addField("unit", entry.SystemDUnit)
+	addField("hostname", entry.Hostname)
+	addField("machine_id", entry.MachineID)
+	addField("boot_id", entry.BootID)
+	addField("pid", entry.PID)
+	addField("syslog_identifier", entry.SyslogIdentifier)
+
+	if priority, err := strconv.Atoi(entry.Priority.String()); err == nil {
+		metadata["priority"] = priority
+	}
+
+	if sourceTimestamp, err := strconv.ParseInt(entry.SourceRealtimeTimestamp.String(), 10, 64); err == nil {
+		metadata["source_timestamp"] = time.UnixMicro(sourceTimestamp).UTC().Format(time.RFC3339Nano)
+	}
+
+	for name, field := range entry.SelectFields(f.Fields) {
+		if name != "MESSAGE" {
+			addField(name, field)
+		}
+	}
+
+	envelope["journal"] = metadata
+
+	encoded, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encoded), nil
+}
+
+// ParseTags parses a comma seperated list of key=value tags, like "team=platform, host={hostname}"
+func ParseTags(tags string) map[string]string {
+	retval := make(map[string]string)
+
+	for _, tag := range strings.Split(tags, ",") {
+		key, value := tag, ""
+		if i := strings.Index(tag, "="); i >= 0 {
+			key, value = tag[:i], tag[i+1:]
+		}
+
+		if key = strings.TrimSpace(key); key != "" {
+			retval[key] = strings.TrimSpace(value)
+		}
+	}
+
+	return retval
+}
+
+// TruncateUTF8 returns at most size bytes of s, without splitting a multi-byte character.
+// It always returns at least one character of a non-empty string, so callers that cut a
+// string into parts always make progress
+func TruncateUTF8(s string, size int) string {
+	if len(s) <= size {
+		return s
+	}
+
+	cut := size
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+
+	if cut == 0 {
+		_, width := utf8.DecodeRuneInString(s)
+		cut = width
+	}
+
+	return s[:cut]
+}
@@ -0,0 +1,87 @@
+package format_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/danesparza/cloudjournal/format"
+	"github.com/danesparza/cloudjournal/journal"
+)
+
+func testEntry(t *testing.T, record string) journal.Entry {
+	entry := journal.Entry{}
+	if err := json.Unmarshal([]byte(record), &entry); err != nil {
+		t.Fatalf("problem decoding test entry: %s", err)
+	}
+	return entry
+}
+
+func TestFormatter_Format_Raw_AppendsExtraFields(t *testing.T) {
+	//	Arrange
+	entry := testEntry(t, `{"__CURSOR":"s=1;i=1","MESSAGE":"hello world","_PID":"282","REQUEST_ID":"abc 123"}`)
+	formatter := format.Formatter{Mode: format.FormatRaw, Fields: []string{"REQUEST_ID", "_PID"}}
+
+	//	Act
+	message := formatter.Format(entry)
+
+	//	Assert
+	expected := `hello world REQUEST_ID="abc 123" _PID=282`
+	if message != expected {
+		t.Errorf("Format - Expected %s but got %s", expected, message)
+	}
+}
+
+func TestFormatter_Format_JSON_MergesJSONMessage(t *testing.T) {
+	//	Arrange
+	entry := testEntry(t, `{
+		"__CURSOR": "s=1;i=1",
+		"MESSAGE": "{\"level\":\"info\",\"msg\":\"System started\",\"count\":12}",
+		"_PID": "282",
+		"PRIORITY": "6",
+		"_SYSTEMD_UNIT": "daydash.service",
+		"_SOURCE_REALTIME_TIMESTAMP": "1636016409883533",
+		"REQUEST_ID": "abc123"
+	}`)
+	formatter := format.Formatter{Mode: format.FormatJSON, Fields: []string{"REQUEST_ID"}}
+
+	//	Act
+	message := formatter.Format(entry)
+
+	//	Assert
+	envelope := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(message), &envelope); err != nil {
+		t.Fatalf("Format - Expected valid JSON but got %s", message)
+	}
+
+	if envelope["msg"] != "System started" || envelope["count"] != float64(12) {
+		t.Errorf("Format - Expected the message to be merged but got %s", message)
+	}
+
+	if _, ok := envelope["message"]; ok {
+		t.Errorf("Format - Expected no double encoded message but got %s", message)
+	}
+
+	metadata := envelope["journal"].(map[string]interface{})
+	if metadata["pid"] != "282" || metadata["priority"] != float64(6) || metadata["unit"] != "daydash.service" || metadata["REQUEST_ID"] != "abc123" {
+		t.Errorf("Format - Unexpected journal metadata: %v", metadata)
+	}
+
+	if metadata["source_timestamp"] != "2021-11-04T09:00:09.883533Z" {
+		t.Errorf("Format - Unexpected source timestamp: %v", metadata["source_timestamp"])
+	}
+}
+
+func TestFormatter_Format_JSON_PlainMessage(t *testing.T) {
+	//	Arrange
+	entry := testEntry(t, `{"__CURSOR":"s=1;i=1","MESSAGE":"plain text"}`)
+	formatter := format.Formatter{Mode: format.FormatJSON}
+
+	//	Act
+	message := formatter.Format(entry)
+
+	//	Assert
+	expected := `{"journal":{},"message":"plain text"}`
+	if message != expected {
+		t.Errorf("Format - Expected %s but got %s", expected, message)
+	}
+}
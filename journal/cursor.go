@@ -0,0 +1,71 @@
+package journal
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Cursor is a parsed journal cursor.  A cursor looks like this:
+// s=7fe895b45f18448daa12dfe9ec1d2993;i=230;b=6b9d0f62f43c4b0bb0f61848b4da3b15;m=3b5c2b9;t=5cff2c0f5338d;x=274b5b63cb69c9f7
+type Cursor struct {
+	SeqnumID  [16]byte
+	Seqnum    uint64
+	BootID    [16]byte
+	Monotonic uint64
+	Realtime  uint64
+	XorHash   uint64
+}
+
+// ParseCursor parses a journal cursor string
+func ParseCursor(cursor string) (Cursor, error) {
+	retval := Cursor{}
+
+	for _, part := range strings.Split(cursor, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return retval, fmt.Errorf("invalid cursor part: %s", part)
+		}
+
+		var err error
+		switch kv[0] {
+		case "s":
+			err = parseID128(kv[1], &retval.SeqnumID)
+		case "i":
+			retval.Seqnum, err = strconv.ParseUint(kv[1], 16, 64)
+		case "b":
+			err = parseID128(kv[1], &retval.BootID)
+		case "m":
+			retval.Monotonic, err = strconv.ParseUint(kv[1], 16, 64)
+		case "t":
+			retval.Realtime, err = strconv.ParseUint(kv[1], 16, 64)
+		case "x":
+			retval.XorHash, err = strconv.ParseUint(kv[1], 16, 64)
+		}
+
+		if err != nil {
+			return retval, fmt.Errorf("invalid cursor part %s: %s", part, err)
+		}
+	}
+
+	return retval, nil
+}
+
+// String formats the cursor the same way journalctl does
+func (c Cursor) String() string {
+	return fmt.Sprintf("s=%x;i=%x;b=%x;m=%x;t=%x;x=%x",
+		c.SeqnumID, c.Seqnum, c.BootID, c.Monotonic, c.Realtime, c.XorHash)
+}
+
+func parseID128(s string, id *[16]byte) error {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) != len(id) {
+		return fmt.Errorf("expected %v bytes but got %v", len(id), len(b))
+	}
+	copy(id[:], b)
+	return nil
+}
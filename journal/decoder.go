@@ -0,0 +1,98 @@
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrMalformedEntry is returned by Decoder.Decode when a record can't be decoded.
+// The record has been skipped, and decoding can continue with the next one
+var ErrMalformedEntry = errors.New("malformed journal entry")
+
+// Decoder reads journal entries one at a time from journalctl --output=json
+// output, which has one JSON object per line
+type Decoder struct {
+	reader *bufio.Reader
+
+	// Records is the number of records read so far (including skipped records
+	// that still had a readable cursor)
+	Records int
+
+	// Skipped is the number of malformed records skipped so far
+	Skipped int
+
+	// LastCursor is the cursor of the last record read, including skipped records.
+	// Saving it lets a reader move past records that can never be decoded
+	LastCursor string
+}
+
+// NewDecoder returns a new Decoder that reads from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{reader: bufio.NewReader(r)}
+}
+
+// Decode reads the next record into entry.  If the record is malformed it is
+// skipped and counted, and an error wrapping ErrMalformedEntry is returned.
+// At the end of the input it returns io.EOF
+func (d *Decoder) Decode(entry *Entry) error {
+	for {
+		line, readErr := d.reader.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+
+		if len(line) > 0 {
+			return d.decodeLine(line, entry)
+		}
+
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// decodeLine decodes a single record
+func (d *Decoder) decodeLine(line []byte, entry *Entry) error {
+	decoded := Entry{}
+
+	dec := json.NewDecoder(bytes.NewReader(line))
+	err := dec.Decode(&decoded)
+	if err == nil && dec.More() {
+		err = fmt.Errorf("unexpected data after the entry")
+	}
+	if err == nil && decoded.Cursor == "" {
+		err = fmt.Errorf("entry has no cursor")
+	}
+
+	if err != nil {
+		d.Skipped++
+
+		//	If the record is valid JSON, we can still move past it
+		if cursor := recoverCursor(line); cursor != "" {
+			d.Records++
+			d.LastCursor = cursor
+		}
+
+		return fmt.Errorf("%w: %s", ErrMalformedEntry, err)
+	}
+
+	d.Records++
+	d.LastCursor = decoded.Cursor
+	*entry = decoded
+	return nil
+}
+
+// recoverCursor gets just the cursor from a record that can't otherwise be decoded
+func recoverCursor(line []byte) string {
+	record := struct {
+		Cursor string `json:"__CURSOR"`
+	}{}
+
+	if err := json.Unmarshal(line, &record); err != nil {
+		return ""
+	}
+
+	return record.Cursor
+}
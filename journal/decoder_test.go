@@ -0,0 +1,79 @@
+package journal_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/danesparza/cloudjournal/journal"
+)
+
+func TestDecoder_Decode_MalformedRecords_AreSkippedAndCounted(t *testing.T) {
+	//	Arrange
+	input := strings.Join([]string{
+		`{"__CURSOR":"s=1;i=1","__REALTIME_TIMESTAMP":"1636016409883533","MESSAGE":"first"}`,
+		`Warning: some journal files were not opened due to insufficient permissions.`,
+		`{"__CURSOR":"s=1;i=2","__REALTIME_TIMESTAMP":"1636016409883534","MESSAGE":{"not":"a string"}}`,
+		``,
+		`{"__CURSOR":"s=1;i=3","__REALTIME_TIMESTAMP":"1636016409883535","MESSAGE":"third"}`,
+		`{"__CURSOR":"s=1;i=4","MESSAGE":"trunc`,
+	}, "\n")
+
+	dec := journal.NewDecoder(strings.NewReader(input))
+	entries := []journal.Entry{}
+
+	//	Act
+	for {
+		entry := journal.Entry{}
+		err := dec.Decode(&entry)
+		if errors.Is(err, journal.ErrMalformedEntry) {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Decode - Unexpected error: %s", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	//	Assert
+	if len(entries) != 2 || entries[0].Message.String() != "first" || entries[1].Message.String() != "third" {
+		t.Errorf("Decode - Expected the two good entries but got: %+v", entries)
+	}
+
+	if dec.Skipped != 3 {
+		t.Errorf("Decode - Expected 3 skipped records but got %v", dec.Skipped)
+	}
+
+	if dec.Records != 3 {
+		t.Errorf("Decode - Expected 3 records with a cursor but got %v", dec.Records)
+	}
+
+	if dec.LastCursor != "s=1;i=3" {
+		t.Errorf("Decode - Expected the last readable cursor but got %s", dec.LastCursor)
+	}
+}
+
+func TestDecoder_Decode_MalformedLastRecord_StillAdvancesCursor(t *testing.T) {
+	//	Arrange
+	input := `{"__CURSOR":"s=1;i=1","MESSAGE":"first"}` + "\n" +
+		`{"__CURSOR":"s=1;i=2","MESSAGE":{"not":"a string"}}` + "\n"
+
+	dec := journal.NewDecoder(strings.NewReader(input))
+
+	//	Act
+	for {
+		entry := journal.Entry{}
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		}
+	}
+
+	//	Assert
+	if dec.LastCursor != "s=1;i=2" {
+		t.Errorf("Decode - Expected the cursor of the skipped record but got %s", dec.LastCursor)
+	}
+}
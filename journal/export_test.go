@@ -0,0 +1,7 @@
+package journal
+
+// HashPayload lets the tests write journal files with a data hash table
+var HashPayload = hashPayload
+
+// DecompressPayload lets the tests check corrupt payloads
+var DecompressPayload = decompressPayload
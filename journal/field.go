@@ -0,0 +1,179 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// BinaryEncoding is how field values that aren't valid UTF-8 are rendered
+type BinaryEncoding string
+
+const (
+	// BinaryUTF8 replaces invalid UTF-8 sequences with the unicode replacement character
+	BinaryUTF8 BinaryEncoding = "utf8"
+
+	// BinaryBase64 renders binary values as standard base64
+	BinaryBase64 BinaryEncoding = "base64"
+
+	// BinaryHex renders binary values as lowercase hex
+	BinaryHex BinaryEncoding = "hex"
+)
+
+// Field is the value of a journal field.  journald emits a field as a JSON string,
+// as an array of bytes when the value isn't valid UTF-8, as an array of values
+// when the field is repeated in an entry, or as null when the value was too large
+// to show.  Field decodes all of these
+type Field struct {
+	// Values holds each value of the field, in order.  Most fields have one value
+	Values [][]byte
+}
+
+// NewField creates a field from one or more string values
+func NewField(values ...string) Field {
+	retval := Field{}
+	for _, value := range values {
+		retval.Values = append(retval.Values, []byte(value))
+	}
+	return retval
+}
+
+// IsEmpty returns true if the field has no value
+func (f Field) IsEmpty() bool {
+	return len(f.Values) == 0
+}
+
+// IsBinary returns true if any value of the field isn't valid UTF-8
+func (f Field) IsBinary() bool {
+	for _, value := range f.Values {
+		if !utf8.Valid(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// String renders the field with lossy UTF-8.  Repeated values are joined with newlines
+func (f Field) String() string {
+	return f.Render(BinaryUTF8)
+}
+
+// Render renders the field, using the given encoding for values that aren't
+// valid UTF-8.  Repeated values are joined with newlines
+func (f Field) Render(encoding BinaryEncoding) string {
+	rendered := make([]string, len(f.Values))
+	for i, value := range f.Values {
+		rendered[i] = renderValue(value, encoding)
+	}
+	return strings.Join(rendered, "\n")
+}
+
+// renderValue renders a single value
+func renderValue(value []byte, encoding BinaryEncoding) string {
+	if utf8.Valid(value) {
+		return string(value)
+	}
+
+	switch encoding {
+	case BinaryBase64:
+		return base64.StdEncoding.EncodeToString(value)
+	case BinaryHex:
+		return hex.EncodeToString(value)
+	default:
+		return strings.ToValidUTF8(string(value), string(utf8.RuneError))
+	}
+}
+
+// UnmarshalJSON decodes a field in any of the forms journalctl emits
+func (f *Field) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	f.Values = nil
+
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		return nil
+
+	case len(data) > 0 && data[0] == '"':
+		value, err := decodeValue(data)
+		if err != nil {
+			return err
+		}
+		f.Values = [][]byte{value}
+		return nil
+
+	case len(data) > 0 && data[0] == '[':
+		//	Either a single binary value (an array of bytes) ...
+		bytesValue := []byte{}
+		if err := json.Unmarshal(data, &bytesValue); err == nil {
+			f.Values = [][]byte{bytesValue}
+			return nil
+		}
+
+		//	... or a repeated field (an array of strings and byte arrays)
+		items := []json.RawMessage{}
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		for _, item := range items {
+			value, err := decodeValue(item)
+			if err != nil {
+				return err
+			}
+			f.Values = append(f.Values, value)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unexpected journal field value: %s", data)
+}
+
+// decodeValue decodes a single value that is either a string or an array of bytes
+func decodeValue(data []byte) ([]byte, error) {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		return []byte(s), nil
+	}
+
+	numbers := []byte{}
+	if err := json.Unmarshal(data, &numbers); err != nil {
+		return nil, fmt.Errorf("unexpected journal field value: %s", data)
+	}
+	return numbers, nil
+}
+
+// MarshalJSON encodes the field the same way journalctl does
+func (f Field) MarshalJSON() ([]byte, error) {
+	switch len(f.Values) {
+	case 0:
+		return []byte("null"), nil
+	case 1:
+		return marshalValue(f.Values[0])
+	}
+
+	items := make([]json.RawMessage, len(f.Values))
+	for i, value := range f.Values {
+		item, err := marshalValue(value)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = item
+	}
+	return json.Marshal(items)
+}
+
+// marshalValue encodes a single value as a string, or as an array of bytes if it isn't valid UTF-8
+func marshalValue(value []byte) ([]byte, error) {
+	if utf8.Valid(value) {
+		return json.Marshal(string(value))
+	}
+
+	numbers := make([]int, len(value))
+	for i, b := range value {
+		numbers[i] = int(b)
+	}
+	return json.Marshal(numbers)
+}
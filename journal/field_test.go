@@ -0,0 +1,145 @@
+package journal_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/danesparza/cloudjournal/journal"
+)
+
+func TestField_Unmarshal_AllForms_Successful(t *testing.T) {
+	//	Arrange
+	input := `{
+		"__CURSOR": "s=1;i=1",
+		"MESSAGE": [104, 105, 255],
+		"_PID": "282",
+		"SYSLOG_IDENTIFIER": ["first", [104, 105]],
+		"CODE_FILE": null
+	}`
+	entry := journal.Entry{}
+
+	//	Act
+	err := json.Unmarshal([]byte(input), &entry)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Unmarshal - Should execute without error, but got: %s", err)
+	}
+
+	if !entry.Message.IsBinary() || string(entry.Message.Values[0]) != "hi\xff" {
+		t.Errorf("Unmarshal - Expected a binary message but got %q", entry.Message.Values)
+	}
+
+	if entry.PID.String() != "282" {
+		t.Errorf("Unmarshal - Expected a string value but got %s", entry.PID)
+	}
+
+	if len(entry.SyslogIdentifier.Values) != 2 || entry.SyslogIdentifier.String() != "first\nhi" {
+		t.Errorf("Unmarshal - Expected repeated values but got %q", entry.SyslogIdentifier.Values)
+	}
+
+	if !entry.Codefile.IsEmpty() {
+		t.Errorf("Unmarshal - Expected null to be empty but got %q", entry.Codefile.Values)
+	}
+}
+
+func TestField_Render_BinaryEncodings(t *testing.T) {
+	//	Arrange
+	field := journal.Field{Values: [][]byte{[]byte("hi\xff")}}
+
+	tests := []struct {
+		encoding journal.BinaryEncoding
+		expected string
+	}{
+		{journal.BinaryUTF8, "hi�"},
+		{journal.BinaryBase64, "aGn/"},
+		{journal.BinaryHex, "6869ff"},
+	}
+
+	for _, test := range tests {
+		//	Act
+		actual := field.Render(test.encoding)
+
+		//	Assert
+		if actual != test.expected {
+			t.Errorf("Render(%s) - Expected %q but got %q", test.encoding, test.expected, actual)
+		}
+	}
+}
+
+func TestField_Marshal_RoundTrips(t *testing.T) {
+	//	Arrange
+	field := journal.Field{Values: [][]byte{[]byte("text"), []byte("hi\xff")}}
+
+	//	Act
+	encoded, err := json.Marshal(field)
+	if err != nil {
+		t.Fatalf("Marshal - Should execute without error, but got: %s", err)
+	}
+	decoded := journal.Field{}
+	err = json.Unmarshal(encoded, &decoded)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Unmarshal - Should execute without error, but got: %s", err)
+	}
+
+	if string(encoded) != `["text",[104,105,255]]` {
+		t.Errorf("Marshal - Unexpected encoding: %s", encoded)
+	}
+
+	if decoded.Render(journal.BinaryHex) != "text\n6869ff" {
+		t.Errorf("Unmarshal - Unexpected values: %q", decoded.Values)
+	}
+}
+
+func TestEntry_Unmarshal_KeepsCustomFields(t *testing.T) {
+	//	Arrange
+	input := `{"__CURSOR":"s=1;i=1","MESSAGE":"hello","_PID":"282","REQUEST_ID":"abc123"}`
+	entry := journal.Entry{}
+
+	//	Act
+	err := json.Unmarshal([]byte(input), &entry)
+	selected := entry.SelectFields([]string{"REQUEST_ID", "MISSING"})
+	all := entry.SelectFields([]string{"*"})
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Unmarshal - Should execute without error, but got: %s", err)
+	}
+
+	if entry.Message.String() != "hello" || entry.Field("REQUEST_ID").String() != "abc123" {
+		t.Errorf("Unmarshal - Expected typed and custom fields but got: %+v", entry)
+	}
+
+	if len(selected) != 1 || selected["REQUEST_ID"].String() != "abc123" {
+		t.Errorf("SelectFields - Expected only REQUEST_ID but got: %v", selected)
+	}
+
+	if len(all) != 3 {
+		t.Errorf("SelectFields - Expected every non-address field but got: %v", all)
+	}
+}
+
+func TestEntry_Marshal_WritesEveryField(t *testing.T) {
+	//	Arrange
+	input := `{"__CURSOR":"s=1;i=1","MESSAGE":"hello","_PID":"282","REQUEST_ID":"abc123","BINARY":[104,105,255]}`
+	entry := journal.Entry{}
+	if err := json.Unmarshal([]byte(input), &entry); err != nil {
+		t.Fatalf("Unmarshal - Should execute without error, but got: %s", err)
+	}
+	entry.Message = journal.NewField("changed")
+
+	//	Act
+	encoded, err := json.Marshal(entry)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Marshal - Should execute without error, but got: %s", err)
+	}
+
+	want := `{"BINARY":[104,105,255],"MESSAGE":"changed","REQUEST_ID":"abc123","_PID":"282","__CURSOR":"s=1;i=1"}`
+	if string(encoded) != want {
+		t.Errorf("Marshal - Expected %s but got %s", want, encoded)
+	}
+}
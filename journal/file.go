@@ -0,0 +1,565 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+/*
+	The systemd journal file format is documented here:
+	https://systemd.io/JOURNAL_FILE_FORMAT/
+
+	All integers are little endian.  A file starts with a header, followed by an
+	arena of 8-byte aligned objects.  Every object starts with a 16 byte object header
+	(type, flags, reserved, size).  Each distinct FIELD=value payload is stored once, in
+	a data object that's found through the data hash table.  A data object links to
+	every entry that uses it: the first one directly, and the rest in a chain of entry
+	array objects.
+*/
+
+const (
+	journalSignature = "LPKSHHRH"
+
+	//	Header incompatible flags
+	headerIncompatibleCompressedXZ   = 1 << 0
+	headerIncompatibleCompressedLZ4  = 1 << 1
+	headerIncompatibleKeyedHash      = 1 << 2
+	headerIncompatibleCompressedZSTD = 1 << 3
+	headerIncompatibleCompact        = 1 << 4
+	headerIncompatibleSupported      = headerIncompatibleCompressedXZ | headerIncompatibleCompressedLZ4 | headerIncompatibleKeyedHash | headerIncompatibleCompressedZSTD | headerIncompatibleCompact
+
+	//	Object types
+	objectData       = 1
+	objectEntry      = 3
+	objectEntryArray = 6
+
+	//	Object flags
+	objectCompressedXZ   = 1 << 0
+	objectCompressedLZ4  = 1 << 1
+	objectCompressedZSTD = 1 << 2
+
+	objectHeaderSize = 16
+
+	//	The smallest header we know how to read (systemd 187+)
+	minHeaderSize = 208
+
+	//	The largest data payload systemd writes (DATA_SIZE_MAX).  Compressed payloads
+	//	that claim to be bigger than this are corrupt
+	maxPayloadSize = 768 << 20
+)
+
+// zstdDecoder is shared by all journal files.  DecodeAll is safe for concurrent use
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxPayloadSize))
+
+// journalFile is a read-only handle on a single journal file
+type journalFile struct {
+	path   string
+	f      *os.File
+	size   int64
+	header fileHeader
+}
+
+// fileHeader contains the parts of the journal file header we use
+type fileHeader struct {
+	IncompatibleFlags   uint32
+	State               uint8
+	FileID              [16]byte
+	SeqnumID            [16]byte
+	HeaderSize          uint64
+	DataHashTableOffset uint64
+	DataHashTableSize   uint64
+	NEntries            uint64
+	TailEntrySeqnum     uint64
+	HeadEntrySeqnum     uint64
+	EntryArrayOffset    uint64
+	HeadEntryRealtime   uint64
+	TailEntryRealtime   uint64
+	TailEntryMonotonic  uint64
+}
+
+// entryHeader is the fixed part of an entry object
+type entryHeader struct {
+	Seqnum    uint64
+	Realtime  uint64
+	Monotonic uint64
+	BootID    [16]byte
+	XorHash   uint64
+}
+
+// rawEntry is an entry read from a journal file, along with all of its fields.
+// Repeated fields keep every value in the order they were found
+type rawEntry struct {
+	entryHeader
+	SeqnumID [16]byte
+	Fields   map[string][]string
+}
+
+// openJournalFile opens a journal file and validates its header
+func openJournalFile(path string) (*journalFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	retval := &journalFile{path: path, f: f, size: info.Size()}
+	if err := retval.readHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return retval, nil
+}
+
+// Close closes the underlying file
+func (jf *journalFile) Close() error {
+	return jf.f.Close()
+}
+
+// readHeader reads and validates the file header
+func (jf *journalFile) readHeader() error {
+	buf := make([]byte, minHeaderSize)
+	if _, err := jf.f.ReadAt(buf, 0); err != nil {
+		return fmt.Errorf("problem reading journal header: %s", err)
+	}
+
+	if string(buf[0:8]) != journalSignature {
+		return fmt.Errorf("not a journal file")
+	}
+
+	h := fileHeader{
+		IncompatibleFlags:   binary.LittleEndian.Uint32(buf[12:16]),
+		State:               buf[16],
+		HeaderSize:          binary.LittleEndian.Uint64(buf[88:96]),
+		DataHashTableOffset: binary.LittleEndian.Uint64(buf[104:112]),
+		DataHashTableSize:   binary.LittleEndian.Uint64(buf[112:120]),
+		NEntries:            binary.LittleEndian.Uint64(buf[152:160]),
+		TailEntrySeqnum:     binary.LittleEndian.Uint64(buf[160:168]),
+		HeadEntrySeqnum:     binary.LittleEndian.Uint64(buf[168:176]),
+		EntryArrayOffset:    binary.LittleEndian.Uint64(buf[176:184]),
+		HeadEntryRealtime:   binary.LittleEndian.Uint64(buf[184:192]),
+		TailEntryRealtime:   binary.LittleEndian.Uint64(buf[192:200]),
+		TailEntryMonotonic:  binary.LittleEndian.Uint64(buf[200:208]),
+	}
+	copy(h.FileID[:], buf[24:40])
+	copy(h.SeqnumID[:], buf[72:88])
+
+	if h.IncompatibleFlags&^headerIncompatibleSupported != 0 {
+		return fmt.Errorf("unsupported journal incompatible flags: %#x", h.IncompatibleFlags)
+	}
+
+	if h.HeaderSize < minHeaderSize {
+		return fmt.Errorf("journal header is too small: %v bytes", h.HeaderSize)
+	}
+
+	jf.header = h
+	return nil
+}
+
+// compact returns true if the file uses the compact object layout
+func (jf *journalFile) compact() bool {
+	return jf.header.IncompatibleFlags&headerIncompatibleCompact != 0
+}
+
+// keyedHash returns true if the file's hash tables use siphash24 keyed with the file id
+func (jf *journalFile) keyedHash() bool {
+	return jf.header.IncompatibleFlags&headerIncompatibleKeyedHash != 0
+}
+
+// readObject reads the complete object at the given offset and checks its type
+func (jf *journalFile) readObject(offset uint64, objectType uint8) (flags uint8, obj []byte, err error) {
+	if offset == 0 || offset%8 != 0 || int64(offset)+objectHeaderSize > jf.size {
+		return 0, nil, fmt.Errorf("invalid object offset %v", offset)
+	}
+
+	hdr := make([]byte, objectHeaderSize)
+	if _, err := jf.f.ReadAt(hdr, int64(offset)); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.LittleEndian.Uint64(hdr[8:16])
+	if hdr[0] != objectType {
+		return 0, nil, fmt.Errorf("object at %v has type %v, expected %v", offset, hdr[0], objectType)
+	}
+	if size < objectHeaderSize || int64(offset+size) > jf.size {
+		return 0, nil, fmt.Errorf("object at %v has invalid size %v", offset, size)
+	}
+
+	obj = make([]byte, size)
+	if _, err := jf.f.ReadAt(obj, int64(offset)); err != nil {
+		return 0, nil, err
+	}
+
+	return hdr[1], obj, nil
+}
+
+// entryArrayItems walks the chain of entry arrays that starts at offset and returns
+// up to limit entry offsets, in seqnum order
+func (jf *journalFile) entryArrayItems(offset, limit uint64) ([]uint64, error) {
+	retval := []uint64{}
+
+	itemSize := uint64(8)
+	if jf.compact() {
+		itemSize = 4
+	}
+
+	next := offset
+	for next != 0 && uint64(len(retval)) < limit {
+		_, obj, err := jf.readObject(next, objectEntryArray)
+		if err != nil {
+			return retval, err
+		}
+
+		if len(obj) < 24 {
+			return retval, fmt.Errorf("entry array at %v is truncated", next)
+		}
+
+		next = binary.LittleEndian.Uint64(obj[16:24])
+		for i := uint64(24); i+itemSize <= uint64(len(obj)) && uint64(len(retval)) < limit; i += itemSize {
+			var item uint64
+			if itemSize == 4 {
+				item = uint64(binary.LittleEndian.Uint32(obj[i : i+4]))
+			} else {
+				item = binary.LittleEndian.Uint64(obj[i : i+8])
+			}
+
+			//	An offset of zero marks the unused tail of the array
+			if item == 0 {
+				return retval, nil
+			}
+			retval = append(retval, item)
+		}
+	}
+
+	return retval, nil
+}
+
+// findData looks up the data object with the payload in the data hash table.  It
+// returns the object, or nil if no entry in the file has the payload
+func (jf *journalFile) findData(payload []byte) ([]byte, error) {
+	buckets := jf.header.DataHashTableSize / 16
+	if buckets == 0 || jf.header.DataHashTableOffset+jf.header.DataHashTableSize > uint64(jf.size) {
+		return nil, fmt.Errorf("journal file has no valid data hash table")
+	}
+
+	hash := hashPayload(jf.keyedHash(), jf.header.FileID, payload)
+
+	item := make([]byte, 16)
+	if _, err := jf.f.ReadAt(item, int64(jf.header.DataHashTableOffset+hash%buckets*16)); err != nil {
+		return nil, err
+	}
+
+	//	Follow the bucket's chain of data objects until we find the one with our payload
+	for next := binary.LittleEndian.Uint64(item[0:8]); next != 0; {
+		offset := next
+		flags, obj, err := jf.readObject(offset, objectData)
+		if err != nil {
+			return nil, err
+		}
+		if len(obj) < 64 {
+			return nil, fmt.Errorf("data object at %v is truncated", offset)
+		}
+		next = binary.LittleEndian.Uint64(obj[24:32])
+
+		if binary.LittleEndian.Uint64(obj[16:24]) != hash {
+			continue
+		}
+
+		found, err := jf.dataPayload(offset, flags, obj)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(found, payload) {
+			return obj, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// dataEntries returns the offsets of every entry that has the payload, in seqnum order
+func (jf *journalFile) dataEntries(payload string) ([]uint64, error) {
+	obj, err := jf.findData([]byte(payload))
+	if err != nil || obj == nil {
+		return nil, err
+	}
+
+	first := binary.LittleEndian.Uint64(obj[40:48])
+	arrayOffset := binary.LittleEndian.Uint64(obj[48:56])
+	count := binary.LittleEndian.Uint64(obj[56:64])
+	if first == 0 || count == 0 {
+		return nil, nil
+	}
+
+	rest, err := jf.entryArrayItems(arrayOffset, count-1)
+	return append([]uint64{first}, rest...), err
+}
+
+// unitEntries returns the offsets of the entries that might belong to the unit, in seqnum
+// order.  These are the entries with any of the fields journalctl --unit matches on, so
+// they still need to be checked with matchesUnit
+func (jf *journalFile) unitEntries(unit string) ([]uint64, error) {
+	seen := make(map[uint64]bool)
+	retval := []uint64{}
+
+	for _, field := range []string{"_SYSTEMD_UNIT", "UNIT", "OBJECT_SYSTEMD_UNIT", "COREDUMP_UNIT"} {
+		offsets, err := jf.dataEntries(field + "=" + unit)
+		if err != nil {
+			return retval, err
+		}
+
+		for _, offset := range offsets {
+			if !seen[offset] {
+				seen[offset] = true
+				retval = append(retval, offset)
+			}
+		}
+	}
+
+	//	Entries are appended to the file, so offset order is seqnum order
+	sort.Slice(retval, func(i, j int) bool { return retval[i] < retval[j] })
+
+	return retval, nil
+}
+
+// readEntryHeader reads just the fixed part of the entry at offset
+func (jf *journalFile) readEntryHeader(offset uint64) (entryHeader, error) {
+	buf := make([]byte, 64)
+	if _, err := jf.f.ReadAt(buf, int64(offset)); err != nil {
+		return entryHeader{}, err
+	}
+	if buf[0] != objectEntry {
+		return entryHeader{}, fmt.Errorf("object at %v is not an entry", offset)
+	}
+
+	return parseEntryHeader(buf), nil
+}
+
+func parseEntryHeader(buf []byte) entryHeader {
+	h := entryHeader{
+		Seqnum:    binary.LittleEndian.Uint64(buf[16:24]),
+		Realtime:  binary.LittleEndian.Uint64(buf[24:32]),
+		Monotonic: binary.LittleEndian.Uint64(buf[32:40]),
+		XorHash:   binary.LittleEndian.Uint64(buf[56:64]),
+	}
+	copy(h.BootID[:], buf[40:56])
+	return h
+}
+
+// readEntry reads the entry at offset, along with all of its data fields
+func (jf *journalFile) readEntry(offset uint64) (rawEntry, error) {
+	_, obj, err := jf.readObject(offset, objectEntry)
+	if err != nil {
+		return rawEntry{}, err
+	}
+	if len(obj) < 64 {
+		return rawEntry{}, fmt.Errorf("entry at %v is truncated", offset)
+	}
+
+	retval := rawEntry{
+		entryHeader: parseEntryHeader(obj),
+		SeqnumID:    jf.header.SeqnumID,
+		Fields:      make(map[string][]string),
+	}
+
+	itemSize := 16
+	if jf.compact() {
+		itemSize = 4
+	}
+
+	for i := 64; i+itemSize <= len(obj); i += itemSize {
+		var dataOffset uint64
+		if jf.compact() {
+			dataOffset = uint64(binary.LittleEndian.Uint32(obj[i : i+4]))
+		} else {
+			dataOffset = binary.LittleEndian.Uint64(obj[i : i+8])
+		}
+
+		payload, err := jf.readData(dataOffset)
+		if err != nil {
+			return retval, err
+		}
+
+		//	Each data payload is in the form FIELD=value
+		sep := bytes.IndexByte(payload, '=')
+		if sep < 1 {
+			continue
+		}
+
+		name := string(payload[:sep])
+		retval.Fields[name] = append(retval.Fields[name], string(payload[sep+1:]))
+	}
+
+	return retval, nil
+}
+
+// readData reads the (decompressed) payload of the data object at offset
+func (jf *journalFile) readData(offset uint64) ([]byte, error) {
+	flags, obj, err := jf.readObject(offset, objectData)
+	if err != nil {
+		return nil, err
+	}
+
+	return jf.dataPayload(offset, flags, obj)
+}
+
+// dataPayload returns the (decompressed) payload of the data object
+func (jf *journalFile) dataPayload(offset uint64, flags uint8, obj []byte) ([]byte, error) {
+	start := 64
+	if jf.compact() {
+		start = 72
+	}
+	if len(obj) < start {
+		return nil, fmt.Errorf("data object at %v is truncated", offset)
+	}
+
+	return decompressPayload(flags, obj[start:])
+}
+
+// decompressPayload decompresses a data object payload based on its object flags
+func decompressPayload(flags uint8, payload []byte) ([]byte, error) {
+	switch {
+	case flags&objectCompressedXZ != 0:
+		r, err := xz.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("problem reading xz payload: %s", err)
+		}
+		retval, err := io.ReadAll(io.LimitReader(r, maxPayloadSize+1))
+		if err == nil && len(retval) > maxPayloadSize {
+			return nil, fmt.Errorf("xz payload is larger than %v bytes", maxPayloadSize)
+		}
+		return retval, err
+
+	case flags&objectCompressedLZ4 != 0:
+		//	LZ4 payloads are prefixed with the uncompressed size.  LZ4 can't compress
+		//	better than 255 to 1, so a bigger size means the object is corrupt
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("lz4 payload is truncated")
+		}
+		size := binary.LittleEndian.Uint64(payload[:8])
+		if size > maxPayloadSize || size > uint64(len(payload)-8)*255 {
+			return nil, fmt.Errorf("lz4 payload has an invalid size %v", size)
+		}
+		dst := make([]byte, size)
+		n, err := lz4.UncompressBlock(payload[8:], dst)
+		if err != nil {
+			return nil, fmt.Errorf("problem reading lz4 payload: %s", err)
+		}
+		return dst[:n], nil
+
+	case flags&objectCompressedZSTD != 0:
+		return zstdDecoder.DecodeAll(payload, nil)
+	}
+
+	return payload, nil
+}
+
+// entriesAfter returns the offsets (in seqnum order) that come after the given
+// cursor.  A nil cursor returns all of them
+func (jf *journalFile) entriesAfter(offsets []uint64, c *Cursor) ([]uint64, error) {
+	if c == nil {
+		return offsets, nil
+	}
+
+	//	A cursor from another file's seqnum id is compared by timestamps, which don't
+	//	have to be in the same order as the file's entries (like after a clock change),
+	//	so check every entry
+	if jf.header.SeqnumID != c.SeqnumID {
+		retval := []uint64{}
+		for _, offset := range offsets {
+			h, err := jf.readEntryHeader(offset)
+			if err != nil {
+				return nil, err
+			}
+			if compareToCursor(h, jf.header.SeqnumID, c) > 0 {
+				retval = append(retval, offset)
+			}
+		}
+		return retval, nil
+	}
+
+	//	Skip the whole file if it ends before the cursor
+	if jf.header.TailEntrySeqnum <= c.Seqnum {
+		return nil, nil
+	}
+
+	//	Entries in a file are in seqnum order, so we can binary search for the first one
+	//	after the cursor
+	var searchErr error
+	first := sort.Search(len(offsets), func(i int) bool {
+		h, err := jf.readEntryHeader(offsets[i])
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return compareToCursor(h, jf.header.SeqnumID, c) > 0
+	})
+	if searchErr != nil {
+		return nil, searchErr
+	}
+
+	return offsets[first:], nil
+}
+
+// compareToCursor orders an entry against a cursor the same way journalctl does.  It
+// compares seqnums if they're from the same seqnum id, monotonic timestamps if they're
+// from the same boot, and otherwise realtime timestamps, using the xor hash to break a
+// tie.  It returns -1, 0 or 1 if the entry is before, the same as, or after the cursor
+func compareToCursor(h entryHeader, seqnumID [16]byte, c *Cursor) int {
+	compare := func(a, b uint64) int {
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	}
+
+	if seqnumID == c.SeqnumID {
+		return compare(h.Seqnum, c.Seqnum)
+	}
+
+	if h.BootID == c.BootID {
+		if retval := compare(h.Monotonic, c.Monotonic); retval != 0 {
+			return retval
+		}
+	}
+
+	if retval := compare(h.Realtime, c.Realtime); retval != 0 {
+		return retval
+	}
+
+	return compare(h.XorHash, c.XorHash)
+}
+
+// cursor returns the cursor for the given entry
+func (e rawEntry) cursor() string {
+	return Cursor{
+		SeqnumID:  e.SeqnumID,
+		Seqnum:    e.Seqnum,
+		BootID:    e.BootID,
+		Monotonic: e.Monotonic,
+		Realtime:  e.Realtime,
+		XorHash:   e.XorHash,
+	}.String()
+}
+
+// bootID returns the hex formatted boot id for the entry
+func (e rawEntry) bootID() string {
+	return hex.EncodeToString(e.BootID[:])
+}
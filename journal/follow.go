@@ -0,0 +1,142 @@
+package journal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/danesparza/cloudjournal/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// nativeFollowInterval is how often the native reader checks the journal files for new entries
+const nativeFollowInterval = time.Second
+
+// Follow streams journal entries for the given unit to the entries channel as they
+// arrive, starting after the given cursor (or from the beginning if the cursor is empty).
+// It blocks until the context is cancelled or the reader fails, and closes the
+// entries channel when it returns
+func Follow(ctx context.Context, unit, cursor string, entries chan<- Entry) error {
+	defer close(entries)
+
+	log.WithFields(log.Fields{
+		"unit":   unit,
+		"cursor": cursor,
+		"reader": viper.GetString("journal.reader"),
+	}).Debug("following journald log entries")
+
+	switch viper.GetString("journal.reader") {
+	case "native":
+		return followNative(ctx, unit, cursor, entries)
+	default:
+		return followJournalctl(ctx, unit, cursor, entries)
+	}
+}
+
+// followJournalctl runs a long-lived journalctl --follow for the unit
+func followJournalctl(ctx context.Context, unit, cursor string, entries chan<- Entry) error {
+
+	//	journalctl --unit=daydash --output=json --no-pager --follow --lines=all
+	// or
+	// journalctl --unit=daydash --output=json --no-pager --follow --after-cursor="s=..."
+	args := []string{"--unit", unit, "--output", "json", "--no-pager", "--follow"}
+	if cursor == "" {
+		args = append(args, "--lines", "all")
+	} else {
+		args = append(args, "--after-cursor", cursor)
+	}
+
+	cmd := exec.CommandContext(ctx, "journalctl", args...)
+
+	//	Keep stderr out of the JSON stream
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("problem starting journalctl: %s", err)
+	}
+
+	dec := NewDecoder(stdout)
+	for {
+		entry := Entry{}
+		err := dec.Decode(&entry)
+		if errors.Is(err, ErrMalformedEntry) {
+			metrics.Add("journal.skipped", 1)
+			log.WithFields(log.Fields{
+				"unit":       unit,
+				"lastCursor": dec.LastCursor,
+				"skipped":    dec.Skipped,
+			}).WithError(err).Warn("skipping journal entry that can't be decoded")
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.WithError(err).Error("problem reading from journalctl")
+			}
+			break
+		}
+
+		select {
+		case entries <- entry:
+		case <-ctx.Done():
+		}
+	}
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("journalctl exited: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return fmt.Errorf("journalctl exited unexpectedly")
+}
+
+// followNative checks the journal files for new entries every nativeFollowInterval
+func followNative(ctx context.Context, unit, cursor string, entries chan<- Entry) error {
+	journalPaths := strings.Split(viper.GetString("journal.path"), ",")
+
+	ticker := time.NewTicker(nativeFollowInterval)
+	defer ticker.Stop()
+
+	pageSize := viper.GetInt("journal.pagesize")
+
+	for {
+		found, err := ReadEntriesForUnitFromCursor(journalPaths, unit, cursor, pageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range found {
+			select {
+			case entries <- entry:
+				cursor = entry.Cursor
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		//	If we got a full page there is more to read right away
+		if pageSize > 0 && len(found) >= pageSize {
+			continue
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
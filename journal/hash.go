@@ -0,0 +1,133 @@
+package journal
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// hashPayload returns the hash systemd uses to find a data object in the data hash table.
+// Files with the keyed hash flag use siphash24 keyed with the file id.  Older files use
+// Jenkins' lookup3 hash
+func hashPayload(keyed bool, fileID [16]byte, payload []byte) uint64 {
+	if keyed {
+		return sipHash24(fileID, payload)
+	}
+	return jenkinsHash64(payload)
+}
+
+// jenkinsHash64 is systemd's jenkins_hash64: lookup3's hashlittle2 with both
+// seeds set to zero, and the two results joined as (c << 32) | b
+func jenkinsHash64(data []byte) uint64 {
+	a := 0xdeadbeef + uint32(len(data))
+	b, c := a, a
+
+	if len(data) == 0 {
+		return uint64(c)<<32 | uint64(b)
+	}
+
+	for len(data) > 12 {
+		a += binary.LittleEndian.Uint32(data[0:4])
+		b += binary.LittleEndian.Uint32(data[4:8])
+		c += binary.LittleEndian.Uint32(data[8:12])
+
+		a -= c
+		a ^= bits.RotateLeft32(c, 4)
+		c += b
+		b -= a
+		b ^= bits.RotateLeft32(a, 6)
+		a += c
+		c -= b
+		c ^= bits.RotateLeft32(b, 8)
+		b += a
+		a -= c
+		a ^= bits.RotateLeft32(c, 16)
+		c += b
+		b -= a
+		b ^= bits.RotateLeft32(a, 19)
+		a += c
+		c -= b
+		c ^= bits.RotateLeft32(b, 4)
+		b += a
+
+		data = data[12:]
+	}
+
+	//	The last 1 to 12 bytes are read as if they were padded with zeros
+	tail := make([]byte, 12)
+	copy(tail, data)
+	a += binary.LittleEndian.Uint32(tail[0:4])
+	b += binary.LittleEndian.Uint32(tail[4:8])
+	c += binary.LittleEndian.Uint32(tail[8:12])
+
+	c ^= b
+	c -= bits.RotateLeft32(b, 14)
+	a ^= c
+	a -= bits.RotateLeft32(c, 11)
+	b ^= a
+	b -= bits.RotateLeft32(a, 25)
+	c ^= b
+	c -= bits.RotateLeft32(b, 16)
+	a ^= c
+	a -= bits.RotateLeft32(c, 4)
+	b ^= a
+	b -= bits.RotateLeft32(a, 14)
+	c ^= b
+	c -= bits.RotateLeft32(b, 24)
+
+	return uint64(c)<<32 | uint64(b)
+}
+
+// sipHash24 is SipHash-2-4 with a 128 bit key
+func sipHash24(key [16]byte, data []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[0:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	length := len(data)
+	for len(data) >= 8 {
+		m := binary.LittleEndian.Uint64(data[0:8])
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		data = data[8:]
+	}
+
+	//	The last block is the remaining bytes, with the length in the top byte
+	tail := make([]byte, 8)
+	copy(tail, data)
+	m := binary.LittleEndian.Uint64(tail) | uint64(length)<<56
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+
+	return v0 ^ v1 ^ v2 ^ v3
+}
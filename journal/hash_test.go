@@ -0,0 +1,46 @@
+package journal_test
+
+import (
+	"testing"
+
+	"github.com/danesparza/cloudjournal/journal"
+)
+
+func TestHash_HashPayload_Jenkins_MatchesLookup3(t *testing.T) {
+	//	Arrange - the test vectors from lookup3.c, with both seeds set to zero
+	tests := map[string]uint64{
+		"":                               0xdeadbeefdeadbeef,
+		"Four score and seven years ago": 0x17770551ce7226e6,
+	}
+
+	for data, want := range tests {
+		//	Act
+		got := journal.HashPayload(false, [16]byte{}, []byte(data))
+
+		//	Assert
+		if got != want {
+			t.Errorf("HashPayload - Expected %#x for %q, but got %#x", want, data, got)
+		}
+	}
+}
+
+func TestHash_HashPayload_Keyed_MatchesSipHash24(t *testing.T) {
+	//	Arrange - the test vectors from the SipHash paper, with the key 00 01 .. 0f
+	key := [16]byte{}
+	for i := range key {
+		key[i] = byte(i)
+	}
+	message := []byte{}
+	for i := 0; i < 15; i++ {
+		message = append(message, byte(i))
+	}
+
+	//	Act
+	empty := journal.HashPayload(true, key, nil)
+	got := journal.HashPayload(true, key, message)
+
+	//	Assert
+	if empty != 0x726fdb47dd0e0e31 || got != 0xa129ca6149be45e5 {
+		t.Errorf("HashPayload - Expected the SipHash-2-4 test vectors, but got %#x and %#x", empty, got)
+	}
+}
@@ -0,0 +1,108 @@
+package journal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// getJournalctlPageForUnitFromCursor gets a page of journal entries by running
+// journalctl for the given unit.  It gets journal entries from the given cursor
+// (or from the beginning if the cursor is empty).  Output is decoded as it streams
+// in, and journalctl is stopped once limit records have been read (a limit less
+// than 1 reads everything)
+func getJournalctlPageForUnitFromCursor(unit, cursor string, limit int) Page {
+
+	retval := Page{Entries: []Entry{}}
+
+	//	Get a list of entries for the given unit:
+	// journalctl --unit=daydash --output=json --no-pager
+	// or
+	// journalctl --unit=daydash --output=json --no-pager --after-cursor="s=f4a560eb4f2b45b8ba4c8b5fba8ab6ce;i=232;b=fb0855f265b440ab8d797634862ddb83;m=24fb96f;t=5d05edfec1b9b;x=7db05987bc8c3aab"
+	args := []string{"--unit", unit, "--output", "json", "--no-pager"}
+	if cursor != "" {
+		args = append(args, "--after-cursor", cursor)
+	}
+
+	cmd := exec.Command("journalctl", args...)
+
+	//	Keep warnings on stderr out of the JSON on stdout
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.WithError(err).Error("problem running journalctl command")
+		return retval
+	}
+
+	if err := cmd.Start(); err != nil {
+		log.WithError(err).Error("problem running journalctl command")
+		return retval
+	}
+
+	//	Decode one record at a time until we have a full page
+	dec := NewDecoder(stdout)
+	stoppedEarly := true
+	for limit < 1 || dec.Records < limit {
+		entry := Entry{}
+		err := dec.Decode(&entry)
+		if err == nil {
+			retval.Entries = append(retval.Entries, entry)
+			continue
+		}
+
+		if errors.Is(err, ErrMalformedEntry) {
+			log.WithFields(log.Fields{
+				"unit":       unit,
+				"lastCursor": dec.LastCursor,
+			}).WithError(err).Warn("skipping journal entry that can't be decoded")
+			continue
+		}
+
+		if err != io.EOF {
+			log.WithError(err).Error("problem reading journalctl output")
+		}
+		stoppedEarly = false
+		break
+	}
+
+	//	We may have stopped reading early, so we don't need journalctl anymore
+	if stoppedEarly {
+		cmd.Process.Kill()
+	}
+	err = cmd.Wait()
+	if err != nil && !stoppedEarly {
+		log.WithFields(log.Fields{
+			"unit":   unit,
+			"cursor": cursor,
+			"stderr": strings.TrimSpace(stderr.String()),
+		}).WithError(err).Error("problem running journalctl command")
+	} else if stderr.Len() > 0 {
+		log.WithFields(log.Fields{
+			"unit":   unit,
+			"stderr": strings.TrimSpace(stderr.String()),
+		}).Debug("journalctl wrote to stderr")
+	}
+
+	retval.LastCursor = dec.LastCursor
+	retval.Records = dec.Records
+	retval.Skipped = dec.Skipped
+
+	if retval.Records > 0 {
+		log.WithFields(log.Fields{
+			"unit":      unit,
+			"cursor":    cursor,
+			"limit":     limit,
+			"itemCount": len(retval.Entries),
+			"skipped":   retval.Skipped,
+		}).Debug("found items in journald")
+	}
+
+	//	Return the page of Entries
+	return retval
+}
@@ -0,0 +1,188 @@
+package journal
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// coredumpMessageID is the MESSAGE_ID systemd-coredump uses for crash reports
+const coredumpMessageID = "fc2e22bc6ee647b6b90729ab34a250b1"
+
+// unitSuffixes are the valid systemd unit type suffixes
+var unitSuffixes = []string{
+	".service", ".socket", ".device", ".mount", ".automount", ".swap",
+	".target", ".path", ".timer", ".snapshot", ".slice", ".scope",
+}
+
+// ReadEntriesForUnitFromCursor reads journal files directly from the given directories
+// (for example /var/log/journal) and returns up to limit entries for the given unit after
+// the given cursor (or from the beginning if the cursor is empty).  A limit less than 1
+// returns every entry.  Active, archived and rotated journal files are all read, and
+// entries are returned in time order
+func ReadEntriesForUnitFromCursor(dirs []string, unit, cursor string, limit int) ([]Entry, error) {
+	retval := []Entry{}
+
+	var after *Cursor
+	if cursor != "" {
+		c, err := ParseCursor(cursor)
+		if err != nil {
+			return retval, err
+		}
+		after = &c
+	}
+
+	unit = mangleUnitName(unit)
+
+	raw := []rawEntry{}
+	for _, path := range journalFiles(dirs) {
+		entries, err := readUnitEntriesFromFile(path, unit, after, limit)
+		if err != nil {
+			//	A single unreadable file (or one being written to) shouldn't stop the others
+			log.WithFields(log.Fields{
+				"path": path,
+				"unit": unit,
+			}).WithError(err).Warn("problem reading journal file")
+		}
+		raw = append(raw, entries...)
+
+		//	Each file returns at most limit entries, so only the first limit entries so
+		//	far need to be kept.  That keeps at most two pages in memory
+		if limit > 0 && len(raw) > limit {
+			sortRawEntries(raw)
+			raw = raw[:limit]
+		}
+	}
+
+	//	Interleave the entries from all files in time order
+	sortRawEntries(raw)
+
+	for _, r := range raw {
+		retval = append(retval, r.toEntry())
+	}
+
+	return retval, nil
+}
+
+// sortRawEntries sorts entries from any number of files in time order
+func sortRawEntries(raw []rawEntry) {
+	sort.SliceStable(raw, func(i, j int) bool {
+		if raw[i].Realtime != raw[j].Realtime {
+			return raw[i].Realtime < raw[j].Realtime
+		}
+		return raw[i].Seqnum < raw[j].Seqnum
+	})
+}
+
+// readUnitEntriesFromFile returns up to limit entries in a single journal file that belong to the unit
+func readUnitEntriesFromFile(path, unit string, after *Cursor, limit int) ([]rawEntry, error) {
+	retval := []rawEntry{}
+
+	jf, err := openJournalFile(path)
+	if err != nil {
+		return retval, err
+	}
+	defer jf.Close()
+
+	//	Only read the entries the data hash table says have one of the unit's fields
+	offsets, err := jf.unitEntries(unit)
+	if err != nil && len(offsets) == 0 {
+		return retval, err
+	}
+
+	offsets, searchErr := jf.entriesAfter(offsets, after)
+	if searchErr != nil {
+		return retval, searchErr
+	}
+
+	for _, offset := range offsets {
+		entry, err := jf.readEntry(offset)
+		if err != nil {
+			return retval, err
+		}
+
+		if matchesUnit(entry.Fields, unit) {
+			retval = append(retval, entry)
+			if limit > 0 && len(retval) >= limit {
+				break
+			}
+		}
+	}
+
+	return retval, err
+}
+
+// journalFiles returns the journal files found in the given directories and
+// their (machine id) subdirectories
+func journalFiles(dirs []string) []string {
+	retval := []string{}
+
+	for _, dir := range dirs {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+
+		for _, pattern := range []string{"*.journal", "*.journal~", "*/*.journal", "*/*.journal~"} {
+			matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+			retval = append(retval, matches...)
+		}
+	}
+
+	return retval
+}
+
+// mangleUnitName adds the .service suffix to a unit name without a type, the
+// same way journalctl --unit does
+func mangleUnitName(unit string) string {
+	for _, suffix := range unitSuffixes {
+		if strings.HasSuffix(unit, suffix) {
+			return unit
+		}
+	}
+
+	return unit + ".service"
+}
+
+// matchesUnit returns true if the fields match the unit, using the same rules as journalctl --unit
+func matchesUnit(fields map[string][]string, unit string) bool {
+	has := func(name, value string) bool {
+		for _, v := range fields[name] {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case has("_SYSTEMD_UNIT", unit):
+		return true
+	case has("_PID", "1") && has("UNIT", unit):
+		return true
+	case has("_UID", "0") && has("OBJECT_SYSTEMD_UNIT", unit):
+		return true
+	case has("_UID", "0") && has("MESSAGE_ID", coredumpMessageID) && has("COREDUMP_UNIT", unit):
+		return true
+	}
+
+	return false
+}
+
+// toEntry converts the raw entry to an Entry, adding the same
+// address fields that journalctl --output=json adds
+func (e rawEntry) toEntry() Entry {
+	fields := make(map[string]Field)
+	for name, values := range e.Fields {
+		fields[name] = NewField(values...)
+	}
+	fields["__CURSOR"] = NewField(e.cursor())
+	fields["__REALTIME_TIMESTAMP"] = NewField(strconv.FormatUint(e.Realtime, 10))
+	fields["__MONOTONIC_TIMESTAMP"] = NewField(strconv.FormatUint(e.Monotonic, 10))
+	fields["_BOOT_ID"] = NewField(e.bootID())
+
+	return newEntry(fields)
+}
@@ -0,0 +1,475 @@
+package journal_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// testJournalEntry is an entry to write to a test journal file
+type testJournalEntry struct {
+	realtime uint64
+	fields   []string
+}
+
+// testJournalFormat is how a test journal file is written
+type testJournalFormat struct {
+	//	compact writes a compact file, with keyed hashes
+	compact bool
+
+	//	compression is the object flag used for fields longer than 64 bytes.  The default is zstd
+	compression uint8
+
+	//	seqnumID is the file's seqnum id.  The default is testSeqnumID
+	seqnumID [16]byte
+}
+
+var testSeqnumID = [16]byte{0x7f, 0xe8, 0x95, 0xb4, 0x5f, 0x18, 0x44, 0x8d, 0xaa, 0x12, 0xdf, 0xe9, 0xec, 0x1d, 0x29, 0x93}
+var testBootID = [16]byte{0x6b, 0x9d, 0x0f, 0x62, 0xf4, 0x3c, 0x4b, 0x0b, 0xb0, 0xf6, 0x18, 0x48, 0xb4, 0xda, 0x3b, 0x15}
+var testFileID = [16]byte{0x3a, 0x1c, 0x5e, 0x20, 0x8d, 0x4f, 0x41, 0x6b, 0x9e, 0x07, 0xc2, 0x6d, 0x51, 0xf3, 0x88, 0x0a}
+
+// writeTestJournal writes a minimal (regular, non-compact) journal file containing the given entries.
+// Fields longer than 64 bytes are zstd compressed
+func writeTestJournal(t *testing.T, path string, firstSeqnum uint64, entries []testJournalEntry) {
+	writeTestJournalFormat(t, path, firstSeqnum, entries, testJournalFormat{})
+}
+
+// writeTestJournalFormat writes a minimal journal file containing the given entries, with a
+// data hash table that links each field to its entries
+func writeTestJournalFormat(t *testing.T, path string, firstSeqnum uint64, entries []testJournalEntry, format testJournalFormat) {
+	const headerSize = 272
+	const buckets = 7
+
+	if format.compression == 0 {
+		format.compression = 4
+	}
+	if format.seqnumID == [16]byte{} {
+		format.seqnumID = testSeqnumID
+	}
+
+	incompatible := uint32(1 << 3)
+	switch format.compression {
+	case 1:
+		incompatible = 1 << 0
+	case 2:
+		incompatible = 1 << 1
+	}
+	if format.compact {
+		incompatible |= 1<<2 | 1<<4
+	}
+
+	buf := make([]byte, headerSize)
+	align := func() {
+		for len(buf)%8 != 0 {
+			buf = append(buf, 0)
+		}
+	}
+	object := func(objectType, flags uint8, payload []byte) uint64 {
+		align()
+		offset := uint64(len(buf))
+		hdr := make([]byte, 16)
+		hdr[0] = objectType
+		hdr[1] = flags
+		binary.LittleEndian.PutUint64(hdr[8:], uint64(16+len(payload)))
+		buf = append(buf, hdr...)
+		buf = append(buf, payload...)
+		return offset
+	}
+	offsetItem := func(offset uint64) []byte {
+		if format.compact {
+			item := make([]byte, 4)
+			binary.LittleEndian.PutUint32(item, uint32(offset))
+			return item
+		}
+		item := make([]byte, 8)
+		binary.LittleEndian.PutUint64(item, offset)
+		return item
+	}
+	compress := func(payload []byte) []byte {
+		switch format.compression {
+		case 1:
+			var compressed bytes.Buffer
+			w, _ := xz.NewWriter(&compressed)
+			w.Write(payload)
+			w.Close()
+			return compressed.Bytes()
+		case 2:
+			compressed := make([]byte, 8+lz4.CompressBlockBound(len(payload)))
+			binary.LittleEndian.PutUint64(compressed, uint64(len(payload)))
+			n, _ := lz4.CompressBlock(payload, compressed[8:], nil)
+			return compressed[:8+n]
+		}
+		encoder, _ := zstd.NewWriter(nil)
+		return encoder.EncodeAll(payload, nil)
+	}
+
+	tableOffset := object(4, 0, make([]byte, buckets*16)) + 16
+
+	dataOffsets := make(map[string]uint64)
+	dataEntries := make(map[uint64][]uint64)
+	data := func(field string) uint64 {
+		if offset, ok := dataOffsets[field]; ok {
+			return offset
+		}
+
+		hash := journal.HashPayload(format.compact, testFileID, []byte(field))
+		payload := []byte(field)
+		flags := uint8(0)
+		if len(payload) > 64 {
+			payload = compress(payload)
+			flags = format.compression
+		}
+
+		obj := make([]byte, 48)
+		if format.compact {
+			obj = make([]byte, 56)
+		}
+		binary.LittleEndian.PutUint64(obj[0:], hash)
+		offset := object(1, flags, append(obj, payload...))
+		dataOffsets[field] = offset
+
+		//	Add the object to the end of its hash table bucket
+		bucket := tableOffset + hash%buckets*16
+		if tail := binary.LittleEndian.Uint64(buf[bucket+8:]); tail != 0 {
+			binary.LittleEndian.PutUint64(buf[tail+24:], offset)
+		} else {
+			binary.LittleEndian.PutUint64(buf[bucket:], offset)
+		}
+		binary.LittleEndian.PutUint64(buf[bucket+8:], offset)
+
+		return offset
+	}
+
+	entryOffsets := []uint64{}
+	seqnum := firstSeqnum
+
+	for _, entry := range entries {
+		items := []byte{}
+		fieldOffsets := []uint64{}
+		for _, field := range entry.fields {
+			offset := data(field)
+			fieldOffsets = append(fieldOffsets, offset)
+
+			items = append(items, offsetItem(offset)...)
+			if !format.compact {
+				items = append(items, make([]byte, 8)...)
+			}
+		}
+
+		e := make([]byte, 48)
+		binary.LittleEndian.PutUint64(e[0:], seqnum)
+		binary.LittleEndian.PutUint64(e[8:], entry.realtime)
+		binary.LittleEndian.PutUint64(e[16:], entry.realtime/2)
+		copy(e[24:40], testBootID[:])
+		binary.LittleEndian.PutUint64(e[40:], seqnum*31)
+		e = append(e, items...)
+		offset := object(3, 0, e)
+		entryOffsets = append(entryOffsets, offset)
+		for _, dataOffset := range fieldOffsets {
+			dataEntries[dataOffset] = append(dataEntries[dataOffset], offset)
+		}
+		seqnum++
+	}
+
+	//	Link each data object to its first entry, and put the rest in an entry array
+	for dataOffset, offsets := range dataEntries {
+		binary.LittleEndian.PutUint64(buf[dataOffset+40:], offsets[0])
+		binary.LittleEndian.PutUint64(buf[dataOffset+56:], uint64(len(offsets)))
+		if len(offsets) > 1 {
+			array := make([]byte, 8)
+			for _, offset := range offsets[1:] {
+				array = append(array, offsetItem(offset)...)
+			}
+			arrayOffset := object(6, 0, array)
+			binary.LittleEndian.PutUint64(buf[dataOffset+48:], arrayOffset)
+		}
+	}
+
+	array := make([]byte, 8)
+	for _, offset := range entryOffsets {
+		array = append(array, offsetItem(offset)...)
+	}
+	arrayOffset := object(6, 0, array)
+	align()
+
+	copy(buf[0:8], "LPKSHHRH")
+	binary.LittleEndian.PutUint32(buf[12:], incompatible)
+	copy(buf[24:40], testFileID[:])
+	copy(buf[56:72], testBootID[:])
+	copy(buf[72:88], format.seqnumID[:])
+	binary.LittleEndian.PutUint64(buf[88:], headerSize)
+	binary.LittleEndian.PutUint64(buf[96:], uint64(len(buf)-headerSize))
+	binary.LittleEndian.PutUint64(buf[104:], tableOffset)
+	binary.LittleEndian.PutUint64(buf[112:], buckets*16)
+	binary.LittleEndian.PutUint64(buf[152:], uint64(len(entries)))
+	binary.LittleEndian.PutUint64(buf[160:], seqnum-1)
+	binary.LittleEndian.PutUint64(buf[168:], firstSeqnum)
+	binary.LittleEndian.PutUint64(buf[176:], arrayOffset)
+	if len(entries) > 0 {
+		last := entries[len(entries)-1].realtime
+		binary.LittleEndian.PutUint64(buf[184:], entries[0].realtime)
+		binary.LittleEndian.PutUint64(buf[192:], last)
+		binary.LittleEndian.PutUint64(buf[200:], last/2)
+	}
+
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatalf("problem writing test journal: %s", err)
+	}
+}
+
+func TestNative_ReadEntriesForUnitFromCursor_NoCursor_ReturnsUnitEntries(t *testing.T) {
+	//	Arrange
+	dir := t.TempDir()
+	longMessage := strings.Repeat("a long message ", 10)
+	writeTestJournal(t, filepath.Join(dir, "system.journal"), 1, []testJournalEntry{
+		{realtime: 1636016409883533, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=first", "_PID=282"}},
+		{realtime: 1636016409883534, fields: []string{"_SYSTEMD_UNIT=daydash.service", "MESSAGE=other unit"}},
+		{realtime: 1636016409883535, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=" + longMessage}},
+	})
+
+	//	Act
+	entries, err := journal.ReadEntriesForUnitFromCursor([]string{dir}, "cron", "", 0)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("ReadEntriesForUnitFromCursor - Should execute without error, but got: %s", err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("ReadEntriesForUnitFromCursor - Expected 2 entries but got %v", len(entries))
+	}
+
+	if entries[0].Message.String() != "first" || entries[0].PID.String() != "282" || entries[0].RealtimeTimestamp != "1636016409883533" {
+		t.Errorf("ReadEntriesForUnitFromCursor - Unexpected first entry: %+v", entries[0])
+	}
+
+	if entries[1].Message.String() != longMessage {
+		t.Errorf("ReadEntriesForUnitFromCursor - Compressed message wasn't decoded: %q", entries[1].Message)
+	}
+
+	if entries[0].BootID.String() != "6b9d0f62f43c4b0bb0f61848b4da3b15" {
+		t.Errorf("ReadEntriesForUnitFromCursor - Unexpected boot id: %s", entries[0].BootID)
+	}
+}
+
+func TestNative_ReadEntriesForUnitFromCursor_WithCursor_ReturnsLaterEntries(t *testing.T) {
+	//	Arrange
+	dir := t.TempDir()
+	writeTestJournal(t, filepath.Join(dir, "system@0005d05edfec1b9b-7db05987bc8c3aab.journal~"), 1, []testJournalEntry{
+		{realtime: 1636016409883533, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=archived"}},
+	})
+	writeTestJournal(t, filepath.Join(dir, "system.journal"), 2, []testJournalEntry{
+		{realtime: 1636016409883534, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=second"}},
+		{realtime: 1636016409883535, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=third"}},
+	})
+
+	all, err := journal.ReadEntriesForUnitFromCursor([]string{dir}, "cron.service", "", 0)
+	if err != nil || len(all) != 3 {
+		t.Fatalf("ReadEntriesForUnitFromCursor - Expected 3 entries across rotated files but got %v (%v)", len(all), err)
+	}
+
+	//	Act
+	entries, err := journal.ReadEntriesForUnitFromCursor([]string{dir}, "cron.service", all[1].Cursor, 0)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("ReadEntriesForUnitFromCursor - Should execute without error, but got: %s", err)
+	}
+
+	if len(entries) != 1 || entries[0].Message.String() != "third" {
+		t.Errorf("ReadEntriesForUnitFromCursor - Expected only the entry after the cursor but got: %+v", entries)
+	}
+}
+
+func TestCursor_ParseCursor_RoundTrips(t *testing.T) {
+	//	Arrange
+	cursor := "s=7fe895b45f18448daa12dfe9ec1d2993;i=e6;b=6b9d0f62f43c4b0bb0f61848b4da3b15;m=3b5c2b9;t=5cff2c0f5338d;x=274b5b63cb69c9f7"
+
+	//	Act
+	parsed, err := journal.ParseCursor(cursor)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("ParseCursor - Should execute without error, but got: %s", err)
+	}
+
+	if parsed.Seqnum != 230 {
+		t.Errorf("ParseCursor - Expected seqnum 230 but got %v", parsed.Seqnum)
+	}
+
+	if parsed.String() != cursor {
+		t.Errorf("ParseCursor - Expected %s but got %s", cursor, parsed.String())
+	}
+}
+
+func TestNative_ReadEntriesForUnitFromCursor_WithLimit_ReturnsFirstPage(t *testing.T) {
+	//	Arrange
+	dir := t.TempDir()
+	writeTestJournal(t, filepath.Join(dir, "system.journal"), 1, []testJournalEntry{
+		{realtime: 1636016409883533, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=first"}},
+		{realtime: 1636016409883534, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=second"}},
+		{realtime: 1636016409883535, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=third"}},
+	})
+
+	//	Act
+	page, err := journal.ReadEntriesForUnitFromCursor([]string{dir}, "cron", "", 2)
+	if err != nil || len(page) != 2 {
+		t.Fatalf("ReadEntriesForUnitFromCursor - Expected a page of 2 entries but got %v (%v)", len(page), err)
+	}
+	next, err := journal.ReadEntriesForUnitFromCursor([]string{dir}, "cron", page[1].Cursor, 2)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("ReadEntriesForUnitFromCursor - Should execute without error, but got: %s", err)
+	}
+
+	if page[0].Message.String() != "first" || page[1].Message.String() != "second" {
+		t.Errorf("ReadEntriesForUnitFromCursor - Expected the oldest entries in the first page but got: %+v", page)
+	}
+
+	if len(next) != 1 || next[0].Message.String() != "third" {
+		t.Errorf("ReadEntriesForUnitFromCursor - Expected the remaining entry in the next page but got: %+v", next)
+	}
+}
+
+func TestNative_ReadEntriesForUnitFromCursor_CompactAndCompressed_ReturnsUnitEntries(t *testing.T) {
+	tests := map[string]testJournalFormat{
+		"xz":           {compression: 1},
+		"lz4":          {compression: 2},
+		"compact zstd": {compact: true},
+		"compact lz4":  {compact: true, compression: 2},
+	}
+
+	for name, format := range tests {
+		//	Arrange
+		dir := t.TempDir()
+		longMessage := strings.Repeat("a long message ", 10)
+		writeTestJournalFormat(t, filepath.Join(dir, "system.journal"), 1, []testJournalEntry{
+			{realtime: 1636016409883533, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=" + longMessage}},
+			{realtime: 1636016409883534, fields: []string{"_SYSTEMD_UNIT=daydash.service", "MESSAGE=" + longMessage}},
+			{realtime: 1636016409883535, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=last"}},
+		}, format)
+
+		//	Act
+		entries, err := journal.ReadEntriesForUnitFromCursor([]string{dir}, "cron", "", 0)
+
+		//	Assert
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("ReadEntriesForUnitFromCursor - Expected 2 %s entries but got %v (%v)", name, len(entries), err)
+		}
+
+		if entries[0].Message.String() != longMessage || entries[1].Message.String() != "last" {
+			t.Errorf("ReadEntriesForUnitFromCursor - Expected the %s entries to be decoded, but got: %+v", name, entries)
+		}
+	}
+}
+
+func TestNative_ReadEntriesForUnitFromCursor_UnitFromSystemd_ReturnsIt(t *testing.T) {
+	//	Arrange
+	dir := t.TempDir()
+	writeTestJournal(t, filepath.Join(dir, "system.journal"), 1, []testJournalEntry{
+		{realtime: 1636016409883533, fields: []string{"_PID=1", "UNIT=cron.service", "MESSAGE=Started Regular background program processing daemon."}},
+		{realtime: 1636016409883534, fields: []string{"_PID=282", "UNIT=cron.service", "MESSAGE=not from systemd"}},
+	})
+
+	//	Act
+	entries, err := journal.ReadEntriesForUnitFromCursor([]string{dir}, "cron", "", 0)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("ReadEntriesForUnitFromCursor - Should execute without error, but got: %s", err)
+	}
+
+	if len(entries) != 1 || entries[0].PID.String() != "1" {
+		t.Errorf("ReadEntriesForUnitFromCursor - Expected only the entry from systemd but got: %+v", entries)
+	}
+}
+
+func TestNative_ReadEntriesForUnitFromCursor_SameTimeInAnotherFile_ReturnsIt(t *testing.T) {
+	//	Arrange - two files with different seqnum ids, and an entry logged at the same time in each
+	dir := t.TempDir()
+	writeTestJournal(t, filepath.Join(dir, "system.journal"), 1, []testJournalEntry{
+		{realtime: 1636016409883533, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=system"}},
+	})
+	otherSeqnumID := testSeqnumID
+	otherSeqnumID[0] = 0
+	writeTestJournalFormat(t, filepath.Join(dir, "user-1000.journal"), 2, []testJournalEntry{
+		{realtime: 1636016409883533, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=user"}},
+	}, testJournalFormat{seqnumID: otherSeqnumID})
+
+	all, err := journal.ReadEntriesForUnitFromCursor([]string{dir}, "cron", "", 0)
+	if err != nil || len(all) != 2 {
+		t.Fatalf("ReadEntriesForUnitFromCursor - Expected 2 entries but got %v (%v)", len(all), err)
+	}
+
+	//	Act
+	entries, err := journal.ReadEntriesForUnitFromCursor([]string{dir}, "cron", all[0].Cursor, 0)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("ReadEntriesForUnitFromCursor - Should execute without error, but got: %s", err)
+	}
+
+	if len(entries) != 1 || entries[0].Message.String() != all[1].Message.String() {
+		t.Errorf("ReadEntriesForUnitFromCursor - Expected the other entry with the same time but got: %+v", entries)
+	}
+}
+
+func TestNative_ReadEntriesForUnitFromCursor_ClockWentBackInAnotherFile_ReturnsLaterEntries(t *testing.T) {
+	//	Arrange - a cursor from one file, and another file (with its own seqnum id) whose
+	//	clock went back, so its entries aren't in timestamp order
+	dir, otherDir := t.TempDir(), t.TempDir()
+	writeTestJournal(t, filepath.Join(dir, "system.journal"), 1, []testJournalEntry{
+		{realtime: 1636016409500000, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=cursor"}},
+	})
+	otherSeqnumID := testSeqnumID
+	otherSeqnumID[0] = 0
+	writeTestJournalFormat(t, filepath.Join(otherDir, "user-1000.journal"), 1, []testJournalEntry{
+		{realtime: 1636016409900000, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=later"}},
+		{realtime: 1636016409100000, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=earlier"}},
+		{realtime: 1636016409700000, fields: []string{"_SYSTEMD_UNIT=cron.service", "MESSAGE=also later"}},
+	}, testJournalFormat{seqnumID: otherSeqnumID})
+
+	first, err := journal.ReadEntriesForUnitFromCursor([]string{dir}, "cron", "", 0)
+	if err != nil || len(first) != 1 {
+		t.Fatalf("ReadEntriesForUnitFromCursor - Expected the cursor entry but got %v (%v)", len(first), err)
+	}
+
+	//	Act
+	entries, err := journal.ReadEntriesForUnitFromCursor([]string{otherDir}, "cron", first[0].Cursor, 0)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("ReadEntriesForUnitFromCursor - Should execute without error, but got: %s", err)
+	}
+
+	messages := []string{}
+	for _, entry := range entries {
+		messages = append(messages, entry.Message.String())
+	}
+	if len(messages) != 2 || messages[0] != "also later" || messages[1] != "later" {
+		t.Errorf("ReadEntriesForUnitFromCursor - Expected both later entries but got: %v", messages)
+	}
+}
+
+func TestFile_DecompressPayload_LZ4SizeTooBig_ReturnsError(t *testing.T) {
+	//	Arrange - a corrupt lz4 payload that claims to decompress to 1 TiB
+	payload := make([]byte, 16)
+	binary.LittleEndian.PutUint64(payload, 1<<40)
+
+	//	Act
+	_, err := journal.DecompressPayload(2, payload)
+
+	//	Assert
+	if err == nil {
+		t.Errorf("DecompressPayload - Expected an error for the size, but got nil")
+	}
+}
@@ -2,11 +2,11 @@ package journal
 
 import (
 	"encoding/json"
-	"fmt"
-	"os/exec"
+	"reflect"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
 /*
@@ -38,92 +38,210 @@ import (
 	}
 */
 
+// Entry is a single journal entry.  The address fields (cursor and timestamps) are
+// always plain strings.  All other fields can be binary or repeated, so they are Fields.
+// Every field in the entry (including custom fields that apps log with sd_journal_send)
+// is also kept in Fields, keyed by field name, and is written back out by MarshalJSON
 type Entry struct {
 	Cursor                  string `json:"__CURSOR"`
 	RealtimeTimestamp       string `json:"__REALTIME_TIMESTAMP"`
 	MonotonicTimestamp      string `json:"__MONOTONIC_TIMESTAMP"`
-	BootID                  string `json:"_BOOT_ID"`
-	Priority                string `json:"PRIORITY"`
-	MachineID               string `json:"_MACHINE_ID"`
-	Hostname                string `json:"_HOSTNAME"`
-	SyslogFacility          string `json:"SYSLOG_FACILITY"`
-	SyslogIdentifier        string `json:"SYSLOG_IDENTIFIER"`
-	UID                     string `json:"_UID"`
-	GID                     string `json:"_GID"`
-	Transport               string `json:"_TRANSPORT"`
-	Codefile                string `json:"CODE_FILE"`
-	Codeline                string `json:"CODE_LINE"`
-	Codefunction            string `json:"CODE_FUNCTION"`
-	MessageID               string `json:"MESSAGE_ID"`
-	Result                  string `json:"RESULT"`
-	PID                     string `json:"_PID"`
-	Comm                    string `json:"_COMM"`
-	EXE                     string `json:"_EXE"`
-	CmdLine                 string `json:"_CMDLINE"`
-	CapEffective            string `json:"_CAP_EFFECTIVE"`
-	SystemDCGroup           string `json:"_SYSTEMD_CGROUP"`
-	SystemDUnit             string `json:"_SYSTEMD_UNIT"`
-	SystemDSlice            string `json:"_SYSTEMD_SLICE"`
-	Unit                    string `json:"UNIT"`
-	Message                 string `json:"MESSAGE"`
-	SourceRealtimeTimestamp string `json:"_SOURCE_REALTIME_TIMESTAMP"`
-	SystemDInvocationID     string `json:"_SYSTEMD_INVOCATION_ID"`
+	BootID                  Field  `json:"_BOOT_ID"`
+	Priority                Field  `json:"PRIORITY"`
+	MachineID               Field  `json:"_MACHINE_ID"`
+	Hostname                Field  `json:"_HOSTNAME"`
+	SyslogFacility          Field  `json:"SYSLOG_FACILITY"`
+	SyslogIdentifier        Field  `json:"SYSLOG_IDENTIFIER"`
+	UID                     Field  `json:"_UID"`
+	GID                     Field  `json:"_GID"`
+	Transport               Field  `json:"_TRANSPORT"`
+	Codefile                Field  `json:"CODE_FILE"`
+	Codeline                Field  `json:"CODE_LINE"`
+	Codefunction            Field  `json:"CODE_FUNCTION"`
+	MessageID               Field  `json:"MESSAGE_ID"`
+	Result                  Field  `json:"RESULT"`
+	PID                     Field  `json:"_PID"`
+	Comm                    Field  `json:"_COMM"`
+	EXE                     Field  `json:"_EXE"`
+	CmdLine                 Field  `json:"_CMDLINE"`
+	CapEffective            Field  `json:"_CAP_EFFECTIVE"`
+	SystemDCGroup           Field  `json:"_SYSTEMD_CGROUP"`
+	SystemDUnit             Field  `json:"_SYSTEMD_UNIT"`
+	SystemDSlice            Field  `json:"_SYSTEMD_SLICE"`
+	Unit                    Field  `json:"UNIT"`
+	Message                 Field  `json:"MESSAGE"`
+	SourceRealtimeTimestamp Field  `json:"_SOURCE_REALTIME_TIMESTAMP"`
+	SystemDInvocationID     Field  `json:"_SYSTEMD_INVOCATION_ID"`
+
+	Fields map[string]Field `json:"-"`
 }
 
-// GetJournalEntriesForUnitFromCursor gets a list of journal entries in JSON format
-// for the given unit.  It gets all journal entries from the given cursor (or from the
-// beginning if the cursor is empty)
-func GetJournalEntriesForUnitFromCursor(unit, cursor string) []Entry {
+// entryFields maps the JSON name of each typed field in Entry to its index
+var entryFields = func() map[string]int {
+	retval := make(map[string]int)
 
-	log.WithFields(log.Fields{
-		"unit":   unit,
-		"cursor": cursor,
-	}).Debug("requested fetch of journald log entries")
+	t := reflect.TypeOf(Entry{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("json"); name != "" && name != "-" {
+			retval[name] = i
+		}
+	}
 
-	retval := []Entry{}
+	return retval
+}()
+
+// newEntry creates an entry from all of its fields, filling in the typed fields
+func newEntry(fields map[string]Field) Entry {
+	retval := Entry{Fields: fields}
+
+	v := reflect.ValueOf(&retval).Elem()
+	for name, i := range entryFields {
+		field, ok := fields[name]
+		if !ok {
+			continue
+		}
+
+		switch target := v.Field(i).Addr().Interface().(type) {
+		case *string:
+			*target = field.String()
+		case *Field:
+			*target = field
+		}
+	}
 
-	var cmd *exec.Cmd
+	return retval
+}
 
-	//	Get a list of entries for the given unit:
-	// journalctl --unit=daydash --output=json --no-pager
-	// or
-	// journalctl --unit=daydash --output=json --no-pager --after-cursor="s=f4a560eb4f2b45b8ba4c8b5fba8ab6ce;i=232;b=fb0855f265b440ab8d797634862ddb83;m=24fb96f;t=5d05edfec1b9b;x=7db05987bc8c3aab"
-	if cursor == "" {
-		cmd = exec.Command("journalctl", "--unit", unit, "--output", "json", "--no-pager")
-	} else {
-		cmd = exec.Command("journalctl", "--unit", unit, "--output", "json", "--no-pager", "--after-cursor", cursor)
+// UnmarshalJSON decodes every field into Fields, and fills in the typed fields from them
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	fields := make(map[string]Field)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
 	}
 
-	content, err := cmd.CombinedOutput()
-	if err != nil {
-		log.WithError(err).Error("problem running journalctl command")
-		return retval
+	*e = newEntry(fields)
+	return nil
+}
+
+// MarshalJSON encodes the entry the same way journalctl does, with every field in
+// Fields.  A typed field that's set replaces the field with the same name
+func (e Entry) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]Field, len(e.Fields))
+	for name, field := range e.Fields {
+		fields[name] = field
 	}
 
-	//	Replace newlines with a comma
-	jsonEntries := strings.ReplaceAll(string(content), "\n", ",")
+	v := reflect.ValueOf(e)
+	for name, i := range entryFields {
+		switch value := v.Field(i).Interface().(type) {
+		case string:
+			if value != "" {
+				fields[name] = NewField(value)
+			}
+		case Field:
+			if !value.IsEmpty() {
+				fields[name] = value
+			}
+		}
+	}
+
+	return json.Marshal(fields)
+}
+
+// Field returns the named field, or an empty Field if the entry doesn't have it
+func (e Entry) Field(name string) Field {
+	return e.Fields[name]
+}
 
-	//	Remove the trailing comma if it exists:
-	jsonEntries = strings.TrimSuffix(jsonEntries, ",")
+// SelectFields returns the named fields that the entry has.  The name * selects
+// every field except the address fields (__CURSOR and the timestamps)
+func (e Entry) SelectFields(names []string) map[string]Field {
+	retval := make(map[string]Field)
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+
+		if name == "*" {
+			for fieldName, field := range e.Fields {
+				if !strings.HasPrefix(fieldName, "__") {
+					retval[fieldName] = field
+				}
+			}
+			continue
+		}
+
+		if field, ok := e.Fields[name]; ok {
+			retval[name] = field
+		}
+	}
 
-	//	Wrap the entire thing in JSON array brackets
-	jsonEntries = fmt.Sprintf("[%s]", jsonEntries)
+	return retval
+}
 
-	//	Deserialize to Entry objects
-	err = json.Unmarshal([]byte(jsonEntries), &retval)
+// Page is a page of entries read from the journal
+type Page struct {
+	// Entries are the entries that were decoded
+	Entries []Entry
+
+	// LastCursor is the cursor of the last record read, including skipped records
+	LastCursor string
+
+	// Records is the number of records read, including skipped records
+	Records int
+
+	// Skipped is the number of malformed records that were skipped
+	Skipped int
+}
+
+// GetJournalPageForUnitFromCursor gets a page of journal entries for the given unit.
+// It reads up to limit records from the given cursor (or from the beginning if the
+// cursor is empty).  A limit less than 1 reads every record.  Malformed records are
+// skipped and counted.  Entries are read using the reader set in journal.reader: either
+// journalctl (the default) or native, which reads the journal files in journal.path directly
+func GetJournalPageForUnitFromCursor(unit, cursor string, limit int) Page {
+
+	log.WithFields(log.Fields{
+		"unit":   unit,
+		"cursor": cursor,
+		"limit":  limit,
+		"reader": viper.GetString("journal.reader"),
+	}).Debug("requested fetch of journald log entries")
+
+	switch viper.GetString("journal.reader") {
+	case "native":
+		return getNativePageForUnitFromCursor(unit, cursor, limit)
+	default:
+		return getJournalctlPageForUnitFromCursor(unit, cursor, limit)
+	}
+}
+
+// getNativePageForUnitFromCursor reads the journal files in journal.path directly
+func getNativePageForUnitFromCursor(unit, cursor string, limit int) Page {
+	journalPaths := strings.Split(viper.GetString("journal.path"), ",")
+
+	entries, err := ReadEntriesForUnitFromCursor(journalPaths, unit, cursor, limit)
 	if err != nil {
-		log.WithError(err).Error("problem deserializing")
-		return retval
+		log.WithFields(log.Fields{
+			"unit":         unit,
+			"cursor":       cursor,
+			"journal.path": viper.GetString("journal.path"),
+		}).WithError(err).Error("problem reading journal files")
+	}
+
+	retval := Page{
+		Entries: entries,
+		Records: len(entries),
 	}
 
-	if len(retval) > 0 {
+	if len(entries) > 0 {
+		retval.LastCursor = entries[len(entries)-1].Cursor
+
 		log.WithFields(log.Fields{
 			"unit":      unit,
 			"cursor":    cursor,
-			"itemCount": len(retval),
+			"itemCount": len(entries),
 		}).Debug("found items in journald")
 	}
 
-	//	Return the list of Entries
 	return retval
 }
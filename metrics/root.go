@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"expvar"
+	"strconv"
+)
+
+// counters are the runtime counters for cloudjournal.  They are published
+// with expvar, as cloudjournal
+var counters = expvar.NewMap("cloudjournal")
+
+// Add adds delta to the named counter
+func Add(name string, delta int64) {
+	counters.Add(name, delta)
+}
+
+// Get returns the current value of the named counter
+func Get(name string) int64 {
+	value := counters.Get(name)
+	if value == nil {
+		return 0
+	}
+
+	retval, _ := strconv.ParseInt(value.String(), 10, 64)
+	return retval
+}
@@ -0,0 +1,54 @@
+// Package retry has the backoff and Retry-After handling shared by cloudwatch and the other sinks
+package retry
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backoff returns the delay before the given retry attempt (starting at 0), using
+// exponential backoff capped at maxDelay, with jitter between half and all of the delay
+func Backoff(attempt int, baseDelay, maxDelay time.Duration) time.Duration {
+	delay := baseDelay
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// After returns how long a Retry-After header asks us to wait.  It can be a number of
+// seconds or an HTTP date.  The wait is capped at maxDelay, so a server can't stall a
+// unit for longer than our own backoff would
+func After(header string, maxDelay time.Duration) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+
+	var retval time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		retval = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		retval = time.Until(date)
+	}
+
+	if retval < 0 {
+		return 0
+	}
+	if retval > maxDelay {
+		return maxDelay
+	}
+
+	return retval
+}
@@ -0,0 +1,51 @@
+package retry_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/danesparza/cloudjournal/retry"
+)
+
+func TestRetry_Backoff_IsCappedWithJitter(t *testing.T) {
+	//	Arrange
+	base := 100 * time.Millisecond
+	max := time.Second
+
+	for attempt := 0; attempt < 10; attempt++ {
+		//	Act
+		delay := retry.Backoff(attempt, base, max)
+
+		//	Assert
+		expected := base << uint(attempt)
+		if expected > max {
+			expected = max
+		}
+		if delay < expected/2 || delay > expected {
+			t.Errorf("Backoff(%v) - Expected between %v and %v but got %v", attempt, expected/2, expected, delay)
+		}
+	}
+}
+
+func TestRetry_After_IsCappedAtMaxDelay(t *testing.T) {
+	max := time.Minute
+	tests := []struct {
+		header   string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"soon", 0},
+		{"-5", 0},
+		{"30", 30 * time.Second},
+		{"86400", max},
+		{time.Now().Add(24 * time.Hour).UTC().Format(http.TimeFormat), max},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+
+	for _, test := range tests {
+		if delay := retry.After(test.header, max); delay != test.expected {
+			t.Errorf("After(%q) - Expected %v but got %v", test.header, test.expected, delay)
+		}
+	}
+}
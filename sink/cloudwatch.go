@@ -0,0 +1,51 @@
+package sink
+
+import (
+	"github.com/danesparza/cloudjournal/cloudwatch"
+	"github.com/danesparza/cloudjournal/data"
+	"github.com/danesparza/cloudjournal/token"
+	"github.com/spf13/viper"
+)
+
+// CloudWatchName is the name of the cloudwatch logs sink
+const CloudWatchName = "cloudwatch"
+
+// CloudWatch ships entries to the cloudwatch log group and stream in
+// cloudwatch.group and cloudwatch.stream
+type CloudWatch struct {
+	Service *cloudwatch.Service
+}
+
+// NewCloudWatch creates a cloudwatch logs sink that uses the service
+func NewCloudWatch(service *cloudwatch.Service) *CloudWatch {
+	return &CloudWatch{Service: service}
+}
+
+// NewCloudWatchFromConfig creates a cloudwatch logs sink that uses the cloudwatch config
+func NewCloudWatchFromConfig(db *data.Manager) *CloudWatch {
+	return NewCloudWatch(cloudwatch.NewService(db))
+}
+
+// Name returns the name of the sink
+func (s *CloudWatch) Name() string {
+	return CloudWatchName
+}
+
+// Write writes the batch to the log stream for the batch's tokens
+func (s *CloudWatch) Write(batch Batch) error {
+	groupName := token.Replace(viper.GetString("cloudwatch.group"), batch.Tokens)
+	streamName := token.Replace(viper.GetString("cloudwatch.stream"), batch.Tokens)
+	options := cloudwatch.NewLogGroupOptionsFromConfig(batch.Tokens)
+
+	return s.Service.WriteToLog(groupName, streamName, options, batch.Entries)
+}
+
+// Close does nothing
+func (s *CloudWatch) Close() error {
+	return nil
+}
+
+// HealthCheck checks the AWS credentials
+func (s *CloudWatch) HealthCheck() error {
+	return s.Service.HealthCheck()
+}
@@ -0,0 +1,32 @@
+package sink_test
+
+import (
+	"testing"
+
+	"github.com/danesparza/cloudjournal/cloudwatch"
+	"github.com/danesparza/cloudjournal/cloudwatch/cloudwatchtest"
+	"github.com/danesparza/cloudjournal/sink"
+)
+
+func TestCloudWatch_Write_UsesTokensForGroupAndStream(t *testing.T) {
+	//	Arrange
+	useConfig(t, map[string]interface{}{
+		"cloudwatch.group":  "/app/cloudjournal/{unit}",
+		"cloudwatch.stream": "{hostname}",
+	})
+
+	fake := cloudwatchtest.NewLogs()
+	out := sink.NewCloudWatch(cloudwatch.NewServiceWithClients(nil, fake, fake))
+
+	//	Act
+	err := out.Write(hostBatch(1, 2))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	if messages := fake.Messages("/app/cloudjournal/cron", "raspberrypi"); len(messages) != 2 {
+		t.Errorf("Write - Expected 2 messages in the unit's log stream, but got %v", messages)
+	}
+}
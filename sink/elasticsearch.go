@@ -0,0 +1,454 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/danesparza/cloudjournal/format"
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/metrics"
+	"github.com/danesparza/cloudjournal/retry"
+	"github.com/danesparza/cloudjournal/token"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ElasticsearchName is the name of the Elasticsearch / OpenSearch sink
+const ElasticsearchName = "elasticsearch"
+
+// errBulkTooLarge is returned by bulk when the cluster says the request is too large (413)
+var errBulkTooLarge = errors.New("elasticsearch says the bulk request is too large")
+
+// Elasticsearch writes entries to Elasticsearch or OpenSearch with the _bulk API.  Each
+// document has an id made from its journal cursor, so writing a batch again doesn't
+// create duplicates
+type Elasticsearch struct {
+	// URL is the base URL of the cluster, like http://localhost:9200
+	URL string
+
+	// Index is the index (or data stream) name.  It can use tokens, including the date
+	// tokens {date}, {year}, {month} and {day} from each entry's timestamp (in UTC)
+	Index string
+
+	// Pipeline is an ingest pipeline to run the documents through, if set
+	Pipeline string
+
+	// DeadLetterIndex is where entries that will never be indexed (like a mapping error) are
+	// written instead, with the reason.  It can use tokens like Index.  If it isn't set, those
+	// entries are dropped.  Either way they're logged and counted, so they don't stall the unit
+	DeadLetterIndex string
+
+	// Username and Password are used for basic auth, if set
+	Username string
+	Password string
+
+	// APIKey is sent as an ApiKey authorization header, if set
+	APIKey string
+
+	// Formatter formats each entry.  Its mode is always json
+	Formatter format.Formatter
+
+	// Retries is how many times items are retried when the cluster is busy or unavailable
+	Retries       int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	Client *http.Client
+}
+
+// bulkItem is a document in a _bulk request
+type bulkItem struct {
+	index    string
+	id       string
+	cursor   string
+	document []byte
+
+	// deadLetter is true for a dead letter document.  It isn't sent to the pipeline, and if
+	// it can't be indexed either it's dropped
+	deadLetter bool
+}
+
+// bulkRejection is an item that will never be indexed, and why
+type bulkRejection struct {
+	item   bulkItem
+	status int
+	kind   string
+	reason string
+}
+
+// bulkResponse is the response to a _bulk request
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkItemResponse `json:"items"`
+}
+
+// bulkItemResponse is the result for one item in a _bulk request
+type bulkItemResponse struct {
+	Index  string `json:"_index"`
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// NewElasticsearchFromConfig creates an Elasticsearch sink from the elasticsearch section of the config
+func NewElasticsearchFromConfig() (*Elasticsearch, error) {
+	retval := &Elasticsearch{
+		URL:             strings.TrimSuffix(viper.GetString("elasticsearch.url"), "/"),
+		Index:           viper.GetString("elasticsearch.index"),
+		Pipeline:        viper.GetString("elasticsearch.pipeline"),
+		DeadLetterIndex: viper.GetString("elasticsearch.deadletterindex"),
+		Username:        viper.GetString("elasticsearch.username"),
+		Password:        viper.GetString("elasticsearch.password"),
+		APIKey:          viper.GetString("elasticsearch.apikey"),
+		Formatter:       newFormatter(format.FormatJSON),
+		Retries:         viper.GetInt("elasticsearch.retries"),
+		RetryDelay:      durationFromConfig("elasticsearch.retrydelay", 500*time.Millisecond),
+		MaxRetryDelay:   durationFromConfig("elasticsearch.maxretrydelay", 30*time.Second),
+		Client:          &http.Client{Timeout: durationFromConfig("elasticsearch.timeout", 30*time.Second)},
+	}
+
+	if retval.URL == "" {
+		return nil, fmt.Errorf("elasticsearch.url isn't set")
+	}
+
+	if retval.Index == "" {
+		return nil, fmt.Errorf("elasticsearch.index isn't set")
+	}
+
+	return retval, nil
+}
+
+// Name returns the name of the sink
+func (s *Elasticsearch) Name() string {
+	return ElasticsearchName
+}
+
+// Write indexes the batch with the _bulk API.  It only returns nil once every entry has
+// been acknowledged, or will never be indexed and was written to the dead letter index (or
+// dropped).  So the unit's cursor isn't saved past an entry that could still be indexed
+func (s *Elasticsearch) Write(batch Batch) error {
+	items := []bulkItem{}
+	for _, entry := range batch.Entries {
+		item, err := s.item(entry, batch.Tokens)
+		if err != nil {
+			//	The entry can't be made into a document, so trying again won't help
+			rejection := bulkRejection{item: item, kind: "document_error", reason: err.Error()}
+			if deadLetter, ok := s.deadLetter(batch, rejection); ok {
+				items = append(items, deadLetter)
+			}
+			continue
+		}
+		items = append(items, item)
+	}
+
+	for attempt := 0; len(items) > 0; {
+		failed, rejected, retryable, err := s.bulkSplit(items)
+		if err != nil {
+			if !retryable {
+				metrics.Add("elasticsearch.batches_failed", 1)
+				return err
+			}
+			failed = items
+		}
+
+		//	Items that will never be indexed are replaced with their dead letters, so they
+		//	don't stall the unit
+		deadLetters := []bulkItem{}
+		for _, rejection := range rejected {
+			if deadLetter, ok := s.deadLetter(batch, rejection); ok {
+				deadLetters = append(deadLetters, deadLetter)
+			}
+		}
+
+		if err == nil && len(failed) == 0 {
+			items = deadLetters
+			continue
+		}
+		if err == nil {
+			err = fmt.Errorf("elasticsearch didn't acknowledge %d of %d entries", len(failed), len(items))
+		}
+
+		if attempt >= s.Retries {
+			metrics.Add("elasticsearch.batches_failed", 1)
+			return err
+		}
+
+		//	Only try again with the items that weren't acknowledged
+		items = append(failed, deadLetters...)
+
+		delay := retry.Backoff(attempt, s.RetryDelay, s.MaxRetryDelay)
+		attempt++
+		metrics.Add("elasticsearch.retries", 1)
+		log.WithFields(log.Fields{
+			"unit":       batch.Unit,
+			"items":      len(items),
+			"attempt":    attempt,
+			"maxRetries": s.Retries,
+			"delay":      delay.String(),
+		}).WithError(err).Warn("problem writing to elasticsearch.  Retrying")
+		time.Sleep(delay)
+	}
+
+	return nil
+}
+
+// Close does nothing
+func (s *Elasticsearch) Close() error {
+	return nil
+}
+
+// HealthCheck checks the cluster can be reached with our credentials
+func (s *Elasticsearch) HealthCheck() error {
+	req, err := http.NewRequest(http.MethodGet, s.URL+"/", nil)
+	if err != nil {
+		return err
+	}
+	s.authorize(req)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("elasticsearch returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// item creates the bulk item for an entry.  If the entry can't be made into a document, it
+// returns an item with just the cursor and the raw message, and the error
+func (s *Elasticsearch) item(entry journal.Entry, tokens map[string]string) (bulkItem, error) {
+	document, timestamp, err := entryDocument(s.Formatter, entry)
+	if err != nil {
+		//	Keep the raw message for the dead letter
+		return bulkItem{cursor: entry.Cursor, document: []byte(entry.Message.Render(s.Formatter.BinaryEncoding))}, err
+	}
+
+	return bulkItem{
+		index:    strings.ToLower(token.Replace(s.Index, DateTokens(tokens, timestamp))),
+		id:       cursorID(entry.Cursor),
+		cursor:   entry.Cursor,
+		document: document,
+	}, nil
+}
+
+// deadLetter logs and counts an item that will never be indexed, and returns the dead letter
+// to index instead.  It returns false if the item is dropped, because there's no dead letter
+// index or the item was already a dead letter
+func (s *Elasticsearch) deadLetter(batch Batch, rejection bulkRejection) (bulkItem, bool) {
+	item := rejection.item
+	fields := log.Fields{
+		"unit":   batch.Unit,
+		"cursor": item.cursor,
+		"index":  item.index,
+		"status": rejection.status,
+		"type":   rejection.kind,
+		"reason": rejection.reason,
+	}
+
+	if s.DeadLetterIndex == "" || item.deadLetter {
+		metrics.Add("elasticsearch.entries_dropped", 1)
+		log.WithFields(fields).Error("elasticsearch will never index an entry.  Dropping it")
+		return bulkItem{}, false
+	}
+
+	now := time.Now().UTC()
+	document, err := json.Marshal(map[string]interface{}{
+		"@timestamp": now.Format(time.RFC3339Nano),
+		"unit":       batch.Unit,
+		"cursor":     item.cursor,
+		"index":      item.index,
+		"document":   string(item.document),
+		"error": map[string]interface{}{
+			"status": rejection.status,
+			"type":   rejection.kind,
+			"reason": rejection.reason,
+		},
+	})
+	if err != nil {
+		metrics.Add("elasticsearch.entries_dropped", 1)
+		log.WithFields(fields).WithError(err).Error("problem creating the elasticsearch dead letter.  Dropping the entry")
+		return bulkItem{}, false
+	}
+
+	log.WithFields(fields).Warn("elasticsearch will never index an entry.  Writing it to the dead letter index")
+
+	return bulkItem{
+		index:      strings.ToLower(token.Replace(s.DeadLetterIndex, DateTokens(batch.Tokens, now))),
+		id:         cursorID(item.cursor),
+		cursor:     item.cursor,
+		document:   document,
+		deadLetter: true,
+	}, true
+}
+
+// bulkSplit sends the items with bulk.  If the request is too large for the cluster, it's
+// split in half and each half is sent on its own.  A single item that's too large will
+// never be indexed, so it's rejected
+func (s *Elasticsearch) bulkSplit(items []bulkItem) ([]bulkItem, []bulkRejection, bool, error) {
+	failed, rejected, retryable, err := s.bulk(items)
+	if !errors.Is(err, errBulkTooLarge) {
+		return failed, rejected, retryable, err
+	}
+
+	if len(items) == 1 {
+		rejection := bulkRejection{item: items[0], status: http.StatusRequestEntityTooLarge, kind: "request_too_large", reason: err.Error()}
+		return nil, []bulkRejection{rejection}, true, nil
+	}
+
+	metrics.Add("elasticsearch.batches_split", 1)
+	failed, rejected = []bulkItem{}, []bulkRejection{}
+	half := len(items) / 2
+	for _, part := range [][]bulkItem{items[:half], items[half:]} {
+		partFailed, partRejected, retryable, err := s.bulkSplit(part)
+		if err != nil {
+			if !retryable {
+				return nil, nil, false, err
+			}
+			partFailed = part
+		}
+		failed = append(failed, partFailed...)
+		rejected = append(rejected, partRejected...)
+	}
+
+	return failed, rejected, true, nil
+}
+
+// bulk sends the items in a _bulk request.  It returns the items that weren't acknowledged
+// but could be tried again, and the items that will never be indexed.  If the request
+// itself fails, it returns the error and whether trying again could help
+func (s *Elasticsearch) bulk(items []bulkItem) ([]bulkItem, []bulkRejection, bool, error) {
+	var body bytes.Buffer
+	for _, item := range items {
+		create := map[string]string{"_index": item.index, "_id": item.id}
+		if item.deadLetter {
+			create["pipeline"] = "_none"
+		}
+		encoded, err := json.Marshal(map[string]map[string]string{"create": create})
+		if err != nil {
+			return nil, nil, false, err
+		}
+		body.Write(encoded)
+		body.WriteByte('\n')
+		body.Write(item.document)
+		body.WriteByte('\n')
+	}
+
+	endpoint := s.URL + "/_bulk"
+	if s.Pipeline != "" {
+		endpoint += "?" + url.Values{"pipeline": {s.Pipeline}}.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, &body)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("User-Agent", "cloudjournal")
+	s.authorize(req)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return nil, nil, false, fmt.Errorf("%w (%s with %d items)", errBulkTooLarge, resp.Status, len(items))
+	}
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		err := fmt.Errorf("elasticsearch returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+		return nil, nil, isRetryableStatus(resp.StatusCode), err
+	}
+
+	response := bulkResponse{}
+	if err := json.NewDecoder(bufio.NewReader(resp.Body)).Decode(&response); err != nil {
+		return nil, nil, true, fmt.Errorf("problem decoding the bulk response: %v", err)
+	}
+
+	if len(response.Items) != len(items) {
+		return nil, nil, true, fmt.Errorf("elasticsearch acknowledged %d of %d items", len(response.Items), len(items))
+	}
+
+	//	Items are in the same order as the request
+	failed := []bulkItem{}
+	rejected := []bulkRejection{}
+	for i, result := range response.Items {
+		for _, item := range result {
+			switch {
+			case item.Status/100 == 2 && items[i].deadLetter:
+				metrics.Add("elasticsearch.entries_deadlettered", 1)
+
+			case item.Status/100 == 2:
+				metrics.Add("elasticsearch.entries_sent", 1)
+
+			//	The document was already created by an earlier try
+			case item.Status == http.StatusConflict:
+				metrics.Add("elasticsearch.entries_duplicate", 1)
+
+			//	Anything else (like a mapping error) won't be fixed by trying again
+			case !isRetryableStatus(item.Status):
+				rejection := bulkRejection{item: items[i], status: item.Status}
+				if item.Error != nil {
+					rejection.kind = item.Error.Type
+					rejection.reason = item.Error.Reason
+				}
+				rejected = append(rejected, rejection)
+
+			default:
+				failed = append(failed, items[i])
+
+				fields := log.Fields{
+					"index":  item.Index,
+					"id":     item.ID,
+					"status": item.Status,
+				}
+				if item.Error != nil {
+					fields["type"] = item.Error.Type
+					fields["reason"] = item.Error.Reason
+				}
+				log.WithFields(fields).Warn("elasticsearch didn't index an entry")
+			}
+		}
+	}
+
+	return failed, rejected, true, nil
+}
+
+// authorize adds the credentials to the request
+func (s *Elasticsearch) authorize(req *http.Request) {
+	if s.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+s.APIKey)
+	} else if s.Username != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+}
+
+// isRetryableStatus returns true if a request (or bulk item) with this status can be tried again
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status/100 == 5
+}
+
+// cursorID returns the document id for a journal cursor
+func cursorID(cursor string) string {
+	id := sha1.Sum([]byte(cursor))
+	return hex.EncodeToString(id[:])
+}
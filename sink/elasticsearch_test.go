@@ -0,0 +1,396 @@
+package sink_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/danesparza/cloudjournal/sink"
+	"github.com/spf13/viper"
+)
+
+// elasticItemFailure is a failure for a single item in a _bulk request
+type elasticItemFailure struct {
+	status int
+	kind   string
+	reason string
+}
+
+// elasticServer is a stand-in for the _bulk API.  It keeps the documents in each index
+// by id, and like the real thing, a create for an id that already exists fails with a
+// 409 version conflict.  Use FailItems to fail individual items
+type elasticServer struct {
+	*testServer
+	indices      map[string]map[string]json.RawMessage
+	order        map[string][]string
+	itemFailures []elasticItemFailure
+}
+
+// useElasticServer starts an Elasticsearch stand-in and points the elasticsearch config at it
+func useElasticServer(t *testing.T) *elasticServer {
+	server := &elasticServer{
+		indices: make(map[string]map[string]json.RawMessage),
+		order:   make(map[string][]string),
+	}
+	server.testServer = newTestServer(t, server.serveHTTP)
+
+	useConfig(t, map[string]interface{}{
+		"elasticsearch.url":           server.URL,
+		"elasticsearch.index":         "journal-{unit}-{date}",
+		"elasticsearch.retrydelay":    "1ms",
+		"elasticsearch.maxretrydelay": "1ms",
+	})
+
+	return server
+}
+
+// FailItems makes the next items (in any request) fail, one failure per item, before
+// items are indexed normally again.  A zero failure lets that item through
+func (server *elasticServer) FailItems(failures ...elasticItemFailure) {
+	server.Lock()
+	defer server.Unlock()
+
+	server.itemFailures = append(server.itemFailures, failures...)
+}
+
+// Documents returns the documents in an index, in the order they were created
+func (server *elasticServer) Documents(index string) []map[string]interface{} {
+	server.Lock()
+	defer server.Unlock()
+
+	retval := []map[string]interface{}{}
+	for _, id := range server.order[index] {
+		document := make(map[string]interface{})
+		json.Unmarshal(server.indices[index][id], &document)
+		retval = append(retval, document)
+	}
+
+	return retval
+}
+
+// Indices returns the names of the indices that have documents, sorted
+func (server *elasticServer) Indices() []string {
+	server.Lock()
+	defer server.Unlock()
+
+	retval := []string{}
+	for index := range server.indices {
+		retval = append(retval, index)
+	}
+	sort.Strings(retval)
+
+	return retval
+}
+
+// bulkItems returns how many items are in a _bulk request
+func bulkItems(r testRequest) int {
+	return strings.Count(strings.TrimSpace(string(r.Body)), "\n")/2 + 1
+}
+
+// serveHTTP handles a _bulk request, and GET / like a cluster info request
+func (server *elasticServer) serveHTTP(w http.ResponseWriter, r testRequest) {
+	if r.Method == http.MethodGet && r.Path == "/" {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name":"test","cluster_name":"test","version":{"number":"8.0.0"}}`)
+		return
+	}
+
+	if r.Method != http.MethodPost || r.Path != "/_bulk" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(r.Body)), "\n")
+	if len(lines)%2 != 0 {
+		http.Error(w, `{"error":{"type":"illegal_argument_exception","reason":"expected an action and a document"}}`, http.StatusBadRequest)
+		return
+	}
+
+	items := []map[string]interface{}{}
+	errors := false
+	for i := 0; i < len(lines); i += 2 {
+		meta := map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}{}
+		json.Unmarshal([]byte(lines[i]), &meta)
+		create, ok := meta["create"]
+		if !ok {
+			http.Error(w, `{"error":{"type":"illegal_argument_exception","reason":"expected a create action"}}`, http.StatusBadRequest)
+			return
+		}
+		result := map[string]interface{}{"_index": create.Index, "_id": create.ID}
+
+		failure := elasticItemFailure{}
+		if len(server.itemFailures) > 0 {
+			failure = server.itemFailures[0]
+			server.itemFailures = server.itemFailures[1:]
+		}
+
+		switch {
+		case failure.status != 0:
+			result["status"] = failure.status
+			result["error"] = map[string]string{"type": failure.kind, "reason": failure.reason}
+			errors = true
+
+		case server.indices[create.Index][create.ID] != nil:
+			result["status"] = http.StatusConflict
+			result["error"] = map[string]string{"type": "version_conflict_engine_exception", "reason": "document already exists"}
+			errors = true
+
+		default:
+			if server.indices[create.Index] == nil {
+				server.indices[create.Index] = make(map[string]json.RawMessage)
+			}
+			server.indices[create.Index][create.ID] = json.RawMessage(lines[i+1])
+			server.order[create.Index] = append(server.order[create.Index], create.ID)
+			result["status"] = http.StatusCreated
+			result["result"] = "created"
+		}
+
+		items = append(items, map[string]interface{}{"create": result})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": errors, "items": items})
+}
+
+func TestElasticsearch_Write_IndexesDocumentsInTemplatedIndex(t *testing.T) {
+	//	Arrange
+	server := useElasticServer(t)
+	viper.Set("elasticsearch.apikey", "secret")
+	out := newTestSink(t, sink.ElasticsearchName)
+
+	//	Act
+	err := out.Write(testBatch(1, 3))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	documents := server.Documents("journal-cron-2021.11.04")
+	if len(documents) != 3 {
+		t.Fatalf("Write - Expected 3 documents in journal-cron-2021.11.04, but got %d (indices %v)", len(documents), server.Indices())
+	}
+
+	if documents[0]["message"] != "message 1" || documents[0]["@timestamp"] != "2021-11-04T04:26:40.001Z" {
+		t.Errorf("Write - Expected the message and @timestamp in the document, but got %v", documents[0])
+	}
+
+	if requests := server.Requests(); len(requests) != 1 || requests[0].Header.Get("Authorization") != "ApiKey secret" {
+		t.Errorf("Write - Expected one request with the API key, but got %+v", requests)
+	}
+}
+
+func TestElasticsearch_Write_WrittenAgain_DoesNotDuplicate(t *testing.T) {
+	//	Arrange
+	server := useElasticServer(t)
+	out := newTestSink(t, sink.ElasticsearchName)
+	if err := out.Write(testBatch(1, 2)); err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	//	Act
+	err := out.Write(testBatch(1, 3))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Documents that already exist should count as acknowledged, but got: %s", err)
+	}
+
+	if documents := server.Documents("journal-cron-2021.11.04"); len(documents) != 3 {
+		t.Errorf("Write - Expected 3 documents, but got %d", len(documents))
+	}
+}
+
+func TestElasticsearch_Write_RejectedItems_RetriesOnlyThoseItems(t *testing.T) {
+	//	Arrange
+	server := useElasticServer(t)
+	viper.Set("elasticsearch.retries", 2)
+	server.FailItems(
+		elasticItemFailure{http.StatusTooManyRequests, "es_rejected_execution_exception", "queue is full"},
+	)
+	out := newTestSink(t, sink.ElasticsearchName)
+
+	//	Act
+	err := out.Write(testBatch(1, 3))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error after retrying, but got: %s", err)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 2 || bulkItems(requests[1]) != 1 {
+		t.Errorf("Write - Expected a retry with just the rejected item, but got %+v", requests)
+	}
+
+	if documents := server.Documents("journal-cron-2021.11.04"); len(documents) != 3 {
+		t.Errorf("Write - Expected 3 documents, but got %d", len(documents))
+	}
+}
+
+func TestElasticsearch_Write_MappingError_DropsItWithoutRetrying(t *testing.T) {
+	//	Arrange
+	server := useElasticServer(t)
+	viper.Set("elasticsearch.retries", 2)
+	server.FailItems(
+		elasticItemFailure{},
+		elasticItemFailure{http.StatusBadRequest, "mapper_parsing_exception", "failed to parse field"},
+	)
+	out := newTestSink(t, sink.ElasticsearchName)
+
+	//	Act
+	err := out.Write(testBatch(1, 3))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - An entry that will never be indexed shouldn't stall the unit, but got: %s", err)
+	}
+
+	if requests := server.Requests(); len(requests) != 1 {
+		t.Errorf("Write - Expected a mapping error not to be retried, but got %d requests", len(requests))
+	}
+
+	if documents := server.Documents("journal-cron-2021.11.04"); len(documents) != 2 {
+		t.Errorf("Write - Expected the other 2 documents, but got %d", len(documents))
+	}
+}
+
+func TestElasticsearch_Write_MappingError_WritesDeadLetter(t *testing.T) {
+	//	Arrange
+	server := useElasticServer(t)
+	viper.Set("elasticsearch.deadletterindex", "journal-deadletter-{unit}")
+	server.FailItems(
+		elasticItemFailure{http.StatusBadRequest, "mapper_parsing_exception", "failed to parse field"},
+	)
+	out := newTestSink(t, sink.ElasticsearchName)
+	batch := testBatch(1, 3)
+	batch.Entries[2].RealtimeTimestamp = "not a timestamp"
+
+	//	Act
+	err := out.Write(batch)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	if documents := server.Documents("journal-cron-2021.11.04"); len(documents) != 1 {
+		t.Errorf("Write - Expected 1 indexed document, but got %d", len(documents))
+	}
+
+	deadLetters := map[interface{}]map[string]interface{}{}
+	for _, document := range server.Documents("journal-deadletter-cron") {
+		deadLetters[document["cursor"]] = document
+	}
+	if len(deadLetters) != 2 {
+		t.Fatalf("Write - Expected 2 dead letters, but got %d (indices %v)", len(deadLetters), server.Indices())
+	}
+
+	rejected := deadLetters["c1"]
+	if failure, _ := rejected["error"].(map[string]interface{}); failure["type"] != "mapper_parsing_exception" ||
+		rejected["index"] != "journal-cron-2021.11.04" || !strings.Contains(fmt.Sprint(rejected["document"]), "message 1") {
+		t.Errorf("Write - Expected the original document, index and error in the dead letter, but got %v", rejected)
+	}
+
+	broken := deadLetters["c3"]
+	if failure, _ := broken["error"].(map[string]interface{}); failure["type"] != "document_error" || broken["document"] != "message 3" {
+		t.Errorf("Write - Expected the raw message in the dead letter for an entry that isn't a document, but got %v", broken)
+	}
+}
+
+func TestElasticsearch_Write_Pipeline_IsEscaped(t *testing.T) {
+	//	Arrange
+	server := useElasticServer(t)
+	viper.Set("elasticsearch.pipeline", "journal&refresh=true")
+	out := newTestSink(t, sink.ElasticsearchName)
+
+	//	Act
+	err := out.Write(testBatch(1, 1))
+
+	//	Assert
+	if requests := server.Requests(); err != nil || len(requests) != 1 || requests[0].Query.Get("pipeline") != "journal&refresh=true" {
+		t.Errorf("Write - Expected the whole pipeline name in one parameter, but got %+v (%v)", requests, err)
+	}
+}
+
+func TestElasticsearch_Write_Unavailable_RetriesWithBackoff(t *testing.T) {
+	//	Arrange
+	server := useElasticServer(t)
+	viper.Set("elasticsearch.retries", 2)
+	server.FailNext(http.StatusServiceUnavailable)
+	out := newTestSink(t, sink.ElasticsearchName)
+
+	//	Act
+	err := out.Write(testBatch(1, 2))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error after retrying, but got: %s", err)
+	}
+
+	if requests := server.Requests(); len(requests) != 2 {
+		t.Errorf("Write - Expected 2 requests, but got %d", len(requests))
+	}
+}
+
+func TestElasticsearch_Write_TooLarge_SplitsTheBatch(t *testing.T) {
+	//	Arrange
+	server := useElasticServer(t)
+	server.FailNext(http.StatusRequestEntityTooLarge, http.StatusRequestEntityTooLarge)
+	out := newTestSink(t, sink.ElasticsearchName)
+
+	//	Act
+	err := out.Write(testBatch(1, 4))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error once the batch is split, but got: %s", err)
+	}
+
+	if requests := server.Requests(); len(requests) != 5 {
+		t.Errorf("Write - Expected the batch to be split twice, but got %d requests", len(requests))
+	}
+
+	if documents := server.Documents("journal-cron-2021.11.04"); len(documents) != 4 {
+		t.Errorf("Write - Expected 4 documents, but got %d", len(documents))
+	}
+}
+
+func TestElasticsearch_Write_EntryTooLarge_DropsIt(t *testing.T) {
+	//	Arrange
+	server := useElasticServer(t)
+	server.FailNext(http.StatusRequestEntityTooLarge)
+	out := newTestSink(t, sink.ElasticsearchName)
+
+	//	Act
+	err := out.Write(testBatch(1, 1))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - An entry that will never be indexed shouldn't stall the unit, but got: %s", err)
+	}
+
+	if requests := server.Requests(); len(requests) != 1 {
+		t.Errorf("Write - Expected the entry not to be retried, but got %d requests", len(requests))
+	}
+}
+
+func TestElasticsearch_HealthCheck_Reachable_Succeeds(t *testing.T) {
+	//	Arrange
+	useElasticServer(t)
+	out := newTestSink(t, sink.ElasticsearchName).(sink.HealthChecker)
+
+	//	Act
+	err := out.HealthCheck()
+
+	//	Assert
+	if err != nil {
+		t.Errorf("HealthCheck - Should execute without error, but got: %s", err)
+	}
+}
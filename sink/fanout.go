@@ -0,0 +1,199 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Fanout writes each batch to all of its sinks.  A batch is only written once every
+// sink has accepted it, so the journal cursor only moves when nothing was lost.
+// When a batch is tried again, sinks that already accepted it only get the entries they
+// haven't seen.  That's only remembered while cloudjournal runs, so a restart after a
+// failure can ship some entries to the other sinks twice.  If a sink buffers a unit's
+// entries, Write returns ErrBuffered until the sink has shipped them
+type Fanout struct {
+	sinks []Sink
+
+	mu       sync.Mutex
+	shipped  map[string]string
+	buffered map[string]bool
+}
+
+// NewFanout creates a Fanout for the sinks
+func NewFanout(sinks ...Sink) *Fanout {
+	return &Fanout{
+		sinks:    sinks,
+		shipped:  make(map[string]string),
+		buffered: make(map[string]bool),
+	}
+}
+
+// Name returns the names of the sinks
+func (f *Fanout) Name() string {
+	names := []string{}
+	for _, s := range f.sinks {
+		names = append(names, s.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// Write writes the batch to every sink, and returns an error if any of them failed.  If
+// they all accepted it but some of the unit's entries are still buffered by a sink, it
+// returns ErrBuffered
+func (f *Fanout) Write(batch Batch) error {
+	failed := []string{}
+	var lastErr error
+	buffered := false
+
+	for _, s := range f.sinks {
+		key := s.Name() + "\x00" + batch.Unit
+
+		f.mu.Lock()
+		entries := entriesAfter(batch.Entries, f.shipped[key])
+		if len(entries) == 0 && f.buffered[key] {
+			buffered = true
+		}
+		f.mu.Unlock()
+
+		if len(entries) == 0 {
+			continue
+		}
+
+		sinkBatch := batch
+		sinkBatch.Entries = entries
+		err := s.Write(sinkBatch)
+		if errors.Is(err, ErrBuffered) {
+			buffered = true
+		} else if err != nil {
+			metrics.Add("sink."+s.Name()+".batches_failed", 1)
+			log.WithFields(log.Fields{
+				"sink":    s.Name(),
+				"unit":    batch.Unit,
+				"entries": len(entries),
+			}).WithError(err).Error("problem writing to sink")
+
+			failed = append(failed, s.Name())
+			lastErr = err
+			continue
+		}
+
+		metrics.Add("sink."+s.Name()+".entries_sent", int64(len(entries)))
+
+		f.mu.Lock()
+		f.shipped[key] = entries[len(entries)-1].Cursor
+		f.buffered[key] = err != nil
+		f.mu.Unlock()
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("problem writing to %s: %w", strings.Join(failed, ", "), lastErr)
+	}
+
+	if buffered {
+		return ErrBuffered
+	}
+
+	return nil
+}
+
+// Flush flushes the unit's entries in every sink that has some buffered.  It returns nil
+// once none of them do, ErrBuffered if some entries aren't due yet, or an error if a sink
+// couldn't ship them
+func (f *Fanout) Flush(unit string, force bool) error {
+	failed := []string{}
+	var lastErr error
+	buffered := false
+
+	for _, s := range f.sinks {
+		key := s.Name() + "\x00" + unit
+
+		f.mu.Lock()
+		pending := f.buffered[key]
+		f.mu.Unlock()
+
+		flusher, ok := s.(Flusher)
+		if !pending || !ok {
+			continue
+		}
+
+		err := flusher.Flush(unit, force)
+		if errors.Is(err, ErrBuffered) {
+			buffered = true
+			continue
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"sink": s.Name(),
+				"unit": unit,
+			}).WithError(err).Error("problem flushing sink")
+
+			failed = append(failed, s.Name())
+			lastErr = err
+			continue
+		}
+
+		f.mu.Lock()
+		delete(f.buffered, key)
+		f.mu.Unlock()
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("problem flushing %s: %w", strings.Join(failed, ", "), lastErr)
+	}
+
+	if buffered {
+		return ErrBuffered
+	}
+
+	return nil
+}
+
+// Close closes every sink, and returns the first error
+func (f *Fanout) Close() error {
+	var retval error
+	for _, s := range f.sinks {
+		if err := s.Close(); err != nil {
+			log.WithFields(log.Fields{
+				"sink": s.Name(),
+			}).WithError(err).Error("problem closing sink")
+			if retval == nil {
+				retval = err
+			}
+		}
+	}
+	return retval
+}
+
+// HealthCheck checks every sink that can be checked, and returns the first error
+func (f *Fanout) HealthCheck() error {
+	for _, s := range f.sinks {
+		if checker, ok := s.(HealthChecker); ok {
+			if err := checker.HealthCheck(); err != nil {
+				return fmt.Errorf("%s: %w", s.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// entriesAfter returns the entries after the one with the cursor.  If the cursor
+// isn't in the entries, all of them are returned
+func entriesAfter(entries []journal.Entry, cursor string) []journal.Entry {
+	if cursor == "" {
+		return entries
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Cursor == cursor {
+			return entries[i+1:]
+		}
+	}
+
+	return entries
+}
@@ -0,0 +1,147 @@
+package sink_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/danesparza/cloudjournal/sink"
+)
+
+// recordingSink remembers the messages it was sent, and fails when told to
+type recordingSink struct {
+	name     string
+	messages []string
+	fail     bool
+	closed   bool
+}
+
+func (s *recordingSink) Name() string { return s.name }
+
+func (s *recordingSink) Write(batch sink.Batch) error {
+	if s.fail {
+		return errors.New("sink is down")
+	}
+	for _, entry := range batch.Entries {
+		s.messages = append(s.messages, entry.Message.String())
+	}
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+// bufferingSink buffers what it's sent until it's flushed with force
+type bufferingSink struct {
+	recordingSink
+	buffered bool
+}
+
+func (s *bufferingSink) Write(batch sink.Batch) error {
+	s.recordingSink.Write(batch)
+	s.buffered = true
+	return sink.ErrBuffered
+}
+
+func (s *bufferingSink) Flush(unit string, force bool) error {
+	if s.buffered && !force {
+		return sink.ErrBuffered
+	}
+	s.buffered = false
+	return nil
+}
+
+func TestFanout_Write_WritesToEverySink(t *testing.T) {
+	//	Arrange
+	first := &recordingSink{name: "first"}
+	second := &recordingSink{name: "second"}
+	out := sink.NewFanout(first, second)
+
+	//	Act
+	err := out.Write(testBatch(1, 3))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	if len(first.messages) != 3 || len(second.messages) != 3 {
+		t.Errorf("Write - Expected 3 messages in each sink, but got %v and %v", first.messages, second.messages)
+	}
+
+	if out.Name() != "first,second" {
+		t.Errorf("Name - Expected first,second but got %v", out.Name())
+	}
+}
+
+func TestFanout_Write_RetryAfterFailure_DoesNotDuplicate(t *testing.T) {
+	//	Arrange - the second sink is down for the first try
+	first := &recordingSink{name: "first"}
+	second := &recordingSink{name: "second", fail: true}
+	out := sink.NewFanout(first, second)
+	failedErr := out.Write(testBatch(1, 3))
+	second.fail = false
+
+	//	Act - the batch is tried again with more entries
+	err := out.Write(testBatch(1, 5))
+
+	//	Assert
+	if failedErr == nil {
+		t.Errorf("Write - Expected an error while a sink is down")
+	}
+
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	if len(first.messages) != 5 || first.messages[3] != "message 4" {
+		t.Errorf("Write - Expected the first sink to get each message once, but got %v", first.messages)
+	}
+
+	if len(second.messages) != 5 || second.messages[0] != "message 1" {
+		t.Errorf("Write - Expected the second sink to get every message, but got %v", second.messages)
+	}
+}
+
+func TestFanout_Write_Buffered_UntilFlushed(t *testing.T) {
+	//	Arrange
+	first := &recordingSink{name: "first"}
+	second := &bufferingSink{recordingSink: recordingSink{name: "second"}}
+	out := sink.NewFanout(first, second)
+
+	//	Act
+	written := out.Write(testBatch(1, 3))
+	again := out.Write(testBatch(1, 3))
+	notDue := out.Flush("cron", false)
+	forced := out.Flush("cron", true)
+	flushed := out.Write(testBatch(1, 3))
+
+	//	Assert
+	if written != sink.ErrBuffered || again != sink.ErrBuffered || notDue != sink.ErrBuffered {
+		t.Errorf("Write - Expected the entries to stay buffered until they're flushed, but got %v, %v and %v", written, again, notDue)
+	}
+
+	if forced != nil || flushed != nil {
+		t.Errorf("Flush - Expected nothing buffered once it's flushed, but got %v and %v", forced, flushed)
+	}
+
+	if len(first.messages) != 3 || len(second.messages) != 3 {
+		t.Errorf("Write - Expected 3 messages in each sink, but got %v and %v", first.messages, second.messages)
+	}
+}
+
+func TestFanout_Close_ClosesEverySink(t *testing.T) {
+	//	Arrange
+	first := &recordingSink{name: "first"}
+	second := &recordingSink{name: "second"}
+	out := sink.NewFanout(first, second)
+
+	//	Act
+	err := out.Close()
+
+	//	Assert
+	if err != nil || !first.closed || !second.closed {
+		t.Errorf("Close - Expected every sink to be closed without error, but got %v", err)
+	}
+}
@@ -0,0 +1,484 @@
+package sink
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danesparza/cloudjournal/format"
+	"github.com/danesparza/cloudjournal/metrics"
+	"github.com/danesparza/cloudjournal/token"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// FileName is the name of the local file sink
+const FileName = "file"
+
+// rotatedTimeFormat is the time format used in the names of rotated files
+const rotatedTimeFormat = "20060102T150405.000"
+
+// tokenPattern matches a token in Path, like {unit}
+var tokenPattern = regexp.MustCompile(`\{[^{}/]+\}`)
+
+// File writes entries as NDJSON to local files (usually one per unit), for hosts that are
+// offline or air-gapped.  Files are rotated when they get too big or too old (even if
+// nothing is written to them), rotated files can be gzipped, and the oldest rotated files
+// are removed to keep the directory under a total size
+type File struct {
+	// Directory is where the files are written
+	Directory string
+
+	// Path is the path of the file for a batch, relative to Directory.  It can use tokens
+	Path string
+
+	// MaxSize is the size (in bytes) a file is rotated at.  0 doesn't rotate by size
+	MaxSize int64
+
+	// MaxAge is how long a file is written to before it's rotated.  0 doesn't rotate by age
+	MaxAge time.Duration
+
+	// Compress gzips rotated files
+	Compress bool
+
+	// MaxTotalSize is the most space (in bytes) all the files in Directory can use.  The oldest
+	// rotated files are removed to stay under it.  0 doesn't limit the total size
+	MaxTotalSize int64
+
+	// Formatter formats each entry.  Its mode is always json
+	Formatter format.Formatter
+
+	// Now returns the current time.  Tests can replace it
+	Now func() time.Time
+
+	mu    sync.Mutex
+	files map[string]*openFile
+	done  chan struct{}
+}
+
+// openFile is a file that is being written to
+type openFile struct {
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+// NewFileFromConfig creates a file sink from the file section of the config
+func NewFileFromConfig() (*File, error) {
+	retval := &File{
+		Directory: viper.GetString("file.directory"),
+		Path:      viper.GetString("file.path"),
+		MaxAge:    durationFromConfig("file.maxage", 0),
+		Compress:  viper.GetBool("file.compress"),
+		Formatter: newFormatter(format.FormatJSON),
+	}
+
+	if retval.Directory == "" {
+		return nil, fmt.Errorf("file.directory isn't set")
+	}
+
+	if retval.Path == "" {
+		return nil, fmt.Errorf("file.path isn't set")
+	}
+
+	var err error
+	if retval.MaxSize, err = ParseSize(viper.GetString("file.maxsize")); err != nil {
+		return nil, fmt.Errorf("problem parsing file.maxsize: %v", err)
+	}
+
+	if retval.MaxTotalSize, err = ParseSize(viper.GetString("file.maxtotalsize")); err != nil {
+		return nil, fmt.Errorf("problem parsing file.maxtotalsize: %v", err)
+	}
+
+	return retval, nil
+}
+
+// Name returns the name of the sink
+func (s *File) Name() string {
+	return FileName
+}
+
+// Write appends the batch to the batch's file, and syncs it to disk before returning.
+// The file is rotated first if it's too big or too old, and old rotated files are
+// removed afterwards if the files are over MaxTotalSize
+func (s *File) Write(batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lines := []byte{}
+	written := 0
+	for _, entry := range batch.Entries {
+		document, _, err := entryDocument(s.Formatter, entry)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"unit":   batch.Unit,
+				"cursor": entry.Cursor,
+			}).WithError(err).Error("problem creating the file document.  Skipping it")
+			continue
+		}
+		lines = append(append(lines, document...), '\n')
+		written++
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	path, err := s.path(batch.Tokens)
+	if err != nil {
+		return err
+	}
+
+	f, err := s.open(path)
+	if err != nil {
+		return err
+	}
+
+	//	Rotate before the write, so a file is never empty after rotating
+	if s.needsRotation(f, int64(len(lines))) {
+		if err := s.rotate(path); err != nil {
+			return err
+		}
+		if f, err = s.open(path); err != nil {
+			return err
+		}
+	}
+
+	if err := s.append(path, f, lines); err != nil {
+		metrics.Add("file.batches_failed", 1)
+		return err
+	}
+
+	if s.MaxTotalSize > 0 {
+		s.removeOldFiles()
+	}
+
+	metrics.Add("file.entries_written", int64(written))
+	return nil
+}
+
+// Close rotates the files that are too old, and closes the rest
+func (s *File) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
+
+	var retval error
+	if err := s.rotateOld(); err != nil {
+		retval = err
+	}
+
+	for path, f := range s.files {
+		if err := f.file.Close(); err != nil && retval == nil {
+			retval = err
+		}
+		delete(s.files, path)
+	}
+
+	return retval
+}
+
+// append writes the lines to the file in one write, and syncs it.  If either fails, the
+// file is truncated back to its old size so it never ends with part of a line, and the
+// whole batch can be written again.  The caller must hold the lock
+func (s *File) append(path string, f *openFile, lines []byte) error {
+	_, err := f.file.Write(lines)
+	if err == nil {
+		err = f.file.Sync()
+	}
+
+	if err == nil {
+		f.size += int64(len(lines))
+		return nil
+	}
+
+	if truncateErr := f.file.Truncate(f.size); truncateErr != nil {
+		log.WithFields(log.Fields{
+			"file": path,
+		}).WithError(truncateErr).Error("problem removing a failed write from the file")
+	}
+
+	return err
+}
+
+// rotateOldFiles rotates the open files that are too old, every interval, until done is closed
+func (s *File) rotateOldFiles(done chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if err := s.rotateOld(); err != nil {
+				log.WithError(err).Error("problem rotating an old file")
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// rotateOld rotates the open files that are older than MaxAge, and returns the first
+// error.  The caller must hold the lock
+func (s *File) rotateOld() error {
+	if s.MaxAge <= 0 {
+		return nil
+	}
+
+	var retval error
+	for path, f := range s.files {
+		if f.size > 0 && s.now().Sub(f.created) >= s.MaxAge {
+			if err := s.rotate(path); err != nil && retval == nil {
+				retval = err
+			}
+		}
+	}
+
+	return retval
+}
+
+// path returns the full path of the file for the tokens, making sure it's inside Directory
+func (s *File) path(tokens map[string]string) (string, error) {
+	directory := filepath.Clean(s.Directory)
+	path := filepath.Join(directory, token.Replace(s.Path, tokens))
+
+	if !strings.HasPrefix(path, directory+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %s isn't inside file.directory %s", path, directory)
+	}
+
+	return path, nil
+}
+
+// open returns the open file for the path, opening (or creating) it if needed.  The
+// caller must hold the lock
+func (s *File) open(path string) (*openFile, error) {
+	if f, ok := s.files[path]; ok {
+		return f, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	//	We don't know when an existing file was created.  Its last change is the
+	//	closest we have, and means a file left over from long ago is rotated right away
+	created := s.now()
+	if info.Size() > 0 {
+		created = info.ModTime()
+	}
+
+	if s.files == nil {
+		s.files = make(map[string]*openFile)
+	}
+
+	//	Check the age of open files in the background, so a file that isn't written
+	//	to any more is still rotated
+	if s.MaxAge > 0 && s.done == nil {
+		interval := s.MaxAge
+		if interval > time.Minute {
+			interval = time.Minute
+		}
+		s.done = make(chan struct{})
+		go s.rotateOldFiles(s.done, interval)
+	}
+	f := &openFile{file: file, size: info.Size(), created: created}
+	s.files[path] = f
+
+	return f, nil
+}
+
+// needsRotation returns true if the file is too old, or would be too big after writing size bytes
+func (s *File) needsRotation(f *openFile, size int64) bool {
+	if f.size == 0 {
+		return false
+	}
+
+	if s.MaxSize > 0 && f.size+size > s.MaxSize {
+		return true
+	}
+
+	return s.MaxAge > 0 && s.now().Sub(f.created) >= s.MaxAge
+}
+
+// rotate closes the file, renames it with the time (like cron-20211104T042640.000.ndjson)
+// and gzips it if Compress is set.  The caller must hold the lock
+func (s *File) rotate(path string) error {
+	if f, ok := s.files[path]; ok {
+		f.file.Close()
+		delete(s.files, path)
+	}
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext) + "-" + s.now().UTC().Format(rotatedTimeFormat)
+	rotated := base + ext
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+
+	if err := os.Rename(path, rotated); err != nil {
+		return err
+	}
+	metrics.Add("file.rotations", 1)
+
+	if s.Compress {
+		if err := gzipFile(rotated); err != nil {
+			//	The rotated file is still there, just not compressed
+			log.WithFields(log.Fields{
+				"file": rotated,
+			}).WithError(err).Error("problem compressing the rotated file")
+		}
+	}
+
+	return nil
+}
+
+// removeOldFiles removes the oldest rotated files until the files in the directory are under
+// MaxTotalSize.  Only files this sink writes count, and files that are being written to are
+// never removed.  The caller must hold the lock
+func (s *File) removeOldFiles() {
+	type rotatedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	pattern := s.rotatedPattern()
+	total := int64(0)
+	rotated := []rotatedFile{}
+	filepath.Walk(s.Directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		if _, open := s.files[path]; open {
+			total += info.Size()
+			return nil
+		}
+
+		relative, err := filepath.Rel(s.Directory, path)
+		if err == nil && pattern.MatchString(filepath.ToSlash(relative)) {
+			total += info.Size()
+			rotated = append(rotated, rotatedFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		}
+		return nil
+	})
+
+	sort.Slice(rotated, func(i, j int) bool {
+		if !rotated[i].modTime.Equal(rotated[j].modTime) {
+			return rotated[i].modTime.Before(rotated[j].modTime)
+		}
+		return rotated[i].path < rotated[j].path
+	})
+
+	for _, f := range rotated {
+		if total <= s.MaxTotalSize {
+			return
+		}
+
+		if err := os.Remove(f.path); err != nil {
+			log.WithFields(log.Fields{
+				"file": f.path,
+			}).WithError(err).Error("problem removing an old file")
+			continue
+		}
+
+		total -= f.size
+		metrics.Add("file.removed", 1)
+		log.WithFields(log.Fields{
+			"file": f.path,
+			"size": f.size,
+		}).Info("removed an old file to stay under file.maxtotalsize")
+	}
+}
+
+// rotatedPattern matches the paths (relative to Directory, with forward slashes) of the
+// files rotate names from Path, like cron-20211104T042640.000.ndjson.gz for {unit}.ndjson.
+// Each token matches anything inside one directory
+func (s *File) rotatedPattern() *regexp.Regexp {
+	template := filepath.ToSlash(filepath.Clean(s.Path))
+	ext := filepath.Ext(template)
+
+	quote := func(part string) string {
+		literals := tokenPattern.Split(part, -1)
+		for i := range literals {
+			literals[i] = regexp.QuoteMeta(literals[i])
+		}
+		return strings.Join(literals, "[^/]*")
+	}
+
+	return regexp.MustCompile("^" + quote(strings.TrimSuffix(template, ext)) +
+		`-\d{8}T\d{6}\.\d{3}(-\d+)?` + quote(ext) + `(\.gz)?$`)
+}
+
+// now returns the current time
+func (s *File) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+
+	return time.Now()
+}
+
+// fileExists returns true if there is a file at the path
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// gzipFile compresses a file to path.gz and removes the original
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,311 @@
+package sink_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danesparza/cloudjournal/metrics"
+	"github.com/danesparza/cloudjournal/sink"
+)
+
+// newTestFile creates a file sink in a temporary directory, with a clock the test controls
+func newTestFile(t *testing.T, now *time.Time) (*sink.File, string) {
+	dir := t.TempDir()
+
+	useConfig(t, map[string]interface{}{
+		"file.directory": dir,
+		"file.path":      "{hostname}/{unit}.ndjson",
+	})
+
+	out := newTestSink(t, sink.FileName).(*sink.File)
+	out.Now = func() time.Time { return *now }
+
+	return out, dir
+}
+
+// rotatedFiles returns the names of the rotated files in the directory, sorted
+func rotatedFiles(t *testing.T, dir string) []string {
+	names := []string{}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir - Should execute without error, but got: %s", err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "cron-") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFile_Write_AppendsNDJSONToUnitFile(t *testing.T) {
+	//	Arrange
+	now := time.Date(2021, 11, 4, 5, 0, 0, 0, time.UTC)
+	out, dir := newTestFile(t, &now)
+
+	//	Act
+	err := out.Write(hostBatch(1, 2))
+	if err == nil {
+		err = out.Write(hostBatch(3, 3))
+	}
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(dir, "raspberrypi", "cron.ndjson"))
+	if err != nil {
+		t.Fatalf("ReadFile - Should execute without error, but got: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Write - Expected 3 lines, but got %q", contents)
+	}
+
+	document := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(lines[2]), &document); err != nil || document["message"] != "message 3" {
+		t.Errorf("Write - Expected a JSON document for message 3, but got %s (%v)", lines[2], err)
+	}
+}
+
+func TestFile_Write_TooBig_RotatesAndCompresses(t *testing.T) {
+	//	Arrange
+	now := time.Date(2021, 11, 4, 5, 0, 0, 0, time.UTC)
+	out, dir := newTestFile(t, &now)
+	out.Path = "{unit}.ndjson"
+	out.MaxSize = 200
+	out.Compress = true
+
+	//	Act
+	for i := 1; i <= 4; i++ {
+		now = now.Add(time.Second)
+		if err := out.Write(testBatch(i, i)); err != nil {
+			t.Fatalf("Write - Should execute without error, but got: %s", err)
+		}
+	}
+
+	//	Assert
+	rotated := rotatedFiles(t, dir)
+	if len(rotated) == 0 {
+		t.Fatalf("Write - Expected rotated files, but got none")
+	}
+
+	f, err := os.Open(filepath.Join(dir, rotated[0]))
+	if err != nil {
+		t.Fatalf("Open - Should execute without error, but got: %s", err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Write - Expected %s to be gzipped, but got: %s", rotated[0], err)
+	}
+
+	first, _ := bufio.NewReader(zr).ReadString('\n')
+	if !strings.Contains(first, "message 1") {
+		t.Errorf("Write - Expected the first rotated file to start with message 1, but got %q", first)
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, "cron.ndjson")); err != nil || info.Size() > 200 {
+		t.Errorf("Write - Expected the current file to be under the max size, but got %v (%v)", info, err)
+	}
+}
+
+func TestFile_Write_TooOld_Rotates(t *testing.T) {
+	//	Arrange
+	now := time.Date(2021, 11, 4, 5, 0, 0, 0, time.UTC)
+	out, dir := newTestFile(t, &now)
+	out.Path = "{unit}.ndjson"
+	out.MaxAge = time.Hour
+
+	//	Act
+	err := out.Write(testBatch(1, 1))
+	if err == nil {
+		now = now.Add(30 * time.Minute)
+		err = out.Write(testBatch(2, 2))
+	}
+	if err == nil {
+		now = now.Add(31 * time.Minute)
+		err = out.Write(testBatch(3, 3))
+	}
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	rotated := rotatedFiles(t, dir)
+	if len(rotated) != 1 || rotated[0] != "cron-20211104T060100.000.ndjson" {
+		t.Errorf("Write - Expected one rotated file, but got %v", rotated)
+	}
+}
+
+func TestFile_Close_TooOld_Rotates(t *testing.T) {
+	//	Arrange
+	now := time.Date(2021, 11, 4, 5, 0, 0, 0, time.UTC)
+	out, dir := newTestFile(t, &now)
+	out.Path = "{unit}.ndjson"
+	out.MaxAge = time.Hour
+
+	//	Act
+	err := out.Write(testBatch(1, 1))
+	now = now.Add(61 * time.Minute)
+	closed := out.Close()
+
+	//	Assert
+	if err != nil || closed != nil {
+		t.Fatalf("Write and Close - Should execute without error, but got: %v and %v", err, closed)
+	}
+
+	if rotated := rotatedFiles(t, dir); len(rotated) != 1 {
+		t.Errorf("Close - Expected the old file to be rotated, but got %v", rotated)
+	}
+}
+
+func TestFile_Write_NothingMoreWritten_RotatesWhenTooOld(t *testing.T) {
+	//	Arrange
+	now := time.Now()
+	out, dir := newTestFile(t, &now)
+	out.Path = "{unit}.ndjson"
+	out.MaxAge = 20 * time.Millisecond
+	out.Now = time.Now
+
+	//	Act
+	err := out.Write(testBatch(1, 1))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); len(rotatedFiles(t, dir)) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Write - Expected the file to be rotated once it's too old, but it wasn't")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFile_Write_SkippedEntry_IsNotCounted(t *testing.T) {
+	//	Arrange
+	now := time.Date(2021, 11, 4, 5, 0, 0, 0, time.UTC)
+	out, _ := newTestFile(t, &now)
+	batch := testBatch(1, 3)
+	batch.Entries[1].RealtimeTimestamp = "not a timestamp"
+	before := metrics.Get("file.entries_written")
+
+	//	Act
+	err := out.Write(batch)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	if written := metrics.Get("file.entries_written") - before; written != 2 {
+		t.Errorf("Write - Expected 2 entries counted as written, but got %v", written)
+	}
+}
+
+func TestFile_Write_OverMaxTotalSize_RemovesOldestRotatedFiles(t *testing.T) {
+	//	Arrange
+	now := time.Date(2021, 11, 4, 5, 0, 0, 0, time.UTC)
+	out, dir := newTestFile(t, &now)
+	out.Path = "{unit}.ndjson"
+	out.MaxSize = 100
+	out.MaxTotalSize = 700
+
+	unrelated := filepath.Join(dir, "notes-20211104T050000.000.txt.keep")
+	if err := os.WriteFile(unrelated, []byte(strings.Repeat("x", 1000)), 0644); err != nil {
+		t.Fatalf("WriteFile - Should execute without error, but got: %s", err)
+	}
+
+	//	Act
+	for i := 1; i <= 10; i++ {
+		now = now.Add(time.Second)
+		if err := out.Write(testBatch(i, i)); err != nil {
+			t.Fatalf("Write - Should execute without error, but got: %s", err)
+		}
+	}
+
+	//	Assert
+	total := int64(0)
+	for _, name := range append(rotatedFiles(t, dir), "cron.ndjson") {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Stat - Should execute without error, but got: %s", err)
+		}
+		total += info.Size()
+	}
+
+	if total > 700 {
+		t.Errorf("Write - Expected at most 700 bytes of files, but got %d (%v)", total, rotatedFiles(t, dir))
+	}
+
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Errorf("Write - Should not remove files the sink didn't write, but got: %s", err)
+	}
+}
+
+func TestFile_Write_OverMaxTotalSize_KeepsUnrelatedFiles(t *testing.T) {
+	//	Arrange
+	now := time.Date(2021, 11, 4, 5, 0, 0, 0, time.UTC)
+	out, dir := newTestFile(t, &now)
+	out.Path = "{unit}.ndjson"
+	out.MaxSize = 100
+	out.MaxTotalSize = 300
+
+	unrelated := []string{
+		filepath.Join(dir, "backup-20211104T050000.000.tar.gz"),
+		filepath.Join(dir, "cron-20211104T050000.000.log"),
+		filepath.Join(dir, "archive", "cron-20211104T050000.000.ndjson"),
+	}
+	for _, path := range unrelated {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", 1000)), 0644); err != nil {
+			t.Fatalf("WriteFile - Should execute without error, but got: %s", err)
+		}
+		os.Chtimes(path, now.Add(-time.Hour), now.Add(-time.Hour))
+	}
+
+	//	Act
+	for i := 1; i <= 10; i++ {
+		now = now.Add(time.Second)
+		if err := out.Write(testBatch(i, i)); err != nil {
+			t.Fatalf("Write - Should execute without error, but got: %s", err)
+		}
+	}
+
+	//	Assert
+	for _, path := range unrelated {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Write - Should not remove %s, which the sink didn't write, but got: %s", path, err)
+		}
+	}
+}
+
+func TestFile_Write_PathOutsideDirectory_ReturnsError(t *testing.T) {
+	//	Arrange
+	now := time.Now()
+	out, _ := newTestFile(t, &now)
+	batch := testBatch(1, 1)
+	batch.Tokens["{hostname}"] = "../../etc"
+
+	//	Act
+	err := out.Write(batch)
+
+	//	Assert
+	if err == nil {
+		t.Errorf("Write - Expected an error for a path outside the directory, but got nil")
+	}
+}
@@ -0,0 +1,309 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/danesparza/cloudjournal/format"
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/metrics"
+	"github.com/danesparza/cloudjournal/token"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/xdg-go/scram"
+)
+
+// KafkaName is the name of the Kafka producer sink
+const KafkaName = "kafka"
+
+// KafkaKeyUnit is the kafka.keyfield setting that keys messages by the unit name
+const KafkaKeyUnit = "unit"
+
+// Kafka SASL mechanisms
+const (
+	KafkaSASLPlain       = "plain"
+	KafkaSASLSCRAMSHA256 = "scram-sha-256"
+	KafkaSASLSCRAMSHA512 = "scram-sha-512"
+)
+
+// Kafka produces entries to a Kafka topic.  Each entry is a message with its JSON document
+// as the value.  The producer waits for every in-sync replica (acks=all) and is
+// idempotent, so retries inside the producer don't create duplicates
+type Kafka struct {
+	// Brokers are the host:port addresses used to find the cluster
+	Brokers []string
+
+	// Topic is the topic name.  It can use tokens, including the date tokens from each
+	// entry's timestamp (in UTC)
+	Topic string
+
+	// KeyField is the journal field (like _BOOT_ID) used as each message's key, or KafkaKeyUnit
+	// to use the unit name.  Messages with the same key go to the same partition, in order.
+	// If it's empty (or the field isn't set) messages are spread across the partitions
+	KeyField string
+
+	// Config is the producer config
+	Config *sarama.Config
+
+	// Formatter formats each entry.  Its mode is always json
+	Formatter format.Formatter
+
+	// Producer sends the messages.  If it isn't set, it's created on the first write
+	Producer sarama.SyncProducer
+
+	mu sync.Mutex
+}
+
+// NewKafkaFromConfig creates a Kafka sink from the kafka section of the config.  It doesn't
+// connect to the cluster until the first write
+func NewKafkaFromConfig() (*Kafka, error) {
+	retval := &Kafka{
+		Brokers:   splitList(viper.GetString("kafka.brokers")),
+		Topic:     viper.GetString("kafka.topic"),
+		KeyField:  viper.GetString("kafka.keyfield"),
+		Formatter: newFormatter(format.FormatJSON),
+	}
+
+	if len(retval.Brokers) == 0 {
+		return nil, fmt.Errorf("kafka.brokers isn't set")
+	}
+
+	if retval.Topic == "" {
+		return nil, fmt.Errorf("kafka.topic isn't set")
+	}
+
+	config, err := NewKafkaConfigFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	retval.Config = config
+
+	return retval, nil
+}
+
+// NewKafkaConfigFromConfig creates the producer config from the kafka section of the config
+func NewKafkaConfigFromConfig() (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.ClientID = viper.GetString("kafka.clientid")
+
+	version, err := sarama.ParseKafkaVersion(viper.GetString("kafka.version"))
+	if err != nil {
+		return nil, fmt.Errorf("problem parsing kafka.version: %v", err)
+	}
+	config.Version = version
+
+	//	Only count a message as sent once every in-sync replica has it, and let the
+	//	brokers drop the duplicates the producer's own retries would otherwise create
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Idempotent = true
+	config.Net.MaxOpenRequests = 1
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Producer.Retry.Max = viper.GetInt("kafka.retries")
+	config.Producer.Retry.Backoff = durationFromConfig("kafka.retrydelay", 500*time.Millisecond)
+
+	timeout := durationFromConfig("kafka.timeout", 30*time.Second)
+	config.Net.DialTimeout = timeout
+	config.Net.ReadTimeout = timeout
+	config.Net.WriteTimeout = timeout
+	config.Producer.Timeout = timeout
+
+	if err := config.Producer.Compression.UnmarshalText([]byte(strings.ToLower(viper.GetString("kafka.compression")))); err != nil {
+		return nil, fmt.Errorf("unknown kafka.compression %q.  Use none, gzip, snappy, lz4 or zstd", viper.GetString("kafka.compression"))
+	}
+
+	if viper.GetBool("kafka.tls") {
+		tlsConfig, err := newTLSConfig("kafka")
+		if err != nil {
+			return nil, err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	switch mechanism := strings.ToLower(viper.GetString("kafka.sasl")); mechanism {
+	case "":
+	case KafkaSASLPlain:
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case KafkaSASLSCRAMSHA256:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &kafkaSCRAMClient{hash: scram.SHA256}
+		}
+	case KafkaSASLSCRAMSHA512:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &kafkaSCRAMClient{hash: scram.SHA512}
+		}
+	default:
+		return nil, fmt.Errorf("unknown kafka.sasl %q.  Use %s, %s or %s", mechanism, KafkaSASLPlain, KafkaSASLSCRAMSHA256, KafkaSASLSCRAMSHA512)
+	}
+
+	if config.Net.SASL.Mechanism != "" {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Handshake = true
+		config.Net.SASL.User = viper.GetString("kafka.username")
+		config.Net.SASL.Password = viper.GetString("kafka.password")
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("problem with the kafka config: %v", err)
+	}
+
+	return config, nil
+}
+
+// Name returns the name of the sink
+func (s *Kafka) Name() string {
+	return KafkaName
+}
+
+// Write produces the batch and waits for the brokers to acknowledge every message.  If
+// any message isn't acknowledged it returns an error, so the unit's cursor isn't saved
+// and the batch is sent again later.  Messages that were acknowledged are sent again
+// too, so consumers can see an entry more than once
+func (s *Kafka) Write(batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := []*sarama.ProducerMessage{}
+	for _, entry := range batch.Entries {
+		message, err := s.message(entry, batch)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"unit":   batch.Unit,
+				"cursor": entry.Cursor,
+			}).WithError(err).Error("problem creating the kafka message.  Skipping it")
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	producer, err := s.producer()
+	if err != nil {
+		metrics.Add("kafka.batches_failed", 1)
+		return err
+	}
+
+	if err := producer.SendMessages(messages); err != nil {
+		failed := len(messages)
+		var producerErrors sarama.ProducerErrors
+		if errors.As(err, &producerErrors) {
+			failed = len(producerErrors)
+		}
+
+		metrics.Add("kafka.entries_sent", int64(len(messages)-failed))
+		metrics.Add("kafka.batches_failed", 1)
+		return fmt.Errorf("kafka didn't acknowledge %d of %d entries: %v", failed, len(messages), err)
+	}
+
+	metrics.Add("kafka.entries_sent", int64(len(messages)))
+	return nil
+}
+
+// Close waits for any messages in flight and closes the producer
+func (s *Kafka) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Producer == nil {
+		return nil
+	}
+
+	err := s.Producer.Close()
+	s.Producer = nil
+
+	return err
+}
+
+// HealthCheck checks the cluster can be reached with our credentials
+func (s *Kafka) HealthCheck() error {
+	client, err := sarama.NewClient(s.Brokers, s.Config)
+	if err != nil {
+		return err
+	}
+
+	return client.Close()
+}
+
+// producer returns the producer, creating it if it hasn't been yet
+func (s *Kafka) producer() (sarama.SyncProducer, error) {
+	if s.Producer != nil {
+		return s.Producer, nil
+	}
+
+	producer, err := sarama.NewSyncProducer(s.Brokers, s.Config)
+	if err != nil {
+		return nil, fmt.Errorf("problem connecting to kafka: %v", err)
+	}
+	s.Producer = producer
+
+	return producer, nil
+}
+
+// message creates the producer message for an entry
+func (s *Kafka) message(entry journal.Entry, batch Batch) (*sarama.ProducerMessage, error) {
+	document, timestamp, err := entryDocument(s.Formatter, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	retval := &sarama.ProducerMessage{
+		Topic:     token.Replace(s.Topic, DateTokens(batch.Tokens, timestamp)),
+		Value:     sarama.ByteEncoder(document),
+		Timestamp: timestamp,
+	}
+
+	if key := s.key(entry, batch.Unit); key != "" {
+		retval.Key = sarama.StringEncoder(key)
+	}
+
+	return retval, nil
+}
+
+// key returns the message key for an entry
+func (s *Kafka) key(entry journal.Entry, unit string) string {
+	switch s.KeyField {
+	case "":
+		return ""
+	case KafkaKeyUnit:
+		return unit
+	}
+
+	return entry.Field(s.KeyField).Render(s.Formatter.BinaryEncoding)
+}
+
+// kafkaSCRAMClient is a sarama.SCRAMClient for SASL/SCRAM
+type kafkaSCRAMClient struct {
+	hash         scram.HashGeneratorFcn
+	conversation *scram.ClientConversation
+}
+
+// Begin starts the SCRAM conversation
+func (c *kafkaSCRAMClient) Begin(userName, password, authzID string) error {
+	client, err := c.hash.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conversation = client.NewConversation()
+
+	return nil
+}
+
+// Step answers the server's challenge
+func (c *kafkaSCRAMClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+// Done returns true once the conversation is over
+func (c *kafkaSCRAMClient) Done() bool {
+	return c.conversation.Done()
+}
@@ -0,0 +1,235 @@
+package sink_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/sink"
+	"github.com/spf13/viper"
+)
+
+// useKafkaConfig sets the kafka config, like the defaults
+func useKafkaConfig(t *testing.T) {
+	useConfig(t, map[string]interface{}{
+		"kafka.brokers":     "broker1:9092, broker2:9092",
+		"kafka.topic":       "journal-{unit}",
+		"kafka.keyfield":    "unit",
+		"kafka.version":     "2.1.0",
+		"kafka.compression": "snappy",
+		"kafka.clientid":    "cloudjournal",
+		"kafka.retries":     "5",
+	})
+}
+
+// newTestKafka creates a Kafka sink that produces with a mock producer, and records
+// the messages the mock acknowledges
+func newTestKafka(t *testing.T) (*sink.Kafka, *mocks.SyncProducer, *[]*sarama.ProducerMessage) {
+	out := newTestSink(t, sink.KafkaName).(*sink.Kafka)
+	producer := mocks.NewSyncProducer(t, out.Config)
+	out.Producer = producer
+
+	return out, producer, &[]*sarama.ProducerMessage{}
+}
+
+// expectKafkaSends expects the producer to acknowledge n messages, and records them
+func expectKafkaSends(producer *mocks.SyncProducer, n int, messages *[]*sarama.ProducerMessage) {
+	for i := 0; i < n; i++ {
+		producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(message *sarama.ProducerMessage) error {
+			*messages = append(*messages, message)
+			return nil
+		})
+	}
+}
+
+func TestKafka_Write_ProducesEachEntry(t *testing.T) {
+	//	Arrange
+	useKafkaConfig(t)
+	out, producer, messages := newTestKafka(t)
+	expectKafkaSends(producer, 3, messages)
+
+	//	Act
+	err := out.Write(testBatch(1, 3))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	if err := out.Close(); err != nil {
+		t.Errorf("Close - Should execute without error, but got: %s", err)
+	}
+
+	if len(*messages) != 3 {
+		t.Fatalf("Write - Expected 3 messages, but got %d", len(*messages))
+	}
+
+	message := (*messages)[2]
+	if message.Topic != "journal-cron" {
+		t.Errorf("Write - Expected the templated topic journal-cron, but got %s", message.Topic)
+	}
+
+	if key, _ := message.Key.Encode(); string(key) != "cron" {
+		t.Errorf("Write - Expected the unit as the key, but got %q", key)
+	}
+
+	value, _ := message.Value.Encode()
+	document := make(map[string]interface{})
+	if err := json.Unmarshal(value, &document); err != nil || document["message"] != "message 3" {
+		t.Errorf("Write - Expected a JSON document for message 3, but got %s (%v)", value, err)
+	}
+
+	if message.Timestamp.UnixMicro() != 1636000000003000 {
+		t.Errorf("Write - Expected the entry's timestamp, but got %v", message.Timestamp)
+	}
+}
+
+func TestKafka_Write_KeyField_KeysByJournalField(t *testing.T) {
+	//	Arrange
+	useKafkaConfig(t)
+	viper.Set("kafka.keyfield", "_BOOT_ID")
+	out, producer, messages := newTestKafka(t)
+	expectKafkaSends(producer, 2, messages)
+	batch := testBatch(1, 2)
+	batch.Entries[0].Fields = map[string]journal.Field{"_BOOT_ID": journal.NewField("boot1")}
+
+	//	Act
+	err := out.Write(batch)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	if key, _ := (*messages)[0].Key.Encode(); string(key) != "boot1" {
+		t.Errorf("Write - Expected the boot id as the key, but got %q", key)
+	}
+
+	//	Without the field there's no key, so the message can go to any partition
+	if (*messages)[1].Key != nil {
+		t.Errorf("Write - Expected no key for an entry without the field, but got %v", (*messages)[1].Key)
+	}
+}
+
+func TestKafka_Write_NotAcknowledged_ReturnsError(t *testing.T) {
+	//	Arrange
+	useKafkaConfig(t)
+	out, producer, messages := newTestKafka(t)
+	expectKafkaSends(producer, 1, messages)
+	producer.ExpectSendMessageAndFail(sarama.ErrNotEnoughReplicas)
+
+	//	Act
+	err := out.Write(testBatch(1, 2))
+
+	//	Assert
+	if err == nil {
+		t.Fatalf("Write - Should return an error when the brokers don't acknowledge an entry")
+	}
+
+	if !strings.Contains(err.Error(), sarama.ErrNotEnoughReplicas.Error()) {
+		t.Errorf("Write - Expected the broker's error, but got: %s", err)
+	}
+}
+
+func TestKafka_NewKafkaConfigFromConfig_AcksAllAndIdempotent(t *testing.T) {
+	//	Arrange
+	useKafkaConfig(t)
+	viper.Set("kafka.compression", "ZSTD")
+
+	//	Act
+	config, err := sink.NewKafkaConfigFromConfig()
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("NewKafkaConfigFromConfig - Should execute without error, but got: %s", err)
+	}
+
+	if config.Producer.RequiredAcks != sarama.WaitForAll || !config.Producer.Idempotent || !config.Producer.Return.Successes {
+		t.Errorf("NewKafkaConfigFromConfig - Expected an idempotent producer that waits for every replica, but got %+v", config.Producer)
+	}
+
+	if config.Producer.Compression != sarama.CompressionZSTD {
+		t.Errorf("NewKafkaConfigFromConfig - Expected zstd compression, but got %v", config.Producer.Compression)
+	}
+
+	if config.Net.SASL.Enable || config.Net.TLS.Enable {
+		t.Errorf("NewKafkaConfigFromConfig - Expected no SASL or TLS by default")
+	}
+}
+
+func TestKafka_NewKafkaConfigFromConfig_SCRAMOverTLS(t *testing.T) {
+	//	Arrange
+	useKafkaConfig(t)
+	viper.Set("kafka.sasl", "scram-sha-512")
+	viper.Set("kafka.username", "shipper")
+	viper.Set("kafka.password", "secret")
+	viper.Set("kafka.tls", true)
+	viper.Set("kafka.servername", "kafka.example.com")
+
+	//	Act
+	config, err := sink.NewKafkaConfigFromConfig()
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("NewKafkaConfigFromConfig - Should execute without error, but got: %s", err)
+	}
+
+	if !config.Net.SASL.Enable || config.Net.SASL.Mechanism != sarama.SASLTypeSCRAMSHA512 || config.Net.SASL.User != "shipper" {
+		t.Errorf("NewKafkaConfigFromConfig - Expected SCRAM-SHA-512 for shipper, but got %+v", config.Net.SASL)
+	}
+
+	//	The SCRAM client should start a conversation with our credentials
+	client := config.Net.SASL.SCRAMClientGeneratorFunc()
+	if err := client.Begin("shipper", "secret", ""); err != nil {
+		t.Errorf("SCRAMClient.Begin - Should execute without error, but got: %s", err)
+	}
+	if first, err := client.Step(""); err != nil || !strings.Contains(first, "n=shipper") {
+		t.Errorf("SCRAMClient.Step - Expected the client's first message, but got %q (%v)", first, err)
+	}
+
+	if !config.Net.TLS.Enable || config.Net.TLS.Config.ServerName != "kafka.example.com" {
+		t.Errorf("NewKafkaConfigFromConfig - Expected TLS with the server name, but got %+v", config.Net.TLS)
+	}
+}
+
+func TestKafka_NewKafkaConfigFromConfig_BadSettings_ReturnsError(t *testing.T) {
+	for _, setting := range []struct{ key, value string }{
+		{"kafka.compression", "brotli"},
+		{"kafka.sasl", "gssapi"},
+		{"kafka.version", "0.10.2.0"},
+		{"kafka.retries", "0"},
+	} {
+		//	Arrange
+		useKafkaConfig(t)
+		viper.Set(setting.key, setting.value)
+
+		//	Act
+		_, err := sink.NewKafkaConfigFromConfig()
+
+		//	Assert
+		if err == nil {
+			t.Errorf("NewKafkaConfigFromConfig - Should return an error for %s %s", setting.key, setting.value)
+		}
+	}
+}
+
+func TestKafka_Write_ProducerCantConnect_ReturnsError(t *testing.T) {
+	//	Arrange
+	useKafkaConfig(t)
+	viper.Set("kafka.brokers", "127.0.0.1:1")
+	viper.Set("kafka.timeout", "100ms")
+	viper.Set("kafka.retrydelay", "1ms")
+	out := newTestSink(t, sink.KafkaName).(*sink.Kafka)
+	out.Config.Metadata.Retry.Max = 0
+
+	//	Act
+	err := out.Write(testBatch(1, 1))
+
+	//	Assert
+	if err == nil {
+		t.Errorf("Write - Should return an error when kafka can't be reached, but got: %v", err)
+	}
+}
@@ -0,0 +1,367 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danesparza/cloudjournal/format"
+	"github.com/danesparza/cloudjournal/metrics"
+	"github.com/danesparza/cloudjournal/retry"
+	"github.com/danesparza/cloudjournal/token"
+	"github.com/klauspost/compress/snappy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// LokiName is the name of the Grafana Loki sink
+const LokiName = "loki"
+
+// Loki push encodings
+const (
+	// LokiProtobuf sends snappy compressed protobuf, which is what Loki's own clients use
+	LokiProtobuf = "protobuf"
+
+	// LokiJSON sends JSON
+	LokiJSON = "json"
+)
+
+// LokiPushPath is the path of Loki's push API
+const LokiPushPath = "/loki/api/v1/push"
+
+// Loki pushes entries to Grafana Loki.  Entries are grouped into streams by their
+// labels, which come from tokens (like {unit}) and journal fields
+type Loki struct {
+	// URL is the base URL of Loki, like http://loki:3100
+	URL string
+
+	// Encoding is LokiProtobuf or LokiJSON
+	Encoding string
+
+	// Labels are label names and values.  Values can use tokens
+	Labels map[string]string
+
+	// FieldLabels are journal fields added as labels, like PRIORITY
+	FieldLabels []string
+
+	// Tenant is sent as X-Scope-OrgID, for multi-tenant Loki
+	Tenant string
+
+	// Username and Password are used for basic auth, if set
+	Username string
+	Password string
+
+	// Formatter formats each entry as a log line
+	Formatter format.Formatter
+
+	// Retries is how many times a push is retried when Loki is rate limiting or unavailable
+	Retries       int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	Client *http.Client
+}
+
+// lokiStream is the entries for one set of labels
+type lokiStream struct {
+	labels  map[string]string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	timestamp time.Time
+	line      string
+}
+
+// NewLokiFromConfig creates a Loki sink from the loki section of the config
+func NewLokiFromConfig() (*Loki, error) {
+	retval := &Loki{
+		URL:           strings.TrimSuffix(viper.GetString("loki.url"), "/"),
+		Encoding:      viper.GetString("loki.encoding"),
+		Labels:        format.ParseTags(viper.GetString("loki.labels")),
+		FieldLabels:   splitList(viper.GetString("loki.fieldlabels")),
+		Tenant:        viper.GetString("loki.tenant"),
+		Username:      viper.GetString("loki.username"),
+		Password:      viper.GetString("loki.password"),
+		Formatter:     newFormatter(viper.GetString("loki.format")),
+		Retries:       viper.GetInt("loki.retries"),
+		RetryDelay:    durationFromConfig("loki.retrydelay", 500*time.Millisecond),
+		MaxRetryDelay: durationFromConfig("loki.maxretrydelay", 30*time.Second),
+		Client:        &http.Client{Timeout: durationFromConfig("loki.timeout", 10*time.Second)},
+	}
+
+	if retval.URL == "" {
+		return nil, fmt.Errorf("loki.url isn't set")
+	}
+
+	if retval.Encoding == "" {
+		retval.Encoding = LokiProtobuf
+	}
+	if retval.Encoding != LokiProtobuf && retval.Encoding != LokiJSON {
+		return nil, fmt.Errorf("unknown loki.encoding %q.  Use %s or %s", retval.Encoding, LokiProtobuf, LokiJSON)
+	}
+
+	return retval, nil
+}
+
+// Name returns the name of the sink
+func (s *Loki) Name() string {
+	return LokiName
+}
+
+// Write pushes the batch to Loki
+func (s *Loki) Write(batch Batch) error {
+	streams := s.streams(batch)
+	if len(streams) == 0 {
+		return nil
+	}
+
+	var body []byte
+	var contentType string
+	var err error
+	if s.Encoding == LokiJSON {
+		body, err = encodeLokiJSON(streams)
+		contentType = "application/json"
+	} else {
+		body = snappy.Encode(nil, encodeLokiProtobuf(streams))
+		contentType = "application/x-protobuf"
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.push(body, contentType, len(batch.Entries))
+}
+
+// Close does nothing
+func (s *Loki) Close() error {
+	return nil
+}
+
+// streams groups the entries in the batch by their labels, oldest first
+func (s *Loki) streams(batch Batch) []*lokiStream {
+	baseLabels := make(map[string]string)
+	for name, value := range s.Labels {
+		baseLabels[LokiLabelName(name)] = token.Replace(value, batch.Tokens)
+	}
+
+	byLabels := make(map[string]*lokiStream)
+	keys := []string{}
+	for _, entry := range batch.Entries {
+		microseconds, err := strconv.ParseInt(entry.RealtimeTimestamp, 10, 64)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"unit":                    batch.Unit,
+				"entry.RealtimeTimestamp": entry.RealtimeTimestamp,
+			}).WithError(err).Error("problem converting timestamp to int64")
+			continue
+		}
+
+		labels := make(map[string]string)
+		for name, value := range baseLabels {
+			labels[name] = value
+		}
+		for _, name := range s.FieldLabels {
+			if value := entry.Field(name).Render(s.Formatter.BinaryEncoding); value != "" {
+				labels[LokiLabelName(name)] = value
+			}
+		}
+
+		key := LokiLabels(labels)
+		stream, ok := byLabels[key]
+		if !ok {
+			stream = &lokiStream{labels: labels}
+			byLabels[key] = stream
+			keys = append(keys, key)
+		}
+
+		stream.entries = append(stream.entries, lokiEntry{
+			timestamp: time.Unix(0, microseconds*int64(time.Microsecond)),
+			line:      s.Formatter.Format(entry),
+		})
+	}
+
+	//	Loki wants the entries in each stream in order
+	retval := []*lokiStream{}
+	for _, key := range keys {
+		stream := byLabels[key]
+		sort.SliceStable(stream.entries, func(i, j int) bool {
+			return stream.entries[i].timestamp.Before(stream.entries[j].timestamp)
+		})
+		retval = append(retval, stream)
+	}
+
+	return retval
+}
+
+// push sends the body to Loki, retrying when Loki is rate limiting or unavailable
+func (s *Loki) push(body []byte, contentType string, entries int) error {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, s.URL+LokiPushPath, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("User-Agent", "cloudjournal")
+		if s.Tenant != "" {
+			req.Header.Set("X-Scope-OrgID", s.Tenant)
+		}
+		if s.Username != "" {
+			req.SetBasicAuth(s.Username, s.Password)
+		}
+
+		var retryAfter time.Duration
+		resp, err := s.Client.Do(req)
+		if err == nil {
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+
+			switch {
+			case resp.StatusCode/100 == 2:
+				metrics.Add("loki.entries_sent", int64(entries))
+				return nil
+
+			//	Entries that are out of order (or too old) will never be accepted.  Loki
+			//	accepts the rest of the push, so there's nothing to try again
+			case resp.StatusCode == http.StatusBadRequest && isLokiRejection(string(message)):
+				metrics.Add("loki.entries_rejected", 1)
+				log.WithFields(log.Fields{
+					"status":  resp.StatusCode,
+					"message": strings.TrimSpace(string(message)),
+				}).Warn("loki rejected entries that were out of order or too old")
+				return nil
+
+			case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+				err = fmt.Errorf("loki returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+				retryAfter = retry.After(resp.Header.Get("Retry-After"), s.MaxRetryDelay)
+
+			default:
+				metrics.Add("loki.batches_failed", 1)
+				return fmt.Errorf("loki returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+			}
+		}
+
+		if attempt >= s.Retries {
+			metrics.Add("loki.batches_failed", 1)
+			return err
+		}
+
+		delay := retry.Backoff(attempt, s.RetryDelay, s.MaxRetryDelay)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+
+		metrics.Add("loki.retries", 1)
+		log.WithFields(log.Fields{
+			"attempt":    attempt + 1,
+			"maxRetries": s.Retries,
+			"delay":      delay.String(),
+		}).WithError(err).Warn("problem pushing to loki.  Retrying")
+		time.Sleep(delay)
+	}
+}
+
+// isLokiRejection returns true if a 400 response is Loki rejecting entries for their timestamps
+func isLokiRejection(message string) bool {
+	message = strings.ToLower(message)
+	return strings.Contains(message, "out of order") ||
+		strings.Contains(message, "too far behind") ||
+		strings.Contains(message, "too old") ||
+		strings.Contains(message, "greater_than_max_sample_age")
+}
+
+// LokiLabelName converts a name (like a journal field) into a valid Loki label name,
+// like _SYSTEMD_UNIT to systemd_unit
+func LokiLabelName(name string) string {
+	name = strings.TrimLeft(strings.ToLower(strings.TrimSpace(name)), "_")
+
+	retval := []byte(name)
+	for i, c := range retval {
+		if !(c >= 'a' && c <= 'z' || c == '_' || (i > 0 && c >= '0' && c <= '9')) {
+			retval[i] = '_'
+		}
+	}
+
+	return string(retval)
+}
+
+// LokiLabels formats labels the way Loki does, like {host="pi", unit="cron"}
+func LokiLabels(labels map[string]string) string {
+	names := []string{}
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := []string{}
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// encodeLokiJSON encodes the streams for the JSON push API
+func encodeLokiJSON(streams []*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+
+	request := struct {
+		Streams []jsonStream `json:"streams"`
+	}{Streams: []jsonStream{}}
+
+	for _, stream := range streams {
+		values := [][2]string{}
+		for _, entry := range stream.entries {
+			values = append(values, [2]string{strconv.FormatInt(entry.timestamp.UnixNano(), 10), entry.line})
+		}
+		request.Streams = append(request.Streams, jsonStream{Stream: stream.labels, Values: values})
+	}
+
+	return json.Marshal(request)
+}
+
+// encodeLokiProtobuf encodes the streams as a logproto.PushRequest:
+//
+//	PushRequest   { repeated StreamAdapter streams = 1; }
+//	StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	EntryAdapter  { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func encodeLokiProtobuf(streams []*lokiStream) []byte {
+	var request []byte
+	for _, stream := range streams {
+		var encodedStream []byte
+		encodedStream = protowire.AppendTag(encodedStream, 1, protowire.BytesType)
+		encodedStream = protowire.AppendString(encodedStream, LokiLabels(stream.labels))
+
+		for _, entry := range stream.entries {
+			var timestamp []byte
+			timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(entry.timestamp.Unix()))
+			timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(entry.timestamp.Nanosecond()))
+
+			var encodedEntry []byte
+			encodedEntry = protowire.AppendTag(encodedEntry, 1, protowire.BytesType)
+			encodedEntry = protowire.AppendBytes(encodedEntry, timestamp)
+			encodedEntry = protowire.AppendTag(encodedEntry, 2, protowire.BytesType)
+			encodedEntry = protowire.AppendString(encodedEntry, entry.line)
+
+			encodedStream = protowire.AppendTag(encodedStream, 2, protowire.BytesType)
+			encodedStream = protowire.AppendBytes(encodedStream, encodedEntry)
+		}
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, encodedStream)
+	}
+
+	return request
+}
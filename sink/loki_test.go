@@ -0,0 +1,399 @@
+package sink_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/sink"
+	"github.com/klauspost/compress/snappy"
+	"github.com/spf13/viper"
+)
+
+// lokiEntry is a log line pushed to lokiServer
+type lokiEntry struct {
+	timestamp time.Time
+	line      string
+}
+
+// lokiServer is a stand-in for Loki's push API.  It keeps the entries for each stream, and
+// like Loki, ignores exact duplicates and rejects entries that are older than the newest
+// entry in their stream (keeping the rest of the push)
+type lokiServer struct {
+	*testServer
+	streams map[string][]lokiEntry
+}
+
+// useLokiServer starts a Loki stand-in and points the loki config at it
+func useLokiServer(t *testing.T) *lokiServer {
+	server := &lokiServer{streams: make(map[string][]lokiEntry)}
+	server.testServer = newTestServer(t, server.push)
+
+	useConfig(t, map[string]interface{}{
+		"loki.url":           server.URL,
+		"loki.labels":        "unit={unit}, host={hostname}",
+		"loki.format":        "raw",
+		"loki.retrydelay":    "1ms",
+		"loki.maxretrydelay": "1ms",
+	})
+
+	return server
+}
+
+// Streams returns the labels of every stream that has entries, like {unit="cron"}, sorted
+func (server *lokiServer) Streams() []string {
+	server.Lock()
+	defer server.Unlock()
+
+	retval := []string{}
+	for labels := range server.streams {
+		retval = append(retval, labels)
+	}
+	sort.Strings(retval)
+
+	return retval
+}
+
+// Lines returns the log lines accepted for a stream, in the order they were accepted
+func (server *lokiServer) Lines(labels string) []string {
+	server.Lock()
+	defer server.Unlock()
+
+	retval := []string{}
+	for _, entry := range server.streams[labels] {
+		retval = append(retval, entry.line)
+	}
+
+	return retval
+}
+
+// push handles a push request
+func (server *lokiServer) push(w http.ResponseWriter, r testRequest) {
+	if r.Method != http.MethodPost || r.Path != "/loki/api/v1/push" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	var streams map[string][]lokiEntry
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		streams, err = decodeLokiJSON(r.Body)
+	} else {
+		streams, err = decodeLokiProtobuf(r.Body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rejected := []string{}
+	for labels, entries := range streams {
+		for _, entry := range entries {
+			existing := server.streams[labels]
+			if lokiDuplicate(existing, entry) {
+				continue
+			}
+			if len(existing) > 0 && entry.timestamp.Before(existing[len(existing)-1].timestamp) {
+				rejected = append(rejected, fmt.Sprintf("entry with timestamp %s ignored, reason: 'entry out of order' for stream: %s", entry.timestamp, labels))
+				continue
+			}
+			server.streams[labels] = append(existing, entry)
+		}
+	}
+
+	if len(rejected) > 0 {
+		http.Error(w, strings.Join(rejected, "\n"), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lokiDuplicate returns true if the stream already has an entry with the same timestamp and line
+func lokiDuplicate(existing []lokiEntry, entry lokiEntry) bool {
+	for i := len(existing) - 1; i >= 0 && !existing[i].timestamp.Before(entry.timestamp); i-- {
+		if existing[i].timestamp.Equal(entry.timestamp) && existing[i].line == entry.line {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeLokiJSON decodes a JSON push request
+func decodeLokiJSON(body []byte) (map[string][]lokiEntry, error) {
+	request := struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}{}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+
+	retval := make(map[string][]lokiEntry)
+	for _, stream := range request.Streams {
+		names := []string{}
+		for name := range stream.Stream {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		pairs := []string{}
+		for _, name := range names {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", name, stream.Stream[name]))
+		}
+		labels := "{" + strings.Join(pairs, ", ") + "}"
+
+		for _, value := range stream.Values {
+			nanoseconds, err := strconv.ParseInt(value[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad timestamp %q: %v", value[0], err)
+			}
+			retval[labels] = append(retval[labels], lokiEntry{timestamp: time.Unix(0, nanoseconds), line: value[1]})
+		}
+	}
+
+	return retval, nil
+}
+
+// decodeLokiProtobuf decodes a snappy compressed logproto.PushRequest
+func decodeLokiProtobuf(body []byte) (map[string][]lokiEntry, error) {
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("bad snappy data: %v", err)
+	}
+
+	request, err := protoFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	retval := make(map[string][]lokiEntry)
+	for _, stream := range request {
+		streamFields, err := protoFields(stream.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		labels := ""
+		entries := []lokiEntry{}
+		for _, streamField := range streamFields {
+			switch streamField.Number {
+			case 1:
+				labels = string(streamField.Bytes)
+			case 2:
+				entry, err := decodeLokiEntry(streamField.Bytes)
+				if err != nil {
+					return nil, err
+				}
+				entries = append(entries, entry)
+			}
+		}
+		retval[labels] = append(retval[labels], entries...)
+	}
+
+	return retval, nil
+}
+
+// decodeLokiEntry decodes a logproto.EntryAdapter
+func decodeLokiEntry(data []byte) (lokiEntry, error) {
+	entry := lokiEntry{}
+	entryFields, err := protoFields(data)
+	if err != nil {
+		return entry, err
+	}
+
+	for _, entryField := range entryFields {
+		switch entryField.Number {
+		case 1:
+			timestamp, err := protoFields(entryField.Bytes)
+			if err != nil {
+				return entry, err
+			}
+			var seconds, nanos uint64
+			for _, part := range timestamp {
+				if part.Number == 1 {
+					seconds = part.Value
+				} else if part.Number == 2 {
+					nanos = part.Value
+				}
+			}
+			entry.timestamp = time.Unix(int64(seconds), int64(nanos))
+		case 2:
+			entry.line = string(entryField.Bytes)
+		}
+	}
+
+	return entry, nil
+}
+
+func TestLoki_Write_Protobuf_PushesStreamWithTokenLabels(t *testing.T) {
+	//	Arrange
+	server := useLokiServer(t)
+	viper.Set("loki.tenant", "platform")
+	out := newTestSink(t, sink.LokiName)
+	batch := hostBatch(1, 3)
+
+	//	Act
+	err := out.Write(batch)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	want := []string{"message 1", "message 2", "message 3"}
+	if lines := server.Lines(`{host="raspberrypi", unit="cron"}`); !reflect.DeepEqual(lines, want) {
+		t.Errorf("Write - Expected %v, but got %v (streams %v)", want, lines, server.Streams())
+	}
+
+	requests := server.Requests()
+	if len(requests) != 1 || requests[0].Header.Get("Content-Type") != "application/x-protobuf" || requests[0].Header.Get("X-Scope-OrgID") != "platform" {
+		t.Errorf("Write - Expected one protobuf push for the tenant, but got %+v", requests)
+	}
+}
+
+func TestLoki_Write_JSON_SplitsStreamsByFieldLabels(t *testing.T) {
+	//	Arrange
+	server := useLokiServer(t)
+	viper.Set("loki.encoding", "json")
+	viper.Set("loki.fieldlabels", "PRIORITY")
+	out := newTestSink(t, sink.LokiName)
+	batch := hostBatch(1, 3)
+	for i := range batch.Entries {
+		priority := "6"
+		if i == 1 {
+			priority = "3"
+		}
+		batch.Entries[i].Fields = map[string]journal.Field{"PRIORITY": journal.NewField(priority)}
+	}
+
+	//	Act
+	err := out.Write(batch)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	if lines := server.Lines(`{host="raspberrypi", priority="6", unit="cron"}`); !reflect.DeepEqual(lines, []string{"message 1", "message 3"}) {
+		t.Errorf("Write - Expected messages 1 and 3 in the priority 6 stream, but got %v (streams %v)", lines, server.Streams())
+	}
+
+	if lines := server.Lines(`{host="raspberrypi", priority="3", unit="cron"}`); !reflect.DeepEqual(lines, []string{"message 2"}) {
+		t.Errorf("Write - Expected message 2 in the priority 3 stream, but got %v (streams %v)", lines, server.Streams())
+	}
+
+	if requests := server.Requests(); len(requests) != 1 || requests[0].Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Write - Expected one JSON push, but got %+v", requests)
+	}
+}
+
+func TestLoki_Write_OutOfOrder_IsNotRetried(t *testing.T) {
+	//	Arrange
+	server := useLokiServer(t)
+	viper.Set("loki.retries", 3)
+	out := newTestSink(t, sink.LokiName)
+	if err := out.Write(hostBatch(5, 6)); err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	//	Act
+	err := out.Write(hostBatch(1, 7))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Out of order entries should be dropped without an error, but got: %s", err)
+	}
+
+	want := []string{"message 5", "message 6", "message 7"}
+	if lines := server.Lines(`{host="raspberrypi", unit="cron"}`); !reflect.DeepEqual(lines, want) {
+		t.Errorf("Write - Expected %v, but got %v", want, lines)
+	}
+
+	if requests := server.Requests(); len(requests) != 2 {
+		t.Errorf("Write - Expected the rejected push not to be retried, but got %d requests", len(requests))
+	}
+}
+
+func TestLoki_Write_RateLimited_RetriesWithBackoff(t *testing.T) {
+	//	Arrange
+	server := useLokiServer(t)
+	viper.Set("loki.retries", 3)
+	server.FailNext(http.StatusTooManyRequests, http.StatusServiceUnavailable)
+	out := newTestSink(t, sink.LokiName)
+
+	//	Act
+	err := out.Write(hostBatch(1, 2))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error after retrying, but got: %s", err)
+	}
+
+	if requests := server.Requests(); len(requests) != 3 {
+		t.Errorf("Write - Expected 3 requests, but got %d", len(requests))
+	}
+
+	if lines := server.Lines(`{host="raspberrypi", unit="cron"}`); len(lines) != 2 {
+		t.Errorf("Write - Expected 2 lines, but got %v", lines)
+	}
+}
+
+func TestLoki_Write_OutOfRetries_ReturnsError(t *testing.T) {
+	//	Arrange
+	server := useLokiServer(t)
+	viper.Set("loki.retries", 1)
+	server.FailNext(http.StatusTooManyRequests, http.StatusTooManyRequests)
+	out := newTestSink(t, sink.LokiName)
+
+	//	Act
+	err := out.Write(hostBatch(1, 2))
+
+	//	Assert
+	if err == nil {
+		t.Errorf("Write - Expected an error when Loki keeps rate limiting, but got nil")
+	}
+
+	if requests := server.Requests(); len(requests) != 2 {
+		t.Errorf("Write - Expected 2 requests, but got %d", len(requests))
+	}
+}
+
+func TestLokiLabelName_JournalField_IsSanitized(t *testing.T) {
+	tests := map[string]string{
+		"_SYSTEMD_UNIT":      "systemd_unit",
+		"PRIORITY":           "priority",
+		"CODE-FILE":          "code_file",
+		"9LIVES":             "_lives",
+		" syslog_identifier": "syslog_identifier",
+	}
+
+	for name, want := range tests {
+		if got := sink.LokiLabelName(name); got != want {
+			t.Errorf("LokiLabelName(%q) - Expected %q, but got %q", name, want, got)
+		}
+	}
+}
+
+func TestNewLokiFromConfig_NoURL_ReturnsError(t *testing.T) {
+	//	Arrange
+	useConfig(t, map[string]interface{}{"loki.url": ""})
+
+	//	Act
+	_, err := sink.NewLokiFromConfig()
+
+	//	Assert
+	if err == nil {
+		t.Errorf("NewLokiFromConfig - Expected an error without loki.url, but got nil")
+	}
+}
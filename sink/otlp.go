@@ -0,0 +1,782 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danesparza/cloudjournal/format"
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/metrics"
+	"github.com/danesparza/cloudjournal/retry"
+	"github.com/danesparza/cloudjournal/token"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	grpcgzip "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// OTLPName is the name of the OpenTelemetry (OTLP) logs sink
+const OTLPName = "otlp"
+
+// OTLP protocols, named like OTEL_EXPORTER_OTLP_PROTOCOL
+const (
+	// OTLPHTTPProtobuf POSTs protobuf encoded requests
+	OTLPHTTPProtobuf = "http/protobuf"
+
+	// OTLPHTTPJSON POSTs JSON encoded requests
+	OTLPHTTPJSON = "http/json"
+
+	// OTLPGRPC calls the LogsService Export method
+	OTLPGRPC = "grpc"
+)
+
+// OTLPLogsPath is the default path of the OTLP/HTTP logs endpoint
+const OTLPLogsPath = "/v1/logs"
+
+// OTLPExportMethod is the OTLP/gRPC logs export method
+const OTLPExportMethod = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+
+// OTLPScopeName is the instrumentation scope of every log record
+const OTLPScopeName = "cloudjournal"
+
+// otlpSeverities maps journal priorities (syslog severities) to OTLP severity numbers
+// and text, like the OpenTelemetry log data model's syslog mapping
+var otlpSeverities = []struct {
+	number int
+	text   string
+}{
+	{24, "emerg"},   // FATAL4
+	{23, "alert"},   // FATAL3
+	{21, "crit"},    // FATAL
+	{17, "err"},     // ERROR
+	{13, "warning"}, // WARN
+	{10, "notice"},  // INFO2
+	{9, "info"},     // INFO
+	{5, "debug"},    // DEBUG
+}
+
+// OTLP exports entries as OpenTelemetry log records, over OTLP/HTTP (protobuf or JSON)
+// or OTLP/gRPC.  Each entry's _HOSTNAME, _MACHINE_ID and _SYSTEMD_UNIT become the
+// host.name, host.id and service.name resource attributes, its PRIORITY becomes the
+// severity, and its MESSAGE becomes the body
+type OTLP struct {
+	// Endpoint is the collector's URL.  For OTLP/HTTP, OTLPLogsPath is used if it doesn't
+	// have a path.  For OTLP/gRPC, http connects without TLS and https with TLS
+	Endpoint *url.URL
+
+	// Protocol is OTLPHTTPProtobuf, OTLPHTTPJSON or OTLPGRPC
+	Protocol string
+
+	// Headers are added to each request (or sent as gRPC metadata).  Values can use tokens
+	Headers map[string]string
+
+	// Resource are extra resource attributes.  Values can use tokens
+	Resource map[string]string
+
+	// Fields are the journal fields added as attributes to each log record
+	Fields []string
+
+	// Gzip compresses each request
+	Gzip bool
+
+	// BinaryEncoding is how values that aren't valid UTF-8 are rendered
+	BinaryEncoding journal.BinaryEncoding
+
+	// Timeout is how long to wait for each export
+	Timeout time.Duration
+
+	// Retries is how many times an export is retried when the collector is busy or
+	// unavailable
+	Retries       int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	// Client is used for OTLP/HTTP
+	Client *http.Client
+
+	// DialOptions are used to connect for OTLP/gRPC
+	DialOptions []grpc.DialOption
+
+	mu   sync.Mutex
+	conn *grpc.ClientConn
+}
+
+// otlpAttribute is a string attribute of a resource or log record
+type otlpAttribute struct {
+	key   string
+	value string
+}
+
+// otlpResource is a resource and its log records
+type otlpResource struct {
+	attributes []otlpAttribute
+	records    []otlpRecord
+}
+
+// otlpRecord is a log record
+type otlpRecord struct {
+	time           time.Time
+	observedTime   time.Time
+	severityNumber int
+	severityText   string
+	body           string
+	attributes     []otlpAttribute
+}
+
+// NewOTLPFromConfig creates an OTLP sink from the otlp section of the config
+func NewOTLPFromConfig() (*OTLP, error) {
+	retval := &OTLP{
+		Protocol:       strings.ToLower(viper.GetString("otlp.protocol")),
+		Headers:        format.ParseTags(viper.GetString("otlp.headers")),
+		Resource:       format.ParseTags(viper.GetString("otlp.resource")),
+		Fields:         splitList(viper.GetString("otlp.fields")),
+		Gzip:           viper.GetBool("otlp.gzip"),
+		BinaryEncoding: journal.BinaryEncoding(viper.GetString("journal.binaryencoding")),
+		Timeout:        durationFromConfig("otlp.timeout", 10*time.Second),
+		Retries:        viper.GetInt("otlp.retries"),
+		RetryDelay:     durationFromConfig("otlp.retrydelay", 500*time.Millisecond),
+		MaxRetryDelay:  durationFromConfig("otlp.maxretrydelay", 30*time.Second),
+	}
+
+	endpoint := viper.GetString("otlp.endpoint")
+	if endpoint == "" {
+		return nil, fmt.Errorf("otlp.endpoint isn't set")
+	}
+
+	var err error
+	retval.Endpoint, err = url.Parse(endpoint)
+	if err != nil || (retval.Endpoint.Scheme != "http" && retval.Endpoint.Scheme != "https") || retval.Endpoint.Host == "" {
+		return nil, fmt.Errorf("otlp.endpoint %q should be a URL, like http://localhost:4318", endpoint)
+	}
+
+	tlsConfig, err := newTLSConfig("otlp")
+	if err != nil {
+		return nil, err
+	}
+
+	switch retval.Protocol {
+	case "":
+		retval.Protocol = OTLPHTTPProtobuf
+		fallthrough
+	case OTLPHTTPProtobuf, OTLPHTTPJSON:
+		if retval.Endpoint.Path == "" || retval.Endpoint.Path == "/" {
+			retval.Endpoint.Path = OTLPLogsPath
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		retval.Client = &http.Client{Timeout: retval.Timeout, Transport: transport}
+
+	case OTLPGRPC:
+		creds := grpc.WithInsecure()
+		if retval.Endpoint.Scheme == "https" {
+			creds = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+		}
+		retval.DialOptions = []grpc.DialOption{creds, grpc.WithUserAgent("cloudjournal")}
+
+	default:
+		return nil, fmt.Errorf("unknown otlp.protocol %q.  Use %s, %s or %s", retval.Protocol, OTLPHTTPProtobuf, OTLPHTTPJSON, OTLPGRPC)
+	}
+
+	return retval, nil
+}
+
+// Name returns the name of the sink
+func (s *OTLP) Name() string {
+	return OTLPName
+}
+
+// Write exports the batch.  It only returns nil once the collector has accepted the
+// request, so the unit's cursor isn't saved past entries that weren't exported.  Records
+// the collector accepts but rejects (a partial success) aren't sent again
+func (s *OTLP) Write(batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resources, count := s.resources(batch)
+	if count == 0 {
+		return nil
+	}
+
+	var request []byte
+	var err error
+	if s.Protocol == OTLPHTTPJSON {
+		request, err = encodeOTLPJSON(resources)
+	} else {
+		request = encodeOTLPProtobuf(resources)
+	}
+	if err != nil {
+		return err
+	}
+
+	rejected, message, err := s.export(request, batch.Tokens)
+	if err != nil {
+		metrics.Add("otlp.batches_failed", 1)
+		return err
+	}
+
+	if rejected > 0 {
+		metrics.Add("otlp.entries_rejected", rejected)
+		log.WithFields(log.Fields{
+			"unit":     batch.Unit,
+			"rejected": rejected,
+			"message":  message,
+		}).Warn("the otlp collector rejected some entries")
+	}
+
+	metrics.Add("otlp.entries_sent", int64(count)-rejected)
+	return nil
+}
+
+// Close closes the gRPC connection, if there is one
+func (s *OTLP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+
+	return err
+}
+
+// resources converts the entries in the batch into log records, grouped by resource.
+// It returns the resources and the number of records
+func (s *OTLP) resources(batch Batch) ([]*otlpResource, int) {
+	keys := []string{}
+	for key := range s.Resource {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	extra := []otlpAttribute{}
+	for _, key := range keys {
+		extra = append(extra, otlpAttribute{key, token.Replace(s.Resource[key], batch.Tokens)})
+	}
+
+	retval := []*otlpResource{}
+	byKey := make(map[string]*otlpResource)
+	count := 0
+	for _, entry := range batch.Entries {
+		record, err := s.record(entry)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"unit":   batch.Unit,
+				"cursor": entry.Cursor,
+			}).WithError(err).Error("problem creating the otlp log record.  Skipping it")
+			continue
+		}
+
+		attributes := []otlpAttribute{
+			{"host.name", s.fieldOr(entry.Hostname, batch.Tokens["{hostname}"])},
+			{"host.id", s.fieldOr(entry.MachineID, batch.Tokens["{machineid}"])},
+			{"service.name", s.fieldOr(entry.SystemDUnit, batch.Unit)},
+		}
+		attributes = append(attributes, extra...)
+
+		key := fmt.Sprint(attributes)
+		resource, ok := byKey[key]
+		if !ok {
+			resource = &otlpResource{attributes: attributes}
+			byKey[key] = resource
+			retval = append(retval, resource)
+		}
+		resource.records = append(resource.records, record)
+		count++
+	}
+
+	return retval, count
+}
+
+// record converts an entry into a log record
+func (s *OTLP) record(entry journal.Entry) (otlpRecord, error) {
+	microseconds, err := strconv.ParseInt(entry.RealtimeTimestamp, 10, 64)
+	if err != nil {
+		return otlpRecord{}, fmt.Errorf("problem converting timestamp to int64: %v", err)
+	}
+
+	retval := otlpRecord{
+		time: time.UnixMicro(microseconds),
+		body: entry.Message.Render(s.BinaryEncoding),
+	}
+
+	retval.observedTime = retval.time
+	if source, err := strconv.ParseInt(entry.SourceRealtimeTimestamp.String(), 10, 64); err == nil {
+		retval.observedTime = time.UnixMicro(source)
+	}
+
+	retval.severityNumber, retval.severityText = OTLPSeverity(entry.Priority.String())
+
+	for _, name := range s.Fields {
+		if value := entry.Field(name).Render(s.BinaryEncoding); value != "" {
+			retval.attributes = append(retval.attributes, otlpAttribute{name, value})
+		}
+	}
+
+	return retval, nil
+}
+
+// fieldOr renders a journal field, or returns the fallback if it isn't set
+func (s *OTLP) fieldOr(field journal.Field, fallback string) string {
+	if value := field.Render(s.BinaryEncoding); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// OTLPSeverity converts a journal priority (0 to 7) into an OTLP severity number and text.
+// An unknown priority is unspecified (0)
+func OTLPSeverity(priority string) (int, string) {
+	number, err := strconv.Atoi(strings.TrimSpace(priority))
+	if err != nil || number < 0 || number >= len(otlpSeverities) {
+		return 0, ""
+	}
+
+	return otlpSeverities[number].number, otlpSeverities[number].text
+}
+
+// export sends the request, retrying when the collector is busy or unavailable.  It returns
+// the number of records the collector rejected, and why
+func (s *OTLP) export(request []byte, tokens map[string]string) (int64, string, error) {
+	for attempt := 0; ; attempt++ {
+		var response []byte
+		var retryAfter time.Duration
+		var retryable bool
+		var err error
+		if s.Protocol == OTLPGRPC {
+			response, retryable, err = s.exportGRPC(request, tokens)
+		} else {
+			response, retryAfter, retryable, err = s.exportHTTP(request, tokens)
+		}
+
+		if err == nil {
+			var rejected int64
+			var message string
+			if s.Protocol == OTLPHTTPJSON {
+				rejected, message, err = otlpPartialSuccessJSON(response)
+			} else {
+				rejected, message, err = otlpPartialSuccessProtobuf(response)
+			}
+
+			//	The collector accepted the request, so sending it again would only duplicate it
+			if err != nil {
+				log.WithFields(log.Fields{
+					"response": string(response),
+				}).WithError(err).Warn("problem decoding the otlp collector's response.  Treating the batch as sent")
+				return 0, "", nil
+			}
+
+			return rejected, message, nil
+		}
+
+		if !retryable || attempt >= s.Retries {
+			return 0, "", err
+		}
+
+		delay := retry.Backoff(attempt, s.RetryDelay, s.MaxRetryDelay)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+
+		metrics.Add("otlp.retries", 1)
+		log.WithFields(log.Fields{
+			"attempt":    attempt + 1,
+			"maxRetries": s.Retries,
+			"delay":      delay.String(),
+		}).WithError(err).Warn("problem exporting to the otlp collector.  Retrying")
+		time.Sleep(delay)
+	}
+}
+
+// exportHTTP POSTs the request.  It returns the response body, how long the collector
+// asked us to wait, and whether trying again could help
+func (s *OTLP) exportHTTP(request []byte, tokens map[string]string) ([]byte, time.Duration, bool, error) {
+	contentType := "application/x-protobuf"
+	if s.Protocol == OTLPHTTPJSON {
+		contentType = "application/json"
+	}
+
+	body := request
+	if s.Gzip {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(request)
+		if err := zw.Close(); err != nil {
+			return nil, 0, false, err
+		}
+		body = compressed.Bytes()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.Endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "cloudjournal")
+	if s.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for name, value := range s.Headers {
+		req.Header.Set(name, token.Replace(value, tokens))
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, 0, true, err
+	}
+	defer resp.Body.Close()
+
+	response, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, 0, true, err
+	}
+
+	if resp.StatusCode/100 == 2 {
+		return response, 0, false, nil
+	}
+
+	err = fmt.Errorf("otlp collector returned %s: %s", resp.Status, strings.TrimSpace(string(response)))
+
+	retryAfter := retry.After(resp.Header.Get("Retry-After"), s.MaxRetryDelay)
+
+	return nil, retryAfter, isRetryableStatus(resp.StatusCode), err
+}
+
+// exportGRPC calls the Export method.  It returns the response, and whether trying again
+// could help
+func (s *OTLP) exportGRPC(request []byte, tokens map[string]string) ([]byte, bool, error) {
+	if s.conn == nil {
+		conn, err := grpc.Dial(s.Endpoint.Host, s.DialOptions...)
+		if err != nil {
+			return nil, false, fmt.Errorf("problem connecting to the otlp collector: %v", err)
+		}
+		s.conn = conn
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	if len(s.Headers) > 0 {
+		md := metadata.MD{}
+		for name, value := range s.Headers {
+			md.Set(name, token.Replace(value, tokens))
+		}
+		ctx = metadata.NewOutgoingContext(ctx, md)
+	}
+
+	options := []grpc.CallOption{grpc.ForceCodec(otlpRawCodec{})}
+	if s.Gzip {
+		options = append(options, grpc.UseCompressor(grpcgzip.Name))
+	}
+
+	var response []byte
+	err := s.conn.Invoke(ctx, OTLPExportMethod, request, &response, options...)
+	if err != nil {
+		return nil, isRetryableCode(status.Code(err)), err
+	}
+
+	return response, false, nil
+}
+
+// isRetryableCode returns true if a gRPC call that failed with this code can be tried again
+func isRetryableCode(code codes.Code) bool {
+	switch code {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded, codes.OutOfRange, codes.DataLoss, codes.Canceled:
+		return true
+	}
+
+	return false
+}
+
+// otlpRawCodec passes already encoded protobuf messages through gRPC
+type otlpRawCodec struct{}
+
+// Marshal returns the encoded message
+func (otlpRawCodec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("can't marshal %T", v)
+	}
+
+	return message, nil
+}
+
+// Unmarshal copies the encoded message
+func (otlpRawCodec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("can't unmarshal into %T", v)
+	}
+	*message = append([]byte{}, data...)
+
+	return nil
+}
+
+// Name is the content subtype, so the collector decodes the messages as protobuf
+func (otlpRawCodec) Name() string {
+	return "proto"
+}
+
+// encodeOTLPProtobuf encodes the resources as an ExportLogsServiceRequest:
+//
+//	ExportLogsServiceRequest { repeated ResourceLogs resource_logs = 1; }
+//	ResourceLogs             { Resource resource = 1; repeated ScopeLogs scope_logs = 2; }
+//	Resource                 { repeated KeyValue attributes = 1; }
+//	ScopeLogs                { InstrumentationScope scope = 1; repeated LogRecord log_records = 2; }
+//	InstrumentationScope     { string name = 1; }
+//	LogRecord                { fixed64 time_unix_nano = 1; SeverityNumber severity_number = 2;
+//	                           string severity_text = 3; AnyValue body = 5;
+//	                           repeated KeyValue attributes = 6; fixed64 observed_time_unix_nano = 11; }
+//	KeyValue                 { string key = 1; AnyValue value = 2; }
+//	AnyValue                 { string string_value = 1; }
+func encodeOTLPProtobuf(resources []*otlpResource) []byte {
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, OTLPScopeName)
+
+	var request []byte
+	for _, resource := range resources {
+		var encodedResource []byte
+		for _, attribute := range resource.attributes {
+			encodedResource = appendOTLPAttribute(encodedResource, 1, attribute)
+		}
+
+		var scopeLogs []byte
+		scopeLogs = protowire.AppendTag(scopeLogs, 1, protowire.BytesType)
+		scopeLogs = protowire.AppendBytes(scopeLogs, scope)
+
+		for _, record := range resource.records {
+			var encodedRecord []byte
+			encodedRecord = protowire.AppendTag(encodedRecord, 1, protowire.Fixed64Type)
+			encodedRecord = protowire.AppendFixed64(encodedRecord, uint64(record.time.UnixNano()))
+			if record.severityNumber != 0 {
+				encodedRecord = protowire.AppendTag(encodedRecord, 2, protowire.VarintType)
+				encodedRecord = protowire.AppendVarint(encodedRecord, uint64(record.severityNumber))
+				encodedRecord = protowire.AppendTag(encodedRecord, 3, protowire.BytesType)
+				encodedRecord = protowire.AppendString(encodedRecord, record.severityText)
+			}
+			encodedRecord = protowire.AppendTag(encodedRecord, 5, protowire.BytesType)
+			encodedRecord = protowire.AppendBytes(encodedRecord, otlpStringValue(record.body))
+			for _, attribute := range record.attributes {
+				encodedRecord = appendOTLPAttribute(encodedRecord, 6, attribute)
+			}
+			encodedRecord = protowire.AppendTag(encodedRecord, 11, protowire.Fixed64Type)
+			encodedRecord = protowire.AppendFixed64(encodedRecord, uint64(record.observedTime.UnixNano()))
+
+			scopeLogs = protowire.AppendTag(scopeLogs, 2, protowire.BytesType)
+			scopeLogs = protowire.AppendBytes(scopeLogs, encodedRecord)
+		}
+
+		var resourceLogs []byte
+		resourceLogs = protowire.AppendTag(resourceLogs, 1, protowire.BytesType)
+		resourceLogs = protowire.AppendBytes(resourceLogs, encodedResource)
+		resourceLogs = protowire.AppendTag(resourceLogs, 2, protowire.BytesType)
+		resourceLogs = protowire.AppendBytes(resourceLogs, scopeLogs)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, resourceLogs)
+	}
+
+	return request
+}
+
+// appendOTLPAttribute appends an attribute as a KeyValue field
+func appendOTLPAttribute(data []byte, number protowire.Number, attribute otlpAttribute) []byte {
+	var keyValue []byte
+	keyValue = protowire.AppendTag(keyValue, 1, protowire.BytesType)
+	keyValue = protowire.AppendString(keyValue, attribute.key)
+	keyValue = protowire.AppendTag(keyValue, 2, protowire.BytesType)
+	keyValue = protowire.AppendBytes(keyValue, otlpStringValue(attribute.value))
+
+	data = protowire.AppendTag(data, number, protowire.BytesType)
+	return protowire.AppendBytes(data, keyValue)
+}
+
+// otlpStringValue encodes a string AnyValue
+func otlpStringValue(value string) []byte {
+	var retval []byte
+	retval = protowire.AppendTag(retval, 1, protowire.BytesType)
+	return protowire.AppendString(retval, value)
+}
+
+// otlpJSONValue is a string AnyValue in OTLP/JSON
+type otlpJSONValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpJSONAttribute is a KeyValue in OTLP/JSON
+type otlpJSONAttribute struct {
+	Key   string        `json:"key"`
+	Value otlpJSONValue `json:"value"`
+}
+
+// encodeOTLPJSON encodes the resources as an ExportLogsServiceRequest in OTLP/JSON, which
+// uses lowerCamelCase names and strings for 64 bit integers
+func encodeOTLPJSON(resources []*otlpResource) ([]byte, error) {
+	type jsonRecord struct {
+		TimeUnixNano         string              `json:"timeUnixNano"`
+		ObservedTimeUnixNano string              `json:"observedTimeUnixNano"`
+		SeverityNumber       int                 `json:"severityNumber,omitempty"`
+		SeverityText         string              `json:"severityText,omitempty"`
+		Body                 otlpJSONValue       `json:"body"`
+		Attributes           []otlpJSONAttribute `json:"attributes,omitempty"`
+	}
+
+	type jsonScopeLogs struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		LogRecords []jsonRecord `json:"logRecords"`
+	}
+
+	type jsonResourceLogs struct {
+		Resource struct {
+			Attributes []otlpJSONAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []jsonScopeLogs `json:"scopeLogs"`
+	}
+
+	request := struct {
+		ResourceLogs []jsonResourceLogs `json:"resourceLogs"`
+	}{ResourceLogs: []jsonResourceLogs{}}
+
+	for _, resource := range resources {
+		resourceLogs := jsonResourceLogs{}
+		resourceLogs.Resource.Attributes = otlpJSONAttributes(resource.attributes)
+
+		scopeLogs := jsonScopeLogs{LogRecords: []jsonRecord{}}
+		scopeLogs.Scope.Name = OTLPScopeName
+		for _, record := range resource.records {
+			scopeLogs.LogRecords = append(scopeLogs.LogRecords, jsonRecord{
+				TimeUnixNano:         strconv.FormatInt(record.time.UnixNano(), 10),
+				ObservedTimeUnixNano: strconv.FormatInt(record.observedTime.UnixNano(), 10),
+				SeverityNumber:       record.severityNumber,
+				SeverityText:         record.severityText,
+				Body:                 otlpJSONValue{StringValue: record.body},
+				Attributes:           otlpJSONAttributes(record.attributes),
+			})
+		}
+
+		resourceLogs.ScopeLogs = []jsonScopeLogs{scopeLogs}
+		request.ResourceLogs = append(request.ResourceLogs, resourceLogs)
+	}
+
+	return json.Marshal(request)
+}
+
+// otlpJSONAttributes converts attributes for OTLP/JSON
+func otlpJSONAttributes(attributes []otlpAttribute) []otlpJSONAttribute {
+	retval := []otlpJSONAttribute{}
+	for _, attribute := range attributes {
+		retval = append(retval, otlpJSONAttribute{Key: attribute.key, Value: otlpJSONValue{StringValue: attribute.value}})
+	}
+
+	return retval
+}
+
+// otlpPartialSuccessProtobuf returns the rejected records from an ExportLogsServiceResponse:
+//
+//	ExportLogsServiceResponse { ExportLogsPartialSuccess partial_success = 1; }
+//	ExportLogsPartialSuccess  { int64 rejected_log_records = 1; string error_message = 2; }
+func otlpPartialSuccessProtobuf(response []byte) (int64, string, error) {
+	var rejected int64
+	var message string
+
+	for len(response) > 0 {
+		number, kind, n := protowire.ConsumeTag(response)
+		if n < 0 {
+			return 0, "", fmt.Errorf("problem decoding the otlp response: %v", protowire.ParseError(n))
+		}
+		response = response[n:]
+
+		if number != 1 || kind != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(number, kind, response)
+			if n < 0 {
+				return 0, "", fmt.Errorf("problem decoding the otlp response: %v", protowire.ParseError(n))
+			}
+			response = response[n:]
+			continue
+		}
+
+		partialSuccess, n := protowire.ConsumeBytes(response)
+		if n < 0 {
+			return 0, "", fmt.Errorf("problem decoding the otlp response: %v", protowire.ParseError(n))
+		}
+		response = response[n:]
+
+		for len(partialSuccess) > 0 {
+			number, kind, n := protowire.ConsumeTag(partialSuccess)
+			if n < 0 {
+				return 0, "", fmt.Errorf("problem decoding the otlp response: %v", protowire.ParseError(n))
+			}
+			partialSuccess = partialSuccess[n:]
+
+			switch {
+			case number == 1 && kind == protowire.VarintType:
+				value, m := protowire.ConsumeVarint(partialSuccess)
+				rejected, n = int64(value), m
+			case number == 2 && kind == protowire.BytesType:
+				value, m := protowire.ConsumeString(partialSuccess)
+				message, n = value, m
+			default:
+				n = protowire.ConsumeFieldValue(number, kind, partialSuccess)
+			}
+			if n < 0 {
+				return 0, "", fmt.Errorf("problem decoding the otlp response: %v", protowire.ParseError(n))
+			}
+			partialSuccess = partialSuccess[n:]
+		}
+	}
+
+	return rejected, message, nil
+}
+
+// otlpPartialSuccessJSON returns the rejected records from an OTLP/JSON ExportLogsServiceResponse
+func otlpPartialSuccessJSON(response []byte) (int64, string, error) {
+	if len(bytes.TrimSpace(response)) == 0 {
+		return 0, "", nil
+	}
+
+	//	64 bit integers can be strings or numbers
+	decoded := struct {
+		PartialSuccess struct {
+			RejectedLogRecords json.RawMessage `json:"rejectedLogRecords"`
+			ErrorMessage       string          `json:"errorMessage"`
+		} `json:"partialSuccess"`
+	}{}
+	if err := json.Unmarshal(response, &decoded); err != nil {
+		return 0, "", fmt.Errorf("problem decoding the otlp response: %v", err)
+	}
+
+	rejected := strings.Trim(string(decoded.PartialSuccess.RejectedLogRecords), `"`)
+	if rejected == "" {
+		return 0, decoded.PartialSuccess.ErrorMessage, nil
+	}
+
+	count, err := strconv.ParseInt(rejected, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("problem decoding the otlp response: bad rejectedLogRecords %s", rejected)
+	}
+
+	return count, decoded.PartialSuccess.ErrorMessage, nil
+}
@@ -0,0 +1,796 @@
+package sink_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/sink"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // Lets the gRPC server accept gzipped requests
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpRecord is a log record exported to otlpServer
+type otlpRecord struct {
+	// Resource are the attributes of the record's resource
+	Resource map[string]string
+
+	// Scope is the name of the record's instrumentation scope
+	Scope string
+
+	Time           time.Time
+	ObservedTime   time.Time
+	SeverityNumber int
+	SeverityText   string
+	Body           string
+	Attributes     map[string]string
+}
+
+// otlpServer is a stand-in for a collector's OTLP/HTTP or OTLP/gRPC logs endpoint.  It
+// keeps the records from every request that didn't fail.  Use FailNext (or FailNextCode
+// for gRPC) to make it return errors, and RejectNext to answer with a partial success
+type otlpServer struct {
+	http *testServer
+
+	mu           sync.Mutex
+	grpcRequests []testRequest
+	records      []otlpRecord
+	codes        []codes.Code
+	rejected     int64
+}
+
+// useOTLPServer starts an OTLP stand-in for the protocol, and points the otlp config at it
+func useOTLPServer(t *testing.T, protocol string) *otlpServer {
+	server := &otlpServer{}
+	endpoint := ""
+	if protocol == "grpc" {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen - Should execute without error, but got: %s", err)
+		}
+		grpcServer := grpc.NewServer(grpc.ForceServerCodec(otlpCodec{}), grpc.UnknownServiceHandler(server.serveGRPC))
+		go grpcServer.Serve(listener)
+		t.Cleanup(grpcServer.Stop)
+		endpoint = "http://" + listener.Addr().String()
+	} else {
+		server.http = newTestServer(t, server.serveHTTP)
+		endpoint = server.http.URL
+	}
+
+	useConfig(t, map[string]interface{}{
+		"otlp.endpoint":      endpoint,
+		"otlp.protocol":      protocol,
+		"otlp.fields":        "SYSLOG_IDENTIFIER, _PID",
+		"otlp.timeout":       "5s",
+		"otlp.retries":       "5",
+		"otlp.retrydelay":    "1ms",
+		"otlp.maxretrydelay": "1ms",
+	})
+
+	return server
+}
+
+// FailNext makes the next OTLP/HTTP requests return the given HTTP status codes
+func (server *otlpServer) FailNext(statusCodes ...int) {
+	server.http.FailNext(statusCodes...)
+}
+
+// FailNextCode makes the next OTLP/gRPC requests fail with the given codes
+func (server *otlpServer) FailNextCode(errorCodes ...codes.Code) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.codes = append(server.codes, errorCodes...)
+}
+
+// RejectNext makes the server answer the next successful request with a partial success
+// that says it rejected some records.  The server still keeps every record
+func (server *otlpServer) RejectNext(rejected int64) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.rejected = rejected
+}
+
+// Requests returns the requests that have been made, in order.  For gRPC, the header
+// is the request's metadata
+func (server *otlpServer) Requests() []testRequest {
+	if server.http != nil {
+		return server.http.Requests()
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return append([]testRequest{}, server.grpcRequests...)
+}
+
+// Records returns the records from every request that didn't fail, in order
+func (server *otlpServer) Records() []otlpRecord {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return append([]otlpRecord{}, server.records...)
+}
+
+// accept keeps the records from a request, and returns the partial success to answer with
+func (server *otlpServer) accept(records []otlpRecord) int64 {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.records = append(server.records, records...)
+	rejected := server.rejected
+	server.rejected = 0
+
+	return rejected
+}
+
+// serveHTTP handles an OTLP/HTTP export request
+func (server *otlpServer) serveHTTP(w http.ResponseWriter, r testRequest) {
+	if r.Method != http.MethodPost || r.Path != "/v1/logs" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	body, err := r.Uncompressed()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	var records []otlpRecord
+	if isJSON {
+		records, err = decodeOTLPJSON(body)
+	} else {
+		records, err = decodeOTLPProtobuf(body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rejected := server.accept(records)
+	w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+	if !isJSON {
+		w.Write(encodeOTLPResponse(rejected))
+		return
+	}
+
+	response := map[string]interface{}{}
+	if rejected > 0 {
+		response["partialSuccess"] = map[string]string{
+			"rejectedLogRecords": strconv.FormatInt(rejected, 10),
+			"errorMessage":       "rejected by the test server",
+		}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// serveGRPC handles an OTLP/gRPC export call
+func (server *otlpServer) serveGRPC(srv interface{}, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	if method != "/opentelemetry.proto.collector.logs.v1.LogsService/Export" {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+	}
+
+	var data []byte
+	if err := stream.RecvMsg(&data); err != nil {
+		return err
+	}
+
+	request := testRequest{Method: http.MethodPost, Path: method, Header: http.Header{}, Body: data}
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	for name, values := range md {
+		for _, value := range values {
+			request.Header.Add(name, value)
+		}
+	}
+
+	server.mu.Lock()
+	server.grpcRequests = append(server.grpcRequests, request)
+	code := codes.OK
+	if len(server.codes) > 0 {
+		code = server.codes[0]
+		server.codes = server.codes[1:]
+	}
+	server.mu.Unlock()
+
+	if code != codes.OK {
+		return status.Error(code, code.String())
+	}
+
+	records, err := decodeOTLPProtobuf(data)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return stream.SendMsg(encodeOTLPResponse(server.accept(records)))
+}
+
+// encodeOTLPResponse encodes an ExportLogsServiceResponse, with a partial success if
+// records were rejected
+func encodeOTLPResponse(rejected int64) []byte {
+	if rejected == 0 {
+		return []byte{}
+	}
+
+	var partial []byte
+	partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+	partial = protowire.AppendVarint(partial, uint64(rejected))
+	partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+	partial = protowire.AppendString(partial, "rejected by the test server")
+
+	var response []byte
+	response = protowire.AppendTag(response, 1, protowire.BytesType)
+	return protowire.AppendBytes(response, partial)
+}
+
+// otlpCodec passes encoded protobuf messages through gRPC as they are
+type otlpCodec struct{}
+
+// Marshal returns the encoded message
+func (otlpCodec) Marshal(v interface{}) ([]byte, error) {
+	return v.([]byte), nil
+}
+
+// Unmarshal copies the encoded message
+func (otlpCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = append([]byte{}, data...)
+	return nil
+}
+
+// Name is the content subtype the sink uses
+func (otlpCodec) Name() string {
+	return "proto"
+}
+
+// otlpJSONValue is a string AnyValue in OTLP/JSON
+type otlpJSONValue struct {
+	StringValue *string `json:"stringValue"`
+}
+
+// otlpJSONAttribute is a KeyValue in OTLP/JSON
+type otlpJSONAttribute struct {
+	Key   string        `json:"key"`
+	Value otlpJSONValue `json:"value"`
+}
+
+// decodeOTLPJSON decodes an OTLP/JSON ExportLogsServiceRequest, failing on fields the
+// sink shouldn't send
+func decodeOTLPJSON(data []byte) ([]otlpRecord, error) {
+	request := struct {
+		ResourceLogs []struct {
+			Resource struct {
+				Attributes []otlpJSONAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeLogs []struct {
+				Scope struct {
+					Name string `json:"name"`
+				} `json:"scope"`
+				LogRecords []struct {
+					TimeUnixNano         string              `json:"timeUnixNano"`
+					ObservedTimeUnixNano string              `json:"observedTimeUnixNano"`
+					SeverityNumber       int                 `json:"severityNumber"`
+					SeverityText         string              `json:"severityText"`
+					Body                 otlpJSONValue       `json:"body"`
+					Attributes           []otlpJSONAttribute `json:"attributes"`
+				} `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return nil, err
+	}
+
+	attributes := func(attributes []otlpJSONAttribute) (map[string]string, error) {
+		retval := make(map[string]string)
+		for _, attribute := range attributes {
+			if attribute.Value.StringValue == nil {
+				return nil, fmt.Errorf("attribute %s isn't a string value", attribute.Key)
+			}
+			retval[attribute.Key] = *attribute.Value.StringValue
+		}
+		return retval, nil
+	}
+
+	nanoseconds := func(value string) (time.Time, error) {
+		n, err := strconv.ParseInt(value, 10, 64)
+		return time.Unix(0, n), err
+	}
+
+	retval := []otlpRecord{}
+	for _, resourceLogs := range request.ResourceLogs {
+		resource, err := attributes(resourceLogs.Resource.Attributes)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, scopeLogs := range resourceLogs.ScopeLogs {
+			for _, logRecord := range scopeLogs.LogRecords {
+				record := otlpRecord{
+					Resource:       resource,
+					Scope:          scopeLogs.Scope.Name,
+					SeverityNumber: logRecord.SeverityNumber,
+					SeverityText:   logRecord.SeverityText,
+				}
+
+				if record.Time, err = nanoseconds(logRecord.TimeUnixNano); err != nil {
+					return nil, err
+				}
+				if record.ObservedTime, err = nanoseconds(logRecord.ObservedTimeUnixNano); err != nil {
+					return nil, err
+				}
+				if logRecord.Body.StringValue == nil {
+					return nil, fmt.Errorf("log record body isn't a string value")
+				}
+				record.Body = *logRecord.Body.StringValue
+				if record.Attributes, err = attributes(logRecord.Attributes); err != nil {
+					return nil, err
+				}
+
+				retval = append(retval, record)
+			}
+		}
+	}
+
+	return retval, nil
+}
+
+// decodeOTLPProtobuf decodes an ExportLogsServiceRequest
+func decodeOTLPProtobuf(data []byte) ([]otlpRecord, error) {
+	request, err := protoFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	retval := []otlpRecord{}
+	for _, resourceLogs := range request {
+		parts, err := protoFields(resourceLogs.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		resource := make(map[string]string)
+		for _, part := range parts {
+			if part.Number == 1 {
+				if resource, err = decodeOTLPAttributes(part.Bytes, 1); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		for _, part := range parts {
+			if part.Number != 2 {
+				continue
+			}
+
+			records, err := decodeOTLPScopeLogs(part.Bytes, resource)
+			if err != nil {
+				return nil, err
+			}
+			retval = append(retval, records...)
+		}
+	}
+
+	return retval, nil
+}
+
+// decodeOTLPScopeLogs decodes the log records in a ScopeLogs
+func decodeOTLPScopeLogs(data []byte, resource map[string]string) ([]otlpRecord, error) {
+	parts, err := protoFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := ""
+	retval := []otlpRecord{}
+	for _, part := range parts {
+		switch part.Number {
+		case 1:
+			scopeFields, err := protoFields(part.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			for _, scopeField := range scopeFields {
+				if scopeField.Number == 1 {
+					scope = string(scopeField.Bytes)
+				}
+			}
+
+		case 2:
+			record := otlpRecord{Resource: resource, Scope: scope}
+			recordFields, err := protoFields(part.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			for _, recordField := range recordFields {
+				switch recordField.Number {
+				case 1:
+					record.Time = time.Unix(0, int64(recordField.Value))
+				case 2:
+					record.SeverityNumber = int(recordField.Value)
+				case 3:
+					record.SeverityText = string(recordField.Bytes)
+				case 5:
+					if record.Body, err = decodeOTLPStringValue(recordField.Bytes); err != nil {
+						return nil, err
+					}
+				case 11:
+					record.ObservedTime = time.Unix(0, int64(recordField.Value))
+				}
+			}
+
+			if record.Attributes, err = decodeOTLPAttributes(part.Bytes, 6); err != nil {
+				return nil, err
+			}
+
+			retval = append(retval, record)
+		}
+	}
+
+	return retval, nil
+}
+
+// decodeOTLPAttributes decodes the string KeyValue fields with the given number in a message
+func decodeOTLPAttributes(data []byte, number protowire.Number) (map[string]string, error) {
+	parts, err := protoFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	retval := make(map[string]string)
+	for _, part := range parts {
+		if part.Number != number {
+			continue
+		}
+
+		keyValue, err := protoFields(part.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		key, value := "", ""
+		for _, kv := range keyValue {
+			switch kv.Number {
+			case 1:
+				key = string(kv.Bytes)
+			case 2:
+				if value, err = decodeOTLPStringValue(kv.Bytes); err != nil {
+					return nil, err
+				}
+			}
+		}
+		retval[key] = value
+	}
+
+	return retval, nil
+}
+
+// decodeOTLPStringValue decodes a string AnyValue
+func decodeOTLPStringValue(data []byte) (string, error) {
+	parts, err := protoFields(data)
+	if err != nil {
+		return "", err
+	}
+
+	for _, part := range parts {
+		if part.Number == 1 {
+			return string(part.Bytes), nil
+		}
+	}
+
+	return "", fmt.Errorf("value isn't a string value")
+}
+
+// otlpBatch is a test batch where the first entry has the journal fields the sink maps
+func otlpBatch() sink.Batch {
+	batch := hostBatch(1, 2)
+	batch.Tokens["{machineid}"] = "machine1"
+
+	entry := &batch.Entries[0]
+	entry.Priority = journal.NewField("3")
+	entry.Hostname = journal.NewField("journalhost")
+	entry.MachineID = journal.NewField("journalmachine")
+	entry.SystemDUnit = journal.NewField("cron.service")
+	entry.SourceRealtimeTimestamp = journal.NewField("1636000000000500")
+	entry.Fields = map[string]journal.Field{
+		"SYSLOG_IDENTIFIER": journal.NewField("CRON"),
+		"_PID":              journal.NewField("1234"),
+	}
+
+	return batch
+}
+
+// checkOTLPRecords checks the records exported for otlpBatch
+func checkOTLPRecords(t *testing.T, records []otlpRecord) {
+	t.Helper()
+
+	if len(records) != 2 {
+		t.Fatalf("Write - Expected 2 records, but got %d", len(records))
+	}
+
+	first := records[0]
+	if first.Resource["host.name"] != "journalhost" || first.Resource["host.id"] != "journalmachine" || first.Resource["service.name"] != "cron.service" {
+		t.Errorf("Write - Expected the entry's resource attributes, but got %v", first.Resource)
+	}
+
+	if first.SeverityNumber != 17 || first.SeverityText != "err" {
+		t.Errorf("Write - Expected priority 3 to be severity 17 (ERROR), but got %d %q", first.SeverityNumber, first.SeverityText)
+	}
+
+	if !first.Time.Equal(time.UnixMicro(1636000000001000)) || !first.ObservedTime.Equal(time.UnixMicro(1636000000000500)) {
+		t.Errorf("Write - Expected the realtime and source realtime timestamps, but got %v and %v", first.Time, first.ObservedTime)
+	}
+
+	if first.Body != "message 1" || first.Attributes["SYSLOG_IDENTIFIER"] != "CRON" || first.Attributes["_PID"] != "1234" || first.Scope != sink.OTLPScopeName {
+		t.Errorf("Write - Expected the message, scope and field attributes, but got %+v", first)
+	}
+
+	//	The second entry doesn't have the fields, so it falls back to the tokens and the unit
+	second := records[1]
+	if second.Resource["host.name"] != "raspberrypi" || second.Resource["host.id"] != "machine1" || second.Resource["service.name"] != "cron" {
+		t.Errorf("Write - Expected the fallback resource attributes, but got %v", second.Resource)
+	}
+
+	if second.SeverityNumber != 0 || !second.ObservedTime.Equal(second.Time) || len(second.Attributes) != 0 {
+		t.Errorf("Write - Expected no severity or attributes, and the observed time to be the time, but got %+v", second)
+	}
+}
+
+func TestOTLP_Write_HTTPProtobuf_MapsEntries(t *testing.T) {
+	//	Arrange
+	server := useOTLPServer(t, "http/protobuf")
+	viper.Set("otlp.headers", "X-Api-Key=secret, X-Host={hostname}")
+	viper.Set("otlp.resource", "deployment.environment=prod")
+	out := newTestSink(t, sink.OTLPName)
+
+	//	Act
+	err := out.Write(otlpBatch())
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 1 || requests[0].Header.Get("Content-Type") != "application/x-protobuf" {
+		t.Fatalf("Write - Expected 1 protobuf request, but got %+v", requests)
+	}
+
+	if requests[0].Header.Get("X-Api-Key") != "secret" || requests[0].Header.Get("X-Host") != "raspberrypi" {
+		t.Errorf("Write - Expected the templated headers, but got %v", requests[0].Header)
+	}
+
+	records := server.Records()
+	checkOTLPRecords(t, records)
+
+	if records[0].Resource["deployment.environment"] != "prod" {
+		t.Errorf("Write - Expected the extra resource attribute, but got %v", records[0].Resource)
+	}
+}
+
+func TestOTLP_Write_HTTPJSON_Gzip_MapsEntries(t *testing.T) {
+	//	Arrange
+	server := useOTLPServer(t, "http/json")
+	viper.Set("otlp.gzip", true)
+	out := newTestSink(t, sink.OTLPName)
+
+	//	Act
+	err := out.Write(otlpBatch())
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 1 || requests[0].Header.Get("Content-Type") != "application/json" || requests[0].Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Write - Expected 1 gzipped JSON request, but got %+v", requests)
+	}
+
+	checkOTLPRecords(t, server.Records())
+}
+
+func TestOTLP_Write_GRPC_MapsEntries(t *testing.T) {
+	//	Arrange
+	server := useOTLPServer(t, "grpc")
+	viper.Set("otlp.headers", "X-Api-Key=secret")
+	viper.Set("otlp.gzip", true)
+	out := newTestSink(t, sink.OTLPName)
+
+	//	Act
+	err := out.Write(otlpBatch())
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 1 || requests[0].Path != "/opentelemetry.proto.collector.logs.v1.LogsService/Export" {
+		t.Fatalf("Write - Expected 1 gRPC export, but got %+v", requests)
+	}
+
+	if requests[0].Header.Get("X-Api-Key") != "secret" {
+		t.Errorf("Write - Expected the headers as metadata, but got %v", requests[0].Header)
+	}
+
+	checkOTLPRecords(t, server.Records())
+}
+
+func TestOTLP_Write_Unavailable_Retries(t *testing.T) {
+	//	Arrange
+	httpServer := useOTLPServer(t, "http/protobuf")
+	httpServer.FailNext(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	httpOut := newTestSink(t, sink.OTLPName)
+
+	grpcServer := useOTLPServer(t, "grpc")
+	grpcServer.FailNextCode(codes.Unavailable, codes.ResourceExhausted)
+	grpcOut := newTestSink(t, sink.OTLPName)
+
+	//	Act
+	httpErr := httpOut.Write(testBatch(1, 3))
+	grpcErr := grpcOut.Write(testBatch(1, 3))
+
+	//	Assert
+	if httpErr != nil || grpcErr != nil {
+		t.Fatalf("Write - Should execute without error after retrying, but got: %v and %v", httpErr, grpcErr)
+	}
+
+	if len(httpServer.Requests()) != 3 || len(httpServer.Records()) != 3 {
+		t.Errorf("Write - Expected 3 HTTP requests and 3 records, but got %d and %d", len(httpServer.Requests()), len(httpServer.Records()))
+	}
+
+	if len(grpcServer.Requests()) != 3 || len(grpcServer.Records()) != 3 {
+		t.Errorf("Write - Expected 3 gRPC requests and 3 records, but got %d and %d", len(grpcServer.Requests()), len(grpcServer.Records()))
+	}
+}
+
+func TestOTLP_Write_BadRequest_ReturnsErrorWithoutRetrying(t *testing.T) {
+	//	Arrange
+	httpServer := useOTLPServer(t, "http/json")
+	httpServer.FailNext(http.StatusBadRequest)
+	httpOut := newTestSink(t, sink.OTLPName)
+
+	grpcServer := useOTLPServer(t, "grpc")
+	grpcServer.FailNextCode(codes.InvalidArgument)
+	grpcOut := newTestSink(t, sink.OTLPName)
+
+	//	Act
+	httpErr := httpOut.Write(testBatch(1, 3))
+	grpcErr := grpcOut.Write(testBatch(1, 3))
+
+	//	Assert
+	if httpErr == nil || grpcErr == nil {
+		t.Fatalf("Write - Should return an error for a bad request, but got: %v and %v", httpErr, grpcErr)
+	}
+
+	if len(httpServer.Requests()) != 1 || len(grpcServer.Requests()) != 1 {
+		t.Errorf("Write - Expected 1 request to each server, but got %d and %d", len(httpServer.Requests()), len(grpcServer.Requests()))
+	}
+}
+
+func TestOTLP_Write_PartialSuccess_ReturnsNil(t *testing.T) {
+	for _, protocol := range []string{"http/protobuf", "http/json", "grpc"} {
+		//	Arrange
+		server := useOTLPServer(t, protocol)
+		server.RejectNext(1)
+		out := newTestSink(t, sink.OTLPName)
+
+		//	Act
+		err := out.Write(testBatch(1, 3))
+
+		//	Assert
+		if err != nil {
+			t.Errorf("Write - Should accept a partial success over %s, but got: %s", protocol, err)
+		}
+
+		if len(server.Requests()) != 1 {
+			t.Errorf("Write - Expected the batch not to be sent again over %s, but got %d requests", protocol, len(server.Requests()))
+		}
+	}
+}
+
+func TestOTLP_Write_UndecodableResponse_ReturnsNil(t *testing.T) {
+	//	Arrange
+	server := newTestServer(t, func(w http.ResponseWriter, r testRequest) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{not json"))
+	})
+
+	useConfig(t, map[string]interface{}{
+		"otlp.endpoint": server.URL,
+		"otlp.protocol": "http/json",
+	})
+	out := newTestSink(t, sink.OTLPName)
+
+	//	Act
+	err := out.Write(testBatch(1, 3))
+
+	//	Assert
+	if err != nil {
+		t.Errorf("Write - Should treat an accepted batch as sent, but got: %s", err)
+	}
+
+	if requests := server.Requests(); len(requests) != 1 {
+		t.Errorf("Write - Expected the batch not to be sent again, but got %d requests", len(requests))
+	}
+}
+
+func TestOTLPSeverity_MapsPriorities(t *testing.T) {
+	for _, test := range []struct {
+		priority string
+		number   int
+		text     string
+	}{
+		{"0", 24, "emerg"},
+		{"2", 21, "crit"},
+		{"4", 13, "warning"},
+		{"5", 10, "notice"},
+		{"6", 9, "info"},
+		{"7", 5, "debug"},
+		{"", 0, ""},
+		{"8", 0, ""},
+	} {
+		//	Act
+		number, text := sink.OTLPSeverity(test.priority)
+
+		//	Assert
+		if number != test.number || text != test.text {
+			t.Errorf("OTLPSeverity - Expected %q to be %d %q, but got %d %q", test.priority, test.number, test.text, number, text)
+		}
+	}
+}
+
+func TestOTLP_NewOTLPFromConfig_BadSettings_ReturnsError(t *testing.T) {
+	for _, setting := range []struct{ endpoint, protocol string }{
+		{"", "grpc"},
+		{"localhost:4317", "grpc"},
+		{"http://localhost:4318", "http/xml"},
+	} {
+		//	Arrange
+		useConfig(t, map[string]interface{}{"otlp.endpoint": setting.endpoint, "otlp.protocol": setting.protocol})
+
+		//	Act
+		_, err := sink.NewOTLPFromConfig()
+
+		//	Assert
+		if err == nil {
+			t.Errorf("NewOTLPFromConfig - Should return an error for %q over %s", setting.endpoint, setting.protocol)
+		}
+	}
+}
+
+func TestOTLP_NewOTLPFromConfig_AddsLogsPath(t *testing.T) {
+	//	Arrange
+	useConfig(t, map[string]interface{}{"otlp.endpoint": "https://collector:4318"})
+
+	//	Act
+	out, err := sink.NewOTLPFromConfig()
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("NewOTLPFromConfig - Should execute without error, but got: %s", err)
+	}
+
+	if out.Protocol != sink.OTLPHTTPProtobuf || out.Endpoint.String() != "https://collector:4318/v1/logs" {
+		t.Errorf("NewOTLPFromConfig - Expected http/protobuf to https://collector:4318/v1/logs, but got %s to %s", out.Protocol, out.Endpoint)
+	}
+}
@@ -0,0 +1,260 @@
+// Package sink defines where journal entries are shipped to.  Each backend (like
+// cloudwatch) is a Sink, and the sinks in monitor.sinks are combined with a Fanout
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danesparza/cloudjournal/data"
+	"github.com/danesparza/cloudjournal/format"
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/spf13/viper"
+)
+
+// Batch is a batch of journal entries from a single unit
+type Batch struct {
+	// Unit is the systemd unit the entries are from
+	Unit string
+
+	// Tokens are the values for tokens like {unit}, {hostname} and {machineid}
+	Tokens map[string]string
+
+	// Entries are the journal entries, oldest first
+	Entries []journal.Entry
+}
+
+// Sink is somewhere journal entries are shipped to
+type Sink interface {
+	// Name is the name of the sink, as used in monitor.sinks
+	Name() string
+
+	// Write ships a batch of entries.  It returns an error if the batch
+	// wasn't shipped, so it can be tried again later
+	Write(batch Batch) error
+
+	// Close flushes anything buffered and releases the sink's resources.  Sinks that
+	// send every write right away have nothing to do
+	Close() error
+}
+
+// HealthChecker is a sink that can check it's able to ship entries
+type HealthChecker interface {
+	HealthCheck() error
+}
+
+// ErrBuffered is returned by Write when a sink kept the batch to ship later (like the s3
+// sink, which collects a unit's entries into bigger objects).  The entries don't need to be
+// written again, but they aren't shipped yet, so the unit's cursor isn't saved
+var ErrBuffered = errors.New("entries are buffered to ship later")
+
+// Flusher is a sink that buffers entries
+type Flusher interface {
+	// Flush ships the unit's buffered entries if they're due, or all of them if force is
+	// true.  It returns nil once nothing is buffered for the unit (so its cursor can be
+	// saved), or ErrBuffered if entries are still buffered
+	Flush(unit string, force bool) error
+}
+
+// New creates the sink with the given name, using its section of the config
+func New(name string, db *data.Manager) (Sink, error) {
+	switch name {
+	case CloudWatchName:
+		return NewCloudWatchFromConfig(db), nil
+	case LokiName:
+		s, err := NewLokiFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case ElasticsearchName:
+		s, err := NewElasticsearchFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case SyslogName:
+		s, err := NewSyslogFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case WebhookName:
+		s, err := NewWebhookFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case FileName:
+		s, err := NewFileFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case S3Name:
+		s, err := NewS3FromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case KafkaName:
+		s, err := NewKafkaFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case OTLPName:
+		s, err := NewOTLPFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("unknown sink %q", name)
+}
+
+// NewFromConfig creates the sinks in the comma seperated list in monitor.sinks
+func NewFromConfig(names string, db *data.Manager) ([]Sink, error) {
+	sinks := []Sink{}
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		s, err := New(name, db)
+		if err != nil {
+			for _, created := range sinks {
+				created.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("no sinks configured")
+	}
+
+	return sinks, nil
+}
+
+// splitList splits a comma seperated list from the config, skipping empty items
+func splitList(list string) []string {
+	retval := []string{}
+
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			retval = append(retval, item)
+		}
+	}
+
+	return retval
+}
+
+// durationFromConfig gets a duration (like 5s) from the config, or the fallback
+// if it isn't set or can't be parsed
+func durationFromConfig(key string, fallback time.Duration) time.Duration {
+	retval, err := time.ParseDuration(viper.GetString(key))
+	if err != nil {
+		return fallback
+	}
+
+	return retval
+}
+
+// newFormatter creates a formatter for a sink's format setting, using the
+// journal fields and binary encoding from the config
+func newFormatter(mode string) format.Formatter {
+	retval := format.NewFormatterFromConfig()
+	retval.Mode = mode
+
+	return retval
+}
+
+// entryDocument formats an entry as the JSON document the sinks that ship JSON send: the
+// formatter's json mode (like cloudwatch.format json), plus an @timestamp if the message
+// didn't have one.  It returns the document and the entry's timestamp
+func entryDocument(formatter format.Formatter, entry journal.Entry) ([]byte, time.Time, error) {
+	microseconds, err := strconv.ParseInt(entry.RealtimeTimestamp, 10, 64)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("problem converting timestamp to int64: %v", err)
+	}
+	timestamp := time.UnixMicro(microseconds).UTC()
+
+	formatter.Mode = format.FormatJSON
+	document := make(map[string]interface{})
+	dec := json.NewDecoder(strings.NewReader(formatter.Format(entry)))
+	dec.UseNumber()
+	if err := dec.Decode(&document); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	//	Keep the app's own @timestamp if its message had one
+	if _, ok := document["@timestamp"]; !ok {
+		document["@timestamp"] = timestamp.Format(time.RFC3339Nano)
+	}
+
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return encoded, timestamp, nil
+}
+
+// ParseSize parses a size like 512KB, 100MB or 1GB (or a number of bytes) into bytes.
+// An empty size is 0
+func ParseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40}, {"B", 1},
+	} {
+		if strings.HasSuffix(size, unit.suffix) {
+			size = strings.TrimSpace(strings.TrimSuffix(size, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%q isn't a size like 100MB", size)
+	}
+
+	return value * multiplier, nil
+}
+
+// DateTokens returns a copy of the tokens with the date tokens {date} (like 2021.11.04),
+// {year} (or {yyyy}), {month} (or {mm}), {day} (or {dd}) and {hh} added for the time
+func DateTokens(tokens map[string]string, t time.Time) map[string]string {
+	retval := make(map[string]string)
+	for key, value := range tokens {
+		retval[key] = value
+	}
+
+	retval["{date}"] = t.Format("2006.01.02")
+	retval["{year}"] = t.Format("2006")
+	retval["{month}"] = t.Format("01")
+	retval["{day}"] = t.Format("02")
+	retval["{yyyy}"] = retval["{year}"]
+	retval["{mm}"] = retval["{month}"]
+	retval["{dd}"] = retval["{day}"]
+	retval["{hh}"] = t.Format("15")
+
+	return retval
+}
@@ -0,0 +1,93 @@
+package sink_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/sink"
+	"github.com/spf13/viper"
+)
+
+// testBatch is a batch for the cron unit with entries first to last.  Each entry's cursor is c<n>
+func testBatch(first, last int) sink.Batch {
+	batch := sink.Batch{Unit: "cron", Tokens: map[string]string{"{unit}": "cron"}}
+	for i := first; i <= last; i++ {
+		batch.Entries = append(batch.Entries, journal.Entry{
+			Cursor:            fmt.Sprintf("c%d", i),
+			RealtimeTimestamp: fmt.Sprintf("%d", 1636000000000000+int64(i)*1000),
+			Message:           journal.NewField(fmt.Sprintf("message %d", i)),
+		})
+	}
+	return batch
+}
+
+// hostBatch is a test batch with the hostname token set
+func hostBatch(first, last int) sink.Batch {
+	batch := testBatch(first, last)
+	batch.Tokens["{hostname}"] = "raspberrypi"
+	return batch
+}
+
+// useConfig sets the config for the test, and resets it when the test is done
+func useConfig(t *testing.T, settings map[string]interface{}) {
+	for key, value := range settings {
+		viper.Set(key, value)
+	}
+	t.Cleanup(viper.Reset)
+}
+
+// newTestSink creates the named sink from the config, and closes it when the test is done
+func newTestSink(t *testing.T, name string) sink.Sink {
+	t.Helper()
+
+	out, err := sink.New(name, nil)
+	if err != nil {
+		t.Fatalf("New(%s) - Should execute without error, but got: %s", name, err)
+	}
+	t.Cleanup(func() { out.Close() })
+
+	return out
+}
+
+func TestRoot_NewFromConfig_UnknownSink_ReturnsError(t *testing.T) {
+	//	Act
+	_, err := sink.NewFromConfig("cloudwatch, carrier-pigeon", nil)
+
+	//	Assert
+	if err == nil {
+		t.Errorf("NewFromConfig - Expected an error for an unknown sink")
+	}
+}
+
+func TestDateTokens_AddsDateTokens(t *testing.T) {
+	//	Arrange
+	tokens := map[string]string{"{unit}": "cron"}
+
+	//	Act
+	got := sink.DateTokens(tokens, time.Date(2021, 11, 4, 5, 0, 0, 0, time.UTC))
+
+	//	Assert
+	if got["{date}"] != "2021.11.04" || got["{year}"] != "2021" || got["{month}"] != "11" || got["{day}"] != "04" || got["{unit}"] != "cron" {
+		t.Errorf("DateTokens - Expected the date tokens and the original tokens, but got %v", got)
+	}
+
+	if _, ok := tokens["{date}"]; ok {
+		t.Errorf("DateTokens - Should not change the original tokens")
+	}
+}
+
+func TestParseSize_SizesWithUnits(t *testing.T) {
+	tests := map[string]int64{"": 0, "512": 512, "10B": 10, "1KB": 1024, "100MB": 100 << 20, "2 gb": 2 << 30}
+
+	for size, want := range tests {
+		if got, err := sink.ParseSize(size); err != nil || got != want {
+			t.Errorf("ParseSize(%q) - Expected %d, but got %d (%v)", size, want, got, err)
+		}
+	}
+
+	if _, err := sink.ParseSize("lots"); err == nil {
+		t.Errorf("ParseSize - Expected an error for an invalid size, but got nil")
+	}
+}
@@ -0,0 +1,339 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/danesparza/cloudjournal/awssession"
+	"github.com/danesparza/cloudjournal/format"
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/metrics"
+	"github.com/danesparza/cloudjournal/token"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// S3Name is the name of the S3 archive sink
+const S3Name = "s3"
+
+// S3API is the part of the S3 API the sink uses
+type S3API interface {
+	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+	HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error)
+}
+
+// S3 archives entries as gzipped NDJSON objects in S3 (or an S3-compatible store like
+// MinIO).  A unit's entries are buffered until they reach MaxSize or MaxAge, and then
+// uploaded as one object.  The object key comes from its first and last cursors, so
+// uploading the same entries again replaces the same object instead of adding another one
+type S3 struct {
+	// Bucket is the bucket objects are uploaded to
+	Bucket string
+
+	// Key is the key of each object.  It can use tokens, the date tokens from the first
+	// entry's timestamp and {cursor-hash}
+	Key string
+
+	// StorageClass is the storage class for objects (like STANDARD_IA or GLACIER_IR), if set
+	StorageClass string
+
+	// ServerSideEncryption is AES256 or aws:kms, if set.  KMSKeyID is the key for aws:kms
+	ServerSideEncryption string
+	KMSKeyID             string
+
+	// Formatter formats each entry.  Its mode is always json
+	Formatter format.Formatter
+
+	// MaxSize is how big (uncompressed) a unit's buffered entries can get before they're
+	// uploaded.  If it's 0, only MaxAge is used
+	MaxSize int64
+
+	// MaxAge is how long a unit's entries can be buffered before they're uploaded.  If
+	// it's 0, every write is uploaded right away
+	MaxAge time.Duration
+
+	mu     sync.Mutex
+	client S3API
+
+	buffersMu sync.Mutex
+	buffers   map[string]*s3Buffer
+}
+
+// s3Buffer is the entries buffered for a unit
+type s3Buffer struct {
+	tokens     map[string]string
+	first      journal.Entry
+	lastCursor string
+	entries    int
+	started    time.Time
+	body       bytes.Buffer
+}
+
+// NewS3 creates an S3 sink that uses the given client
+func NewS3(client S3API, bucket, key string) *S3 {
+	return &S3{
+		Bucket:    bucket,
+		Key:       key,
+		Formatter: newFormatter(format.FormatJSON),
+		client:    client,
+		buffers:   make(map[string]*s3Buffer),
+	}
+}
+
+// NewS3FromConfig creates an S3 sink from the s3 section of the config
+func NewS3FromConfig() (*S3, error) {
+	retval := NewS3(nil, viper.GetString("s3.bucket"), viper.GetString("s3.key"))
+	retval.StorageClass = viper.GetString("s3.storageclass")
+	retval.ServerSideEncryption = viper.GetString("s3.sse")
+	retval.KMSKeyID = viper.GetString("s3.kms_key_id")
+	retval.MaxAge = durationFromConfig("s3.maxage", 5*time.Minute)
+
+	maxSize, err := ParseSize(viper.GetString("s3.maxsize"))
+	if err != nil {
+		return nil, fmt.Errorf("problem parsing s3.maxsize: %v", err)
+	}
+	retval.MaxSize = maxSize
+
+	if retval.Bucket == "" {
+		return nil, fmt.Errorf("s3.bucket isn't set")
+	}
+
+	if retval.Key == "" {
+		return nil, fmt.Errorf("s3.key isn't set")
+	}
+
+	return retval, nil
+}
+
+// Name returns the name of the sink
+func (s *S3) Name() string {
+	return S3Name
+}
+
+// Write adds the batch to the unit's buffer.  Once the buffer is due (it reaches MaxSize
+// or MaxAge) it's uploaded as one object, and Write returns nil so the unit's cursor is
+// saved.  Until then (or if the upload fails) it returns ErrBuffered, so the cursor isn't
+// saved past entries that haven't been archived yet.  Entries that are already in the
+// buffer aren't added again
+func (s *S3) Write(batch Batch) error {
+	s.buffersMu.Lock()
+	defer s.buffersMu.Unlock()
+
+	buffer := s.buffers[batch.Unit]
+	entries := batch.Entries
+	if buffer != nil {
+		entries = entriesAfter(entries, buffer.lastCursor)
+	}
+
+	for _, entry := range entries {
+		document, _, err := entryDocument(s.Formatter, entry)
+		if err != nil {
+			metrics.Add("s3.entries_dropped", 1)
+			log.WithFields(log.Fields{
+				"unit":   batch.Unit,
+				"cursor": entry.Cursor,
+			}).WithError(err).Error("problem creating the s3 document.  Dropping it")
+			continue
+		}
+
+		if buffer == nil {
+			buffer = &s3Buffer{tokens: make(map[string]string), first: entry, started: time.Now()}
+			for name, value := range batch.Tokens {
+				buffer.tokens[name] = value
+			}
+			s.buffers[batch.Unit] = buffer
+		}
+
+		buffer.body.Write(document)
+		buffer.body.WriteByte('\n')
+		buffer.lastCursor = entry.Cursor
+		buffer.entries++
+	}
+
+	//	A failed upload is tried again by the next Write or Flush.  The entries are in
+	//	the buffer, so they don't need to be written again
+	if err := s.flush(batch.Unit, false); err != nil {
+		return ErrBuffered
+	}
+
+	return nil
+}
+
+// Flush uploads the unit's buffered entries if they're due, or if force is true.  It
+// returns ErrBuffered if they aren't due yet
+func (s *S3) Flush(unit string, force bool) error {
+	s.buffersMu.Lock()
+	defer s.buffersMu.Unlock()
+
+	return s.flush(unit, force)
+}
+
+// Close uploads everything that's buffered, and returns the first error
+func (s *S3) Close() error {
+	s.buffersMu.Lock()
+	defer s.buffersMu.Unlock()
+
+	var retval error
+	for unit := range s.buffers {
+		if err := s.flush(unit, true); err != nil && retval == nil {
+			retval = err
+		}
+	}
+
+	return retval
+}
+
+// flush uploads the unit's buffer if it's due (or force is true), and forgets it once it's
+// uploaded.  If the upload fails the buffer is kept, so it can be tried again.  The caller
+// must hold buffersMu
+func (s *S3) flush(unit string, force bool) error {
+	buffer := s.buffers[unit]
+	if buffer == nil {
+		return nil
+	}
+
+	due := force || s.MaxAge <= 0 || time.Since(buffer.started) >= s.MaxAge ||
+		(s.MaxSize > 0 && int64(buffer.body.Len()) >= s.MaxSize)
+	if !due {
+		return ErrBuffered
+	}
+
+	if err := s.upload(unit, buffer); err != nil {
+		return err
+	}
+
+	delete(s.buffers, unit)
+	return nil
+}
+
+// upload uploads a unit's buffer as one gzipped object
+func (s *S3) upload(unit string, buffer *s3Buffer) error {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write(buffer.body.Bytes())
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	key := s.ObjectKey(buffer.tokens, buffer.first, buffer.lastCursor)
+
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:          aws.String(s.Bucket),
+		Key:             aws.String(key),
+		Body:            bytes.NewReader(body.Bytes()),
+		ContentType:     aws.String("application/x-ndjson"),
+		ContentEncoding: aws.String("gzip"),
+		Metadata: map[string]*string{
+			"Unit":         aws.String(unit),
+			"Entries":      aws.String(strconv.Itoa(buffer.entries)),
+			"First-Cursor": aws.String(buffer.first.Cursor),
+			"Last-Cursor":  aws.String(buffer.lastCursor),
+		},
+	}
+	if s.StorageClass != "" {
+		input.StorageClass = aws.String(s.StorageClass)
+	}
+	if s.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(s.ServerSideEncryption)
+	}
+	if s.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.KMSKeyID)
+	}
+
+	if _, err := client.PutObject(input); err != nil {
+		metrics.Add("s3.batches_failed", 1)
+		log.WithFields(log.Fields{
+			"bucket": s.Bucket,
+			"key":    key,
+		}).WithError(err).Error("problem uploading to s3")
+		return err
+	}
+
+	metrics.Add("s3.objects_uploaded", 1)
+	metrics.Add("s3.entries_sent", int64(buffer.entries))
+	return nil
+}
+
+// HealthCheck checks the bucket exists and we can get to it
+func (s *S3) HealthCheck() error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(s.Bucket)})
+	return err
+}
+
+// ObjectKey returns the key for a batch that starts with the first entry and ends with
+// the last cursor.  {cursor-hash} is a hash of the first and last cursors, and the date
+// tokens come from the first entry's timestamp
+func (s *S3) ObjectKey(tokens map[string]string, first journal.Entry, lastCursor string) string {
+	hash := sha1.Sum([]byte(first.Cursor + "\n" + lastCursor))
+
+	var keyTokens map[string]string
+	if microseconds, err := strconv.ParseInt(first.RealtimeTimestamp, 10, 64); err == nil {
+		keyTokens = DateTokens(tokens, time.UnixMicro(microseconds).UTC())
+	} else {
+		keyTokens = DateTokens(tokens, time.Now().UTC())
+	}
+	keyTokens["{cursor-hash}"] = hex.EncodeToString(hash[:8])
+
+	return strings.TrimPrefix(token.Replace(s.Key, keyTokens), "/")
+}
+
+// getClient gets the S3 client, creating it the first time
+func (s *S3) getClient() (S3API, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	config := aws.NewConfig().
+		WithS3ForcePathStyle(viper.GetBool("s3.pathstyle")).
+		WithMaxRetries(viper.GetInt("s3.retries"))
+	if endpoint := viper.GetString("s3.endpoint"); endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	if region := viper.GetString("s3.region"); region != "" {
+		config = config.WithRegion(region)
+	}
+
+	//	S3-compatible stores usually have their own keys.  Otherwise use the same
+	//	AWS credentials (and role) as cloudwatch
+	var sess *session.Session
+	var err error
+	if accessKeyID := viper.GetString("s3.access_key_id"); accessKeyID != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(accessKeyID, viper.GetString("s3.secret_access_key"), ""))
+		if config.Region == nil {
+			config = config.WithRegion(viper.GetString("cloudwatch.region"))
+		}
+		sess, err = session.NewSession(config)
+	} else {
+		sess, err = awssession.New()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.client = s3.New(sess, config)
+	return s.client, nil
+}
@@ -0,0 +1,301 @@
+package sink_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/danesparza/cloudjournal/sink"
+	"github.com/spf13/viper"
+)
+
+// s3Server is a stand-in for the parts of S3 the s3 sink uses: HeadBucket and PutObject,
+// with path-style addressing, for a single bucket called archive
+type s3Server struct {
+	*testServer
+	objects map[string]testRequest
+}
+
+// useS3Server starts an S3 stand-in and points the s3 config at its archive bucket
+func useS3Server(t *testing.T) *s3Server {
+	server := &s3Server{objects: make(map[string]testRequest)}
+	server.testServer = newTestServer(t, server.serveHTTP)
+
+	useConfig(t, map[string]interface{}{
+		"s3.bucket":            "archive",
+		"s3.key":               "{hostname}/{unit}/{yyyy}/{mm}/{dd}/{cursor-hash}.ndjson.gz",
+		"s3.endpoint":          server.URL,
+		"s3.pathstyle":         true,
+		"s3.region":            "us-east-1",
+		"s3.access_key_id":     "minioadmin",
+		"s3.secret_access_key": "minioadmin",
+		"s3.retries":           2,
+		"s3.maxage":            "0s",
+	})
+
+	return server
+}
+
+// Puts returns how many PutObject requests have been made, including ones that failed
+func (server *s3Server) Puts() int {
+	puts := 0
+	for _, request := range server.Requests() {
+		if request.Method == http.MethodPut {
+			puts++
+		}
+	}
+
+	return puts
+}
+
+// Keys returns the keys of the objects in the bucket, sorted
+func (server *s3Server) Keys() []string {
+	server.Lock()
+	defer server.Unlock()
+
+	retval := []string{}
+	for key := range server.objects {
+		retval = append(retval, key)
+	}
+	sort.Strings(retval)
+
+	return retval
+}
+
+// Object returns the PutObject request for an object, with its body gunzipped
+func (server *s3Server) Object(t *testing.T, key string) (testRequest, []byte) {
+	t.Helper()
+
+	server.Lock()
+	object := server.objects[key]
+	server.Unlock()
+
+	zr, err := gzip.NewReader(bytes.NewReader(object.Body))
+	if err != nil {
+		t.Fatalf("Write - Expected a gzipped body, but got: %s", err)
+	}
+	contents, _ := io.ReadAll(zr)
+
+	return object, contents
+}
+
+// serveHTTP handles HEAD /archive and PUT /archive/key
+func (server *s3Server) serveHTTP(w http.ResponseWriter, r testRequest) {
+	switch {
+	case r.Method == http.MethodHead && r.Path == "/archive":
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodPut && strings.HasPrefix(r.Path, "/archive/"):
+		server.objects[strings.TrimPrefix(r.Path, "/archive/")] = r
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, len(r.Body)))
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchBucket</Code><Message>The specified bucket does not exist</Message></Error>`)
+	}
+}
+
+func TestS3_Write_UploadsGzippedNDJSON(t *testing.T) {
+	//	Arrange
+	server := useS3Server(t)
+	viper.Set("s3.storageclass", "STANDARD_IA")
+	out := newTestSink(t, sink.S3Name)
+
+	//	Act
+	err := out.Write(hostBatch(1, 3))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	keys := server.Keys()
+	if len(keys) != 1 || !strings.HasPrefix(keys[0], "raspberrypi/cron/2021/11/04/") || !strings.HasSuffix(keys[0], ".ndjson.gz") {
+		t.Fatalf("Write - Expected one object under raspberrypi/cron/2021/11/04/, but got %v", keys)
+	}
+
+	object, contents := server.Object(t, keys[0])
+	if object.Header.Get("Content-Encoding") != "gzip" || object.Header.Get("X-Amz-Storage-Class") != "STANDARD_IA" || object.Header.Get("X-Amz-Meta-Last-Cursor") != "c3" {
+		t.Errorf("Write - Expected a gzipped STANDARD_IA object with the last cursor, but got %v", object.Header)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(string(contents)), "\n"); len(lines) != 3 || !strings.Contains(lines[0], `"message":"message 1"`) {
+		t.Errorf("Write - Expected 3 JSON lines, but got %q", contents)
+	}
+}
+
+func TestS3_Write_SameBatchAgain_ReplacesTheSameObject(t *testing.T) {
+	//	Arrange
+	server := useS3Server(t)
+	out := newTestSink(t, sink.S3Name)
+
+	//	Act
+	err := out.Write(hostBatch(1, 3))
+	if err == nil {
+		err = out.Write(hostBatch(1, 3))
+	}
+	if err == nil {
+		err = out.Write(hostBatch(4, 5))
+	}
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	if keys := server.Keys(); len(keys) != 2 {
+		t.Errorf("Write - Expected 2 objects, but got %v", keys)
+	}
+}
+
+func TestS3_Write_SlowDown_IsRetried(t *testing.T) {
+	//	Arrange
+	server := useS3Server(t)
+	server.FailNext(http.StatusServiceUnavailable)
+	out := newTestSink(t, sink.S3Name)
+
+	//	Act
+	err := out.Write(hostBatch(1, 2))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error after retrying, but got: %s", err)
+	}
+
+	if puts := server.Puts(); puts != 2 {
+		t.Errorf("Write - Expected 2 uploads, but got %d", puts)
+	}
+}
+
+func TestS3_Write_AccessDenied_UploadsOnceWithoutDuplicates(t *testing.T) {
+	//	Arrange
+	server := useS3Server(t)
+	server.FailNext(http.StatusForbidden)
+	out := newTestSink(t, sink.S3Name)
+
+	//	Act
+	failed := out.Write(hostBatch(1, 2))
+	keys := server.Keys()
+	retried := out.Write(hostBatch(1, 2))
+
+	//	Assert
+	if failed != sink.ErrBuffered || len(keys) != 0 {
+		t.Fatalf("Write - Expected the entries to stay buffered, so the cursor isn't saved, but got %v and objects %v", failed, keys)
+	}
+
+	if retried != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", retried)
+	}
+
+	keys = server.Keys()
+	if len(keys) != 1 {
+		t.Fatalf("Write - Expected one object, but got %v", keys)
+	}
+
+	object, contents := server.Object(t, keys[0])
+	if lines := strings.Split(strings.TrimSpace(string(contents)), "\n"); len(lines) != 2 || object.Header.Get("X-Amz-Meta-Entries") != "2" {
+		t.Errorf("Write - Expected each entry once, but got %q", contents)
+	}
+}
+
+func TestS3_Write_BuffersUntilClose(t *testing.T) {
+	//	Arrange
+	server := useS3Server(t)
+	viper.Set("s3.maxage", "1h")
+	out := newTestSink(t, sink.S3Name).(*sink.S3)
+
+	//	Act
+	first := out.Write(hostBatch(1, 2))
+	second := out.Write(hostBatch(3, 4))
+	flushed := out.Flush("cron", false)
+	keys := server.Keys()
+	closed := out.Close()
+
+	//	Assert
+	if first != sink.ErrBuffered || second != sink.ErrBuffered || flushed != sink.ErrBuffered || len(keys) != 0 {
+		t.Fatalf("Write - Expected the entries to be buffered, but got %v, %v, %v and objects %v", first, second, flushed, keys)
+	}
+
+	if closed != nil {
+		t.Fatalf("Close - Should execute without error, but got: %s", closed)
+	}
+
+	keys = server.Keys()
+	if len(keys) != 1 {
+		t.Fatalf("Close - Expected the buffer in one object, but got %v", keys)
+	}
+
+	if object, _ := server.Object(t, keys[0]); object.Header.Get("X-Amz-Meta-First-Cursor") != "c1" || object.Header.Get("X-Amz-Meta-Last-Cursor") != "c4" || object.Header.Get("X-Amz-Meta-Entries") != "4" {
+		t.Errorf("Close - Expected entries c1 to c4 in the object, but got %v", object.Header)
+	}
+}
+
+func TestS3_Write_MaxSize_UploadsTheBuffer(t *testing.T) {
+	//	Arrange
+	server := useS3Server(t)
+	viper.Set("s3.maxage", "1h")
+	viper.Set("s3.maxsize", "200")
+	out := newTestSink(t, sink.S3Name)
+
+	//	Act
+	first := out.Write(hostBatch(1, 1))
+	second := out.Write(hostBatch(2, 3))
+
+	//	Assert
+	if first != sink.ErrBuffered || second != nil {
+		t.Fatalf("Write - Expected the buffer to be uploaded once it's big enough, but got %v and %v", first, second)
+	}
+
+	if keys := server.Keys(); len(keys) != 1 {
+		t.Errorf("Write - Expected one object, but got %v", keys)
+	}
+}
+
+func TestS3_Flush_UploadFails_KeepsTheBuffer(t *testing.T) {
+	//	Arrange
+	server := useS3Server(t)
+	viper.Set("s3.maxage", "1h")
+	out := newTestSink(t, sink.S3Name).(*sink.S3)
+	out.Write(hostBatch(1, 2))
+	server.FailNext(http.StatusForbidden)
+
+	//	Act
+	failed := out.Flush("cron", true)
+	retried := out.Flush("cron", true)
+
+	//	Assert
+	if failed == nil || retried != nil {
+		t.Fatalf("Flush - Expected the upload to fail and then succeed, but got %v and %v", failed, retried)
+	}
+
+	keys := server.Keys()
+	if len(keys) != 1 {
+		t.Fatalf("Flush - Expected one object, but got %v", keys)
+	}
+
+	if object, _ := server.Object(t, keys[0]); object.Header.Get("X-Amz-Meta-Entries") != "2" {
+		t.Errorf("Flush - Expected both entries in the object, but got %v", object.Header)
+	}
+}
+
+func TestS3_HealthCheck_MissingBucket_ReturnsError(t *testing.T) {
+	//	Arrange
+	useS3Server(t)
+	viper.Set("s3.bucket", "missing")
+	out := newTestSink(t, sink.S3Name).(*sink.S3)
+
+	//	Act
+	err := out.HealthCheck()
+
+	//	Assert
+	if err == nil {
+		t.Errorf("HealthCheck - Expected an error for a missing bucket, but got nil")
+	}
+}
@@ -0,0 +1,290 @@
+package sink_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testRequest is a request a testServer received
+type testRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+
+	// ClientCommonName is the common name of the client certificate, if one was presented
+	ClientCommonName string
+}
+
+// Uncompressed returns the body, gunzipped if it was sent with Content-Encoding gzip
+func (r testRequest) Uncompressed() ([]byte, error) {
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return r.Body, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(r.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(zr)
+}
+
+// testServer is a local HTTP server for the sinks that talk HTTP.  It records every request,
+// answers the ones queued with FailNext with an error, and passes the rest to its handler
+// (or answers 204 No Content if it doesn't have one).  The handler is called with the server
+// locked, so anything it keeps can be read safely by locking the server
+type testServer struct {
+	*httptest.Server
+	sync.Mutex
+
+	handler  func(w http.ResponseWriter, r testRequest)
+	requests []testRequest
+	failures []int
+}
+
+// newTestServer starts a server with the handler, and closes it when the test is done
+func newTestServer(t *testing.T, handler func(w http.ResponseWriter, r testRequest)) *testServer {
+	server := &testServer{handler: handler}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serveHTTP))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// newTLSTestServer starts an HTTPS server with the handler that requires a client certificate
+// signed by the certificates' CA, and closes it when the test is done
+func newTLSTestServer(t *testing.T, handler func(w http.ResponseWriter, r testRequest)) (*testServer, *testCertificates) {
+	certs := newTestCertificates(t)
+
+	server := &testServer{handler: handler}
+	server.Server = httptest.NewUnstartedServer(http.HandlerFunc(server.serveHTTP))
+	server.Server.TLS = certs.ServerConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server, certs
+}
+
+// FailNext makes the next requests return the given HTTP status codes, one per request,
+// before the server behaves normally again.  A 429 asks the client to retry right away
+func (server *testServer) FailNext(statusCodes ...int) {
+	server.Lock()
+	defer server.Unlock()
+
+	server.failures = append(server.failures, statusCodes...)
+}
+
+// Requests returns the requests that have been received, in order
+func (server *testServer) Requests() []testRequest {
+	server.Lock()
+	defer server.Unlock()
+
+	return append([]testRequest{}, server.requests...)
+}
+
+// serveHTTP records a request, and fails it or passes it to the handler
+func (server *testServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	request := testRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Header: r.Header.Clone(), Body: body}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		request.ClientCommonName = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	server.Lock()
+	defer server.Unlock()
+
+	server.requests = append(server.requests, request)
+	if len(server.failures) > 0 {
+		status := server.failures[0]
+		server.failures = server.failures[1:]
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if server.handler == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	server.handler(w, request)
+}
+
+// protoField is a field of an encoded protobuf message.  Value is set for varint and
+// fixed64 fields, and Bytes for length delimited ones
+type protoField struct {
+	Number protowire.Number
+	Bytes  []byte
+	Value  uint64
+}
+
+// protoFields decodes the fields of a protobuf message, so tests can check what a sink
+// encoded without the generated types
+func protoFields(data []byte) ([]protoField, error) {
+	retval := []protoField{}
+	for len(data) > 0 {
+		number, kind, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		field := protoField{Number: number}
+		switch kind {
+		case protowire.BytesType:
+			field.Bytes, n = protowire.ConsumeBytes(data)
+		case protowire.VarintType:
+			field.Value, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			field.Value, n = protowire.ConsumeFixed64(data)
+		default:
+			n = protowire.ConsumeFieldValue(number, kind, data)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		retval = append(retval, field)
+	}
+
+	return retval, nil
+}
+
+// testCertificates are a throwaway CA, a server certificate for localhost and 127.0.0.1,
+// and a client certificate, for testing the sinks that use TLS and client certificates
+type testCertificates struct {
+	// CAFile, CertFile and KeyFile are PEM files with the CA, and the client certificate and key
+	CAFile   string
+	CertFile string
+	KeyFile  string
+
+	ca     *x509.Certificate
+	server tls.Certificate
+}
+
+// newTestCertificates creates the certificates, and writes the PEM files to a temporary directory
+func newTestCertificates(t *testing.T) *testCertificates {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey - Should execute without error, but got: %s", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate - Should execute without error, but got: %s", err)
+	}
+
+	dir := t.TempDir()
+	retval := &testCertificates{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client-key.pem"),
+	}
+	retval.ca, _ = x509.ParseCertificate(caDER)
+
+	serverPEM, serverKeyPEM := issueTestCertificate(t, retval.ca, caKey, 2, "localhost", x509.ExtKeyUsageServerAuth)
+	if retval.server, err = tls.X509KeyPair(serverPEM, serverKeyPEM); err != nil {
+		t.Fatalf("X509KeyPair - Should execute without error, but got: %s", err)
+	}
+
+	clientPEM, clientKeyPEM := issueTestCertificate(t, retval.ca, caKey, 3, "cloudjournal", x509.ExtKeyUsageClientAuth)
+	files := map[string][]byte{
+		retval.CAFile:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		retval.CertFile: clientPEM,
+		retval.KeyFile:  clientKeyPEM,
+	}
+	for path, contents := range files {
+		if err := os.WriteFile(path, contents, 0600); err != nil {
+			t.Fatalf("WriteFile - Should execute without error, but got: %s", err)
+		}
+	}
+
+	return retval
+}
+
+// ServerConfig returns a TLS config that serves the server certificate and requires
+// a client certificate signed by the CA
+func (c *testCertificates) ServerConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.ca)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{c.server},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// issueTestCertificate creates a certificate signed by the CA, and returns it and its key as PEM
+func issueTestCertificate(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial int64, commonName string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey - Should execute without error, but got: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate - Should execute without error, but got: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey - Should execute without error, but got: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -0,0 +1,393 @@
+package sink
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danesparza/cloudjournal/format"
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/metrics"
+	"github.com/danesparza/cloudjournal/token"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// SyslogName is the name of the remote syslog sink
+const SyslogName = "syslog"
+
+// Syslog transports
+const (
+	// SyslogUDP sends one message per datagram (RFC 5426)
+	SyslogUDP = "udp"
+
+	// SyslogTCP sends messages with octet-counting framing (RFC 6587)
+	SyslogTCP = "tcp"
+
+	// SyslogTLS sends messages like SyslogTCP, over TLS (RFC 5425)
+	SyslogTLS = "tls"
+)
+
+// syslogFacilities are the facility names that can be used in syslog.facility
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "ntp": 12, "security": 13, "console": 14, "solaris-cron": 15,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Syslog forwards entries to a remote syslog server as RFC 5424 messages
+type Syslog struct {
+	// Address is the host:port of the syslog server
+	Address string
+
+	// Network is SyslogUDP, SyslogTCP or SyslogTLS
+	Network string
+
+	// TLSConfig is used when Network is SyslogTLS
+	TLSConfig *tls.Config
+
+	// Hostname is used for entries that don't have a _HOSTNAME.  It can use tokens
+	Hostname string
+
+	// Facility is used for entries that don't have a SYSLOG_FACILITY
+	Facility int
+
+	// SDID is the structured data id for journal fields, like journal@<private enterprise number>
+	SDID string
+
+	// Fields are the journal fields to send as structured data
+	Fields []string
+
+	// Formatter formats each entry's MSG
+	Formatter format.Formatter
+
+	// MaxSize is the largest message (in bytes) that is sent.  Longer messages are truncated
+	MaxSize int
+
+	// Timeout is how long to wait to connect and for each write
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogFromConfig creates a syslog sink from the syslog section of the config
+func NewSyslogFromConfig() (*Syslog, error) {
+	retval := &Syslog{
+		Address:   viper.GetString("syslog.address"),
+		Network:   strings.ToLower(viper.GetString("syslog.network")),
+		Hostname:  viper.GetString("syslog.hostname"),
+		SDID:      viper.GetString("syslog.sdid"),
+		Fields:    splitList(viper.GetString("syslog.fields")),
+		Formatter: newFormatter(viper.GetString("syslog.format")),
+		MaxSize:   viper.GetInt("syslog.maxsize"),
+		Timeout:   durationFromConfig("syslog.timeout", 10*time.Second),
+	}
+
+	if retval.Address == "" {
+		return nil, fmt.Errorf("syslog.address isn't set")
+	}
+
+	//	Structured data ids (other than the few registered with IANA) are name@<private enterprise number>
+	if len(retval.Fields) > 0 && !strings.Contains(retval.SDID, "@") {
+		return nil, fmt.Errorf("syslog.sdid has to be set to name@<private enterprise number> to send syslog.fields")
+	}
+
+	facility, err := ParseSyslogFacility(viper.GetString("syslog.facility"))
+	if err != nil {
+		return nil, err
+	}
+	retval.Facility = facility
+
+	switch retval.Network {
+	case "":
+		retval.Network = SyslogUDP
+	case SyslogUDP, SyslogTCP:
+	case SyslogTLS:
+		retval.TLSConfig, err = newTLSConfig("syslog")
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown syslog.network %q.  Use %s, %s or %s", retval.Network, SyslogUDP, SyslogTCP, SyslogTLS)
+	}
+
+	return retval, nil
+}
+
+// ParseSyslogFacility converts a facility name (like daemon or local0) or number into its number
+func ParseSyslogFacility(facility string) (int, error) {
+	facility = strings.ToLower(strings.TrimSpace(facility))
+	if facility == "" {
+		return syslogFacilities["user"], nil
+	}
+
+	if number, ok := syslogFacilities[facility]; ok {
+		return number, nil
+	}
+
+	if number, err := strconv.Atoi(facility); err == nil && number >= 0 && number <= 23 {
+		return number, nil
+	}
+
+	return 0, fmt.Errorf("unknown syslog facility %q", facility)
+}
+
+// newTLSConfig creates a TLS config from the ca, cert, key and servername settings
+// in a section of the config (like syslog.ca)
+func newTLSConfig(section string) (*tls.Config, error) {
+	retval := &tls.Config{
+		ServerName: viper.GetString(section + ".servername"),
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile := viper.GetString(section + ".ca"); caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("problem reading %s.ca: %v", section, err)
+		}
+
+		retval.RootCAs = x509.NewCertPool()
+		if !retval.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s.ca %s", section, caFile)
+		}
+	}
+
+	certFile := viper.GetString(section + ".cert")
+	keyFile := viper.GetString(section + ".key")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("problem loading the %s client certificate: %v", section, err)
+		}
+		retval.Certificates = []tls.Certificate{cert}
+	}
+
+	return retval, nil
+}
+
+// Name returns the name of the sink
+func (s *Syslog) Name() string {
+	return SyslogName
+}
+
+// Write sends each entry in the batch to the syslog server.  If the connection was
+// lost, it reconnects once before giving up
+func (s *Syslog) Write(batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, entry := range batch.Entries {
+		message := s.Format(entry, batch.Tokens)
+
+		err := s.send(message)
+		if err != nil && s.Network != SyslogUDP {
+			log.WithFields(log.Fields{
+				"address": s.Address,
+				"network": s.Network,
+			}).WithError(err).Warn("problem writing to syslog.  Reconnecting")
+			err = s.send(message)
+		}
+
+		if err != nil {
+			metrics.Add("syslog.entries_sent", int64(i))
+			metrics.Add("syslog.batches_failed", 1)
+			return err
+		}
+	}
+
+	metrics.Add("syslog.entries_sent", int64(len(batch.Entries)))
+	return nil
+}
+
+// Close closes the connection to the syslog server
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.disconnect()
+}
+
+// HealthCheck checks the syslog server can be reached
+func (s *Syslog) HealthCheck() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connect()
+}
+
+// connect connects to the syslog server, if we aren't connected.  The caller must hold the lock
+func (s *Syslog) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	dialer := &net.Dialer{Timeout: s.Timeout}
+
+	var err error
+	switch s.Network {
+	case SyslogTLS:
+		s.conn, err = tls.DialWithDialer(dialer, "tcp", s.Address, s.TLSConfig)
+	default:
+		s.conn, err = dialer.Dial(s.Network, s.Address)
+	}
+
+	return err
+}
+
+// disconnect closes the connection, if there is one.  The caller must hold the lock
+func (s *Syslog) disconnect() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// send sends a message, framed for the transport.  If it fails, the connection is
+// closed so the next send reconnects.  The caller must hold the lock
+func (s *Syslog) send(message string) error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	frame := message
+	if s.Network != SyslogUDP {
+		frame = strconv.Itoa(len(message)) + " " + message
+	}
+
+	if s.Timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.Timeout))
+	}
+
+	if _, err := s.conn.Write([]byte(frame)); err != nil {
+		s.disconnect()
+		return err
+	}
+
+	return nil
+}
+
+// Format formats an entry as an RFC 5424 message:
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID NAME="value" ...] MSG
+//
+// PRI comes from SYSLOG_FACILITY and PRIORITY, APP-NAME from SYSLOG_IDENTIFIER,
+// PROCID from _PID, MSGID from MESSAGE_ID and the structured data from the configured
+// journal fields.  Values that are missing are sent as -.  MSG is the entry formatted
+// by the Formatter
+func (s *Syslog) Format(entry journal.Entry, tokens map[string]string) string {
+	facility := s.Facility
+	if value, err := strconv.Atoi(entry.SyslogFacility.String()); err == nil && value >= 0 && value <= 23 {
+		facility = value
+	}
+
+	severity := 6
+	if value, err := strconv.Atoi(entry.Priority.String()); err == nil && value >= 0 && value <= 7 {
+		severity = value
+	}
+
+	timestamp := "-"
+	if microseconds, err := strconv.ParseInt(entry.RealtimeTimestamp, 10, 64); err == nil {
+		timestamp = time.UnixMicro(microseconds).UTC().Format("2006-01-02T15:04:05.000000Z07:00")
+	}
+
+	hostname := entry.Hostname.String()
+	if hostname == "" {
+		hostname = token.Replace(s.Hostname, tokens)
+	}
+
+	appName := entry.SyslogIdentifier.String()
+	if appName == "" {
+		appName = entry.Comm.String()
+	}
+
+	header := fmt.Sprintf("<%d>1 %s %s %s %s %s %s",
+		facility*8+severity,
+		timestamp,
+		syslogHeaderField(hostname, 255),
+		syslogHeaderField(appName, 48),
+		syslogHeaderField(entry.PID.String(), 128),
+		syslogHeaderField(entry.MessageID.String(), 32),
+		s.structuredData(entry),
+	)
+
+	message := s.Formatter.Format(entry)
+	if message == "" {
+		return header
+	}
+
+	retval := header + " " + message
+	if s.MaxSize > 0 && len(retval) > s.MaxSize {
+		retval = format.TruncateUTF8(retval, s.MaxSize)
+		metrics.Add("syslog.entries_truncated", 1)
+	}
+
+	return retval
+}
+
+// structuredData formats the configured journal fields as an SD-ELEMENT, or - if there aren't any
+func (s *Syslog) structuredData(entry journal.Entry) string {
+	selected := entry.SelectFields(s.Fields)
+	if len(selected) == 0 || s.SDID == "" {
+		return "-"
+	}
+
+	names := []string{}
+	for name := range selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	retval := "[" + syslogName(s.SDID)
+	for _, name := range names {
+		value := selected[name].Render(s.Formatter.BinaryEncoding)
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+		retval += " " + syslogName(name) + `="` + value + `"`
+	}
+
+	return retval + "]"
+}
+
+// syslogHeaderField makes a header field valid: at most size printable ASCII characters, or -
+func syslogHeaderField(value string, size int) string {
+	retval := []byte{}
+	for i := 0; i < len(value) && len(retval) < size; i++ {
+		if value[i] >= 33 && value[i] <= 126 {
+			retval = append(retval, value[i])
+		}
+	}
+
+	if len(retval) == 0 {
+		return "-"
+	}
+
+	return string(retval)
+}
+
+// syslogName makes an SD-ID or PARAM-NAME valid: at most 32 printable ASCII
+// characters other than =, space, ] and "
+func syslogName(name string) string {
+	retval := []byte{}
+	for i := 0; i < len(name) && len(retval) < 32; i++ {
+		c := name[i]
+		if c >= 33 && c <= 126 && c != '=' && c != ']' && c != '"' {
+			retval = append(retval, c)
+		}
+	}
+
+	if len(retval) == 0 {
+		return "_"
+	}
+
+	return string(retval)
+}
@@ -0,0 +1,335 @@
+package sink_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danesparza/cloudjournal/format"
+	"github.com/danesparza/cloudjournal/journal"
+	"github.com/danesparza/cloudjournal/sink"
+	"github.com/spf13/viper"
+)
+
+// syslogEntry is a journal entry with the fields that map to the syslog header
+func syslogEntry() journal.Entry {
+	return journal.Entry{
+		Cursor:            "c1",
+		RealtimeTimestamp: "1636000000123456",
+		Priority:          journal.NewField("3"),
+		SyslogFacility:    journal.NewField("9"),
+		SyslogIdentifier:  journal.NewField("CRON"),
+		PID:               journal.NewField("1234"),
+		Hostname:          journal.NewField("raspberrypi"),
+		Message:           journal.NewField("pam_unix(cron:session): session opened"),
+		Fields: map[string]journal.Field{
+			"_SYSTEMD_UNIT": journal.NewField("cron.service"),
+			"REQUEST_ID":    journal.NewField(`say "hi" [ok]`),
+		},
+	}
+}
+
+// syslogServer is a local syslog server that keeps the messages it receives: one per
+// datagram over UDP, and with octet-counting framing over TCP and TLS
+type syslogServer struct {
+	// Certificates are the certificates a TLS server uses
+	Certificates *testCertificates
+
+	mu         sync.Mutex
+	messages   []string
+	conns      int
+	clientName string
+}
+
+// useSyslogServer starts a udp, tcp or tls syslog server (the TLS one requires a client
+// certificate), and points the syslog config at it.  It's stopped when the test is done
+func useSyslogServer(t *testing.T, network string) *syslogServer {
+	server := &syslogServer{}
+
+	var addr net.Addr
+	switch network {
+	case "udp":
+		packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("ListenPacket - Should execute without error, but got: %s", err)
+		}
+		t.Cleanup(func() { packet.Close() })
+		addr = packet.LocalAddr()
+		go server.servePackets(packet)
+
+	default:
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen - Should execute without error, but got: %s", err)
+		}
+		if network == "tls" {
+			server.Certificates = newTestCertificates(t)
+			listener = tls.NewListener(listener, server.Certificates.ServerConfig())
+		}
+		t.Cleanup(func() { listener.Close() })
+		addr = listener.Addr()
+		go server.serveConns(listener)
+	}
+
+	useConfig(t, map[string]interface{}{
+		"syslog.address": addr.String(),
+		"syslog.network": network,
+		"syslog.sdid":    "journal@12345",
+		"syslog.fields":  "_SYSTEMD_UNIT",
+	})
+
+	return server
+}
+
+// WaitForMessages waits up to a second for at least n messages, and returns the messages received
+func (server *syslogServer) WaitForMessages(n int) []string {
+	deadline := time.Now().Add(time.Second)
+	for {
+		server.mu.Lock()
+		messages := append([]string{}, server.messages...)
+		server.mu.Unlock()
+
+		if len(messages) >= n || time.Now().After(deadline) {
+			return messages
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Connections returns how many connections have been accepted, and the common name of
+// the last client certificate presented
+func (server *syslogServer) Connections() (int, string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.conns, server.clientName
+}
+
+// servePackets keeps each datagram until the server is stopped
+func (server *syslogServer) servePackets(packet net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := packet.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		server.add(string(buf[:n]))
+	}
+}
+
+// serveConns reads octet-counted messages (like "11 <14>1 hello") from each connection
+// until the server is stopped
+func (server *syslogServer) serveConns(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				server.mu.Lock()
+				server.clientName = tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+				server.mu.Unlock()
+			}
+
+			server.mu.Lock()
+			server.conns++
+			server.mu.Unlock()
+
+			reader := bufio.NewReader(conn)
+			for {
+				var size int
+				if _, err := fmt.Fscanf(reader, "%d ", &size); err != nil || size < 0 {
+					return
+				}
+
+				message := make([]byte, size)
+				if _, err := io.ReadFull(reader, message); err != nil {
+					return
+				}
+				server.add(string(message))
+			}
+		}()
+	}
+}
+
+// add keeps a message
+func (server *syslogServer) add(message string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.messages = append(server.messages, message)
+}
+
+func TestSyslog_Format_MapsJournalFieldsToRFC5424(t *testing.T) {
+	//	Arrange
+	out := &sink.Syslog{Facility: 1, SDID: "journal@12345", Fields: []string{"_SYSTEMD_UNIT", "REQUEST_ID"}}
+
+	//	Act
+	message := out.Format(syslogEntry(), nil)
+
+	//	Assert
+	want := `<75>1 2021-11-04T04:26:40.123456Z raspberrypi CRON 1234 - [journal@12345 REQUEST_ID="say \"hi\" [ok\]" _SYSTEMD_UNIT="cron.service"] pam_unix(cron:session): session opened`
+	if message != want {
+		t.Errorf("Format - Expected:\n%s\nbut got:\n%s", want, message)
+	}
+}
+
+func TestSyslog_Format_MissingFields_UsesDefaults(t *testing.T) {
+	//	Arrange
+	out := &sink.Syslog{Facility: 3, Hostname: "{hostname}"}
+	entry := journal.Entry{RealtimeTimestamp: "1636000000000000", Message: journal.NewField("hello")}
+
+	//	Act
+	message := out.Format(entry, map[string]string{"{hostname}": "dashboard"})
+
+	//	Assert
+	want := "<30>1 2021-11-04T04:26:40.000000Z dashboard - - - - hello"
+	if message != want {
+		t.Errorf("Format - Expected %q, but got %q", want, message)
+	}
+}
+
+func TestSyslog_Format_LongMessage_IsTruncated(t *testing.T) {
+	//	Arrange
+	out := &sink.Syslog{Facility: 1, MaxSize: 100}
+	entry := syslogEntry()
+	entry.Message = journal.NewField(strings.Repeat("é", 200))
+
+	//	Act
+	message := out.Format(entry, nil)
+
+	//	Assert
+	if len(message) > 100 || !strings.HasPrefix(message, "<75>1 ") {
+		t.Errorf("Format - Expected a message of at most 100 bytes, but got %d: %q", len(message), message)
+	}
+}
+
+func TestSyslog_Format_BinaryMessage_UsesBinaryEncoding(t *testing.T) {
+	//	Arrange
+	out := &sink.Syslog{Facility: 1, Formatter: format.Formatter{Mode: format.FormatRaw, BinaryEncoding: journal.BinaryBase64}}
+	entry := journal.Entry{RealtimeTimestamp: "1636000000000000", Message: journal.Field{Values: [][]byte{{0x68, 0x69, 0xff}}}}
+
+	//	Act
+	message := out.Format(entry, nil)
+
+	//	Assert
+	if !strings.HasSuffix(message, " aGn/") {
+		t.Errorf("Format - Expected a base64 MSG, but got %q", message)
+	}
+}
+
+func TestSyslog_Write_UDP_SendsOneDatagramPerEntry(t *testing.T) {
+	//	Arrange
+	server := useSyslogServer(t, "udp")
+	out := newTestSink(t, sink.SyslogName)
+
+	//	Act
+	err := out.Write(testBatch(1, 3))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	messages := server.WaitForMessages(3)
+	if len(messages) != 3 || !strings.HasSuffix(messages[2], " message 3") {
+		t.Errorf("Write - Expected 3 messages, but got %q", messages)
+	}
+}
+
+func TestSyslog_Write_TCP_UsesOctetCountingAndReconnects(t *testing.T) {
+	//	Arrange
+	server := useSyslogServer(t, "tcp")
+	out := newTestSink(t, sink.SyslogName)
+
+	//	Act
+	err := out.Write(testBatch(1, 2))
+	if err == nil {
+		server.WaitForMessages(2)
+		out.Close()
+		err = out.Write(testBatch(3, 4))
+	}
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	messages := server.WaitForMessages(4)
+	if len(messages) != 4 || !strings.HasSuffix(messages[3], " message 4") {
+		t.Errorf("Write - Expected 4 messages, but got %q", messages)
+	}
+
+	if connections, _ := server.Connections(); connections != 2 {
+		t.Errorf("Write - Expected 2 connections, but got %d", connections)
+	}
+}
+
+func TestSyslog_Write_TLS_UsesClientCertificate(t *testing.T) {
+	//	Arrange
+	server := useSyslogServer(t, "tls")
+	viper.Set("syslog.ca", server.Certificates.CAFile)
+	viper.Set("syslog.cert", server.Certificates.CertFile)
+	viper.Set("syslog.key", server.Certificates.KeyFile)
+	out := newTestSink(t, sink.SyslogName)
+
+	//	Act
+	err := out.Write(testBatch(1, 2))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	if messages := server.WaitForMessages(2); len(messages) != 2 {
+		t.Errorf("Write - Expected 2 messages, but got %q", messages)
+	}
+
+	if _, name := server.Connections(); name != "cloudjournal" {
+		t.Errorf("Write - Expected the client certificate to be presented, but got %q", name)
+	}
+}
+
+func TestSyslog_New_FieldsWithoutSDID_ReturnsError(t *testing.T) {
+	//	Arrange
+	useConfig(t, map[string]interface{}{
+		"syslog.address": "127.0.0.1:514",
+		"syslog.fields":  "_SYSTEMD_UNIT",
+	})
+
+	//	Act
+	_, err := sink.NewSyslogFromConfig()
+
+	//	Assert
+	if err == nil {
+		t.Errorf("NewSyslogFromConfig - Expected an error when syslog.fields is set without syslog.sdid, but got nil")
+	}
+}
+
+func TestParseSyslogFacility_NamesAndNumbers(t *testing.T) {
+	tests := map[string]int{"": 1, "daemon": 3, "LOCAL0": 16, "9": 9}
+
+	for facility, want := range tests {
+		got, err := sink.ParseSyslogFacility(facility)
+		if err != nil || got != want {
+			t.Errorf("ParseSyslogFacility(%q) - Expected %d, but got %d (%v)", facility, want, got, err)
+		}
+	}
+
+	if _, err := sink.ParseSyslogFacility("local8"); err == nil {
+		t.Errorf("ParseSyslogFacility - Expected an error for an unknown facility, but got nil")
+	}
+}
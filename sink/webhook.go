@@ -0,0 +1,259 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/danesparza/cloudjournal/format"
+	"github.com/danesparza/cloudjournal/metrics"
+	"github.com/danesparza/cloudjournal/retry"
+	"github.com/danesparza/cloudjournal/token"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// WebhookName is the name of the HTTP / webhook sink
+const WebhookName = "webhook"
+
+// Webhook body formats
+const (
+	// WebhookNDJSON sends one JSON document per line
+	WebhookNDJSON = "ndjson"
+
+	// WebhookArray sends a JSON array of documents
+	WebhookArray = "array"
+)
+
+// WebhookEntriesToken is replaced with the JSON array of documents in a webhook body template
+const WebhookEntriesToken = "{entries}"
+
+// Webhook POSTs batches of entries to an HTTP endpoint, as NDJSON or a JSON array
+type Webhook struct {
+	// URL is the endpoint.  It can use tokens
+	URL string
+
+	// Format is WebhookNDJSON or WebhookArray
+	Format string
+
+	// Body is a template for the body when Format is WebhookArray, like
+	// {"host":"{hostname}","logs":{entries}}.  It can use tokens.  If it isn't set, the
+	// body is just the array
+	Body string
+
+	// Headers are added to each request.  Values can use tokens
+	Headers map[string]string
+
+	// Gzip compresses the body
+	Gzip bool
+
+	// Username and Password are used for basic auth, if set
+	Username string
+	Password string
+
+	// BearerToken is sent as a bearer token authorization header, if set
+	BearerToken string
+
+	// BatchSize is the most entries sent in one request
+	BatchSize int
+
+	// Formatter formats each entry.  Its mode is always json
+	Formatter format.Formatter
+
+	// Retries is how many times a request is retried when the endpoint has a server error,
+	// is rate limiting or can't be reached
+	Retries       int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	Client *http.Client
+}
+
+// NewWebhookFromConfig creates a webhook sink from the webhook section of the config
+func NewWebhookFromConfig() (*Webhook, error) {
+	retval := &Webhook{
+		URL:           viper.GetString("webhook.url"),
+		Format:        strings.ToLower(viper.GetString("webhook.format")),
+		Body:          viper.GetString("webhook.body"),
+		Headers:       format.ParseTags(viper.GetString("webhook.headers")),
+		Gzip:          viper.GetBool("webhook.gzip"),
+		Username:      viper.GetString("webhook.username"),
+		Password:      viper.GetString("webhook.password"),
+		BearerToken:   viper.GetString("webhook.bearertoken"),
+		BatchSize:     viper.GetInt("webhook.batchsize"),
+		Formatter:     newFormatter(format.FormatJSON),
+		Retries:       viper.GetInt("webhook.retries"),
+		RetryDelay:    durationFromConfig("webhook.retrydelay", 500*time.Millisecond),
+		MaxRetryDelay: durationFromConfig("webhook.maxretrydelay", 30*time.Second),
+	}
+
+	if retval.URL == "" {
+		return nil, fmt.Errorf("webhook.url isn't set")
+	}
+
+	switch retval.Format {
+	case "":
+		retval.Format = WebhookNDJSON
+	case WebhookNDJSON, WebhookArray:
+	default:
+		return nil, fmt.Errorf("unknown webhook.format %q.  Use %s or %s", retval.Format, WebhookNDJSON, WebhookArray)
+	}
+
+	if retval.Body != "" && retval.Format != WebhookArray {
+		return nil, fmt.Errorf("webhook.body can only be used with webhook.format %s", WebhookArray)
+	}
+
+	tlsConfig, err := newTLSConfig("webhook")
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	retval.Client = &http.Client{
+		Timeout:   durationFromConfig("webhook.timeout", 30*time.Second),
+		Transport: transport,
+	}
+
+	return retval, nil
+}
+
+// Name returns the name of the sink
+func (s *Webhook) Name() string {
+	return WebhookName
+}
+
+// Write POSTs the batch, in requests of up to BatchSize entries.  If a request fails,
+// the rest of the batch isn't sent and an error is returned, so the unit's cursor isn't saved
+func (s *Webhook) Write(batch Batch) error {
+	documents := [][]byte{}
+	for _, entry := range batch.Entries {
+		document, _, err := entryDocument(s.Formatter, entry)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"unit":   batch.Unit,
+				"cursor": entry.Cursor,
+			}).WithError(err).Error("problem creating the webhook document.  Skipping it")
+			continue
+		}
+		documents = append(documents, document)
+	}
+
+	batchSize := s.BatchSize
+	if batchSize < 1 {
+		batchSize = len(documents)
+	}
+
+	for start := 0; start < len(documents); start += batchSize {
+		end := start + batchSize
+		if end > len(documents) {
+			end = len(documents)
+		}
+
+		if err := s.post(s.body(documents[start:end], batch.Tokens), batch.Tokens); err != nil {
+			metrics.Add("webhook.batches_failed", 1)
+			return err
+		}
+		metrics.Add("webhook.entries_sent", int64(end-start))
+	}
+
+	return nil
+}
+
+// Close does nothing
+func (s *Webhook) Close() error {
+	return nil
+}
+
+// body creates the request body for the documents
+func (s *Webhook) body(documents [][]byte, tokens map[string]string) []byte {
+	if s.Format == WebhookNDJSON {
+		return append(bytes.Join(documents, []byte("\n")), '\n')
+	}
+
+	array := "[" + string(bytes.Join(documents, []byte(","))) + "]"
+	if s.Body == "" {
+		return []byte(array)
+	}
+
+	//	Replace the tokens first, so token values can't add an entries token
+	return []byte(strings.ReplaceAll(token.Replace(s.Body, tokens), WebhookEntriesToken, array))
+}
+
+// post sends the body, retrying server errors, rate limiting and network errors
+func (s *Webhook) post(body []byte, tokens map[string]string) error {
+	contentType := "application/x-ndjson"
+	if s.Format == WebhookArray {
+		contentType = "application/json"
+	}
+
+	if s.Gzip {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = compressed.Bytes()
+	}
+
+	url := token.Replace(s.URL, tokens)
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("User-Agent", "cloudjournal")
+		if s.Gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		for name, value := range s.Headers {
+			req.Header.Set(name, token.Replace(value, tokens))
+		}
+		if s.BearerToken != "" {
+			req.Header.Set("Authorization", "Bearer "+s.BearerToken)
+		} else if s.Username != "" {
+			req.SetBasicAuth(s.Username, s.Password)
+		}
+
+		var retryAfter time.Duration
+		resp, err := s.Client.Do(req)
+		if err == nil {
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+
+			if resp.StatusCode/100 == 2 {
+				return nil
+			}
+
+			err = fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+			if !isRetryableStatus(resp.StatusCode) {
+				return err
+			}
+
+			retryAfter = retry.After(resp.Header.Get("Retry-After"), s.MaxRetryDelay)
+		}
+
+		if attempt >= s.Retries {
+			return err
+		}
+
+		delay := retry.Backoff(attempt, s.RetryDelay, s.MaxRetryDelay)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+
+		metrics.Add("webhook.retries", 1)
+		log.WithFields(log.Fields{
+			"attempt":    attempt + 1,
+			"maxRetries": s.Retries,
+			"delay":      delay.String(),
+		}).WithError(err).Warn("problem posting to the webhook.  Retrying")
+		time.Sleep(delay)
+	}
+}
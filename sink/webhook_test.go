@@ -0,0 +1,190 @@
+package sink_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/danesparza/cloudjournal/sink"
+	"github.com/spf13/viper"
+)
+
+// useWebhookServer points the webhook config at the server
+func useWebhookServer(t *testing.T, server *testServer) {
+	useConfig(t, map[string]interface{}{
+		"webhook.url":           server.URL + "/ingest/{unit}",
+		"webhook.retrydelay":    "1ms",
+		"webhook.maxretrydelay": "1ms",
+	})
+}
+
+func TestWebhook_Write_NDJSON_PostsOneDocumentPerLine(t *testing.T) {
+	//	Arrange
+	server := newTestServer(t, nil)
+	useWebhookServer(t, server)
+	viper.Set("webhook.headers", "X-Source={hostname}, X-Team=platform")
+	viper.Set("webhook.bearertoken", "secret")
+	out := newTestSink(t, sink.WebhookName)
+	batch := hostBatch(1, 3)
+
+	//	Act
+	err := out.Write(batch)
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("Write - Expected 1 request, but got %d", len(requests))
+	}
+	request := requests[0]
+
+	if request.Path != "/ingest/cron" || request.Header.Get("X-Source") != "raspberrypi" || request.Header.Get("X-Team") != "platform" {
+		t.Errorf("Write - Expected the templated path and headers, but got %s %v", request.Path, request.Header)
+	}
+
+	if request.Header.Get("Authorization") != "Bearer secret" || request.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("Write - Expected a bearer token and the ndjson content type, but got %v", request.Header)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(request.Body)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Write - Expected 3 lines, but got %q", request.Body)
+	}
+
+	document := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(lines[2]), &document); err != nil || document["message"] != "message 3" {
+		t.Errorf("Write - Expected a JSON document for message 3, but got %s (%v)", lines[2], err)
+	}
+}
+
+func TestWebhook_Write_ArrayWithBodyTemplate_IsGzipped(t *testing.T) {
+	//	Arrange
+	server := newTestServer(t, nil)
+	useWebhookServer(t, server)
+	viper.Set("webhook.format", "array")
+	viper.Set("webhook.body", `{"host":"{hostname}","logs":{entries}}`)
+	viper.Set("webhook.gzip", true)
+	viper.Set("webhook.username", "cloudjournal")
+	viper.Set("webhook.password", "hunter2")
+	out := newTestSink(t, sink.WebhookName)
+
+	//	Act
+	err := out.Write(hostBatch(1, 2))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	request := server.Requests()[0]
+	if request.Header.Get("Content-Encoding") != "gzip" || !strings.HasPrefix(request.Header.Get("Authorization"), "Basic ") {
+		t.Errorf("Write - Expected a gzipped body with basic auth, but got %v", request.Header)
+	}
+
+	uncompressed, err := request.Uncompressed()
+	if err != nil {
+		t.Fatalf("Write - Expected a gzipped body, but got: %s", err)
+	}
+
+	body := struct {
+		Host string                   `json:"host"`
+		Logs []map[string]interface{} `json:"logs"`
+	}{}
+	if err := json.Unmarshal(uncompressed, &body); err != nil {
+		t.Fatalf("Write - Expected a JSON body, but got %s (%v)", uncompressed, err)
+	}
+
+	if body.Host != "raspberrypi" || len(body.Logs) != 2 {
+		t.Errorf("Write - Expected the host and 2 logs, but got %+v", body)
+	}
+}
+
+func TestWebhook_Write_BatchSize_SplitsRequests(t *testing.T) {
+	//	Arrange
+	server := newTestServer(t, nil)
+	useWebhookServer(t, server)
+	viper.Set("webhook.batchsize", 2)
+	out := newTestSink(t, sink.WebhookName)
+
+	//	Act
+	err := out.Write(testBatch(1, 5))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 3 || bytes.Count(requests[2].Body, []byte("\n")) != 1 {
+		t.Errorf("Write - Expected requests of 2, 2 and 1 entries, but got %d requests", len(requests))
+	}
+}
+
+func TestWebhook_Write_ServerError_RetriesThenSucceeds(t *testing.T) {
+	//	Arrange
+	server := newTestServer(t, nil)
+	useWebhookServer(t, server)
+	viper.Set("webhook.retries", 2)
+	server.FailNext(http.StatusBadGateway, http.StatusServiceUnavailable)
+	out := newTestSink(t, sink.WebhookName)
+
+	//	Act
+	err := out.Write(testBatch(1, 2))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error after retrying, but got: %s", err)
+	}
+
+	if requests := server.Requests(); len(requests) != 3 {
+		t.Errorf("Write - Expected 3 requests, but got %d", len(requests))
+	}
+}
+
+func TestWebhook_Write_ClientError_ReturnsErrorWithoutRetrying(t *testing.T) {
+	//	Arrange
+	server := newTestServer(t, nil)
+	useWebhookServer(t, server)
+	viper.Set("webhook.retries", 2)
+	server.FailNext(http.StatusUnauthorized)
+	out := newTestSink(t, sink.WebhookName)
+
+	//	Act
+	err := out.Write(testBatch(1, 2))
+
+	//	Assert
+	if err == nil {
+		t.Errorf("Write - Expected an error, but got nil")
+	}
+
+	if requests := server.Requests(); len(requests) != 1 {
+		t.Errorf("Write - Expected a client error not to be retried, but got %d requests", len(requests))
+	}
+}
+
+func TestWebhook_Write_MutualTLS_PresentsClientCertificate(t *testing.T) {
+	//	Arrange
+	server, certs := newTLSTestServer(t, nil)
+	useWebhookServer(t, server)
+	viper.Set("webhook.ca", certs.CAFile)
+	viper.Set("webhook.cert", certs.CertFile)
+	viper.Set("webhook.key", certs.KeyFile)
+	out := newTestSink(t, sink.WebhookName)
+
+	//	Act
+	err := out.Write(testBatch(1, 2))
+
+	//	Assert
+	if err != nil {
+		t.Fatalf("Write - Should execute without error, but got: %s", err)
+	}
+
+	if requests := server.Requests(); len(requests) != 1 || requests[0].ClientCommonName != "cloudjournal" {
+		t.Errorf("Write - Expected a request with the client certificate, but got %+v", requests)
+	}
+}